@@ -61,6 +61,7 @@ type Homeserver struct {
 type User struct {
 	Localpart   string
 	DisplayName string
+	// The avatar URL, which can refer to uploaded media e.g "$media:my_avatar"
 	AvatarURL   string
 	AccountData []AccountData
 	DeviceID    *string
@@ -68,8 +69,37 @@ type User struct {
 	// amount of one-time keys. This requires the DeviceId to be set as
 	// well.
 	OneTimeKeys uint
+	// Additional devices to log in, after the user is registered.
+	Devices []Device
+	// Upload cross-signing keys for this user, after their devices have been set up.
+	CrossSigning bool
+	// Media to upload as this user. Event content and avatar URLs on the same homeserver can refer to the
+	// uploaded media with the string "$media:<Ref>" which will be replaced with its mxc:// URI.
+	Media []Media
+	// Pushers to set for this user, as the body of /pushers/set
+	Pushers []map[string]interface{}
 }
 
+type Device struct {
+	ID string
+	// Upload the given amount of one-time keys for this device.
+	OneTimeKeys uint
+	// Delete this device once it has been set up, so the user has devices which no longer exist.
+	Delete bool
+}
+
+type Media struct {
+	// The reference for this media, unique per homeserver, used to refer to it via "$media:<Ref>".
+	Ref         string
+	ContentType string
+	Filename    string
+	// The bytes to upload, which is base64 in JSON/YAML.
+	Content []byte
+}
+
+// MediaRefPrefix is the prefix for strings which refer to uploaded media, see User.Media.
+const MediaRefPrefix = "$media:"
+
 type AccountData struct {
 	Type  string
 	Value map[string]interface{}
@@ -81,6 +111,42 @@ type Room struct {
 	Creator    string
 	CreateRoom map[string]interface{}
 	Events     []Event
+	// Room-scoped account data, set after the events are sent.
+	AccountData []RoomAccountData
+	// Room tags, set after the events are sent.
+	Tags []Tag
+	// Read receipts and markers, sent after the events.
+	Receipts []Receipt
+	// Aliases to create for this room, e.g "#foo:hs1". Created by the room creator.
+	Aliases []string
+	// If true, the room creator publishes the room in the public room directory.
+	Publish bool
+}
+
+type RoomAccountData struct {
+	User  string
+	Type  string
+	Value map[string]interface{}
+}
+
+type Tag struct {
+	User  string
+	Tag   string
+	Order *float64
+}
+
+const (
+	ReceiptTypeRead        = "m.read"
+	ReceiptTypeReadPrivate = "m.read.private"
+	ReceiptTypeFullyRead   = "m.fully_read"
+)
+
+type Receipt struct {
+	User string
+	// One of the ReceiptType constants. m.fully_read sets the fully read marker.
+	Type string
+	// The index in Events of the event to send the receipt for.
+	EventIndex int
 }
 
 type ApplicationService struct {
@@ -97,6 +163,11 @@ type Event struct {
 	Sender   string                 `json:"sender,omitempty"`
 	StateKey *string                `json:"state_key,omitempty"`
 	Content  map[string]interface{} `json:"content"`
+	// Optional: a name for this event, unique within the blueprint, which other events can wait for with After.
+	ID string `json:"id,omitempty"`
+	// Optional: the IDs of events, possibly on other homeservers, which must be sent before this event.
+	// See HasDependencies.
+	After []string `json:"after,omitempty"`
 }
 
 func MustValidate(bp Blueprint) Blueprint {
@@ -113,6 +184,7 @@ func Validate(bp Blueprint) (Blueprint, error) {
 	}
 	var err error
 	for _, hs := range bp.Homeservers {
+		mediaRefs := make(map[string]string) // media Ref -> localpart of the user who uploads it
 		for i, u := range hs.Users {
 			if !strings.HasPrefix(u.Localpart, "@") {
 				return bp, fmt.Errorf("HS %s user localpart '%s' must start with '@'", hs.Name, u.Localpart)
@@ -122,6 +194,20 @@ func Validate(bp Blueprint) (Blueprint, error) {
 			}
 			// strip the @
 			hs.Users[i].Localpart = hs.Users[i].Localpart[1:]
+			for _, d := range u.Devices {
+				if d.ID == "" {
+					return bp, fmt.Errorf("HS %s user '%s' has a device without an ID", hs.Name, u.Localpart)
+				}
+			}
+			for _, m := range u.Media {
+				if m.Ref == "" {
+					return bp, fmt.Errorf("HS %s user '%s' has media without a Ref", hs.Name, u.Localpart)
+				}
+				if existing, ok := mediaRefs[m.Ref]; ok {
+					return bp, fmt.Errorf("HS %s media Ref '%s' is used by both '%s' and '%s'", hs.Name, m.Ref, existing, u.Localpart)
+				}
+				mediaRefs[m.Ref] = u.Localpart
+			}
 		}
 		for i := range hs.Rooms {
 			hs.Rooms[i], err = normaliseRoom(hs.Name, hs.Rooms[i])
@@ -136,6 +222,9 @@ func Validate(bp Blueprint) (Blueprint, error) {
 			}
 		}
 	}
+	if err = validateDependencies(bp); err != nil {
+		return bp, err
+	}
 
 	return bp, nil
 }
@@ -150,12 +239,48 @@ func normaliseRoom(hsName string, r Room) (Room, error) {
 	} else if r.Ref == "" {
 		return r, fmt.Errorf("%s : room must have either a Ref or a Creator", hsName)
 	}
+	for i := range r.AccountData {
+		r.AccountData[i].User, err = normaliseUser(r.AccountData[i].User, hsName)
+		if err != nil {
+			return r, err
+		}
+	}
+	for i := range r.Tags {
+		r.Tags[i].User, err = normaliseUser(r.Tags[i].User, hsName)
+		if err != nil {
+			return r, err
+		}
+	}
+	for i, receipt := range r.Receipts {
+		r.Receipts[i].User, err = normaliseUser(receipt.User, hsName)
+		if err != nil {
+			return r, err
+		}
+		if receipt.EventIndex < 0 || receipt.EventIndex >= len(r.Events) {
+			return r, fmt.Errorf("%s : receipt for event index %d but the room has %d events", hsName, receipt.EventIndex, len(r.Events))
+		}
+		if r.Events[receipt.EventIndex].StateKey != nil && r.Events[receipt.EventIndex].Type == "m.room.member" {
+			return r, fmt.Errorf("%s : receipt for event index %d but membership events have no event ID", hsName, receipt.EventIndex)
+		}
+		switch receipt.Type {
+		case ReceiptTypeRead, ReceiptTypeReadPrivate, ReceiptTypeFullyRead:
+		default:
+			return r, fmt.Errorf("%s : unknown receipt type '%s'", hsName, receipt.Type)
+		}
+	}
+	if (len(r.Aliases) > 0 || r.Publish) && r.Creator == "" {
+		return r, fmt.Errorf("%s : room must have a Creator to create aliases or be published", hsName)
+	}
 	for i := range r.Events {
 		r.Events[i].Sender, err = normaliseUser(r.Events[i].Sender, hsName)
 		if err != nil {
 			return r, err
 		}
 		if r.Events[i].StateKey != nil && r.Events[i].Type == "m.room.member" {
+			if strings.Contains(*r.Events[i].StateKey, ":") {
+				// the target can be on another homeserver e.g inviting a remote user
+				continue
+			}
 			skey, err := normaliseUser(*r.Events[i].StateKey, hsName)
 			if err != nil {
 				return r, err
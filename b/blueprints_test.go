@@ -0,0 +1,117 @@
+package b
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	memberKey := "@bob"
+	message := Event{Type: "m.room.message", Sender: "@alice"}
+	member := Event{Type: "m.room.member", Sender: "@bob", StateKey: &memberKey}
+	testCases := []struct {
+		name    string
+		hs      Homeserver
+		wantErr string
+	}{
+		{
+			name: "valid",
+			hs: Homeserver{
+				Name: "hs1",
+				Users: []User{
+					{Localpart: "@alice", Devices: []Device{{ID: "PHONE"}}, Media: []Media{{Ref: "cat"}}},
+					{Localpart: "@bob", Media: []Media{{Ref: "dog"}}},
+				},
+				Rooms: []Room{{
+					Creator:  "@alice",
+					Events:   []Event{member, message},
+					Receipts: []Receipt{{User: "@bob", Type: ReceiptTypeFullyRead, EventIndex: 1}},
+					Tags:     []Tag{{User: "@bob", Tag: "m.favourite"}},
+					Aliases:  []string{"#room:hs1"},
+					Publish:  true,
+				}},
+			},
+		},
+		{
+			name:    "device without an ID",
+			hs:      Homeserver{Name: "hs1", Users: []User{{Localpart: "@alice", Devices: []Device{{}}}}},
+			wantErr: "has a device without an ID",
+		},
+		{
+			name:    "media without a Ref",
+			hs:      Homeserver{Name: "hs1", Users: []User{{Localpart: "@alice", Media: []Media{{}}}}},
+			wantErr: "has media without a Ref",
+		},
+		{
+			name: "duplicate media Ref",
+			hs: Homeserver{Name: "hs1", Users: []User{
+				{Localpart: "@alice", Media: []Media{{Ref: "cat"}}},
+				{Localpart: "@bob", Media: []Media{{Ref: "cat"}}},
+			}},
+			wantErr: "media Ref 'cat' is used by both '@alice' and '@bob'",
+		},
+		{
+			name: "receipt for an event which does not exist",
+			hs: Homeserver{Name: "hs1", Rooms: []Room{{
+				Creator:  "@alice",
+				Events:   []Event{message},
+				Receipts: []Receipt{{User: "@bob", Type: ReceiptTypeRead, EventIndex: 1}},
+			}}},
+			wantErr: "receipt for event index 1 but the room has 1 events",
+		},
+		{
+			name: "receipt for a membership event",
+			hs: Homeserver{Name: "hs1", Rooms: []Room{{
+				Creator:  "@alice",
+				Events:   []Event{member},
+				Receipts: []Receipt{{User: "@bob", Type: ReceiptTypeRead, EventIndex: 0}},
+			}}},
+			wantErr: "membership events have no event ID",
+		},
+		{
+			name: "unknown receipt type",
+			hs: Homeserver{Name: "hs1", Rooms: []Room{{
+				Creator:  "@alice",
+				Events:   []Event{message},
+				Receipts: []Receipt{{User: "@bob", Type: "m.unread", EventIndex: 0}},
+			}}},
+			wantErr: "unknown receipt type 'm.unread'",
+		},
+		{
+			name:    "alias without a creator",
+			hs:      Homeserver{Name: "hs1", Rooms: []Room{{Ref: "room", Aliases: []string{"#room:hs1"}}}},
+			wantErr: "must have a Creator to create aliases",
+		},
+		{
+			name:    "published without a creator",
+			hs:      Homeserver{Name: "hs1", Rooms: []Room{{Ref: "room", Publish: true}}},
+			wantErr: "must have a Creator to create aliases or be published",
+		},
+	}
+	for _, tc := range testCases {
+		_, err := Validate(Blueprint{Name: "test", Homeservers: []Homeserver{tc.hs}})
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error %v, want '%s'", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateMediaRefsPerHomeserver(t *testing.T) {
+	// media Refs only need to be unique per homeserver, as they are uploaded to and used on one homeserver
+	_, err := Validate(Blueprint{
+		Name: "test",
+		Homeservers: []Homeserver{
+			{Name: "hs1", Users: []User{{Localpart: "@alice", Media: []Media{{Ref: "cat"}}}}},
+			{Name: "hs2", Users: []User{{Localpart: "@alice", Media: []Media{{Ref: "cat"}}}}},
+		},
+	})
+	if err != nil {
+		t.Errorf("got error %s, want none", err)
+	}
+}
@@ -0,0 +1,141 @@
+package b
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HasDependencies returns true if any event in the blueprint has an ID or waits for other events with After.
+//
+// Blueprints without dependencies are built one homeserver at a time, in the order they are listed, so a room
+// with a Ref must be created by an earlier homeserver than the ones which join it.
+//
+// Blueprints with dependencies are built by starting all homeservers, creating all users, then sending the
+// events for every room on every homeserver at the same time. Each event waits for the events in its After
+// list, and for the events before it in the same room. Joining a room by Ref additionally waits for the room
+// to be created, but nothing else: any other ordering between homeservers must be declared with After. For
+// example, for hs2 to join a room created on hs1 only once hs1 has invited it:
+//
+//	hs1: Room{Ref: "r", Creator: "@alice", Events: [invite "@bob:hs2" with ID "invite_bob"]}
+//	hs2: Room{Ref: "r", Events: [join "@bob" with After ["invite_bob"]]}
+func HasDependencies(bp Blueprint) bool {
+	for _, hs := range bp.Homeservers {
+		for _, room := range hs.Rooms {
+			for _, ev := range room.Events {
+				if ev.ID != "" || len(ev.After) > 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// step is a node in the dependency graph: an event in a room, or the start of the room if event is -1.
+type step struct {
+	hs    string
+	room  int
+	event int
+}
+
+func (s step) String() string {
+	if s.event < 0 {
+		return fmt.Sprintf("%s room %d start", s.hs, s.room)
+	}
+	return fmt.Sprintf("%s room %d event %d", s.hs, s.room, s.event)
+}
+
+// validateDependencies checks that every After refers to an event ID which exists and that there are no cycles,
+// which would otherwise deadlock the blueprint when it is built.
+func validateDependencies(bp Blueprint) error {
+	if !HasDependencies(bp) {
+		return nil
+	}
+	ids := make(map[string]step)
+	creators := make(map[string]step) // room Ref -> start of the room which creates it
+	for _, hs := range bp.Homeservers {
+		for ri, room := range hs.Rooms {
+			if room.Creator != "" && room.Ref != "" {
+				creators[room.Ref] = step{hs.Name, ri, -1}
+			}
+			for ei, ev := range room.Events {
+				if ev.ID == "" {
+					continue
+				}
+				if existing, ok := ids[ev.ID]; ok {
+					return fmt.Errorf("event ID '%s' is used by both %s and %s", ev.ID, existing, step{hs.Name, ri, ei})
+				}
+				ids[ev.ID] = step{hs.Name, ri, ei}
+			}
+		}
+	}
+
+	// edges point from a step to the steps which must happen before it
+	deps := make(map[step][]step)
+	for _, hs := range bp.Homeservers {
+		for ri, room := range hs.Rooms {
+			start := step{hs.Name, ri, -1}
+			if room.Creator == "" {
+				creator, ok := creators[room.Ref]
+				if !ok {
+					return fmt.Errorf("%s joins room Ref '%s' but no room with that Ref has a Creator", start, room.Ref)
+				}
+				deps[start] = append(deps[start], creator)
+			}
+			prev := start
+			for ei, ev := range room.Events {
+				s := step{hs.Name, ri, ei}
+				deps[s] = append(deps[s], prev)
+				for _, id := range ev.After {
+					dep, ok := ids[id]
+					if !ok {
+						return fmt.Errorf("%s must be sent after unknown event ID '%s'", s, id)
+					}
+					deps[s] = append(deps[s], dep)
+				}
+				prev = s
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[step]int)
+	var path []step
+	var visit func(s step) error
+	visit = func(s step) error {
+		switch state[s] {
+		case visited:
+			return nil
+		case visiting:
+			var cycle []string
+			for i := len(path) - 1; i >= 0; i-- {
+				cycle = append([]string{path[i].String()}, cycle...)
+				if path[i] == s {
+					break
+				}
+			}
+			cycle = append(cycle, s.String())
+			return fmt.Errorf("events wait for each other in a cycle: %s", strings.Join(cycle, " waits for "))
+		}
+		state[s] = visiting
+		path = append(path, s)
+		for _, dep := range deps[s] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[s] = visited
+		return nil
+	}
+	for s := range deps {
+		if err := visit(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
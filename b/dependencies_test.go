@@ -0,0 +1,84 @@
+package b
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateDependencies(t *testing.T) {
+	invite := Event{Type: "m.room.member", Sender: "@alice", ID: "invite_bob"}
+	testCases := []struct {
+		name    string
+		hs1     []Room
+		hs2     []Room
+		wantErr string
+	}{
+		{
+			name: "no dependencies",
+			hs1:  []Room{{Ref: "r", Creator: "@alice", Events: []Event{{Type: "m.room.message"}}}},
+		},
+		{
+			name: "join after invite",
+			hs1:  []Room{{Ref: "r", Creator: "@alice", Events: []Event{invite}}},
+			hs2:  []Room{{Ref: "r", Events: []Event{{Type: "m.room.member", Sender: "@bob", After: []string{"invite_bob"}}}}},
+		},
+		{
+			name:    "unknown event ID",
+			hs1:     []Room{{Ref: "r", Creator: "@alice", Events: []Event{{Type: "m.room.message", After: []string{"missing"}}}}},
+			wantErr: "hs1 room 0 event 0 must be sent after unknown event ID 'missing'",
+		},
+		{
+			name:    "duplicate event ID",
+			hs1:     []Room{{Ref: "r", Creator: "@alice", Events: []Event{invite}}},
+			hs2:     []Room{{Ref: "s", Creator: "@bob", Events: []Event{invite}}},
+			wantErr: "event ID 'invite_bob' is used by both hs1 room 0 event 0 and hs2 room 0 event 0",
+		},
+		{
+			name:    "joined room is never created",
+			hs1:     []Room{{Ref: "r", Creator: "@alice", Events: []Event{invite}}},
+			hs2:     []Room{{Ref: "missing", Events: []Event{{Type: "m.room.member", After: []string{"invite_bob"}}}}},
+			wantErr: "hs2 room 0 start joins room Ref 'missing' but no room with that Ref has a Creator",
+		},
+		{
+			name: "cycle across homeservers",
+			hs1: []Room{{Ref: "r", Creator: "@alice", Events: []Event{
+				{Type: "m.room.message", ID: "a", After: []string{"b"}},
+			}}},
+			hs2: []Room{{Ref: "s", Creator: "@bob", Events: []Event{
+				{Type: "m.room.message", ID: "b", After: []string{"a"}},
+			}}},
+			wantErr: "events wait for each other in a cycle",
+		},
+		{
+			name: "cycle with an earlier event in the same room",
+			hs1: []Room{{Ref: "r", Creator: "@alice", Events: []Event{
+				{Type: "m.room.message", ID: "a", After: []string{"b"}},
+				{Type: "m.room.message", ID: "b"},
+			}}},
+			wantErr: "events wait for each other in a cycle",
+		},
+	}
+	for _, tc := range testCases {
+		bp := Blueprint{
+			Name: "test",
+			Homeservers: []Homeserver{
+				{Name: "hs1", Rooms: tc.hs1},
+				{Name: "hs2", Rooms: tc.hs2},
+			},
+		}
+		err := validateDependencies(bp)
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tc.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected error containing '%s', got none", tc.name, tc.wantErr)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error '%s', want '%s'", tc.name, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package b
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Blueprint files are YAML or JSON documents with the same structure as the Blueprint struct, see
+// blueprint.schema.json. Field names are case-insensitive, so `Homeservers` and `homeservers` are
+// equivalent. In addition to the Blueprint fields, files can contain:
+//
+//   - Include: a list of blueprint files to merge into this one, relative to this file. Homeservers with
+//     the same name are merged, with this file's users, rooms and application services coming last.
+//   - ManyMessages: a generator in a room's Events, e.g `{ManyMessages: {Senders: ["@alice"], Count: 100}}`
+//     which expands to that many m.room.message events, round-robining between the senders.
+//   - ManyUsers: a generator in a homeserver's Users, e.g `{ManyUsers: {LocalpartPrefix: "@user", Count: 100}}`
+//     which expands to users @user-0 to @user-99.
+
+// Schema is the JSON Schema for blueprint files. Every file is checked against it before it is loaded,
+// including included files, so a file on its own does not need a Name.
+//
+//go:embed blueprint.schema.json
+var Schema []byte
+
+// LoadFile loads and validates a blueprint file, see ParseFile.
+func LoadFile(path string) (Blueprint, error) {
+	bp, err := ParseFile(path)
+	if err != nil {
+		return bp, err
+	}
+	return Validate(bp)
+}
+
+// MustLoadFile is LoadFile which panics on error, for use in tests.
+func MustLoadFile(path string) Blueprint {
+	bp, err := LoadFile(path)
+	if err != nil {
+		panic("MustLoadFile: " + err.Error())
+	}
+	return bp
+}
+
+// ParseFile parses a YAML or JSON blueprint file, resolving includes and expanding generators. The
+// blueprint is not validated, so user IDs are exactly as they are written in the file.
+func ParseFile(path string) (Blueprint, error) {
+	return parseFile(path, make(map[string]bool))
+}
+
+func parseFile(path string, seen map[string]bool) (Blueprint, error) {
+	var bp Blueprint
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return bp, err
+	}
+	if seen[absPath] {
+		return bp, fmt.Errorf("%s: include cycle", path)
+	}
+	seen[absPath] = true
+	defer delete(seen, absPath)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return bp, err
+	}
+	// YAML is a superset of JSON so this handles both
+	var doc map[string]interface{}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return bp, fmt.Errorf("%s: %s", path, err)
+	}
+	var generic interface{}
+	if err = convert(doc, &generic); err != nil {
+		return bp, fmt.Errorf("%s: %s", path, err)
+	}
+	if err = validateSchema(generic); err != nil {
+		return bp, fmt.Errorf("%s: %s", path, err)
+	}
+	var includes []string
+	if inc, ok := popKey(doc, "include"); ok {
+		if err = convert(inc, &includes); err != nil {
+			return bp, fmt.Errorf("%s: Include must be a list of paths: %s", path, err)
+		}
+	}
+	if err = expandGenerators(doc); err != nil {
+		return bp, fmt.Errorf("%s: %s", path, err)
+	}
+	if err = convert(doc, &bp); err != nil {
+		return bp, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if len(includes) == 0 {
+		return bp, nil
+	}
+	var base Blueprint
+	for _, inc := range includes {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(path), inc)
+		}
+		included, err := parseFile(inc, seen)
+		if err != nil {
+			return bp, err
+		}
+		base = merge(base, included)
+	}
+	return merge(base, bp), nil
+}
+
+// merge `bp` into `base`, returning the merged blueprint.
+func merge(base, bp Blueprint) Blueprint {
+	if bp.Name != "" {
+		base.Name = bp.Name
+	}
+	base.KeepAccessTokensForUsers = append(base.KeepAccessTokensForUsers, bp.KeepAccessTokensForUsers...)
+	for _, hs := range bp.Homeservers {
+		merged := false
+		for i := range base.Homeservers {
+			if base.Homeservers[i].Name != hs.Name {
+				continue
+			}
+			base.Homeservers[i].Users = append(base.Homeservers[i].Users, hs.Users...)
+			base.Homeservers[i].Rooms = append(base.Homeservers[i].Rooms, hs.Rooms...)
+			base.Homeservers[i].ApplicationServices = append(base.Homeservers[i].ApplicationServices, hs.ApplicationServices...)
+			if hs.BaseImageURI != nil {
+				base.Homeservers[i].BaseImageURI = hs.BaseImageURI
+			}
+			merged = true
+		}
+		if !merged {
+			base.Homeservers = append(base.Homeservers, hs)
+		}
+	}
+	return base
+}
+
+type manyMessagesGenerator struct {
+	Senders []string
+	Count   int
+}
+
+type manyUsersGenerator struct {
+	LocalpartPrefix string
+	Count           int
+}
+
+// expandGenerators replaces generators in the homeservers of this document with what they generate.
+func expandGenerators(doc map[string]interface{}) error {
+	homeservers, _ := getKey(doc, "homeservers").([]interface{})
+	for _, hsVal := range homeservers {
+		hs, ok := hsVal.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		users, err := expandList(getKey(hs, "users"), "manyusers", func(gen interface{}) ([]interface{}, error) {
+			var g manyUsersGenerator
+			if err := convert(gen, &g); err != nil {
+				return nil, fmt.Errorf("invalid ManyUsers: %s", err)
+			}
+			generated := make([]interface{}, g.Count)
+			for i := range generated {
+				generated[i] = map[string]interface{}{
+					"Localpart": fmt.Sprintf("%s-%d", g.LocalpartPrefix, i),
+				}
+			}
+			return generated, nil
+		})
+		if err != nil {
+			return err
+		}
+		setKey(hs, "users", users)
+		rooms, _ := getKey(hs, "rooms").([]interface{})
+		for _, roomVal := range rooms {
+			room, ok := roomVal.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			events, err := expandList(getKey(room, "events"), "manymessages", func(gen interface{}) ([]interface{}, error) {
+				var g manyMessagesGenerator
+				if err := convert(gen, &g); err != nil {
+					return nil, fmt.Errorf("invalid ManyMessages: %s", err)
+				}
+				if len(g.Senders) == 0 {
+					return nil, fmt.Errorf("ManyMessages must have at least one sender")
+				}
+				var generated []interface{}
+				if err := convert(manyMessages(g.Senders, g.Count), &generated); err != nil {
+					return nil, err
+				}
+				return generated, nil
+			})
+			if err != nil {
+				return err
+			}
+			setKey(room, "events", events)
+		}
+	}
+	return nil
+}
+
+// expandList replaces items in the list which are generators with the given name with what they generate.
+func expandList(listVal interface{}, generatorName string, generate func(gen interface{}) ([]interface{}, error)) (interface{}, error) {
+	list, ok := listVal.([]interface{})
+	if !ok {
+		return listVal, nil
+	}
+	var expanded []interface{}
+	for _, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok || len(obj) != 1 || getKey(obj, generatorName) == nil {
+			expanded = append(expanded, item)
+			continue
+		}
+		generated, err := generate(getKey(obj, generatorName))
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, generated...)
+	}
+	return expanded, nil
+}
+
+// getKey returns the value for the case-insensitive key, or nil.
+func getKey(m map[string]interface{}, key string) interface{} {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
+
+func setKey(m map[string]interface{}, key string, val interface{}) {
+	if val == nil {
+		return
+	}
+	for k := range m {
+		if strings.EqualFold(k, key) {
+			m[k] = val
+			return
+		}
+	}
+}
+
+func popKey(m map[string]interface{}, key string) (interface{}, bool) {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			delete(m, k)
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// convert the YAML value into the struct via JSON, so field names are matched in the same way as JSON
+// blueprints. Unknown fields are rejected to catch typos.
+func convert(in interface{}, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(out)
+}
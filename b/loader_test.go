@@ -0,0 +1,141 @@
+package b
+
+import (
+	"strings"
+	"testing"
+)
+
+func localparts(users []User) (lps []string) {
+	for _, u := range users {
+		lps = append(lps, u.Localpart)
+	}
+	return lps
+}
+
+func TestParseFileIncludes(t *testing.T) {
+	bp, err := ParseFile("testdata/includes/main.yaml")
+	if err != nil {
+		t.Fatalf("ParseFile returned error: %s", err)
+	}
+	if bp.Name != "chatting" {
+		t.Errorf("got Name %s want chatting", bp.Name)
+	}
+	if len(bp.Homeservers) != 2 {
+		t.Fatalf("got %d homeservers want 2", len(bp.Homeservers))
+	}
+	hs1, hs2 := bp.Homeservers[0], bp.Homeservers[1]
+	testCases := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"included homeservers come first", hs1.Name + "," + hs2.Name, "hs1,hs2"},
+		{"users are merged with this file's users last", strings.Join(localparts(hs1.Users), ","), "@alice,@lurker-0,@lurker-1,@lurker-2,@charlie"},
+		{"homeservers only in the include are kept", strings.Join(localparts(hs2.Users), ","), "@bob"},
+		{"access tokens are merged", strings.Join(bp.KeepAccessTokensForUsers, ","), "@alice:hs1,@charlie:hs1"},
+	}
+	for _, tc := range testCases {
+		if tc.got != tc.want {
+			t.Errorf("%s: got %s want %s", tc.name, tc.got, tc.want)
+		}
+	}
+
+	if len(hs1.Rooms) != 1 {
+		t.Fatalf("got %d rooms want 1", len(hs1.Rooms))
+	}
+	events := hs1.Rooms[0].Events
+	wantSenders := []string{"@lurker-0", "@alice", "@charlie", "@alice"}
+	if len(events) != len(wantSenders) {
+		t.Fatalf("got %d events want %d", len(events), len(wantSenders))
+	}
+	for i, ev := range events {
+		if ev.Sender != wantSenders[i] {
+			t.Errorf("event %d: got sender %s want %s", i, ev.Sender, wantSenders[i])
+		}
+	}
+	if body := events[3].Content["body"]; body != "Hello world 2" {
+		t.Errorf("got generated body %v want 'Hello world 2'", body)
+	}
+	if preset := hs1.Rooms[0].CreateRoom["preset"]; preset != "public_chat" {
+		t.Errorf("got preset %v want public_chat", preset)
+	}
+}
+
+func TestLoadFileJSON(t *testing.T) {
+	bp, err := LoadFile("testdata/main.json")
+	if err != nil {
+		t.Fatalf("LoadFile returned error: %s", err)
+	}
+	if len(bp.Homeservers) != 3 {
+		t.Fatalf("got %d homeservers want 3", len(bp.Homeservers))
+	}
+	dave := bp.Homeservers[2].Users[0]
+	// LoadFile validates the blueprint, which strips the @
+	if dave.Localpart != "dave" || dave.OneTimeKeys != 5 || dave.DeviceID == nil || *dave.DeviceID != "DAVE" {
+		t.Errorf("got user %+v", dave)
+	}
+}
+
+func TestParseFileErrors(t *testing.T) {
+	testCases := []struct {
+		file    string
+		wantErr string
+	}{
+		{"testdata/cycle_a.yaml", "include cycle"},
+		{"testdata/unknown_field.yaml", "Homeservers[0].Users[0] has unknown field DisplayNmae"},
+		{"testdata/bad_generator.yaml", "ManyMessages.Senders must have at least 1 items"},
+		{"testdata/bad_localpart.yaml", "Homeservers[0].Users[0].Localpart '@alice:hs1' must match"},
+		{"testdata/bad_type.yaml", "Homeservers[0].Users[0].OneTimeKeys must be at least 0"},
+		{"testdata/missing_include.yaml", "does_not_exist.yaml"},
+	}
+	for _, tc := range testCases {
+		_, err := ParseFile(tc.file)
+		if err == nil {
+			t.Errorf("%s: expected error containing '%s', got none", tc.file, tc.wantErr)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error '%s', want '%s'", tc.file, err, tc.wantErr)
+		}
+	}
+}
+
+func TestLoadFileRequiresName(t *testing.T) {
+	_, err := LoadFile("testdata/includes/users.yaml")
+	if err == nil || !strings.Contains(err.Error(), "must have a Name") {
+		t.Errorf("got error %v, want a missing Name error", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	image := "other-image"
+	base := Blueprint{
+		Name: "base",
+		Homeservers: []Homeserver{
+			{Name: "hs1", Users: []User{{Localpart: "@alice"}}, Rooms: []Room{{Ref: "a"}}},
+		},
+	}
+	bp := Blueprint{
+		Homeservers: []Homeserver{
+			{Name: "hs1", Users: []User{{Localpart: "@bob"}}, Rooms: []Room{{Ref: "b"}}, BaseImageURI: &image},
+			{Name: "hs2"},
+		},
+	}
+	got := merge(base, bp)
+	if got.Name != "base" {
+		t.Errorf("got Name %s, want the base Name to be kept when not overridden", got.Name)
+	}
+	if len(got.Homeservers) != 2 {
+		t.Fatalf("got %d homeservers want 2", len(got.Homeservers))
+	}
+	hs1 := got.Homeservers[0]
+	if lps := strings.Join(localparts(hs1.Users), ","); lps != "@alice,@bob" {
+		t.Errorf("got users %s want @alice,@bob", lps)
+	}
+	if len(hs1.Rooms) != 2 || hs1.Rooms[0].Ref != "a" || hs1.Rooms[1].Ref != "b" {
+		t.Errorf("got rooms %+v want a then b", hs1.Rooms)
+	}
+	if hs1.BaseImageURI == nil || *hs1.BaseImageURI != image {
+		t.Errorf("BaseImageURI was not overridden")
+	}
+}
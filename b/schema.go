@@ -0,0 +1,222 @@
+package b
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// schemaNode is the subset of JSON Schema which blueprint.schema.json uses.
+type schemaNode struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Properties           map[string]*schemaNode `json:"properties"`
+	Items                *schemaNode            `json:"items"`
+	OneOf                []*schemaNode          `json:"oneOf"`
+	AnyOf                []*schemaNode          `json:"anyOf"`
+	Enum                 []interface{}          `json:"enum"`
+	Minimum              *float64               `json:"minimum"`
+	MinLength            int                    `json:"minLength"`
+	MinItems             int                    `json:"minItems"`
+	Pattern              string                 `json:"pattern"`
+	Defs                 map[string]*schemaNode `json:"$defs"`
+}
+
+var rootSchema = mustParseSchema(Schema)
+
+func mustParseSchema(data []byte) *schemaNode {
+	var root schemaNode
+	if err := json.Unmarshal(data, &root); err != nil {
+		panic("blueprint.schema.json is invalid: " + err.Error())
+	}
+	return &root
+}
+
+// validateSchema checks a blueprint file document against Schema. Property names are matched
+// case-insensitively, in the same way as they are when the document is loaded. The document must be
+// made of JSON types, i.e decoded with encoding/json.
+func validateSchema(doc interface{}) error {
+	return rootSchema.validate(doc, "")
+}
+
+func (s *schemaNode) resolve() (*schemaNode, error) {
+	if s.Ref == "" {
+		return s, nil
+	}
+	name := strings.TrimPrefix(s.Ref, "#/$defs/")
+	def, ok := rootSchema.Defs[name]
+	if !ok {
+		return nil, fmt.Errorf("schema: unknown $ref %s", s.Ref)
+	}
+	return def, nil
+}
+
+func (s *schemaNode) validate(val interface{}, path string) error {
+	s, err := s.resolve()
+	if err != nil {
+		return err
+	}
+	where := path
+	if where == "" {
+		where = "blueprint"
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if e == val {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v, got %v", where, s.Enum, val)
+		}
+	}
+	if len(s.OneOf) > 0 {
+		matched := 0
+		var optionErr error
+		for _, option := range s.OneOf {
+			if err := option.validate(val, path); err != nil {
+				// report the error for the alternative the value was most likely meant to be
+				if optionErr == nil || option.hasRequired(val) {
+					optionErr = err
+				}
+				continue
+			}
+			matched++
+		}
+		if matched == 0 {
+			return optionErr
+		}
+		if matched > 1 {
+			return fmt.Errorf("%s is ambiguous: matches %d alternatives", where, matched)
+		}
+	}
+	if len(s.AnyOf) > 0 {
+		var firstErr error
+		for _, option := range s.AnyOf {
+			if firstErr = option.validate(val, path); firstErr == nil {
+				break
+			}
+		}
+		if firstErr != nil {
+			return firstErr
+		}
+	}
+
+	if obj, ok := val.(map[string]interface{}); ok {
+		for _, req := range s.Required {
+			if getKey(obj, req) == nil {
+				return fmt.Errorf("%s is missing %s", where, req)
+			}
+		}
+	}
+
+	switch s.Type {
+	case "":
+	case "object":
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", where)
+		}
+		return s.validateObject(obj, path)
+	case "array":
+		arr, ok := val.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be a list", where)
+		}
+		if len(arr) < s.MinItems {
+			return fmt.Errorf("%s must have at least %d items", where, s.MinItems)
+		}
+		if s.Items == nil {
+			return nil
+		}
+		for i, item := range arr {
+			if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", where)
+		}
+		if len(str) < s.MinLength {
+			return fmt.Errorf("%s must have at least %d characters", where, s.MinLength)
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(str) {
+			return fmt.Errorf("%s '%s' must match %s", where, str, s.Pattern)
+		}
+	case "integer", "number":
+		num, ok := val.(float64)
+		if !ok {
+			return fmt.Errorf("%s must be a number", where)
+		}
+		if s.Type == "integer" && num != math.Trunc(num) {
+			return fmt.Errorf("%s must be an integer", where)
+		}
+		if s.Minimum != nil && num < *s.Minimum {
+			return fmt.Errorf("%s must be at least %v", where, *s.Minimum)
+		}
+	case "boolean":
+		if _, ok := val.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", where)
+		}
+	default:
+		return fmt.Errorf("schema: unsupported type %s", s.Type)
+	}
+	return nil
+}
+
+// hasRequired returns true if the value is an object with all the fields the schema requires.
+func (s *schemaNode) hasRequired(val interface{}) bool {
+	s, err := s.resolve()
+	if err != nil {
+		return false
+	}
+	obj, ok := val.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, req := range s.Required {
+		if getKey(obj, req) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *schemaNode) validateObject(obj map[string]interface{}, path string) error {
+	where := path
+	if where == "" {
+		where = "blueprint"
+	}
+	for k, v := range obj {
+		var prop *schemaNode
+		var name string
+		for propName, p := range s.Properties {
+			if strings.EqualFold(k, propName) {
+				prop, name = p, propName
+				break
+			}
+		}
+		if prop == nil {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				return fmt.Errorf("%s has unknown field %s", where, k)
+			}
+			continue
+		}
+		childPath := name
+		if path != "" {
+			childPath = path + "." + name
+		}
+		if err := prop.validate(v, childPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
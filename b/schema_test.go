@@ -0,0 +1,138 @@
+package b
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fieldNames returns the JSON field names of the struct type.
+func fieldNames(typ reflect.Type) (names []string) {
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" {
+			name = tag
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func propertyNames(s *schemaNode) (names []string) {
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestSchemaMatchesTypes checks blueprint.schema.json has exactly the fields of the Go types, so files can
+// use every field and the schema does not drift from the types.
+func TestSchemaMatchesTypes(t *testing.T) {
+	defs := rootSchema.Defs
+	user := defs["User"].Properties
+	room := defs["Room"].Properties
+	root := *rootSchema
+	root.Properties = make(map[string]*schemaNode)
+	for name, prop := range rootSchema.Properties {
+		if name != "Include" { // only in files
+			root.Properties[name] = prop
+		}
+	}
+	testCases := []struct {
+		name   string
+		schema *schemaNode
+		typ    interface{}
+	}{
+		{"root", &root, Blueprint{}},
+		{"Homeserver", defs["Homeserver"], Homeserver{}},
+		{"User", defs["User"], User{}},
+		{"User.AccountData", user["AccountData"].Items, AccountData{}},
+		{"User.Devices", user["Devices"].Items, Device{}},
+		{"User.Media", user["Media"].Items, Media{}},
+		{"Room", defs["Room"], Room{}},
+		{"Room.AccountData", room["AccountData"].Items, RoomAccountData{}},
+		{"Room.Tags", room["Tags"].Items, Tag{}},
+		{"Room.Receipts", room["Receipts"].Items, Receipt{}},
+		{"Event", defs["Event"], Event{}},
+		{"ApplicationService", defs["ApplicationService"], ApplicationService{}},
+		{"ManyUsers", defs["ManyUsers"].Properties["ManyUsers"], manyUsersGenerator{}},
+		{"ManyMessages", defs["ManyMessages"].Properties["ManyMessages"], manyMessagesGenerator{}},
+	}
+	for _, tc := range testCases {
+		got := strings.Join(propertyNames(tc.schema), ",")
+		want := strings.Join(fieldNames(reflect.TypeOf(tc.typ)), ",")
+		if got != want {
+			t.Errorf("%s: schema has properties %s but the type has fields %s", tc.name, got, want)
+		}
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	testCases := []struct {
+		name    string
+		doc     map[string]interface{}
+		wantErr string
+	}{
+		{
+			name: "field names are case-insensitive",
+			doc:  map[string]interface{}{"name": "x", "HOMESERVERS": []interface{}{map[string]interface{}{"name": "hs1"}}},
+		},
+		{
+			name:    "homeserver without a name",
+			doc:     map[string]interface{}{"Homeservers": []interface{}{map[string]interface{}{}}},
+			wantErr: "Homeservers[0] is missing Name",
+		},
+		{
+			name:    "wrong type",
+			doc:     map[string]interface{}{"Name": float64(1)},
+			wantErr: "Name must be a string",
+		},
+		{
+			name: "non-integer count",
+			doc: map[string]interface{}{"Homeservers": []interface{}{map[string]interface{}{
+				"Name":  "hs1",
+				"Users": []interface{}{map[string]interface{}{"ManyUsers": map[string]interface{}{"LocalpartPrefix": "@u", "Count": 1.5}}},
+			}}},
+			wantErr: "Count must be an integer",
+		},
+		{
+			name: "unknown receipt type",
+			doc: map[string]interface{}{"Homeservers": []interface{}{map[string]interface{}{
+				"Name": "hs1",
+				"Rooms": []interface{}{map[string]interface{}{
+					"Creator":  "@alice",
+					"Receipts": []interface{}{map[string]interface{}{"User": "@alice", "Type": "m.unread", "EventIndex": float64(0)}},
+				}},
+			}}},
+			wantErr: "Type must be one of",
+		},
+		{
+			name: "room without a creator or ref",
+			doc: map[string]interface{}{"Homeservers": []interface{}{map[string]interface{}{
+				"Name":  "hs1",
+				"Rooms": []interface{}{map[string]interface{}{"Publish": true}},
+			}}},
+			wantErr: "Rooms[0] is missing",
+		},
+	}
+	for _, tc := range testCases {
+		err := validateSchema(tc.doc)
+		if tc.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tc.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected error containing '%s', got none", tc.name, tc.wantErr)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error '%s', want '%s'", tc.name, err, tc.wantErr)
+		}
+	}
+}
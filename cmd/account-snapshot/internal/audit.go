@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// AuditReport summarises what the anonymiser kept and dropped, and lists any strings in the anonymised snapshot
+// which look like they could identify someone, so the snapshot can be checked before it is shared.
+type AuditReport struct {
+	// event type -> counts, for room state and timeline events
+	EventTypes map[string]*AuditCounts
+	// account data type -> counts
+	AccountData map[string]*AuditCounts
+	// Strings which survived anonymisation and look like PII, most frequent first
+	Suspicious []SuspiciousString
+}
+
+type AuditCounts struct {
+	Kept    int
+	Dropped int
+}
+
+// SuspiciousString is a string which looks like PII, found in the anonymised snapshot.
+type SuspiciousString struct {
+	Kind  string // user_id, room_id, url, email or localpart
+	Value string
+	Count int
+	// Where the first occurrence is, e.g "room !3:hs1 m.room.message"
+	Where string
+}
+
+var piiRegexps = []struct {
+	kind   string
+	regexp *regexp.Regexp
+}{
+	{"user_id", userIDRegexp},
+	{"room_id", roomIDRegexp},
+	{"url", regexp.MustCompile(`(?i)\b(?:https?|mxc)://[^\s"]+`)},
+	{"email", regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)},
+}
+
+func newAuditReport() *AuditReport {
+	return &AuditReport{
+		EventTypes:  make(map[string]*AuditCounts),
+		AccountData: make(map[string]*AuditCounts),
+	}
+}
+
+func countIn(counts map[string]*AuditCounts, typ string, kept bool) {
+	c, ok := counts[typ]
+	if !ok {
+		c = &AuditCounts{}
+		counts[typ] = c
+	}
+	if kept {
+		c.Kept++
+	} else {
+		c.Dropped++
+	}
+}
+
+func (r *AuditReport) countEvent(evType string, kept bool) {
+	countIn(r.EventTypes, evType, kept)
+}
+
+// countAccountData counts the global account data, of which only m.direct and m.push_rules are kept.
+func countAccountData(syncData []byte, r *AuditReport) {
+	gjson.GetBytes(syncData, "account_data.events").ForEach(func(_, v gjson.Result) bool {
+		typ := v.Get("type").Str
+		countIn(r.AccountData, typ, typ == "m.direct" || typ == "m.push_rules")
+		return true
+	})
+}
+
+// scan looks for PII-like strings in the snapshot, ignoring the anonymous identifiers created by the mappings. The
+// localpart of the user whose snapshot this is is also looked for on its own, as it appears in e.g push rules.
+func (r *AuditReport) scan(sshot *Snapshot, userID string, mappings *AnonMappings) {
+	var localpart string
+	if userID != "" {
+		localpart, _ = split(userID)
+		localpart = strings.ToLower(localpart)
+	}
+	anonIDs := make(map[string]bool)
+	for _, m := range []map[string]string{mappings.Users, mappings.Rooms} {
+		for _, anon := range m {
+			anonIDs[anon] = true
+		}
+	}
+	found := make(map[string]*SuspiciousString) // kind + value -> suspicious string
+	record := func(where, kind, value string) {
+		key := kind + " " + value
+		if s, ok := found[key]; ok {
+			s.Count++
+			return
+		}
+		found[key] = &SuspiciousString{Kind: kind, Value: value, Count: 1, Where: where}
+	}
+	check := func(where, str string) {
+		for _, pr := range piiRegexps {
+			for _, match := range pr.regexp.FindAllString(str, -1) {
+				if anonIDs[match] {
+					continue
+				}
+				record(where, pr.kind, match)
+			}
+		}
+		if localpart != "" && strings.Contains(strings.ToLower(str), localpart) {
+			record(where, "localpart", localpart)
+		}
+	}
+	var walk func(where string, v gjson.Result)
+	walk = func(where string, v gjson.Result) {
+		switch {
+		case v.IsObject() || v.IsArray():
+			v.ForEach(func(k, child gjson.Result) bool {
+				if k.Type == gjson.String {
+					check(where, k.Str)
+				}
+				walk(where, child)
+				return true
+			})
+		case v.Type == gjson.String:
+			check(where, v.Str)
+		}
+	}
+	for _, room := range sshot.Rooms {
+		for _, events := range [][]json.RawMessage{room.State, room.Timeline} {
+			for _, ev := range events {
+				parsed := gjson.ParseBytes(ev)
+				walk(fmt.Sprintf("room %s %s", room.ID, parsed.Get("type").Str), parsed)
+			}
+		}
+	}
+	for userID, roomIDs := range sshot.AccountDataDMs {
+		check("account data m.direct", userID)
+		for _, roomID := range roomIDs {
+			check("account data m.direct", roomID)
+		}
+	}
+	if sshot.PushRules != nil {
+		walk("account data m.push_rules", gjson.ParseBytes(sshot.PushRules))
+	}
+	r.Suspicious = nil
+	for _, s := range found {
+		r.Suspicious = append(r.Suspicious, *s)
+	}
+	sort.Slice(r.Suspicious, func(i, j int) bool {
+		if r.Suspicious[i].Count != r.Suspicious[j].Count {
+			return r.Suspicious[i].Count > r.Suspicious[j].Count
+		}
+		return r.Suspicious[i].Value < r.Suspicious[j].Value
+	})
+}
+
+// String returns a human readable report.
+func (r *AuditReport) String() string {
+	var sb strings.Builder
+	writeCounts := func(title string, counts map[string]*AuditCounts) {
+		var types []string
+		for typ := range counts {
+			types = append(types, typ)
+		}
+		sort.Strings(types)
+		fmt.Fprintf(&sb, "%s:\n", title)
+		for _, typ := range types {
+			fmt.Fprintf(&sb, "  %-50s kept=%-8d dropped=%d\n", typ, counts[typ].Kept, counts[typ].Dropped)
+		}
+	}
+	writeCounts("Event types", r.EventTypes)
+	writeCounts("Account data types", r.AccountData)
+	if len(r.Suspicious) == 0 {
+		sb.WriteString("No PII-like strings survived anonymisation.\n")
+		return sb.String()
+	}
+	fmt.Fprintf(&sb, "%d PII-like strings survived anonymisation, check these before sharing the snapshot:\n", len(r.Suspicious))
+	for _, s := range r.Suspicious {
+		fmt.Fprintf(&sb, "  %-8s %s (x%d, first in %s)\n", s.Kind, s.Value, s.Count, s.Where)
+	}
+	return sb.String()
+}
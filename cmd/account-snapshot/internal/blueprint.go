@@ -12,7 +12,7 @@ import (
 var ignoredEventType = map[string]bool{
 	"m.room.tombstone": true, // TODO: need to hit /upgrade API
 	"m.room.encrypted": true, // TODO: need to be able to send E2E messages and then give keys to homerunner clients
-	"m.reaction":       true, // TODO: uhh not in spec, needs event_id mapping
+	"m.reaction":       true, // TODO: needs events to be able to relate to other events in the blueprint
 	"m.room.redaction": true, // TODO: Hit /redact API, needs event_id mapping first
 }
 var regexpAlphanums = regexp.MustCompile("[^a-zA-Z0-9]+")
@@ -247,7 +247,7 @@ func convertRoom(sr *AnonSnapshotRoom) *b.Room {
 			Sender:   gjson.GetBytes(ev, "sender").Str,
 			StateKey: sk,
 			Type:     evType,
-			Content:  jsonObject([]byte(gjson.GetBytes(ev, "content").Raw)),
+			Content:  timelineContent(ev),
 		})
 	}
 
@@ -300,7 +300,7 @@ func convertTimelineOnlyRoom(sr *AnonSnapshotRoom) *b.Room {
 				Sender:   gjson.GetBytes(ev, "sender").Str,
 				StateKey: sk,
 				Type:     evType,
-				Content:  jsonObject([]byte(gjson.GetBytes(ev, "content").Raw)),
+				Content:  timelineContent(ev),
 			})
 		}
 	}
@@ -329,6 +329,14 @@ func removeUnusedUsers(hs *b.Homeserver) {
 	hs.Users = users
 }
 
+// timelineContent returns the content of a timeline event without any relation, as the anonymised event IDs do not
+// exist in the blueprint.
+func timelineContent(ev json.RawMessage) map[string]interface{} {
+	content := jsonObject([]byte(gjson.GetBytes(ev, "content").Raw))
+	delete(content, "m.relates_to")
+	return content
+}
+
 func jsonObject(in json.RawMessage) (out map[string]interface{}) {
 	_ = json.Unmarshal(in, &out)
 	return
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// HistoryOptions controls how much of each room is fetched in addition to the /sync response.
+type HistoryOptions struct {
+	// The maximum number of events to back-paginate in each room with /messages, before the /sync timeline. 0 disables.
+	Depth int
+	// If true, the current state of each room is fetched with /state and replaces the /sync state.
+	FullState bool
+	// The directory to store the progress of each room in, so an interrupted snapshot can be resumed.
+	ProgressDir string
+}
+
+// roomHistory is the progress of fetching the history of a single room, which is stored on disk after every request.
+type roomHistory struct {
+	RoomID string
+	// The prev_batch of the /sync timeline which pagination started from. If /sync is performed again the progress
+	// is discarded, as the fetched events would no longer join up with the new timeline.
+	PrevBatch string
+	// The token to paginate from next, or "" if there is no more history.
+	From string
+	// Events from /messages, newest first.
+	Events    []json.RawMessage
+	State     []json.RawMessage
+	StateDone bool
+}
+
+func (h *roomHistory) paginationDone(depth int) bool {
+	return h.From == "" || len(h.Events) >= depth
+}
+
+// LoadHistory back-paginates and/or fetches the state of every joined room in the /sync response, and returns the
+// /sync response with the extra events added, so it can be redacted as normal. Paginated events are prepended to
+// the room's timeline. Progress is saved in opts.ProgressDir, so calling this again with the same directory resumes
+// where it left off. Rooms which cannot be fetched, e.g because the user can no longer see their history, are kept
+// with whatever was fetched before the failure. An error is only returned if the homeserver is unavailable, so it
+// can be resumed later.
+func LoadHistory(hsURL, token string, syncData json.RawMessage, opts HistoryOptions) (json.RawMessage, error) {
+	if opts.Depth <= 0 && !opts.FullState {
+		return syncData, nil
+	}
+	if err := os.MkdirAll(opts.ProgressDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create progress directory: %w", err)
+	}
+	httpCli := &http.Client{}
+	var roomIDs []string
+	gjson.GetBytes(syncData, "rooms.join").ForEach(func(k, v gjson.Result) bool {
+		roomIDs = append(roomIDs, k.Str)
+		return true
+	})
+	sort.Strings(roomIDs)
+	for i, roomID := range roomIDs {
+		log.Printf("Fetching history for room %s %d/%d\n", roomID, i+1, len(roomIDs))
+		roomPath := "rooms.join." + gjsonEscape(roomID)
+		progressFile := filepath.Join(opts.ProgressDir, hex.EncodeToString([]byte(roomID))+".json")
+		prevBatch := gjson.GetBytes(syncData, roomPath+".timeline.prev_batch").Str
+		h, err := loadRoomHistory(progressFile)
+		if err != nil {
+			return nil, err
+		}
+		if h != nil && h.PrevBatch != prevBatch {
+			log.Printf("  discarding progress as it is for an older /sync response\n")
+			h = nil
+		}
+		if h == nil {
+			h = &roomHistory{
+				RoomID:    roomID,
+				PrevBatch: prevBatch,
+				From:      prevBatch,
+			}
+		}
+		if err = fetchRoomHistory(httpCli, hsURL, token, h, opts, progressFile); err != nil {
+			if !isPermanent(err) {
+				return nil, fmt.Errorf("room %s: %w", roomID, err)
+			}
+			log.Printf("WARNING: room %s: skipping the rest of its history: %s\n", roomID, err)
+		}
+		if syncData, err = mergeRoomHistory(syncData, roomPath, h); err != nil {
+			return nil, fmt.Errorf("room %s: %w", roomID, err)
+		}
+	}
+	return syncData, nil
+}
+
+func fetchRoomHistory(httpCli *http.Client, hsURL, token string, h *roomHistory, opts HistoryOptions, progressFile string) error {
+	roomURL := hsURL + "/_matrix/client/v3/rooms/" + url.PathEscape(h.RoomID)
+	if opts.FullState && !h.StateDone {
+		body, err := doRequestWithRetries(httpCli, roomURL+"/state", token)
+		if err != nil {
+			return fmt.Errorf("failed to fetch /state: %w", err)
+		}
+		if err = json.Unmarshal(body, &h.State); err != nil {
+			return fmt.Errorf("failed to parse /state response: %w", err)
+		}
+		h.StateDone = true
+		if err = saveRoomHistory(progressFile, h); err != nil {
+			return err
+		}
+	}
+	for !h.paginationDone(opts.Depth) {
+		limit := opts.Depth - len(h.Events)
+		if limit > 100 {
+			limit = 100
+		}
+		body, err := doRequestWithRetries(httpCli, fmt.Sprintf("%s/messages?dir=b&limit=%d&from=%s", roomURL, limit, url.QueryEscape(h.From)), token)
+		if err != nil {
+			return fmt.Errorf("failed to fetch /messages: %w", err)
+		}
+		chunk := gjson.GetBytes(body, "chunk").Array()
+		for _, ev := range chunk {
+			h.Events = append(h.Events, json.RawMessage(ev.Raw))
+		}
+		// no end token or no events means we have reached the start of the room
+		h.From = gjson.GetBytes(body, "end").Str
+		if len(chunk) == 0 {
+			h.From = ""
+		}
+		if err = saveRoomHistory(progressFile, h); err != nil {
+			return err
+		}
+		log.Printf("  fetched %d events\n", len(h.Events))
+	}
+	return nil
+}
+
+// mergeRoomHistory adds the fetched history to the room in the /sync response.
+func mergeRoomHistory(syncData json.RawMessage, roomPath string, h *roomHistory) (json.RawMessage, error) {
+	var err error
+	if h.StateDone {
+		if syncData, err = sjson.SetBytes(syncData, roomPath+".state.events", h.State); err != nil {
+			return nil, err
+		}
+	}
+	if len(h.Events) == 0 {
+		return syncData, nil
+	}
+	var timeline []json.RawMessage
+	for i := len(h.Events) - 1; i >= 0; i-- {
+		// the create event can only be part of the state the room is created with
+		if gjson.GetBytes(h.Events[i], "type").Str == "m.room.create" {
+			continue
+		}
+		timeline = append(timeline, h.Events[i])
+	}
+	gjson.GetBytes(syncData, roomPath+".timeline.events").ForEach(func(_, v gjson.Result) bool {
+		timeline = append(timeline, json.RawMessage(v.Raw))
+		return true
+	})
+	return sjson.SetBytes(syncData, roomPath+".timeline.events", timeline)
+}
+
+func loadRoomHistory(progressFile string) (*roomHistory, error) {
+	data, err := ioutil.ReadFile(progressFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read progress from %s: %w", progressFile, err)
+	}
+	var h roomHistory
+	if err = json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("failed to parse progress from %s: %w", progressFile, err)
+	}
+	log.Printf("  resuming with %d events\n", len(h.Events))
+	return &h, nil
+}
+
+func saveRoomHistory(progressFile string, h *roomHistory) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	// write then rename so an interrupted write doesn't lose the progress so far
+	if err = ioutil.WriteFile(progressFile+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write progress: %w", err)
+	}
+	return os.Rename(progressFile+".tmp", progressFile)
+}
+
+// isPermanent returns true if the request failed because of the request itself rather than the homeserver being
+// unavailable, so retrying it will never succeed.
+func isPermanent(err error) bool {
+	var se *statusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	return se.StatusCode != http.StatusTooManyRequests && se.StatusCode < 500
+}
+
+// maxHistoryAttempts is the number of times a request is sent before giving up.
+const maxHistoryAttempts = 10
+
+// doRequestWithRetries performs a GET request, retrying with exponential backoff if the homeserver is rate limiting
+// us or is unavailable. Rate limited requests wait for as long as the homeserver asks. Other errors are returned
+// immediately.
+func doRequestWithRetries(httpCli *http.Client, reqURL, token string) ([]byte, error) {
+	backoff := historyBackoff
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest("GET", reqURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		body, err := doRequest(httpCli, req, token)
+		if err == nil {
+			return body, nil
+		}
+		if isPermanent(err) || attempt >= maxHistoryAttempts {
+			return nil, err
+		}
+		wait := backoff
+		var se *statusError
+		if errors.As(err, &se) && se.StatusCode == http.StatusTooManyRequests {
+			if retryAfterMs := gjson.GetBytes(se.Body, "retry_after_ms"); retryAfterMs.Exists() {
+				wait = time.Duration(retryAfterMs.Int()) * time.Millisecond
+			}
+		}
+		log.Printf("  request failed: %s, retrying in %v\n", err, wait)
+		time.Sleep(wait)
+		if backoff *= 2; backoff > maxHistoryBackoff {
+			backoff = maxHistoryBackoff
+		}
+	}
+}
+
+// The backoff between attempts, which doubles up to maxHistoryBackoff. Variables so tests don't have to wait.
+var (
+	historyBackoff    = time.Second
+	maxHistoryBackoff = 30 * time.Second
+)
@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestPaginationDone(t *testing.T) {
+	events := []json.RawMessage{[]byte(`{}`), []byte(`{}`)}
+	testCases := []struct {
+		name  string
+		h     roomHistory
+		depth int
+		want  bool
+	}{
+		{"no more history", roomHistory{From: ""}, 10, true},
+		{"more history", roomHistory{From: "t1", Events: events}, 10, false},
+		{"depth reached", roomHistory{From: "t1", Events: events}, 2, true},
+		{"depth exceeded", roomHistory{From: "t1", Events: events}, 1, true},
+	}
+	for _, tc := range testCases {
+		if got := tc.h.paginationDone(tc.depth); got != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMergeRoomHistory(t *testing.T) {
+	syncData := json.RawMessage(`{"rooms":{"join":{"!a:hs1":{
+		"state":{"events":[{"type":"m.room.name","event_id":"$sync_state"}]},
+		"timeline":{"prev_batch":"t0","events":[{"type":"m.room.message","event_id":"$4"}]}
+	}}}}`)
+	roomPath := "rooms.join." + gjsonEscape("!a:hs1")
+	eventIDs := func(data json.RawMessage, path string) (ids []string) {
+		gjson.GetBytes(data, path).ForEach(func(_, v gjson.Result) bool {
+			ids = append(ids, v.Get("event_id").Str)
+			return true
+		})
+		return ids
+	}
+	testCases := []struct {
+		name         string
+		h            roomHistory
+		wantTimeline []string
+		wantState    []string
+	}{
+		{
+			name:         "nothing fetched",
+			h:            roomHistory{},
+			wantTimeline: []string{"$4"},
+			wantState:    []string{"$sync_state"},
+		},
+		{
+			name: "events are prepended oldest first without the create event",
+			h: roomHistory{Events: []json.RawMessage{
+				[]byte(`{"type":"m.room.message","event_id":"$3"}`),
+				[]byte(`{"type":"m.room.member","event_id":"$2"}`),
+				[]byte(`{"type":"m.room.create","event_id":"$1"}`),
+			}},
+			wantTimeline: []string{"$2", "$3", "$4"},
+			wantState:    []string{"$sync_state"},
+		},
+		{
+			name: "full state replaces the sync state",
+			h: roomHistory{StateDone: true, State: []json.RawMessage{
+				[]byte(`{"type":"m.room.create","event_id":"$1"}`),
+				[]byte(`{"type":"m.room.name","event_id":"$full_state"}`),
+			}},
+			wantTimeline: []string{"$4"},
+			wantState:    []string{"$1", "$full_state"},
+		},
+	}
+	for _, tc := range testCases {
+		got, err := mergeRoomHistory(syncData, roomPath, &tc.h)
+		if err != nil {
+			t.Fatalf("%s: mergeRoomHistory returned error: %s", tc.name, err)
+		}
+		if timeline := eventIDs(got, roomPath+".timeline.events"); strings.Join(timeline, ",") != strings.Join(tc.wantTimeline, ",") {
+			t.Errorf("%s: got timeline %v want %v", tc.name, timeline, tc.wantTimeline)
+		}
+		if state := eventIDs(got, roomPath+".state.events"); strings.Join(state, ",") != strings.Join(tc.wantState, ",") {
+			t.Errorf("%s: got state %v want %v", tc.name, state, tc.wantState)
+		}
+	}
+}
+
+func TestLoadHistory(t *testing.T) {
+	historyBackoff = time.Millisecond
+	defer func() { historyBackoff = time.Second }()
+
+	var mu sync.Mutex
+	requests := make(map[string]int) // room ID -> number of /messages requests
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		roomID := strings.Split(strings.TrimPrefix(req.URL.Path, "/_matrix/client/v3/rooms/"), "/")[0]
+		requests[roomID]++
+		switch roomID {
+		case "!forbidden:hs1":
+			w.WriteHeader(403)
+			w.Write([]byte(`{"errcode":"M_FORBIDDEN"}`))
+		case "!ratelimited:hs1":
+			if requests[roomID] == 1 {
+				w.WriteHeader(429)
+				w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":1}`))
+				return
+			}
+			fallthrough
+		default:
+			if req.URL.Query().Get("from") != "new" {
+				t.Errorf("%s: paginated from %s, want the prev_batch of the new /sync", roomID, req.URL.Query().Get("from"))
+			}
+			w.Write([]byte(`{"chunk":[{"type":"m.room.message","event_id":"$old"}],"end":""}`))
+		}
+	}))
+	defer srv.Close()
+
+	syncData := json.RawMessage(`{"rooms":{"join":{
+		"!forbidden:hs1":{"timeline":{"prev_batch":"new","events":[{"type":"m.room.message","event_id":"$f"}]}},
+		"!ratelimited:hs1":{"timeline":{"prev_batch":"new","events":[{"type":"m.room.message","event_id":"$r"}]}}
+	}}}`)
+	progressDir := t.TempDir()
+	// progress from before /sync was performed again must not be used
+	stale := &roomHistory{RoomID: "!ratelimited:hs1", PrevBatch: "old", From: "older", Events: []json.RawMessage{[]byte(`{"event_id":"$stale"}`)}}
+	if err := saveRoomHistory(filepath.Join(progressDir, hex.EncodeToString([]byte(stale.RoomID))+".json"), stale); err != nil {
+		t.Fatalf("failed to save stale progress: %s", err)
+	}
+
+	got, err := LoadHistory(srv.URL, "token", syncData, HistoryOptions{Depth: 10, ProgressDir: progressDir})
+	if err != nil {
+		t.Fatalf("LoadHistory returned error: %s", err)
+	}
+	if requests["!forbidden:hs1"] != 1 {
+		t.Errorf("forbidden room was requested %d times, want 1", requests["!forbidden:hs1"])
+	}
+	if requests["!ratelimited:hs1"] != 2 {
+		t.Errorf("rate limited room was requested %d times, want 2", requests["!ratelimited:hs1"])
+	}
+	timeline := gjson.GetBytes(got, "rooms.join."+gjsonEscape("!ratelimited:hs1")+".timeline.events.#.event_id").String()
+	if timeline != `["$old","$r"]` {
+		t.Errorf("got rate limited room timeline %s want [$old,$r]", timeline)
+	}
+	timeline = gjson.GetBytes(got, "rooms.join."+gjsonEscape("!forbidden:hs1")+".timeline.events.#.event_id").String()
+	if timeline != `["$f"]` {
+		t.Errorf("got forbidden room timeline %s want [$f]", timeline)
+	}
+}
+
+func TestLoadHistoryUnavailable(t *testing.T) {
+	historyBackoff = time.Millisecond
+	defer func() { historyBackoff = time.Second }()
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.WriteHeader(502)
+	}))
+	defer srv.Close()
+
+	syncData := json.RawMessage(`{"rooms":{"join":{"!a:hs1":{"timeline":{"prev_batch":"t0","events":[]}}}}}`)
+	_, err := LoadHistory(srv.URL, "token", syncData, HistoryOptions{Depth: 10, ProgressDir: t.TempDir()})
+	if err == nil {
+		t.Fatalf("LoadHistory succeeded, want an error so it can be resumed")
+	}
+	if attempts != maxHistoryAttempts {
+		t.Errorf("got %d attempts want %d", attempts, maxHistoryAttempts)
+	}
+}
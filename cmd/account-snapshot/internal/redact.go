@@ -1,11 +1,15 @@
 package internal
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -22,15 +26,23 @@ type Snapshot struct {
 	Servers        []string
 	AccountDataDMs map[string][]string
 	Devices        map[string][]string
-	UserID         string // the anonymous user whose snapshot this is - important for setting account data
+	UserID         string          // the anonymous user whose snapshot this is - important for setting account data
+	PushRules      json.RawMessage `json:",omitempty"` // the anonymised m.push_rules account data content, if any
+	// What was kept and dropped, and any PII-like strings which survived. Not part of the snapshot itself.
+	Audit *AuditReport `json:"-"`
 }
 
 // @localpart:domain
 var userIDRegexp = regexp.MustCompile(`@[A-Za-z0-9\-\.=_/]+:[A-Za-z0-9\-\.=_/]+`)
 
-// Redact syncData into an anonymised snapshot
-func Redact(syncData []byte, anonMappings AnonMappings) *Snapshot {
-	sshot := &Snapshot{}
+// !opaque:domain
+var roomIDRegexp = regexp.MustCompile(`![A-Za-z0-9\-\.=_/]+:[A-Za-z0-9\-\.=_/]+`)
+
+// Redact syncData for the given user into an anonymised snapshot
+func Redact(syncData []byte, userID string, anonMappings AnonMappings) *Snapshot {
+	sshot := &Snapshot{
+		Audit: newAuditReport(),
+	}
 	joins := gjson.GetBytes(syncData, "rooms.join")
 	// sort the room IDs
 	var joinedRooms []string
@@ -44,7 +56,7 @@ func Redact(syncData []byte, anonMappings AnonMappings) *Snapshot {
 	for i, roomID := range joinedRooms {
 		log.Printf("Processing room %s %d/%d\n", roomID, i+1, len(joinedRooms))
 		roomData := roomIDToRoomData[roomID]
-		room, err := mapAnonRoom(i, roomID, roomData, &anonMappings)
+		room, err := mapAnonRoom(i, roomID, roomData, &anonMappings, sshot.Audit)
 		if err != nil {
 			log.Printf("WARNING: skipping room - failed to anonymise room: %s\n", err)
 			continue
@@ -65,6 +77,8 @@ func Redact(syncData []byte, anonMappings AnonMappings) *Snapshot {
 	}
 	sshot.Servers = anonServers
 	sshot.AccountDataDMs = processAccountDataDMs(syncData, anonMappings)
+	sshot.PushRules = processAccountDataPushRules(syncData, userID, &anonMappings)
+	countAccountData(syncData, sshot.Audit)
 	sshot.Devices = anonMappings.deviceMap()
 	for _, userID := range anonUsers {
 		if _, ok := sshot.Devices[userID]; ok {
@@ -72,6 +86,8 @@ func Redact(syncData []byte, anonMappings AnonMappings) *Snapshot {
 		}
 		sshot.Devices[userID] = []string{NoEncryptedDevice}
 	}
+	sshot.UserID = anonMappings.User(userID)
+	sshot.Audit.scan(sshot, userID, &anonMappings)
 	return sshot
 }
 
@@ -106,6 +122,37 @@ var RedactRules = map[string][]redaction{
 			key:         "type",
 			replaceWith: passThrough,
 		},
+		{
+			key: "event_id",
+			replaceWith: func(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
+				return mappings.Event(key.Str)
+			},
+		},
+		// relations: threads, replies, edits, reactions and references can be on any event type
+		{
+			key:         "content.m\\.relates_to.rel_type",
+			replaceWith: passThrough,
+		},
+		{
+			key: "content.m\\.relates_to.event_id",
+			replaceWith: func(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
+				return mappings.Event(key.Str)
+			},
+		},
+		{
+			key:         "content.m\\.relates_to.key",
+			replaceWith: reactionKey,
+		},
+		{
+			key:         "content.m\\.relates_to.is_falling_back",
+			replaceWith: passThrough,
+		},
+		{
+			key: "content.m\\.relates_to.m\\.in_reply_to.event_id",
+			replaceWith: func(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
+				return mappings.Event(key.Str)
+			},
+		},
 	},
 	// TODO:
 	// m.room.third_party_invite
@@ -131,6 +178,10 @@ var RedactRules = map[string][]redaction{
 			key:         "content.room_version",
 			replaceWith: passThrough,
 		},
+		{
+			key:         "content.type",
+			replaceWith: passThrough,
+		},
 	},
 	"m.room.name": {
 		{
@@ -197,15 +248,7 @@ var RedactRules = map[string][]redaction{
 			replaceWith: passThrough,
 		},
 	},
-	"m.reaction": {
-		{
-			key: "content.m\\.relates_to.event_id",
-			replaceWith: func(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
-				// TODO: event_id mapper
-				return ""
-			},
-		},
-	}, // TODO
+	"m.reaction": {}, // the relation is handled by "all"
 	"m.room.encryption": {
 		{
 			key:         "content.algorithm",
@@ -237,6 +280,102 @@ var RedactRules = map[string][]redaction{
 			key:         "content.join_rule",
 			replaceWith: passThrough,
 		},
+		{
+			key: "content.allow",
+			replaceWith: func(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
+				// restricted rooms: [{ type: m.room_membership, room_id }]
+				var allow []map[string]string
+				key.ForEach(func(_, v gjson.Result) bool {
+					allow = append(allow, map[string]string{
+						"type":    v.Get("type").Str,
+						"room_id": mappings.ExternalRoom(v.Get("room_id").Str),
+					})
+					return true
+				})
+				return allow
+			},
+		},
+	},
+	"m.space.child": {
+		{
+			key: "state_key",
+			replaceWith: func(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
+				return mappings.ExternalRoom(key.Str)
+			},
+		},
+		{
+			key:         "content.via",
+			replaceWith: redactServerArray,
+		},
+		{
+			key:         "content.suggested",
+			replaceWith: passThrough,
+		},
+	},
+	"m.space.parent": {
+		{
+			key: "state_key",
+			replaceWith: func(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
+				return mappings.ExternalRoom(key.Str)
+			},
+		},
+		{
+			key:         "content.via",
+			replaceWith: redactServerArray,
+		},
+		{
+			key:         "content.canonical",
+			replaceWith: passThrough,
+		},
+	},
+	"m.poll.start": {
+		{
+			// question and answers, keeping the answer IDs so responses still match
+			key:         "content.m\\.poll",
+			replaceWith: redactStrings("kind", "max_selections", "id", "m.id", "mimetype"),
+		},
+		{
+			key:         "content.m\\.text",
+			replaceWith: redactStrings("mimetype"),
+		},
+	},
+	"m.poll.response": {
+		{
+			key:         "content.m\\.selections",
+			replaceWith: passThrough,
+		},
+	},
+	"m.poll.end": {
+		{
+			key:         "content.m\\.text",
+			replaceWith: redactStrings("mimetype"),
+		},
+	},
+	"org.matrix.msc3381.poll.start": {
+		{
+			key:         "content.org\\.matrix\\.msc3381\\.poll\\.start",
+			replaceWith: redactStrings("kind", "max_selections", "id", "mimetype"),
+		},
+		{
+			key:         "content.body",
+			replaceWith: bodyReplacer,
+		},
+	},
+	"org.matrix.msc3381.poll.response": {
+		{
+			key:         "content.org\\.matrix\\.msc3381\\.poll\\.response.answers",
+			replaceWith: passThrough,
+		},
+	},
+	"org.matrix.msc3381.poll.end": {
+		{
+			key:         "content.org\\.matrix\\.msc1767\\.text",
+			replaceWith: redactStrings(),
+		},
+		{
+			key:         "content.body",
+			replaceWith: bodyReplacer,
+		},
 	},
 	"org.matrix.room.preview_urls": {
 		{
@@ -357,16 +496,8 @@ var RedactRules = map[string][]redaction{
 	},
 	"m.room.encrypted": {
 		{
-			key: "content",
-			replaceWith: func(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
-				// map device ID so we know which device sent the encrypted message.
-				deviceID := key.Get("device_id").Str
-				return map[string]interface{}{
-					"device_id":         mappings.Device(event.Get("sender").Str, deviceID),
-					"algorithm":         key.Get("algorithm").Str,
-					"ciphertext_length": len(key.Get("ciphertext").Str),
-				}
-			},
+			key:         "content",
+			replaceWith: encryptedContent,
 		},
 	},
 	"m.room.redaction": {
@@ -374,13 +505,7 @@ var RedactRules = map[string][]redaction{
 			key: "content",
 			replaceWith: func(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
 				if key.Get("ciphertext").Exists() { // E2E redaction
-					// map device ID so we know which device sent the encrypted message.
-					deviceID := key.Get("device_id").Str
-					return map[string]interface{}{
-						"device_id":         mappings.Device(event.Get("sender").Str, deviceID),
-						"algorithm":         key.Get("algorithm").Str,
-						"ciphertext_length": len(key.Get("ciphertext").Str),
-					}
+					return encryptedContent(mappings, event, key, anonRoomID)
 				}
 				// normal redaction
 				return map[string]interface{}{}
@@ -456,6 +581,90 @@ func redactStringArray(mappings *AnonMappings, event, key gjson.Result, anonRoom
 	return list
 }
 
+// redactServerArray replaces a list of server names, e.g "via", with anonymous ones.
+func redactServerArray(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
+	servers := []string{}
+	key.ForEach(func(_, v gjson.Result) bool {
+		servers = append(servers, mappings.Server(v.Str))
+		return true
+	})
+	return servers
+}
+
+// redactStrings returns a replacer which keeps the structure of the value but redacts every string in it, except
+// the values of the given keys.
+func redactStrings(keepKeys ...string) func(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
+	keep := make(map[string]bool)
+	for _, k := range keepKeys {
+		keep[k] = true
+	}
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch val := v.(type) {
+		case string:
+			return strings.Map(redactFunc, val)
+		case []interface{}:
+			for i := range val {
+				val[i] = walk(val[i])
+			}
+			return val
+		case map[string]interface{}:
+			for k := range val {
+				if !keep[k] {
+					val[k] = walk(val[k])
+				}
+			}
+			return val
+		default:
+			return val
+		}
+	}
+	return func(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
+		return walk(key.Value())
+	}
+}
+
+// reactionKey keeps emoji reactions, which are most of them, but redacts any with text in.
+func reactionKey(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
+	for _, r := range key.Str {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return strings.Map(redactFunc, key.Str)
+		}
+	}
+	return key.Str
+}
+
+// encryptedContent replaces encrypted content with its shape: the algorithm, the anonymised sending device and
+// session, and the size of the ciphertext, so the blueprint can send similarly sized events. Any relation, which is
+// not encrypted, is added afterwards by the "all" rules.
+func encryptedContent(mappings *AnonMappings, event, key gjson.Result, anonRoomID string) interface{} {
+	content := map[string]interface{}{
+		"algorithm": key.Get("algorithm").Str,
+	}
+	// map device ID so we know which device sent the encrypted message.
+	if deviceID := key.Get("device_id"); deviceID.Exists() {
+		content["device_id"] = mappings.Device(event.Get("sender").Str, deviceID.Str)
+	} else {
+		content["device_id"] = mappings.Device(event.Get("sender").Str, "")
+	}
+	ciphertext := key.Get("ciphertext")
+	if ciphertext.IsObject() {
+		// olm: recipient key -> { type, body }
+		var lengths []int
+		ciphertext.ForEach(func(_, v gjson.Result) bool {
+			lengths = append(lengths, len(v.Get("body").Str))
+			return true
+		})
+		content["ciphertext_lengths"] = lengths
+	} else {
+		content["ciphertext_length"] = len(ciphertext.Str)
+	}
+	if sessionID := key.Get("session_id"); sessionID.Exists() {
+		content["session_id"] = mappings.Session(sessionID.Str)
+	}
+	return content
+}
+
 func redactFunc(r rune) rune {
 	if unicode.IsSpace(r) {
 		return r
@@ -482,9 +691,12 @@ func bodyReplacer(mappings *AnonMappings, event, key gjson.Result, anonRoomID st
 	return redactedBody
 }
 
-// AnonMappings contains the mappings to convert live sync data to anonymous sync data. This is done via incremental
-// counts rather than hashing which is potentially vulnerable to reverse lookup attacks.
+// AnonMappings contains the mappings to convert live sync data to anonymous sync data. By default this is done via
+// incremental counts rather than hashing which is potentially vulnerable to reverse lookup attacks. If Secret is set,
+// anonymous IDs are instead derived from a HMAC of the real ID keyed with the secret, so snapshots taken with the same
+// secret (e.g before and after a bug) use the same anonymous IDs, but cannot be reversed or linked without the secret.
 type AnonMappings struct {
+	Secret            []byte                     // if set, anonymous IDs are keyed HMACs rather than counters
 	Users             map[string]string          // real user ID -> anonymised
 	UsersCount        int                        // counter for generating anonymous user IDs
 	Devices           map[string]string          // real device ID -> anonymised device ID
@@ -492,6 +704,11 @@ type AnonMappings struct {
 	Servers           map[string]string          // real server name -> anonymised server name
 	ServersCount      int                        // counter for generating anonymous servers
 	Rooms             map[string]string          // real room ID -> anonymised room ID, counter is from sorted room IDs
+	ExternalRoomCount int                        // counter for rooms which are referenced but not joined, e.g space children
+	Events            map[string]string          // real event ID -> anonymised event ID
+	EventsCount       int                        // counter for generating anonymous event IDs
+	Sessions          map[string]string          // real megolm session ID -> anonymised session ID
+	SessionsCount     int                        // counter for generating anonymous session IDs
 	AnonUserToDevices map[string]map[string]bool // anon user -> anon devices
 	SingleServerName  string                     // if set, all users get to live on this single server
 }
@@ -502,9 +719,8 @@ func (a *AnonMappings) Device(userID, deviceID string) string {
 		return anonDevice
 	}
 	// make an anon device
-	anonDevice = fmt.Sprintf("device-%x", a.DevicesCount)
+	anonDevice = "device-" + a.anonID("device", deviceID, &a.DevicesCount)
 	a.Devices[deviceID] = anonDevice
-	a.DevicesCount++
 	// store the fact that this user has a device
 	anonUser := a.User(userID)
 	deviceSet, ok := a.AnonUserToDevices[anonUser]
@@ -530,9 +746,8 @@ func (a *AnonMappings) User(userID string) string {
 	if domain == "" {
 		return "" // invalid user ID
 	}
-	anonUser = fmt.Sprintf("@anon-%x:%s", a.UsersCount, a.Server(domain))
+	anonUser = fmt.Sprintf("@anon-%s:%s", a.anonID("user", userID, &a.UsersCount), a.Server(domain))
 	a.Users[userID] = anonUser
-	a.UsersCount++
 	return anonUser
 }
 
@@ -545,9 +760,8 @@ func (a *AnonMappings) Server(realServer string) string {
 		return anonServer
 	}
 	// make an anon server
-	anonServer = fmt.Sprintf("server-%x", a.ServersCount)
+	anonServer = "server-" + a.anonID("server", realServer, &a.ServersCount)
 	a.Servers[realServer] = anonServer
-	a.ServersCount++
 	return anonServer
 }
 
@@ -559,6 +773,78 @@ func (a *AnonMappings) SetRoom(roomID, anonRoomID string) {
 	a.Rooms[roomID] = anonRoomID
 }
 
+// JoinedRoom returns the anonymised room ID for the index'th joined room, in sorted order, and remembers it. If the
+// room was already referenced by another room, e.g as a space child, that ID is used.
+func (a *AnonMappings) JoinedRoom(index int, roomID, anonServer string) string {
+	if anonRoomID, ok := a.Rooms[roomID]; ok {
+		return anonRoomID
+	}
+	localpart := strconv.Itoa(index)
+	if len(a.Secret) > 0 {
+		localpart = a.anonID("room", roomID, nil)
+	}
+	anonRoomID := "!" + localpart + ":" + anonServer
+	a.SetRoom(roomID, anonRoomID)
+	return anonRoomID
+}
+
+// ExternalRoom returns the anonymised room ID for a room which may not be joined, e.g a space child, creating one if needed.
+func (a *AnonMappings) ExternalRoom(roomID string) string {
+	if len(roomID) == 0 || roomID[0] != '!' {
+		return ""
+	}
+	anonRoom, ok := a.Rooms[roomID]
+	if ok {
+		return anonRoom
+	}
+	_, domain := split(roomID)
+	if len(a.Secret) > 0 {
+		// the same as JoinedRoom so rooms are the same whether they are joined or not
+		anonRoom = fmt.Sprintf("!%s:%s", a.anonID("room", roomID, nil), a.Server(domain))
+	} else {
+		anonRoom = fmt.Sprintf("!ext-%s:%s", a.anonID("room", roomID, &a.ExternalRoomCount), a.Server(domain))
+	}
+	a.Rooms[roomID] = anonRoom
+	return anonRoom
+}
+
+func (a *AnonMappings) Event(eventID string) string {
+	if eventID == "" {
+		return ""
+	}
+	anonEvent, ok := a.Events[eventID]
+	if ok {
+		return anonEvent
+	}
+	anonEvent = "$anon-" + a.anonID("event", eventID, &a.EventsCount)
+	a.Events[eventID] = anonEvent
+	return anonEvent
+}
+
+func (a *AnonMappings) Session(sessionID string) string {
+	anonSession, ok := a.Sessions[sessionID]
+	if ok {
+		return anonSession
+	}
+	anonSession = "session-" + a.anonID("session", sessionID, &a.SessionsCount)
+	a.Sessions[sessionID] = anonSession
+	return anonSession
+}
+
+// anonID returns a new anonymous identifier for the real one. If there is a secret, this is the first 8 bytes of the
+// HMAC-SHA256 of the kind and real identifier, so that different kinds of identifiers with the same value differ.
+// Otherwise it is the counter, which is then incremented.
+func (a *AnonMappings) anonID(kind, real string, counter *int) string {
+	if len(a.Secret) > 0 {
+		mac := hmac.New(sha256.New, a.Secret)
+		mac.Write([]byte(kind + "\x00" + real))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+	id := fmt.Sprintf("%x", *counter)
+	*counter++
+	return id
+}
+
 // returns user_id => device_ids
 func (a *AnonMappings) deviceMap() map[string][]string {
 	result := make(map[string][]string)
@@ -624,7 +910,13 @@ func findEventInArray(evType, stateKey string, arrs ...gjson.Result) (event *gjs
 	return
 }
 
-func mapAnonRoom(index int, roomID string, roomData gjson.Result, mappings *AnonMappings) (*AnonSnapshotRoom, error) {
+// rulesFor returns the redaction rules for the event type. The "all" rules are applied last so that rules which replace
+// the entire content, e.g for encrypted events, don't remove the relation.
+func rulesFor(eventType string) []redaction {
+	return append(append([]redaction{}, RedactRules[eventType]...), RedactRules["all"]...)
+}
+
+func mapAnonRoom(index int, roomID string, roomData gjson.Result, mappings *AnonMappings, audit *AuditReport) (*AnonSnapshotRoom, error) {
 	// pull out the create event
 	stateEvents := roomData.Get("state.events")
 	timelineEvents := roomData.Get("timeline.events")
@@ -637,15 +929,15 @@ func mapAnonRoom(index int, roomID string, roomData gjson.Result, mappings *Anon
 		return nil, fmt.Errorf("failed to find room creator, create event missing sender")
 	}
 	_, domain := split(creator)
-	anonRoomID := fmt.Sprintf("!%d:%s", index, mappings.Server(domain))
+	anonRoomID := mappings.JoinedRoom(index, roomID, mappings.Server(domain))
 	room := &AnonSnapshotRoom{
 		Creator: creator,
 		ID:      anonRoomID,
 	}
-	mappings.SetRoom(roomID, anonRoomID)
 
 	var dropEventType = func(evType string) bool {
 		_, ok := RedactRules[evType]
+		audit.countEvent(evType, ok)
 		if ok {
 			return false
 		}
@@ -659,9 +951,7 @@ func mapAnonRoom(index int, roomID string, roomData gjson.Result, mappings *Anon
 		if dropEventType(eventType) {
 			return true
 		}
-		redactions := RedactRules["all"]
-		redactions = append(redactions, RedactRules[eventType]...)
-		evJSON := redact(v.Raw, anonRoomID, mappings, redactions)
+		evJSON := redact(v.Raw, anonRoomID, mappings, rulesFor(eventType))
 		// blueprints only care about a few fields, so just add those fields on a whitelist basis
 		blueprintEvent := map[string]interface{}{}
 		blueprintEvent["sender"] = gjson.Get(evJSON, "sender").Str
@@ -681,9 +971,7 @@ func mapAnonRoom(index int, roomID string, roomData gjson.Result, mappings *Anon
 		if dropEventType(eventType) {
 			return true
 		}
-		redactions := RedactRules["all"]
-		redactions = append(redactions, RedactRules[eventType]...)
-		evJSON := redact(v.Raw, anonRoomID, mappings, redactions)
+		evJSON := redact(v.Raw, anonRoomID, mappings, rulesFor(eventType))
 		// blueprints only care about a few fields, so just add those fields on a whitelist basis
 		blueprintEvent := map[string]interface{}{}
 		blueprintEvent["sender"] = gjson.Get(evJSON, "sender").Str
@@ -692,6 +980,10 @@ func mapAnonRoom(index int, roomID string, roomData gjson.Result, mappings *Anon
 		if sk.Exists() {
 			blueprintEvent["state_key"] = sk.Str
 		}
+		// keep the event ID so relations to this event can be followed
+		if eventID := gjson.Get(evJSON, "event_id"); eventID.Exists() {
+			blueprintEvent["event_id"] = eventID.Str
+		}
 		blueprintEvent["content"] = json.RawMessage(gjson.Get(evJSON, "content").Raw)
 		be, err := json.Marshal(blueprintEvent)
 		if err != nil {
@@ -726,8 +1018,122 @@ func processAccountDataDMs(syncData []byte, anonMappings AnonMappings) (anonDMMa
 				anonDMMap[anonMappings.User(userID)] = anonRoomIDs
 			}
 		}
-		// TODO: push rules
 		return true
 	})
 	return anonDMMap
 }
+
+// processAccountDataPushRules returns the anonymised m.push_rules account data content for the given user, or nil if
+// there is none.
+func processAccountDataPushRules(syncData []byte, userID string, anonMappings *AnonMappings) json.RawMessage {
+	var pushRules json.RawMessage
+	gjson.GetBytes(syncData, "account_data.events").ForEach(func(_, v gjson.Result) bool {
+		if v.Get("type").Str != "m.push_rules" {
+			return true
+		}
+		anonRuleSets := map[string]map[string][]interface{}{}
+		v.Get("content").ForEach(func(scope, ruleSet gjson.Result) bool {
+			anonRuleSets[scope.Str] = map[string][]interface{}{}
+			ruleSet.ForEach(func(kind, rules gjson.Result) bool {
+				anonRules := []interface{}{}
+				rules.ForEach(func(_, rule gjson.Result) bool {
+					anonRules = append(anonRules, redactPushRule(kind.Str, rule, userID, anonMappings))
+					return true
+				})
+				anonRuleSets[scope.Str][kind.Str] = anonRules
+				return true
+			})
+			return true
+		})
+		b, err := json.Marshal(anonRuleSets)
+		if err != nil {
+			log.Printf("Failed to marshal push rules: %s\n", err)
+			return false
+		}
+		pushRules = b
+		return false
+	})
+	return pushRules
+}
+
+// redactPushRule anonymises a single push rule for the given user. Server-default rules (with IDs starting with '.')
+// are the same for everyone, so keep their IDs and patterns, apart from the parts which refer to the user e.g the
+// localpart in .m.rule.contains_user_name and the user ID in .m.rule.is_user_mention. Custom rules can contain
+// keywords, user IDs and room IDs anywhere.
+func redactPushRule(kind string, rule gjson.Result, userID string, mappings *AnonMappings) interface{} {
+	ruleID := rule.Get("rule_id").Str
+	isDefault := strings.HasPrefix(ruleID, ".")
+	anonRule := map[string]interface{}{
+		"actions": rule.Get("actions").Value(),
+		"enabled": rule.Get("enabled").Bool(),
+		"default": rule.Get("default").Bool(),
+	}
+	switch {
+	case isDefault:
+		anonRule["rule_id"] = ruleID
+	case kind == "room":
+		anonRule["rule_id"] = mappings.ExternalRoom(ruleID)
+	case kind == "sender":
+		anonRule["rule_id"] = mappings.User(ruleID)
+	default:
+		anonRule["rule_id"] = strings.Map(redactFunc, ruleID)
+	}
+	if pattern := rule.Get("pattern"); pattern.Exists() {
+		switch {
+		case ruleID == ".m.rule.contains_user_name" && userID != "":
+			anonRule["pattern"], _ = split(mappings.User(userID))
+		case isDefault:
+			anonRule["pattern"] = pattern.Value()
+		default:
+			anonRule["pattern"] = strings.Map(redactFunc, pattern.Str)
+		}
+	}
+	if conditions := rule.Get("conditions"); conditions.Exists() {
+		anonConditions := []interface{}{}
+		conditions.ForEach(func(_, cond gjson.Result) bool {
+			anonConditions = append(anonConditions, redactPushCondition(cond, isDefault, mappings))
+			return true
+		})
+		anonRule["conditions"] = anonConditions
+	}
+	return anonRule
+}
+
+// redactPushCondition anonymises a single push rule condition. Values which are user or room IDs are always
+// anonymised, and other strings are only kept for server-default rules.
+func redactPushCondition(cond gjson.Result, isDefault bool, mappings *AnonMappings) map[string]interface{} {
+	redactString := func(key, str string) string {
+		switch {
+		case key == "room_id" || roomIDRegexp.FindString(str) == str:
+			return mappings.ExternalRoom(str)
+		case key == "sender" || key == "user_id" || userIDRegexp.FindString(str) == str:
+			return mappings.User(str)
+		case isDefault:
+			return str
+		}
+		switch key {
+		case "type", "content.msgtype", "state_key", `content.m\.relates_to.rel_type`:
+			return str
+		}
+		return strings.Map(redactFunc, str)
+	}
+	key := cond.Get("key").Str
+	anonCond := map[string]interface{}{}
+	cond.ForEach(func(k, v gjson.Result) bool {
+		switch k.Str {
+		case "kind", "key", "is", "rel_type", "include_fallbacks":
+			anonCond[k.Str] = v.Value()
+		case "pattern":
+			anonCond[k.Str] = redactString(key, v.Str)
+		case "value":
+			// event_property_is and event_property_contains match exact values, which can be any JSON scalar
+			if v.Type == gjson.String {
+				anonCond[k.Str] = redactString(key, v.Str)
+			} else {
+				anonCond[k.Str] = v.Value()
+			}
+		}
+		return true
+	})
+	return anonCond
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func newTestMappings() AnonMappings {
+	return AnonMappings{
+		Devices:           make(map[string]string),
+		Servers:           make(map[string]string),
+		Users:             make(map[string]string),
+		Rooms:             make(map[string]string),
+		Events:            make(map[string]string),
+		Sessions:          make(map[string]string),
+		AnonUserToDevices: make(map[string]map[string]bool),
+		SingleServerName:  "hs1",
+	}
+}
+
+func TestRedactPushRules(t *testing.T) {
+	syncData, err := os.ReadFile("testdata/push_rules_sync.json")
+	if err != nil {
+		t.Fatalf("failed to read fixture: %s", err)
+	}
+	mappings := newTestMappings()
+	sshot := Redact(syncData, "@alice:example.org", mappings)
+	if sshot.PushRules == nil {
+		t.Fatalf("push rules were not kept")
+	}
+	for _, real := range []string{"alice", "bob", "example.org", "nightingale", "dDwsPQmrUlgWCqZbEX"} {
+		if strings.Contains(string(sshot.PushRules), real) {
+			t.Errorf("anonymised push rules contain '%s': %s", real, string(sshot.PushRules))
+		}
+	}
+	anonLocalpart, _ := split(sshot.UserID)
+	rules := gjson.ParseBytes(sshot.PushRules)
+	rule := func(kind, ruleID string) gjson.Result {
+		return rules.Get(`global.` + kind + `.#(rule_id=="` + ruleID + `")`)
+	}
+
+	testCases := []struct {
+		name string
+		got  gjson.Result
+		want interface{}
+	}{
+		{"contains_user_name pattern", rule("content", ".m.rule.contains_user_name").Get("pattern"), anonLocalpart},
+		{"is_user_mention value", rule("override", ".m.rule.is_user_mention").Get("conditions.0.value"), sshot.UserID},
+		{"invite_for_me state_key", rule("override", ".m.rule.invite_for_me").Get("conditions.2.pattern"), sshot.UserID},
+		{"default pattern is kept", rule("override", ".m.rule.invite_for_me").Get("conditions.1.pattern"), "invite"},
+		{"default value is kept", rule("override", ".m.rule.is_room_mention").Get("conditions.0.value"), true},
+		{"default condition kind is kept", rule("override", ".m.rule.is_room_mention").Get("conditions.1.kind"), "sender_notification_permission"},
+		{"default condition key is kept", rule("override", ".m.rule.is_room_mention").Get("conditions.1.key"), "room"},
+		{"member count is kept", rule("underride", ".m.rule.room_one_to_one").Get("conditions.0.is"), "2"},
+		{"custom string value is redacted", rule("override", "xxxxxxxxxxxx").Get("conditions.0.value"), "xxxxxxxxxxxxxxxxxxx"},
+		{"custom number value is kept", rule("override", "xxxxxxxxxxxx").Get("conditions.1.value"), float64(3)},
+		{"custom sender is anonymised", rule("override", "xxxxxxxxxxxx").Get("conditions.2.pattern"), mappings.Users["@bob:example.org"]},
+		{"custom keyword is redacted", rule("content", "xxxxxxxxxxx").Get("pattern"), "xxxxxxxxxxx"},
+		{"sender rule ID is anonymised", rules.Get("global.sender.0.rule_id"), mappings.Users["@bob:example.org"]},
+	}
+	for _, tc := range testCases {
+		if !tc.got.Exists() {
+			t.Errorf("%s: missing", tc.name)
+			continue
+		}
+		if tc.got.Value() != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, tc.got.Value(), tc.want)
+		}
+	}
+
+	if len(sshot.Audit.Suspicious) != 0 {
+		t.Errorf("audit found PII-like strings in the anonymised push rules: %+v", sshot.Audit.Suspicious)
+	}
+	if counts := sshot.Audit.AccountData["m.push_rules"]; counts == nil || counts.Kept != 1 {
+		t.Errorf("audit did not count m.push_rules as kept: %+v", counts)
+	}
+}
+
+func TestAuditFindsLocalpart(t *testing.T) {
+	mappings := newTestMappings()
+	sshot := &Snapshot{
+		PushRules: []byte(`{"global":{"content":[{"rule_id":".m.rule.contains_user_name","pattern":"Alice"}]}}`),
+	}
+	report := newAuditReport()
+	report.scan(sshot, "@alice:example.org", &mappings)
+	if len(report.Suspicious) != 1 {
+		t.Fatalf("got %d suspicious strings, want 1: %+v", len(report.Suspicious), report.Suspicious)
+	}
+	got := report.Suspicious[0]
+	if got.Kind != "localpart" || got.Value != "alice" || got.Where != "account data m.push_rules" {
+		t.Errorf("got %+v, want the localpart in the push rules", got)
+	}
+}
+
+func TestAnonID(t *testing.T) {
+	secret := []byte("secret")
+	withSecret := func(s []byte) AnonMappings {
+		m := newTestMappings()
+		m.Secret = s
+		m.SingleServerName = ""
+		return m
+	}
+	a, b := withSecret(secret), withSecret(secret)
+	// IDs are assigned in a different order, as they would be if the account changed between snapshots
+	a.User("@alice:example.org")
+	a.User("@bob:example.org")
+	b.User("@bob:example.org")
+	b.User("@alice:example.org")
+	other := withSecret([]byte("other secret"))
+	counters := newTestMappings()
+
+	testCases := []struct {
+		name  string
+		got   string
+		want  string
+		equal bool
+	}{
+		{"same secret gives the same user", a.User("@alice:example.org"), b.User("@alice:example.org"), true},
+		{"same secret gives the same server", a.Server("example.org"), b.Server("example.org"), true},
+		{"same secret gives the same event", a.Event("$ev"), b.Event("$ev"), true},
+		{"joined and external rooms match", a.JoinedRoom(0, "!r:example.org", a.Server("example.org")), b.ExternalRoom("!r:example.org"), true},
+		{"different secrets differ", a.User("@alice:example.org"), other.User("@alice:example.org"), false},
+		{"different users differ", a.User("@alice:example.org"), a.User("@bob:example.org"), false},
+		{"kinds are separate", a.anonID("device", "ABC", nil), a.anonID("session", "ABC", nil), false},
+		{"without a secret the first user is 0", counters.User("@carol:example.org"), "@anon-0:hs1", true},
+		{"without a secret the next user is 1", counters.User("@dave:example.org"), "@anon-1:hs1", true},
+		{"without a secret users are remembered", counters.User("@carol:example.org"), "@anon-0:hs1", true},
+		{"without a secret joined rooms use the index", counters.JoinedRoom(3, "!r:example.org", "hs1"), "!3:hs1", true},
+	}
+	for _, tc := range testCases {
+		if (tc.got == tc.want) != tc.equal {
+			t.Errorf("%s: got %s and %s, want equal: %v", tc.name, tc.got, tc.want, tc.equal)
+		}
+	}
+	if anon := a.User("@alice:example.org"); strings.Contains(anon, "alice") || strings.Contains(anon, "example.org") {
+		t.Errorf("anonymous user %s contains the real user ID", anon)
+	}
+}
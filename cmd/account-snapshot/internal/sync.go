@@ -77,7 +77,8 @@ func doRequest(httpCli *http.Client, req *http.Request, token string) ([]byte, e
 	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("response returned %s", res.Status)
+		body, _ := io.ReadAll(res.Body)
+		return nil, &statusError{StatusCode: res.StatusCode, Status: res.Status, Body: body}
 	}
 	out := bytes.NewBuffer(nil)
 	// non-fatal if we have no content length
@@ -91,6 +92,17 @@ func doRequest(httpCli *http.Client, req *http.Request, token string) ([]byte, e
 	return out.Bytes(), nil
 }
 
+// statusError is returned by doRequest when the response is not a 200.
+type statusError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("response returned %s", e.Status)
+}
+
 type writeCounter struct {
 	contentLength int
 	total         int
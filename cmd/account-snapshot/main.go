@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -14,6 +15,8 @@ import (
 /*
  * Account Snapshot - Take an anonymised snapshot of this account.
  * Raw /sync results stored in sync_snapshot.json
+ * Progress of fetching room history stored in history_snapshot/
+ * A report of what was anonymised is stored in audit_report.json and printed to stderr
  * The anonymised output is written to stdout
  */
 
@@ -23,6 +26,10 @@ var (
 	flagUserID      = flag.String("user", "", "Matrix User ID, needed to configure blueprints correctly for account data")
 	flagFromAnon    = flag.String("from-anon", "", "If set, loads anonymous snapshot from file and then produces blueprint")
 	flagAnonOnly    = flag.Bool("anon-only", false, "If set, outputs an anonymous sync output only, not a blueprint")
+	flagHistory     = flag.Int("history", 0, "If set, back-paginates up to this many events in each room with /messages, in addition to the /sync timeline")
+	flagSecretFile  = flag.String("secret-file", "", "If set, anonymous IDs are derived from a HMAC keyed with the contents of this file, so snapshots taken with the same secret have the same anonymous IDs")
+	flagAudit       = flag.String("audit", "audit_report.json", "Where to write the anonymisation audit report")
+	flagFullState   = flag.Bool("full-state", false, "If set, fetches the current state of each room with /state rather than using the /sync state")
 	imageURI        = "complement-dendrite:latest"
 )
 
@@ -47,6 +54,7 @@ func main() {
 				"Capture an anonymous snapshot of this account.\n"+
 					"User name is required to map DM rooms correctly.\n"+
 					"/sync output is stored in 'sync_snapshot.json'\n"+
+					"-history and -full-state progress is stored in 'history_snapshot/'\n"+
 					"Anonymised output is written to stdout\n\n"+
 					"Usage: ./account_snapshot -token MDA.... -user @alice:matrix.org > output.json\n\n"+
 					"Currently handles the following events:\n"+eventsHandled+"\n\n")
@@ -58,15 +66,40 @@ func main() {
 		if err != nil {
 			log.Panicf("FATAL: LoadSyncData %s\n", err)
 		}
+		syncData, err = internal.LoadHistory(*flagHSURL, *flagAccessToken, syncData, internal.HistoryOptions{
+			Depth:       *flagHistory,
+			FullState:   *flagFullState,
+			ProgressDir: "history_snapshot",
+		})
+		if err != nil {
+			log.Panicf("FATAL: LoadHistory %s\n", err)
+		}
 		var anonMappings internal.AnonMappings
 		anonMappings.Devices = make(map[string]string)
 		anonMappings.Servers = make(map[string]string)
 		anonMappings.Users = make(map[string]string)
 		anonMappings.Rooms = make(map[string]string)
+		anonMappings.Events = make(map[string]string)
+		anonMappings.Sessions = make(map[string]string)
 		anonMappings.AnonUserToDevices = make(map[string]map[string]bool)
 		anonMappings.SingleServerName = "hs1"
-		snapshot = internal.Redact(syncData, anonMappings)
-		snapshot.UserID = anonMappings.User(*flagUserID)
+		if *flagSecretFile != "" {
+			secret, err := os.ReadFile(*flagSecretFile)
+			if err != nil {
+				log.Panicf("FATAL: Failed to read secret file: %s", err)
+			}
+			anonMappings.Secret = bytes.TrimSpace(secret)
+			if len(anonMappings.Secret) == 0 {
+				log.Panicf("FATAL: Secret file %s is empty", *flagSecretFile)
+			}
+		}
+		snapshot = internal.Redact(syncData, *flagUserID, anonMappings)
+		fmt.Fprint(os.Stderr, snapshot.Audit.String())
+		if auditJSON, err := json.MarshalIndent(snapshot.Audit, "", "  "); err != nil {
+			log.Printf("WARNING: failed to marshal audit report: %s", err)
+		} else if err = os.WriteFile(*flagAudit, auditJSON, 0644); err != nil {
+			log.Printf("WARNING: failed to write audit report: %s", err)
+		}
 		if *flagAnonOnly {
 			b, err := json.MarshalIndent(snapshot, "", "  ")
 			if err != nil {
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/matrix-org/complement/b"
+)
+
+const usage = `Usage: blueprint <command> [flags] <file>...
+
+Commands:
+  validate   Check that blueprint files are valid.
+  fmt        Print a blueprint file with includes and generators expanded, in the same format as blueprint files.
+  normalise  Print a blueprint as Complement will run it, with full user IDs. This is the format homerunner
+             accepts for in-line blueprints.
+  schema     Print the JSON Schema for blueprint files.
+
+Flags:
+`
+
+var flagFormat = flag.String("o", "yaml", "Output format for fmt and normalise: yaml or json")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	if len(os.Args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd := os.Args[1]
+	if err := flag.CommandLine.Parse(os.Args[2:]); err != nil {
+		os.Exit(2)
+	}
+	files := flag.Args()
+
+	switch cmd {
+	case "validate":
+		if len(files) == 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		failed := false
+		for _, file := range files {
+			if _, err := b.LoadFile(file); err != nil {
+				fmt.Fprintf(os.Stderr, "INVALID %s\n", err)
+				failed = true
+				continue
+			}
+			fmt.Printf("OK %s\n", file)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	case "fmt", "normalise":
+		if len(files) != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		load := b.ParseFile
+		if cmd == "normalise" {
+			load = b.LoadFile
+		}
+		bp, err := load(files[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err = write(bp); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "schema":
+		os.Stdout.Write(b.Schema)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// write the blueprint to stdout in the output format.
+func write(bp b.Blueprint) error {
+	// go via JSON so the YAML has the same field names as JSON, omitting empty fields
+	data, err := json.Marshal(bp)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	if err = json.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	generic = omitEmpty(generic)
+	switch *flagFormat {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(generic)
+	case "yaml":
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		defer enc.Close()
+		return enc.Encode(generic)
+	default:
+		return fmt.Errorf("unknown output format '%s'", *flagFormat)
+	}
+}
+
+// Fields which are sent to the homeserver as-is, or where empty values are meaningful. Null values are
+// still removed.
+var keepAsIs = map[string]bool{
+	"content":    true,
+	"state_key":  true,
+	"CreateRoom": true,
+	"Value":      true,
+}
+
+// Pointer fields, where zero values are meaningful so only null values are removed.
+var keepZero = map[string]bool{
+	"BaseImageURI": true,
+	"DeviceID":     true,
+	"Order":        true,
+}
+
+// omitEmpty removes null, empty and false fields, as Blueprint has no omitempty tags.
+func omitEmpty(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if child == nil {
+				delete(val, k)
+				continue
+			}
+			if keepAsIs[k] {
+				continue
+			}
+			child = omitEmpty(child)
+			if keepZero[k] {
+				continue
+			}
+			switch c := child.(type) {
+			case string:
+				if c == "" {
+					delete(val, k)
+					continue
+				}
+			case bool:
+				if !c {
+					delete(val, k)
+					continue
+				}
+			case float64:
+				if c == 0 {
+					delete(val, k)
+					continue
+				}
+			case []interface{}:
+				if len(c) == 0 {
+					delete(val, k)
+					continue
+				}
+			}
+			val[k] = child
+		}
+		return val
+	case []interface{}:
+		for i := range val {
+			val[i] = omitEmpty(val[i])
+		}
+		return val
+	}
+	return v
+}
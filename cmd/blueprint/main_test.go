@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/complement/b"
+)
+
+func TestOmitEmpty(t *testing.T) {
+	zero := 0.0
+	bp := b.Blueprint{
+		Name: "test",
+		Homeservers: []b.Homeserver{{
+			Name:  "hs1",
+			Users: []b.User{{Localpart: "@alice", DeviceID: b.Ptr("")}},
+			Rooms: []b.Room{{
+				Creator: "@alice",
+				Tags: []b.Tag{
+					{User: "@alice", Tag: "m.favourite", Order: &zero},
+					{User: "@alice", Tag: "u.work"},
+				},
+			}},
+		}},
+	}
+	data, err := json.Marshal(bp)
+	if err != nil {
+		t.Fatalf("failed to marshal blueprint: %s", err)
+	}
+	var generic interface{}
+	if err = json.Unmarshal(data, &generic); err != nil {
+		t.Fatalf("failed to unmarshal blueprint: %s", err)
+	}
+	want := map[string]interface{}{
+		"Name": "test",
+		"Homeservers": []interface{}{map[string]interface{}{
+			"Name": "hs1",
+			// an empty device ID is kept, as it is a pointer
+			"Users": []interface{}{map[string]interface{}{"Localpart": "@alice", "DeviceID": ""}},
+			"Rooms": []interface{}{map[string]interface{}{
+				"Creator": "@alice",
+				"Tags": []interface{}{
+					// an order of 0 is kept, as it is a pointer
+					map[string]interface{}{"User": "@alice", "Tag": "m.favourite", "Order": 0.0},
+					map[string]interface{}{"User": "@alice", "Tag": "u.work"},
+				},
+			}},
+		}},
+	}
+	if got := omitEmpty(generic); !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		t.Errorf("got %s\nwant %s", gotJSON, wantJSON)
+	}
+}
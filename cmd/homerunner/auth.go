@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/util"
+)
+
+// Tenant is a user of a shared homerunner, identified by their bearer token. Deployments are owned by
+// the tenant which created them, and are only visible to that tenant.
+type Tenant struct {
+	// Human readable name for this tenant, which deployments are attributed to.
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// The maximum number of concurrent deployments. 0 means no limit.
+	MaxDeployments int `json:"max_deployments"`
+	// The maximum lifetime of a deployment, including when it is extended. 0 means HOMERUNNER_LIFETIME_MINS,
+	// which is also the default lifetime.
+	MaxLifetimeMins int `json:"max_lifetime_mins"`
+	// The base images which can be used to build blueprints. Empty means any image. Pre-committed images
+	// can only be used if they were built from one of these images.
+	AllowedBaseImages []string `json:"allowed_base_images"`
+}
+
+// String returns the tenant name, so tokens are not logged when printing the config.
+func (t Tenant) String() string {
+	return t.Name
+}
+
+// CanAccess returns true if the tenant can see and manage this deployment. A nil tenant means auth is
+// disabled, so can access everything.
+func (t *Tenant) CanAccess(rd RunningDeployment) bool {
+	return t == nil || rd.Owner == t.Name
+}
+
+// CanUseBaseImage returns true if this tenant can build blueprints using this base image.
+func (t *Tenant) CanUseBaseImage(imageURI string) bool {
+	if t == nil || len(t.AllowedBaseImages) == 0 {
+		return true
+	}
+	for _, allowed := range t.AllowedBaseImages {
+		if allowed == imageURI {
+			return true
+		}
+	}
+	return false
+}
+
+// CanUseBlueprint returns true if this tenant can build this blueprint on top of this base image. Every
+// homeserver which overrides the base image must also use an allowed image.
+func (t *Tenant) CanUseBlueprint(baseImageURI string, bp *b.Blueprint) (bool, string) {
+	if !t.CanUseBaseImage(baseImageURI) {
+		return false, baseImageURI
+	}
+	for _, hs := range bp.Homeservers {
+		if hs.BaseImageURI != nil && !t.CanUseBaseImage(*hs.BaseImageURI) {
+			return false, *hs.BaseImageURI
+		}
+	}
+	return true, ""
+}
+
+// CanUsePrebuilt returns true if this tenant can deploy pre-committed images which were built from these
+// base images. Images which do not record their base image can only be used if any image is allowed.
+func (t *Tenant) CanUsePrebuilt(baseImages []string) (bool, string) {
+	for _, imageURI := range baseImages {
+		if !t.CanUseBaseImage(imageURI) {
+			return false, imageURI
+		}
+	}
+	return true, ""
+}
+
+// MaxLifetime returns the longest a deployment owned by this tenant can live for.
+func (t *Tenant) MaxLifetime(cfg *Config) time.Duration {
+	if t == nil || t.MaxLifetimeMins <= 0 {
+		return time.Duration(cfg.HomeserverLifetimeMins) * time.Minute
+	}
+	return time.Duration(t.MaxLifetimeMins) * time.Minute
+}
+
+// Owner returns the name to attribute deployments to, which is empty if auth is disabled.
+func (t *Tenant) Owner() string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// LoadTenants reads a JSON file of the form { "tenants": [ Tenant, ... ] }
+func LoadTenants(path string) ([]Tenant, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tenants file: %s", err)
+	}
+	defer f.Close()
+	var file struct {
+		Tenants []Tenant `json:"tenants"`
+	}
+	if err = json.NewDecoder(f).Decode(&file); err != nil {
+		return nil, fmt.Errorf("tenants file is not valid JSON: %s", err)
+	}
+	names := make(map[string]bool)
+	for _, t := range file.Tenants {
+		if t.Name == "" || t.Token == "" {
+			return nil, fmt.Errorf("tenants must have a name and token")
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate tenant name '%s'", t.Name)
+		}
+		names[t.Name] = true
+	}
+	return file.Tenants, nil
+}
+
+type tenantContextKey struct{}
+
+// TenantFromContext returns the authenticated tenant for this request, or nil if auth is disabled.
+func TenantFromContext(ctx context.Context) *Tenant {
+	t, _ := ctx.Value(tenantContextKey{}).(*Tenant)
+	return t
+}
+
+// WithAuth requires requests to have the bearer token of a tenant, which is then available via
+// TenantFromContext. If there are no tenants, auth is disabled and all requests are allowed.
+// The token can also be supplied via the `access_token` query parameter, as EventSource cannot
+// set headers.
+func WithAuth(tenants []Tenant, next http.Handler) http.Handler {
+	if len(tenants) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// set CORS headers on every response, else browsers cannot read why a request was rejected
+		util.SetCORSHeaders(w)
+		if req.Method == http.MethodOptions {
+			// CORS preflight requests never have credentials
+			next.ServeHTTP(w, req)
+			return
+		}
+		token := req.URL.Query().Get("access_token")
+		if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if token == "" {
+			writeJSONResponse(w, util.MessageResponse(401, "missing access token"))
+			return
+		}
+		for i := range tenants {
+			if subtle.ConstantTimeCompare([]byte(tenants[i].Token), []byte(token)) == 1 {
+				ctx := context.WithValue(req.Context(), tenantContextKey{}, &tenants[i])
+				next.ServeHTTP(w, req.WithContext(ctx))
+				return
+			}
+		}
+		writeJSONResponse(w, util.MessageResponse(401, "unknown access token"))
+	})
+}
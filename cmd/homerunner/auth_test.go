@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/b"
+)
+
+func TestWithAuth(t *testing.T) {
+	tenants := []Tenant{
+		{Name: "team-a", Token: "token-a"},
+		{Name: "team-b", Token: "token-b"},
+	}
+	// echoes the authenticated tenant
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("tenant=" + TenantFromContext(req.Context()).Owner()))
+	})
+	testCases := []struct {
+		name     string
+		tenants  []Tenant
+		method   string
+		path     string
+		header   string
+		wantCode int
+		wantBody string
+	}{
+		{"auth disabled", nil, "GET", "/deployments", "", 200, "tenant="},
+		{"missing token", tenants, "GET", "/deployments", "", 401, "missing access token"},
+		{"unknown token", tenants, "GET", "/deployments", "Bearer nope", 401, "unknown access token"},
+		{"header token", tenants, "GET", "/deployments", "Bearer token-b", 200, "tenant=team-b"},
+		{"query param token", tenants, "GET", "/events?access_token=token-a", "", 200, "tenant=team-a"},
+		{"header overrides query param", tenants, "GET", "/events?access_token=token-a", "Bearer token-b", 200, "tenant=team-b"},
+		{"unknown query param token", tenants, "GET", "/events?access_token=nope", "", 401, "unknown access token"},
+		{"not a bearer token", tenants, "GET", "/deployments", "Basic token-a", 401, "missing access token"},
+		{"CORS preflight without a token", tenants, "OPTIONS", "/create", "", 200, "tenant="},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		w := httptest.NewRecorder()
+		WithAuth(tc.tenants, next).ServeHTTP(w, req)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got code %d want %d", tc.name, w.Code, tc.wantCode)
+		}
+		if !strings.Contains(w.Body.String(), tc.wantBody) {
+			t.Errorf("%s: got body %s want %s", tc.name, w.Body.String(), tc.wantBody)
+		}
+		if tc.tenants != nil && w.Header().Get("Access-Control-Allow-Origin") == "" {
+			t.Errorf("%s: missing CORS headers", tc.name)
+		}
+	}
+}
+
+func TestTenantCanUseBlueprint(t *testing.T) {
+	synapse := "complement-synapse"
+	other := "evil-image"
+	restricted := &Tenant{Name: "a", AllowedBaseImages: []string{"complement-synapse", "complement-dendrite"}}
+	testCases := []struct {
+		name      string
+		tenant    *Tenant
+		imageURI  string
+		hsImage   *string
+		wantOK    bool
+		wantImage string
+	}{
+		{"auth disabled", nil, other, &other, true, ""},
+		{"no allowlist", &Tenant{Name: "a"}, other, nil, true, ""},
+		{"allowed image", restricted, "complement-dendrite", nil, true, ""},
+		{"disallowed image", restricted, other, nil, false, other},
+		{"allowed homeserver image", restricted, "complement-dendrite", &synapse, true, ""},
+		{"disallowed homeserver image", restricted, synapse, &other, false, other},
+	}
+	for _, tc := range testCases {
+		bp := &b.Blueprint{
+			Name:        "test",
+			Homeservers: []b.Homeserver{{Name: "hs1"}, {Name: "hs2", BaseImageURI: tc.hsImage}},
+		}
+		ok, imageURI := tc.tenant.CanUseBlueprint(tc.imageURI, bp)
+		if ok != tc.wantOK || imageURI != tc.wantImage {
+			t.Errorf("%s: got %v,%s want %v,%s", tc.name, ok, imageURI, tc.wantOK, tc.wantImage)
+		}
+	}
+}
+
+func TestTenantCanUsePrebuilt(t *testing.T) {
+	restricted := &Tenant{Name: "a", AllowedBaseImages: []string{"complement-synapse"}}
+	testCases := []struct {
+		name       string
+		tenant     *Tenant
+		baseImages []string
+		wantOK     bool
+		wantImage  string
+	}{
+		{"auth disabled", nil, []string{"evil-image", ""}, true, ""},
+		{"no allowlist", &Tenant{Name: "a"}, []string{"evil-image", ""}, true, ""},
+		{"no images", restricted, nil, true, ""},
+		{"allowed images", restricted, []string{"complement-synapse", "complement-synapse"}, true, ""},
+		{"one disallowed image", restricted, []string{"complement-synapse", "evil-image"}, false, "evil-image"},
+		{"unrecorded base image", restricted, []string{""}, false, ""},
+	}
+	for _, tc := range testCases {
+		ok, imageURI := tc.tenant.CanUsePrebuilt(tc.baseImages)
+		if ok != tc.wantOK || imageURI != tc.wantImage {
+			t.Errorf("%s: got %v,%s want %v,%s", tc.name, ok, imageURI, tc.wantOK, tc.wantImage)
+		}
+	}
+}
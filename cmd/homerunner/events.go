@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The types of lifecycle event for a deployment.
+const (
+	EventBuilding  = "building"
+	EventDeployed  = "deployed"
+	EventFailed    = "failed"
+	EventExpired   = "expired"
+	EventDestroyed = "destroyed"
+)
+
+type LifecycleEvent struct {
+	Type          string    `json:"type"`
+	DeploymentID  string    `json:"deployment_id"`
+	BlueprintName string    `json:"blueprint_name"`
+	Owner         string    `json:"owner,omitempty"`
+	Time          time.Time `json:"time"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// EventBroker fans out lifecycle events to all subscribers.
+type EventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan LifecycleEvent]struct{}
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{
+		subscribers: make(map[chan LifecycleEvent]struct{}),
+	}
+}
+
+// Subscribe returns a channel which will receive all lifecycle events until Unsubscribe is called.
+func (b *EventBroker) Subscribe() chan LifecycleEvent {
+	ch := make(chan LifecycleEvent, 64)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *EventBroker) Unsubscribe(ch chan LifecycleEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, ch)
+}
+
+// Publish an event to all subscribers. Never blocks: slow subscribers will miss events.
+func (b *EventBroker) Publish(eventType, deploymentID, blueprintName, owner string, err error) {
+	ev := LifecycleEvent{
+		Type:          eventType,
+		DeploymentID:  deploymentID,
+		BlueprintName: blueprintName,
+		Owner:         owner,
+		Time:          time.Now(),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			logrus.Warnf("Dropping %s event for '%s' as subscriber is too slow", eventType, deploymentID)
+		}
+	}
+}
@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/docker"
 	"github.com/sirupsen/logrus"
@@ -23,6 +26,12 @@ type Config struct {
 	KeepBlueprints         []string
 	Snapshot               string
 	HSPortBindingIP        string
+	PoolSize               int
+	PoolBlueprints         []string
+	PoolBaseImageURI       string
+	PoolTTLMins            int
+	// If set, requests must be authenticated as one of these tenants.
+	Tenants []Tenant
 }
 
 func (c *Config) DeriveComplementConfig(baseImageURI string) *config.Complement {
@@ -51,6 +60,8 @@ func NewConfig() *Config {
 		KeepBlueprints:         strings.Split(os.Getenv("HOMERUNNER_KEEP_BLUEPRINTS"), " "),
 		Snapshot:               os.Getenv("HOMERUNNER_SNAPSHOT_BLUEPRINT"),
 		HSPortBindingIP:        Getenv("HOMERUNNER_HS_PORTBINDING_IP", "127.0.0.1"),
+		PoolBlueprints:         strings.Fields(os.Getenv("HOMERUNNER_POOL_BLUEPRINTS")),
+		PoolBaseImageURI:       os.Getenv("HOMERUNNER_POOL_BASE_IMAGE_URI"),
 	}
 	if val, _ := strconv.Atoi(os.Getenv("HOMERUNNER_LIFETIME_MINS")); val != 0 {
 		cfg.HomeserverLifetimeMins = val
@@ -61,6 +72,20 @@ func NewConfig() *Config {
 	if val, _ := strconv.Atoi(os.Getenv("HOMERUNNER_SPAWN_HS_TIMEOUT_SECS")); val != 0 {
 		cfg.SpawnHSTimeout = time.Duration(val) * time.Second
 	}
+	if val, _ := strconv.Atoi(os.Getenv("HOMERUNNER_POOL_SIZE")); val > 0 {
+		cfg.PoolSize = val
+	}
+	cfg.PoolTTLMins = cfg.HomeserverLifetimeMins
+	if val, _ := strconv.Atoi(os.Getenv("HOMERUNNER_POOL_TTL_MINS")); val > 0 {
+		cfg.PoolTTLMins = val
+	}
+	if path := os.Getenv("HOMERUNNER_TENANTS_FILE"); path != "" {
+		tenants, err := LoadTenants(path)
+		if err != nil {
+			logrus.Fatalf("failed to load HOMERUNNER_TENANTS_FILE: %s", err)
+		}
+		cfg.Tenants = tenants
+	}
 	return cfg
 }
 
@@ -92,28 +117,55 @@ func main() {
 		if err := json.NewDecoder(reqFile).Decode(&rc); err != nil {
 			logrus.Fatalf("file is not JSON: %s", err)
 		}
-		dep, _, err := rt.CreateDeployment(rc.BaseImageURI, rc.Blueprint)
+		rd, err := rt.CreateDeployment(rc.BaseImageURI, rc.Blueprint, nil)
 		if err != nil {
 			logrus.Fatalf("failed to create deployment: %s", err)
 		}
-		logrus.Infof("Successful deployment. Created %d homeserver images visible in 'docker image ls'.", len(dep.HS))
+		logrus.Infof("Successful deployment. Created %d homeserver images visible in 'docker image ls'.", len(rd.Deployment.HS))
 		logrus.Infof("Clients: to run this blueprint in homerunner, use the blueprint name '%s'", rc.Blueprint.Name)
 		logrus.Infof("Servers: Run Homerunner with the env var HOMERUNNER_KEEP_BLUEPRINTS=%s set to prevent this blueprint being cleaned up", rc.Blueprint.Name)
 
 		// clean up after ourselves
-		_ = rt.DestroyDeployment(dep.BlueprintName)
+		_ = rt.DestroyDeployment(rd.ID)
 		return
 	}
 
+	if rt.Pool != nil {
+		for _, name := range cfg.PoolBlueprints {
+			blueprint, ok := b.KnownBlueprints[name]
+			if !ok {
+				// assume it's a pre-committed image, which doesn't need a base image
+				rt.Pool.Warm("none", &b.Blueprint{Name: name})
+				continue
+			}
+			if cfg.PoolBaseImageURI == "" {
+				logrus.Fatalf("HOMERUNNER_POOL_BASE_IMAGE_URI must be set to pool blueprint '%s'", name)
+			}
+			rt.Pool.Warm(cfg.PoolBaseImageURI, blueprint)
+		}
+	}
+
+	// There is no read or write timeout for the whole request, as that would cut off the event streams:
+	// other requests are limited by Routes instead.
 	srv := &http.Server{
-		ReadTimeout:  10 * time.Minute,
-		WriteTimeout: 10 * time.Minute,
-		Handler:      Routes(rt, cfg),
-		Addr:         fmt.Sprintf("0.0.0.0:%d", cfg.Port),
+		ReadHeaderTimeout: time.Minute,
+		Handler:           Routes(rt, cfg),
+		Addr:              fmt.Sprintf("0.0.0.0:%d", cfg.Port),
 	}
 	logrus.Infof("Homerunner listening on :%d with config %+v", cfg.Port, cfg)
 
-	if err := srv.ListenAndServe(); err != nil {
+	go func() {
+		// tear down the pool on exit, as nothing else knows about the deployments in it
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		logrus.Infof("Shutting down")
+		_ = srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		logrus.Fatalf("ListenAndServe failed: %s", err)
 	}
+	if rt.Pool != nil {
+		rt.Pool.Close()
+	}
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// poolKey identifies the deployments which can be handed out for a request. Deployments of the same
+// blueprint on different base images are built under different names, see Runtime.buildName, so must
+// be pooled separately.
+type poolKey struct {
+	imageURI      string
+	blueprintName string
+}
+
+type pooledDeployment struct {
+	id         string
+	deployment *docker.Deployment
+	// fires when the deployment has been in the pool for too long
+	timer *time.Timer
+}
+
+// Pool keeps a number of deployments of each blueprint ready in the background, so they can be handed
+// out without waiting for homeservers to start. Pools are created for a blueprint when it is first
+// requested, or on startup via HOMERUNNER_POOL_BLUEPRINTS. Deployments which are not handed out within
+// the TTL are destroyed, and the pool for that blueprint is refilled on the next request.
+type Pool struct {
+	rt   *Runtime
+	size int
+	ttl  time.Duration
+
+	mu         sync.Mutex
+	ready      map[poolKey][]pooledDeployment
+	warming    map[poolKey]int
+	blueprints map[poolKey]*b.Blueprint
+	closed     bool
+	// tracks warmOne goroutines, so Close can wait for them
+	wg sync.WaitGroup
+}
+
+func NewPool(rt *Runtime, size int, ttl time.Duration) *Pool {
+	return &Pool{
+		rt:         rt,
+		size:       size,
+		ttl:        ttl,
+		ready:      make(map[poolKey][]pooledDeployment),
+		warming:    make(map[poolKey]int),
+		blueprints: make(map[poolKey]*b.Blueprint),
+	}
+}
+
+// Take a ready deployment of this blueprint from the pool, returning false if there are none ready.
+// Either way, the pool for this blueprint is replenished in the background.
+func (p *Pool) Take(imageURI string, blueprint *b.Blueprint) (pooledDeployment, bool) {
+	key := poolKey{imageURI: imageURI, blueprintName: blueprint.Name}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.blueprints[key] = blueprint
+	ready := p.ready[key]
+	var pd pooledDeployment
+	if len(ready) > 0 {
+		pd = ready[0]
+		pd.timer.Stop()
+		p.ready[key] = ready[1:]
+	}
+	p.replenish(key)
+	return pd, pd.deployment != nil
+}
+
+// Warm starts filling the pool for this blueprint.
+func (p *Pool) Warm(imageURI string, blueprint *b.Blueprint) {
+	key := poolKey{imageURI: imageURI, blueprintName: blueprint.Name}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.blueprints[key] = blueprint
+	p.replenish(key)
+}
+
+// replenish starts deploying enough deployments to fill the pool for this key. Must be called with
+// the lock held.
+func (p *Pool) replenish(key poolKey) {
+	if p.closed {
+		return
+	}
+	for len(p.ready[key])+p.warming[key] < p.size {
+		p.warming[key]++
+		p.wg.Add(1)
+		go p.warmOne(key, p.blueprints[key])
+	}
+}
+
+// Close destroys all ready deployments, and waits for deployments which are still being warmed so they
+// can be destroyed too. The pool hands out no more deployments once closed.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	for key, ready := range p.ready {
+		for _, pd := range ready {
+			pd.timer.Stop()
+			destroyPooled(pd)
+		}
+		delete(p.ready, key)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// expire removes the deployment with this ID from the pool and destroys it, if it is still in the pool.
+func (p *Pool) expire(key poolKey, id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ready := p.ready[key]
+	for i, pd := range ready {
+		if pd.id != id {
+			continue
+		}
+		logrus.Infof("Pooled deployment '%s' has expired. Tearing down network.", id)
+		p.ready[key] = append(ready[:i:i], ready[i+1:]...)
+		destroyPooled(pd)
+		return
+	}
+}
+
+func destroyPooled(pd pooledDeployment) {
+	pd.deployment.Deployer.Destroy(pd.deployment, false, "", false)
+}
+
+func (p *Pool) warmOne(key poolKey, blueprint *b.Blueprint) {
+	defer p.wg.Done()
+	id, err := newDeploymentID(blueprint.Name)
+	var dep *docker.Deployment
+	if err == nil {
+		dep, err = p.rt.deploy(id, key.imageURI, blueprint)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.warming[key]--
+	if err != nil {
+		// don't retry immediately else we'll spin on a broken blueprint, the next Take will try again
+		logrus.WithError(err).Errorf("Failed to warm pooled deployment of '%s'", blueprint.Name)
+		return
+	}
+	pd := pooledDeployment{
+		id:         id,
+		deployment: dep,
+	}
+	if p.closed {
+		destroyPooled(pd)
+		return
+	}
+	logrus.Infof("Pooled deployment '%s' is ready", id)
+	pd.timer = time.AfterFunc(p.ttl, func() {
+		p.expire(key, id)
+	})
+	p.ready[key] = append(p.ready[key], pd)
+}
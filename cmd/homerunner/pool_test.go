@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/b"
+)
+
+// newTestPool returns a pool with these ready deployments. The pool has a size of 0 so it never warms
+// deployments, which would need docker.
+func newTestPool(t *testing.T, ready map[poolKey][]string) *Pool {
+	t.Helper()
+	p := NewPool(newTestRuntime(t), 0, time.Hour)
+	for key, ids := range ready {
+		for _, id := range ids {
+			p.ready[key] = append(p.ready[key], pooledDeployment{
+				id:         id,
+				deployment: testDeployment(),
+				timer:      time.AfterFunc(time.Hour, func() {}),
+			})
+		}
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func readyIDs(p *Pool, key poolKey) (ids []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pd := range p.ready[key] {
+		ids = append(ids, pd.id)
+	}
+	return ids
+}
+
+func TestPoolTake(t *testing.T) {
+	synapse := poolKey{imageURI: "complement-synapse", blueprintName: "one_to_one_room"}
+	dendrite := poolKey{imageURI: "complement-dendrite", blueprintName: "one_to_one_room"}
+	p := newTestPool(t, map[poolKey][]string{
+		synapse:  {"a", "b"},
+		dendrite: {"c"},
+	})
+	blueprint := &b.Blueprint{Name: "one_to_one_room"}
+
+	testCases := []struct {
+		name     string
+		imageURI string
+		wantID   string
+	}{
+		{"takes the oldest deployment", "complement-synapse", "a"},
+		{"takes the next deployment", "complement-synapse", "b"},
+		{"none left for this image", "complement-synapse", ""},
+		{"pooled separately per image", "complement-dendrite", "c"},
+		{"unknown image", "complement-conduit", ""},
+	}
+	for _, tc := range testCases {
+		pd, ok := p.Take(tc.imageURI, blueprint)
+		if ok != (tc.wantID != "") || pd.id != tc.wantID {
+			t.Errorf("%s: got %s,%v want %s", tc.name, pd.id, ok, tc.wantID)
+			continue
+		}
+		if ok && pd.timer.Stop() {
+			t.Errorf("%s: expiry timer of the taken deployment was not stopped", tc.name)
+		}
+	}
+}
+
+func TestPoolExpire(t *testing.T) {
+	key := poolKey{imageURI: "complement-synapse", blueprintName: "one_to_one_room"}
+	p := newTestPool(t, map[poolKey][]string{
+		key: {"a", "b", "c"},
+	})
+	testCases := []struct {
+		name    string
+		id      string
+		wantIDs []string
+	}{
+		{"removes the expired deployment", "b", []string{"a", "c"}},
+		{"ignores deployments which were taken", "b", []string{"a", "c"}},
+		{"removes the first deployment", "a", []string{"c"}},
+		{"removes the last deployment", "c", nil},
+	}
+	for _, tc := range testCases {
+		p.expire(key, tc.id)
+		got := readyIDs(p, key)
+		if len(got) != len(tc.wantIDs) {
+			t.Errorf("%s: got ready %v want %v", tc.name, got, tc.wantIDs)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.wantIDs[i] {
+				t.Errorf("%s: got ready %v want %v", tc.name, got, tc.wantIDs)
+				break
+			}
+		}
+	}
+}
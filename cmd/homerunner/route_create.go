@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -17,8 +18,12 @@ type ReqCreate struct {
 }
 
 type ResCreate struct {
-	Homeservers map[string]*docker.HomeserverDeployment `json:"homeservers"`
-	Expires     time.Time                               `json:"expires"`
+	// The tenant which owns this deployment, empty if auth is disabled.
+	Owner string `json:"owner,omitempty"`
+	// The ID to use when referring to this deployment, as the same blueprint can be deployed many times.
+	DeploymentID string                                  `json:"deployment_id"`
+	Homeservers  map[string]*docker.HomeserverDeployment `json:"homeservers"`
+	Expires      time.Time                               `json:"expires"`
 }
 
 // RouteCreate handles creating blueprint deployments. There are 3 supported types of requests:
@@ -26,11 +31,15 @@ type ResCreate struct {
 //   - B: Creating an in-line blueprint where the blueprint is in the request.
 //   - C: Creating a deployment from a pre-made blueprint image, e.g using account-snapshot.
 func RouteCreate(ctx context.Context, rt *Runtime, rc *ReqCreate) util.JSONResponse {
+	tenant := TenantFromContext(ctx)
+	// Only named blueprints can be pooled: in-line blueprints may have different contents for the same name.
+	named := false
 	// Use case A: if the blueprint name is given, check for static ones
 	knownBlueprint, ok := b.KnownBlueprints[rc.BlueprintName]
 	if ok {
 		// clobber it and pretend it's inline
 		rc.Blueprint = knownBlueprint
+		named = true
 	}
 
 	if rc.Blueprint != nil {
@@ -38,6 +47,12 @@ func RouteCreate(ctx context.Context, rt *Runtime, rc *ReqCreate) util.JSONRespo
 		if rc.BaseImageURI == "" {
 			return util.MessageResponse(400, "missing base image uri")
 		}
+		if rc.BaseImageURI == "none" && !named {
+			return util.MessageResponse(400, "base image uri 'none' can only be used with 'blueprint_name'")
+		}
+		if ok, imageURI := tenant.CanUseBlueprint(rc.BaseImageURI, rc.Blueprint); !ok {
+			return util.MessageResponse(403, fmt.Sprintf("base image '%s' is not allowed", imageURI))
+		}
 	} else if rc.BlueprintName != "" {
 		// Use case C: the blueprint name isn't static, try it with just a name which will succeed
 		// if the blueprint is already in the docker image cache.
@@ -45,19 +60,43 @@ func RouteCreate(ctx context.Context, rt *Runtime, rc *ReqCreate) util.JSONRespo
 			Name: rc.BlueprintName,
 		}
 		rc.BaseImageURI = "none"
+		named = true
 	} else {
 		return util.MessageResponse(400, "one of 'blueprint_name' or 'blueprint' must be specified")
 	}
 
-	dep, expires, err := rt.CreateDeployment(rc.BaseImageURI, rc.Blueprint)
+	if rc.BaseImageURI == "none" && !tenant.CanUseBaseImage("") {
+		// pre-committed images may have been built by anyone, so check the images they were built from
+		baseImages, err := rt.BaseImages(rc.Blueprint.Name)
+		if err != nil {
+			return util.MessageResponse(500, fmt.Sprintf("failed to check base images: %s", err))
+		}
+		if ok, imageURI := tenant.CanUsePrebuilt(baseImages); !ok {
+			if imageURI == "" {
+				return util.MessageResponse(403, fmt.Sprintf("blueprint '%s' does not record its base image", rc.Blueprint.Name))
+			}
+			return util.MessageResponse(403, fmt.Sprintf("blueprint '%s' was built from base image '%s' which is not allowed", rc.Blueprint.Name, imageURI))
+		}
+	}
+
+	createDeployment := rt.CreateDeployment
+	if named {
+		createDeployment = rt.CreatePooledDeployment
+	}
+	rd, err := createDeployment(rc.BaseImageURI, rc.Blueprint, tenant)
+	if errors.Is(err, ErrTooManyDeployments) {
+		return util.MessageResponse(429, fmt.Sprintf("failed to create deployment: %s", err))
+	}
 	if err != nil {
 		return util.MessageResponse(400, fmt.Sprintf("failed to create deployment: %s", err))
 	}
 	return util.JSONResponse{
 		Code: 200,
 		JSON: ResCreate{
-			Homeservers: dep.HS,
-			Expires:     expires,
+			Owner:        rd.Owner,
+			DeploymentID: rd.ID,
+			Homeservers:  rd.Deployment.HS,
+			Expires:      rd.Expires,
 		},
 	}
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/util"
+)
+
+type ResDeployment struct {
+	DeploymentID  string                                  `json:"deployment_id"`
+	Owner         string                                  `json:"owner,omitempty"`
+	BlueprintName string                                  `json:"blueprint_name"`
+	Homeservers   map[string]*docker.HomeserverDeployment `json:"homeservers"`
+	Expires       time.Time                               `json:"expires"`
+}
+
+type ResListDeployments struct {
+	Deployments []ResDeployment `json:"deployments"`
+}
+
+func newResDeployment(rd RunningDeployment) ResDeployment {
+	return ResDeployment{
+		DeploymentID:  rd.ID,
+		Owner:         rd.Owner,
+		BlueprintName: rd.Deployment.BlueprintName,
+		Homeservers:   rd.Deployment.HS,
+		Expires:       rd.Expires,
+	}
+}
+
+// RouteListDeployments lists all running deployments owned by the tenant, optionally only those of the
+// given blueprint.
+func RouteListDeployments(ctx context.Context, rt *Runtime, blueprintName string) util.JSONResponse {
+	res := ResListDeployments{
+		Deployments: []ResDeployment{},
+	}
+	for _, id := range rt.DeploymentIDs(blueprintName, TenantFromContext(ctx)) {
+		rd, ok := rt.GetDeployment(id)
+		if !ok {
+			continue // destroyed since we listed IDs
+		}
+		res.Deployments = append(res.Deployments, newResDeployment(rd))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// RouteGetDeployment returns the homeservers in a deployment, including their URLs and access tokens.
+func RouteGetDeployment(ctx context.Context, rt *Runtime, deploymentID string) util.JSONResponse {
+	rd, ok := rt.GetDeployment(deploymentID)
+	if !ok || !TenantFromContext(ctx).CanAccess(rd) {
+		return util.MessageResponse(404, fmt.Sprintf("no deployment with ID '%s' exists", deploymentID))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: newResDeployment(rd),
+	}
+}
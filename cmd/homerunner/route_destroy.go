@@ -8,6 +8,8 @@ import (
 )
 
 type ReqDestroy struct {
+	DeploymentID string `json:"deployment_id"`
+	// Deprecated: use DeploymentID. Only works if there is exactly one deployment of this blueprint.
 	BlueprintName string `json:"blueprint_name"`
 }
 
@@ -15,10 +17,24 @@ type ResDestroy struct {
 }
 
 func RouteDestroy(ctx context.Context, rt *Runtime, rc *ReqDestroy) util.JSONResponse {
-	if rc.BlueprintName == "" {
-		return util.MessageResponse(400, "missing blueprint name")
+	tenant := TenantFromContext(ctx)
+	deploymentID := rc.DeploymentID
+	if deploymentID == "" {
+		if rc.BlueprintName == "" {
+			return util.MessageResponse(400, "missing deployment ID")
+		}
+		ids := rt.DeploymentIDs(rc.BlueprintName, tenant)
+		if len(ids) != 1 {
+			return util.MessageResponse(400, fmt.Sprintf(
+				"there are %d deployments of blueprint '%s', specify a 'deployment_id' instead", len(ids), rc.BlueprintName,
+			))
+		}
+		deploymentID = ids[0]
 	}
-	err := rt.DestroyDeployment(rc.BlueprintName)
+	if rd, ok := rt.GetDeployment(deploymentID); !ok || !tenant.CanAccess(rd) {
+		return util.MessageResponse(404, fmt.Sprintf("no deployment with ID '%s' exists", deploymentID))
+	}
+	err := rt.DestroyDeployment(deploymentID)
 	if err != nil {
 		return util.MessageResponse(500, fmt.Sprintf("failed to destroy deployment: %s", err))
 	}
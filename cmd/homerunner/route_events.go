@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+// RouteEvents streams deployment lifecycle events (building, deployed, failed, expired, destroyed) as
+// Server-Sent Events. The event name is the type of lifecycle event.
+//
+// Only events for deployments owned by the tenant are sent.
+//
+// Query parameters:
+//   - blueprint_name: only stream events for deployments of this blueprint
+//   - deployment_id: only stream events for this deployment
+func RouteEvents(w http.ResponseWriter, req *http.Request, rt *Runtime) {
+	tenant := TenantFromContext(req.Context())
+	blueprintName := req.URL.Query().Get("blueprint_name")
+	deploymentID := req.URL.Query().Get("deployment_id")
+	ch := rt.Events.Subscribe()
+	defer rt.Events.Unsubscribe(ch)
+	sse, err := newSSEWriter(w)
+	if err != nil {
+		writeJSONResponse(w, util.MessageResponse(500, err.Error()))
+		return
+	}
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev := <-ch:
+			if blueprintName != "" && ev.BlueprintName != blueprintName {
+				continue
+			}
+			if deploymentID != "" && ev.DeploymentID != deploymentID {
+				continue
+			}
+			if tenant != nil && ev.Owner != tenant.Name {
+				continue
+			}
+			err = sse.Event(ev.Type, "", ev)
+		case <-keepAlive.C:
+			err = sse.KeepAlive()
+		case <-req.Context().Done():
+			return
+		}
+		if err != nil {
+			return // client went away
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+type ReqExtend struct {
+	// How long from now the deployment should expire. If 0, uses HOMERUNNER_LIFETIME_MINS, or the tenant's
+	// maximum lifetime if that is lower.
+	LifetimeMins int `json:"lifetime_mins"`
+}
+
+type ResExtend struct {
+	Expires time.Time `json:"expires"`
+}
+
+// RouteExtend resets the expiry time of a deployment.
+func RouteExtend(ctx context.Context, rt *Runtime, deploymentID string, rc *ReqExtend) util.JSONResponse {
+	tenant := TenantFromContext(ctx)
+	if rd, ok := rt.GetDeployment(deploymentID); !ok || !tenant.CanAccess(rd) {
+		return util.MessageResponse(404, fmt.Sprintf("no deployment with ID '%s' exists", deploymentID))
+	}
+	maxLifetime := tenant.MaxLifetime(rt.Config)
+	lifetime := time.Duration(rc.LifetimeMins) * time.Minute
+	if rc.LifetimeMins <= 0 {
+		lifetime = time.Duration(rt.Config.HomeserverLifetimeMins) * time.Minute
+		if lifetime > maxLifetime {
+			lifetime = maxLifetime
+		}
+	} else if lifetime > maxLifetime && tenant != nil {
+		return util.MessageResponse(403, fmt.Sprintf("lifetime_mins cannot be more than %d", int(maxLifetime.Minutes())))
+	}
+	expires, err := rt.ExtendDeployment(deploymentID, lifetime)
+	if err != nil {
+		return util.MessageResponse(404, fmt.Sprintf("failed to extend deployment: %s", err))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ResExtend{
+			Expires: expires,
+		},
+	}
+}
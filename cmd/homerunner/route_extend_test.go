@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRouteExtend(t *testing.T) {
+	rt := newTestRuntime(t) // HomeserverLifetimeMins is 30
+	long := &Tenant{Name: "long", MaxLifetimeMins: 60}
+	short := &Tenant{Name: "short", MaxLifetimeMins: 10}
+	addTestDeployment(t, rt, "unowned", nil)
+	addTestDeployment(t, rt, "long", long)
+	addTestDeployment(t, rt, "short", short)
+
+	testCases := []struct {
+		name         string
+		tenant       *Tenant
+		id           string
+		lifetimeMins int
+		wantCode     int
+		wantLifetime time.Duration
+	}{
+		{"default lifetime", nil, "unowned", 0, 200, 30 * time.Minute},
+		{"no limit without auth", nil, "unowned", 120, 200, 120 * time.Minute},
+		{"default lifetime below the tenant max", long, "long", 0, 200, 30 * time.Minute},
+		{"default lifetime capped to the tenant max", short, "short", 0, 200, 10 * time.Minute},
+		{"requested lifetime within the tenant max", long, "long", 45, 200, 45 * time.Minute},
+		{"requested lifetime above the tenant max", long, "long", 90, 403, 0},
+		{"deployment owned by another tenant", long, "short", 0, 404, 0},
+		{"unknown deployment", nil, "unknown", 0, 404, 0},
+	}
+	for _, tc := range testCases {
+		ctx := context.Background()
+		if tc.tenant != nil {
+			ctx = context.WithValue(ctx, tenantContextKey{}, tc.tenant)
+		}
+		before := time.Now()
+		res := RouteExtend(ctx, rt, tc.id, &ReqExtend{LifetimeMins: tc.lifetimeMins})
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got code %d want %d: %+v", tc.name, res.Code, tc.wantCode, res.JSON)
+			continue
+		}
+		if tc.wantCode != 200 {
+			continue
+		}
+		expires := res.JSON.(ResExtend).Expires
+		if expires.Before(before.Add(tc.wantLifetime)) || expires.After(time.Now().Add(tc.wantLifetime)) {
+			t.Errorf("%s: got expiry in %v, want %v", tc.name, expires.Sub(before), tc.wantLifetime)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+type LogLine struct {
+	HSName string `json:"hs"`
+	Stream string `json:"stream"` // stdout or stderr
+	Time   string `json:"time"`   // RFC3339Nano
+	Line   string `json:"line"`
+}
+
+// lineWriter splits container output into lines and sends them to a channel.
+type lineWriter struct {
+	ctx    context.Context
+	hsName string
+	stream string
+	ch     chan<- LogLine
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.buf[:i])
+		w.buf = w.buf[i+1:]
+		// lines are prefixed with their timestamp
+		timestamp, text, _ := strings.Cut(line, " ")
+		select {
+		case w.ch <- LogLine{
+			HSName: w.hsName,
+			Stream: w.stream,
+			Time:   timestamp,
+			Line:   text,
+		}:
+		case <-w.ctx.Done():
+			return 0, w.ctx.Err()
+		}
+	}
+	return len(p), nil
+}
+
+// RouteLogs streams the logs of all homeservers in a deployment as Server-Sent Events, until the
+// deployment is destroyed. Each `log` event has the timestamp of the line as its ID, so clients which
+// reconnect will resume from where they left off. The stream ends with an `end` event.
+//
+// Query parameters:
+//   - hs: only stream logs for this homeserver
+//   - since: only stream logs from this RFC3339 timestamp onwards, overrides Last-Event-ID
+func RouteLogs(w http.ResponseWriter, req *http.Request, rt *Runtime, deploymentID string) {
+	rd, ok := rt.GetDeployment(deploymentID)
+	if !ok || !TenantFromContext(req.Context()).CanAccess(rd) {
+		writeJSONResponse(w, util.MessageResponse(404, fmt.Sprintf("no deployment with ID '%s' exists", deploymentID)))
+		return
+	}
+	dep := rd.Deployment
+	hsFilter := req.URL.Query().Get("hs")
+	if _, ok = dep.HS[hsFilter]; hsFilter != "" && !ok {
+		writeJSONResponse(w, util.MessageResponse(404, fmt.Sprintf("deployment '%s' has no homeserver '%s'", deploymentID, hsFilter)))
+		return
+	}
+	since := resumeLogsFrom(req.Header.Get("Last-Event-ID"))
+	if s := req.URL.Query().Get("since"); s != "" {
+		since = s
+	}
+	sse, err := newSSEWriter(w)
+	if err != nil {
+		writeJSONResponse(w, util.MessageResponse(500, err.Error()))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	lines := make(chan LogLine, 256)
+	var wg sync.WaitGroup
+	for hsName := range dep.HS {
+		if hsFilter != "" && hsName != hsFilter {
+			continue
+		}
+		wg.Add(1)
+		go func(hsName string) {
+			defer wg.Done()
+			stdout := &lineWriter{ctx: ctx, hsName: hsName, stream: "stdout", ch: lines}
+			stderr := &lineWriter{ctx: ctx, hsName: hsName, stream: "stderr", ch: lines}
+			err := dep.Deployer.FollowLogs(ctx, dep.HS[hsName], since, stdout, stderr)
+			if err != nil && ctx.Err() == nil {
+				logrus.WithError(err).Warnf("Failed to follow logs for %s in '%s'", hsName, deploymentID)
+			}
+		}(hsName)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case line := <-lines:
+			err = sse.Event("log", line.Time, line)
+		case <-keepAlive.C:
+			err = sse.KeepAlive()
+		case <-done:
+			// all containers have gone, send any remaining lines then end the stream
+			for {
+				select {
+				case line := <-lines:
+					if err = sse.Event("log", line.Time, line); err != nil {
+						return
+					}
+				default:
+					_ = sse.Event("end", "", struct{}{})
+					return
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return // client went away
+		}
+	}
+}
+
+// resumeLogsFrom returns the timestamp to resume logs from when a client reconnects after receiving the
+// line with the given ID. Docker includes lines at exactly `since`, so this is 1ns after the line, else the
+// client would receive it again.
+func resumeLogsFrom(lastEventID string) string {
+	if lastEventID == "" {
+		return ""
+	}
+	ts, err := time.Parse(time.RFC3339Nano, lastEventID)
+	if err != nil {
+		return lastEventID // let docker reject it
+	}
+	return ts.Add(time.Nanosecond).Format(time.RFC3339Nano)
+}
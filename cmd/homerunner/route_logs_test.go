@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResumeLogsFrom(t *testing.T) {
+	testCases := []struct {
+		name        string
+		lastEventID string
+		want        string
+	}{
+		{"no last event", "", ""},
+		{"resumes after the last line", "2021-03-09T18:02:37.818757Z", "2021-03-09T18:02:37.818757001Z"},
+		{"keeps the time zone", "2021-03-09T18:02:37.999999999+01:00", "2021-03-09T18:02:38+01:00"},
+		{"passes through invalid IDs", "not-a-time", "not-a-time"},
+	}
+	for _, tc := range testCases {
+		if got := resumeLogsFrom(tc.lastEventID); got != tc.want {
+			t.Errorf("%s: got %s want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	ch := make(chan LogLine, 10)
+	w := &lineWriter{ctx: context.Background(), hsName: "hs1", stream: "stderr", ch: ch}
+	writes := []string{
+		"2021-03-09T18:02:37Z first line\n2021-03-09T18:02:38Z sec",
+		"ond line\n",
+		"2021-03-09T18:02:39Z",
+		" third line with  spaces\nno-timestamp\n2021-03-09T18:02:40Z incomplete",
+	}
+	for _, s := range writes {
+		n, err := w.Write([]byte(s))
+		if err != nil || n != len(s) {
+			t.Fatalf("Write returned %d, %v want %d, nil", n, err, len(s))
+		}
+	}
+	close(ch)
+	want := []LogLine{
+		{HSName: "hs1", Stream: "stderr", Time: "2021-03-09T18:02:37Z", Line: "first line"},
+		{HSName: "hs1", Stream: "stderr", Time: "2021-03-09T18:02:38Z", Line: "second line"},
+		{HSName: "hs1", Stream: "stderr", Time: "2021-03-09T18:02:39Z", Line: "third line with  spaces"},
+		{HSName: "hs1", Stream: "stderr", Time: "no-timestamp", Line: ""},
+	}
+	var got []LogLine
+	for line := range ch {
+		got = append(got, line)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d: got %+v want %+v", i, got[i], want[i])
+		}
+	}
+	if string(w.buf) != "2021-03-09T18:02:40Z incomplete" {
+		t.Errorf("got buffered %q, want the incomplete line", w.buf)
+	}
+}
+
+func TestLineWriterCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// nothing reads the channel, so the writer must give up when the context is cancelled
+	w := &lineWriter{ctx: ctx, hsName: "hs1", stream: "stdout", ch: make(chan LogLine)}
+	if _, err := w.Write([]byte("2021-03-09T18:02:37Z line\n")); err != context.Canceled {
+		t.Errorf("got error %v want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/util"
+)
+
+// RouteServerAction stops, starts, pauses or unpauses a single homeserver in a deployment. Returns the
+// homeserver, whose URLs may have changed if it was started.
+func RouteServerAction(ctx context.Context, rt *Runtime, deploymentID, hsName, action string) util.JSONResponse {
+	rd, ok := rt.GetDeployment(deploymentID)
+	if !ok || !TenantFromContext(ctx).CanAccess(rd) {
+		return util.MessageResponse(404, fmt.Sprintf("no deployment with ID '%s' exists", deploymentID))
+	}
+	dep := rd.Deployment
+	hsDep, ok := dep.HS[hsName]
+	if !ok {
+		return util.MessageResponse(404, fmt.Sprintf("deployment '%s' has no homeserver '%s'", deploymentID, hsName))
+	}
+	var fn func(hsDep *docker.HomeserverDeployment) error
+	switch action {
+	case "stop":
+		fn = dep.Deployer.StopServer
+	case "start":
+		fn = dep.Deployer.StartServer
+	case "pause":
+		fn = dep.Deployer.PauseServer
+	case "unpause":
+		fn = dep.Deployer.UnpauseServer
+	default:
+		return util.MessageResponse(400, fmt.Sprintf("unknown action '%s'", action))
+	}
+	if err := fn(hsDep); err != nil {
+		return util.MessageResponse(500, fmt.Sprintf("failed to %s %s: %s", action, hsName, err))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: hsDep,
+	}
+}
@@ -2,15 +2,28 @@ package main
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/util"
 )
 
+// requestTimeout is how long requests other than event streams can take, including building blueprints.
+const requestTimeout = 10 * time.Minute
+
 func Routes(rt *Runtime, cfg *Config) http.Handler {
-	mux := mux.NewRouter()
-	mux.Path("/create").Methods("POST").HandlerFunc(
+	router := mux.NewRouter()
+	// all routes except /health require auth, if it is enabled
+	auth := func(h http.Handler) http.Handler {
+		return WithAuth(cfg.Tenants, h)
+	}
+	// the server has no write timeout so streams can stay open, so limit every other request instead
+	limit := func(h http.Handler) http.Handler {
+		return http.TimeoutHandler(h, requestTimeout, "request timed out")
+	}
+	router.Path("/create").Methods("POST").Handler(auth(limit(
 		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
 			func(req *http.Request) util.JSONResponse {
 				rc := ReqCreate{}
@@ -20,8 +33,8 @@ func Routes(rt *Runtime, cfg *Config) http.Handler {
 				return RouteCreate(req.Context(), rt, &rc)
 			},
 		))),
-	)
-	mux.Path("/destroy").Methods("POST").HandlerFunc(
+	)))
+	router.Path("/destroy").Methods("POST").Handler(auth(limit(
 		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
 			func(req *http.Request) util.JSONResponse {
 				rc := ReqDestroy{}
@@ -31,11 +44,55 @@ func Routes(rt *Runtime, cfg *Config) http.Handler {
 				return RouteDestroy(req.Context(), rt, &rc)
 			},
 		))),
-	)
-	mux.Path("/health").Methods("GET").HandlerFunc(
+	)))
+	router.Path("/deployments").Methods("GET").Handler(auth(limit(
+		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				return RouteListDeployments(req.Context(), rt, req.URL.Query().Get("blueprint_name"))
+			},
+		))),
+	)))
+	router.Path("/deployments/{id}").Methods("GET").Handler(auth(limit(
+		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				return RouteGetDeployment(req.Context(), rt, mux.Vars(req)["id"])
+			},
+		))),
+	)))
+	router.Path("/deployments/{id}/extend").Methods("POST").Handler(auth(limit(
+		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				rc := ReqExtend{}
+				// the body is optional
+				if err := json.NewDecoder(req.Body).Decode(&rc); err != nil && err != io.EOF {
+					return util.MessageResponse(400, "request body not JSON")
+				}
+				return RouteExtend(req.Context(), rt, mux.Vars(req)["id"], &rc)
+			},
+		))),
+	)))
+	router.Path("/deployments/{id}/servers/{hs}/{action:stop|start|pause|unpause}").Methods("POST").Handler(auth(limit(
+		util.WithCORSOptions(util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				vars := mux.Vars(req)
+				return RouteServerAction(req.Context(), rt, vars["id"], vars["hs"], vars["action"])
+			},
+		))),
+	)))
+	router.Path("/deployments/{id}/logs").Methods("GET").Handler(auth(
+		util.WithCORSOptions(func(res http.ResponseWriter, req *http.Request) {
+			RouteLogs(res, req, rt, mux.Vars(req)["id"])
+		}),
+	))
+	router.Path("/events").Methods("GET").Handler(auth(
+		util.WithCORSOptions(func(res http.ResponseWriter, req *http.Request) {
+			RouteEvents(res, req, rt)
+		}),
+	))
+	router.Path("/health").Methods("GET").HandlerFunc(
 		func(res http.ResponseWriter, req *http.Request) {
 			res.WriteHeader(200)
 		},
 	)
-	return mux
+	return router
 }
@@ -2,90 +2,318 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/docker"
 )
 
+// RunningDeployment is a deployment managed by homerunner.
+type RunningDeployment struct {
+	// Unique ID for this deployment, as the same blueprint can be deployed many times.
+	ID string
+	// The name of the tenant which created this deployment, empty if auth is disabled.
+	Owner      string
+	Deployment *docker.Deployment
+	Expires    time.Time
+	timer      *time.Timer
+}
+
 type Runtime struct {
-	Config                *Config
-	mu                    *sync.Mutex
-	BlueprintToDeployment map[string]*docker.Deployment
-	BlueprintToTimer      map[string]*time.Timer
+	Config *Config
+	mu     *sync.Mutex
+	// Deployment ID -> deployment
+	Deployments map[string]*RunningDeployment
+	Events      *EventBroker
+	// Ready deployments to hand out, nil if pooling is disabled.
+	Pool *Pool
+	// Tenant name -> number of deployments currently being created, for enforcing quotas.
+	creating map[string]int
+	// Build name -> lock held whilst building that blueprint, protected by mu.
+	buildLocks map[string]*sync.Mutex
 }
 
+// ErrTooManyDeployments is returned when creating a deployment would exceed the tenant's quota.
+var ErrTooManyDeployments = errors.New("too many deployments")
+
 // NewRuntime makes a homerunner runtime
 func NewRuntime(cfg *Config) (*Runtime, error) {
-	return &Runtime{
-		Config:                cfg,
-		BlueprintToDeployment: make(map[string]*docker.Deployment),
-		BlueprintToTimer:      make(map[string]*time.Timer),
-		mu:                    &sync.Mutex{},
+	rt := &Runtime{
+		Config:      cfg,
+		Deployments: make(map[string]*RunningDeployment),
+		Events:      NewEventBroker(),
+		mu:          &sync.Mutex{},
+		creating:    make(map[string]int),
+		buildLocks:  make(map[string]*sync.Mutex),
+	}
+	if cfg.PoolSize > 0 {
+		rt.Pool = NewPool(rt, cfg.PoolSize, time.Duration(cfg.PoolTTLMins)*time.Minute)
+	}
+	return rt, nil
+}
+
+// newDeploymentID returns a unique ID for a deployment of this blueprint.
+func newDeploymentID(blueprintName string) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return blueprintName + "_" + hex.EncodeToString(b), nil
+}
+
+// reserve counts a deployment being created against the tenant's quota, returning a function to call
+// once it has been created (or failed), or ErrTooManyDeployments if the tenant is at their limit.
+func (r *Runtime) reserve(tenant *Tenant) (release func(), err error) {
+	if tenant == nil || tenant.MaxDeployments <= 0 {
+		return func() {}, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := r.creating[tenant.Name]
+	for _, rd := range r.Deployments {
+		if rd.Owner == tenant.Name {
+			count++
+		}
+	}
+	if count >= tenant.MaxDeployments {
+		return nil, fmt.Errorf("%w: tenant '%s' is limited to %d", ErrTooManyDeployments, tenant.Name, tenant.MaxDeployments)
+	}
+	r.creating[tenant.Name]++
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.creating[tenant.Name]--
 	}, nil
 }
 
-func (r *Runtime) CreateDeployment(imageURI string, blueprint *b.Blueprint) (*docker.Deployment, time.Time, error) {
-	duration := time.Duration(r.Config.HomeserverLifetimeMins) * time.Minute
-	var expires time.Time
+// CreateDeployment deploys the blueprint, building it first if needed. The same blueprint can be deployed
+// any number of times, each with a unique deployment ID. The deployment is owned by the tenant, which
+// may be nil if auth is disabled.
+func (r *Runtime) CreateDeployment(imageURI string, blueprint *b.Blueprint, tenant *Tenant) (RunningDeployment, error) {
 	if blueprint == nil {
-		return nil, expires, fmt.Errorf("blueprint must be supplied")
+		return RunningDeployment{}, fmt.Errorf("blueprint must be supplied")
 	}
-	namespace := "homerunner_" + blueprint.Name
-	cfg := r.Config.DeriveComplementConfig(imageURI)
+	release, err := r.reserve(tenant)
+	if err != nil {
+		return RunningDeployment{}, err
+	}
+	defer release()
+	id, err := newDeploymentID(blueprint.Name)
+	if err != nil {
+		return RunningDeployment{}, fmt.Errorf("CreateDeployment: failed to make deployment ID: %s", err)
+	}
+	r.Events.Publish(EventBuilding, id, blueprint.Name, tenant.Owner(), nil)
+	rd, err := r.createDeployment(id, imageURI, blueprint, tenant)
+	if err != nil {
+		r.Events.Publish(EventFailed, id, blueprint.Name, tenant.Owner(), err)
+		return RunningDeployment{}, err
+	}
+	r.Events.Publish(EventDeployed, id, blueprint.Name, tenant.Owner(), nil)
+	return rd, nil
+}
+
+// CreatePooledDeployment hands out a ready deployment of the blueprint from the pool if there is one,
+// else deploys it like CreateDeployment. The blueprint must always have the same contents for the same
+// name, so in-line blueprints should not be pooled.
+func (r *Runtime) CreatePooledDeployment(imageURI string, blueprint *b.Blueprint, tenant *Tenant) (RunningDeployment, error) {
+	if r.Pool == nil || blueprint == nil {
+		return r.CreateDeployment(imageURI, blueprint, tenant)
+	}
+	release, err := r.reserve(tenant)
+	if err != nil {
+		return RunningDeployment{}, err
+	}
+	pd, ok := r.Pool.Take(imageURI, blueprint)
+	if !ok {
+		release()
+		return r.CreateDeployment(imageURI, blueprint, tenant)
+	}
+	defer release()
+	rd := r.addDeployment(pd.id, pd.deployment, tenant)
+	r.Events.Publish(EventDeployed, pd.id, blueprint.Name, tenant.Owner(), nil)
+	return rd, nil
+}
+
+func (r *Runtime) createDeployment(id, imageURI string, blueprint *b.Blueprint, tenant *Tenant) (RunningDeployment, error) {
+	dep, err := r.deploy(id, imageURI, blueprint)
+	if err != nil {
+		return RunningDeployment{}, err
+	}
+	return r.addDeployment(id, dep, tenant), nil
+}
+
+// buildLock returns the lock to hold whilst building the blueprint with this build name. Containers and
+// images are named after the build name, so this is the only thing which needs to differ between builds.
+func (r *Runtime) buildLock(buildName string) *sync.Mutex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lock, ok := r.buildLocks[buildName]
+	if !ok {
+		lock = &sync.Mutex{}
+		r.buildLocks[buildName] = lock
+	}
+	return lock
+}
+
+// build constructs the blueprint if it has not been built already. The blueprint must be named with
+// its build name. Only one build of each blueprint runs at a time, else concurrent deployments would each
+// build a set of images for the blueprint and clash on container names, and Deploy would then deploy
+// all of them.
+func (r *Runtime) build(cfg *config.Complement, blueprint *b.Blueprint) error {
+	lock := r.buildLock(blueprint.Name)
+	lock.Lock()
+	defer lock.Unlock()
 	builder, err := docker.NewBuilder(cfg)
 	if err != nil {
-		return nil, expires, err
+		return err
+	}
+	return builder.ConstructBlueprintIfNotExist(*blueprint)
+}
+
+// buildName returns the name to build the blueprint under when using this base image. Images are found
+// by blueprint name alone, so blueprints are built under a name which includes every base image they
+// use, else a blueprint built on one image would be handed out to requests for another. Pre-built images
+// ("none") and images built in snapshot mode, which are deployed later by name, use the blueprint name.
+func (r *Runtime) buildName(imageURI string, blueprint *b.Blueprint) string {
+	if imageURI == "none" || r.Config.Snapshot != "" {
+		return blueprint.Name
 	}
-	if err = builder.ConstructBlueprintIfNotExist(*blueprint); err != nil {
-		return nil, expires, fmt.Errorf("CreateDeployment: Failed to construct blueprint: %s", err)
+	h := sha256.New()
+	h.Write([]byte(imageURI))
+	for _, hs := range blueprint.Homeservers {
+		if hs.BaseImageURI != nil {
+			h.Write([]byte("\x00" + hs.Name + "\x00" + *hs.BaseImageURI))
+		}
+	}
+	return blueprint.Name + "_" + hex.EncodeToString(h.Sum(nil)[:4])
+}
+
+// deploy builds the blueprint if needed then deploys it, without adding it to the runtime.
+func (r *Runtime) deploy(id, imageURI string, blueprint *b.Blueprint) (*docker.Deployment, error) {
+	namespace := "homerunner_" + id
+	cfg := r.Config.DeriveComplementConfig(imageURI)
+	bp := *blueprint
+	bp.Name = r.buildName(imageURI, blueprint)
+	if err := r.build(cfg, &bp); err != nil {
+		return nil, fmt.Errorf("CreateDeployment: Failed to construct blueprint: %s", err)
 	}
 	d, err := docker.NewDeployer(namespace, cfg)
 	if err != nil {
-		return nil, expires, fmt.Errorf("CreateDeployment: NewDeployer returned error %s", err)
+		return nil, fmt.Errorf("CreateDeployment: NewDeployer returned error %s", err)
 	}
-	dep, err := d.Deploy(context.Background(), blueprint.Name)
+	// each deployment needs its own network else concurrent deployments of a blueprint will clash
+	d.IsolateNetwork = true
+	dep, err := d.Deploy(context.Background(), bp.Name)
 	if err != nil {
-		return nil, expires, fmt.Errorf("CreateDeployment: Deploy returned error %s", err)
+		return nil, fmt.Errorf("CreateDeployment: Deploy returned error %s", err)
 	}
-	if err := r.addDeployment(blueprint.Name, dep, duration); err != nil {
-		return nil, expires, err
+	// deployments are listed and reported under the requested blueprint name
+	dep.BlueprintName = blueprint.Name
+	return dep, nil
+}
+
+// BaseImages returns the base images which the pre-built images of this blueprint were built from. Images
+// which do not record their base image have an empty base image.
+func (r *Runtime) BaseImages(blueprintName string) ([]string, error) {
+	builder, err := docker.NewBuilder(r.Config.DeriveComplementConfig("none"))
+	if err != nil {
+		return nil, err
 	}
-	return dep, time.Now().Add(duration), nil
+	return builder.BaseImages(blueprintName)
 }
 
-func (r *Runtime) addDeployment(blueprintName string, d *docker.Deployment, duration time.Duration) error {
+func (r *Runtime) addDeployment(id string, d *docker.Deployment, tenant *Tenant) RunningDeployment {
+	duration := time.Duration(r.Config.HomeserverLifetimeMins) * time.Minute
+	if max := tenant.MaxLifetime(r.Config); duration > max {
+		duration = max
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if _, ok := r.BlueprintToDeployment[blueprintName]; ok {
-		return fmt.Errorf("deployment with name %s already exists", blueprintName)
+	rd := &RunningDeployment{
+		ID:         id,
+		Owner:      tenant.Owner(),
+		Deployment: d,
+		Expires:    time.Now().Add(duration),
 	}
-	r.BlueprintToDeployment[blueprintName] = d
-	r.BlueprintToTimer[blueprintName] = time.AfterFunc(duration, func() {
-		logrus.Infof("Blueprint '%s' has expired. Tearing down network.", blueprintName)
-		err := r.DestroyDeployment(blueprintName)
+	rd.timer = time.AfterFunc(duration, func() {
+		logrus.Infof("Deployment '%s' has expired. Tearing down network.", id)
+		r.Events.Publish(EventExpired, id, d.BlueprintName, tenant.Owner(), nil)
+		err := r.DestroyDeployment(id)
 		if err != nil {
-			logrus.WithError(err).Errorf("Failed to tear down expired blueprint '%s'", blueprintName)
+			logrus.WithError(err).Errorf("Failed to tear down expired deployment '%s'", id)
 		}
 	})
-	return nil
+	r.Deployments[id] = rd
+	return *rd
 }
 
-func (r *Runtime) DestroyDeployment(blueprintName string) error {
+func (r *Runtime) DestroyDeployment(id string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	d, ok := r.BlueprintToDeployment[blueprintName]
+	rd, ok := r.Deployments[id]
 	if !ok {
-		return fmt.Errorf("no deployment with name '%s' exists", blueprintName)
+		return fmt.Errorf("no deployment with ID '%s' exists", id)
 	}
-	d.Deployer.Destroy(d, false, "", false)
-	delete(r.BlueprintToDeployment, blueprintName)
-	timer := r.BlueprintToTimer[blueprintName]
-	timer.Stop()
-	delete(r.BlueprintToTimer, blueprintName)
+	rd.Deployment.Deployer.Destroy(rd.Deployment, false, "", false)
+	rd.timer.Stop()
+	delete(r.Deployments, id)
+	r.Events.Publish(EventDestroyed, id, rd.Deployment.BlueprintName, rd.Owner, nil)
 	return nil
 }
+
+// GetDeployment returns the deployment with this ID, or false if it does not exist.
+func (r *Runtime) GetDeployment(id string) (RunningDeployment, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rd, ok := r.Deployments[id]
+	if !ok {
+		return RunningDeployment{}, false
+	}
+	return *rd, true
+}
+
+// DeploymentIDs returns the IDs of all current deployments which the tenant can access, sorted. If
+// blueprintName is not empty, only deployments of that blueprint are returned.
+func (r *Runtime) DeploymentIDs(blueprintName string, tenant *Tenant) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]string, 0, len(r.Deployments))
+	for id, rd := range r.Deployments {
+		if blueprintName != "" && rd.Deployment.BlueprintName != blueprintName {
+			continue
+		}
+		if !tenant.CanAccess(*rd) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ExtendDeployment resets the expiry timer for this deployment so it expires after `duration` from now.
+func (r *Runtime) ExtendDeployment(id string, duration time.Duration) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rd, ok := r.Deployments[id]
+	if !ok {
+		return time.Time{}, fmt.Errorf("no deployment with ID '%s' exists", id)
+	}
+	if !rd.timer.Stop() {
+		// the timer already fired and is waiting on the lock to destroy the deployment
+		return time.Time{}, fmt.Errorf("deployment with ID '%s' has already expired", id)
+	}
+	rd.timer.Reset(duration)
+	rd.Expires = time.Now().Add(duration)
+	return rd.Expires, nil
+}
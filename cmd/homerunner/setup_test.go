@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+func newTestRuntime(t *testing.T) *Runtime {
+	t.Helper()
+	rt, err := NewRuntime(&Config{HomeserverLifetimeMins: 30})
+	if err != nil {
+		t.Fatalf("NewRuntime: %s", err)
+	}
+	return rt
+}
+
+// testDeployment returns a deployment without any homeservers, which can be destroyed without docker.
+func testDeployment() *docker.Deployment {
+	return &docker.Deployment{
+		Deployer:      &docker.Deployer{},
+		BlueprintName: "test_blueprint",
+	}
+}
+
+// addTestDeployment adds a deployment owned by the tenant to the runtime, destroying it at the end of the test.
+func addTestDeployment(t *testing.T, rt *Runtime, id string, tenant *Tenant) RunningDeployment {
+	t.Helper()
+	rd := rt.addDeployment(id, testDeployment(), tenant)
+	t.Cleanup(func() {
+		_ = rt.DestroyDeployment(id)
+	})
+	return rd
+}
+
+func TestExtendDeployment(t *testing.T) {
+	rt := newTestRuntime(t)
+	addTestDeployment(t, rt, "extend", nil)
+	addTestDeployment(t, rt, "expired", nil)
+
+	before := time.Now()
+	expires, err := rt.ExtendDeployment("extend", time.Hour)
+	if err != nil {
+		t.Fatalf("ExtendDeployment returned error: %s", err)
+	}
+	if expires.Before(before.Add(time.Hour)) || expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("got expiry %v, want an hour from now", expires)
+	}
+	if rd, _ := rt.GetDeployment("extend"); !rd.Expires.Equal(expires) {
+		t.Errorf("deployment has expiry %v, want %v", rd.Expires, expires)
+	}
+
+	// make the timer fire, as if the deployment expired just before it was extended
+	fired := make(chan struct{})
+	rt.mu.Lock()
+	rt.Deployments["expired"].timer.Stop()
+	rt.Deployments["expired"].timer = time.AfterFunc(0, func() { close(fired) })
+	rt.mu.Unlock()
+	<-fired
+
+	testCases := []struct {
+		name    string
+		id      string
+		wantErr string
+	}{
+		{"timer already fired", "expired", "has already expired"},
+		{"unknown deployment", "unknown", "no deployment with ID 'unknown' exists"},
+	}
+	for _, tc := range testCases {
+		_, err := rt.ExtendDeployment(tc.id, time.Hour)
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got error %v, want '%s'", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestReserve(t *testing.T) {
+	rt := newTestRuntime(t)
+	limited := &Tenant{Name: "limited", MaxDeployments: 3}
+	other := &Tenant{Name: "other", MaxDeployments: 1}
+	addTestDeployment(t, rt, "limited_1", limited)
+	addTestDeployment(t, rt, "other_1", other)
+
+	// one deployment is running and one is being created
+	release, err := rt.reserve(limited)
+	if err != nil {
+		t.Fatalf("reserve returned error: %s", err)
+	}
+	testCases := []struct {
+		name    string
+		tenant  *Tenant
+		wantErr bool
+	}{
+		{"counts running deployments", other, true},
+		{"counts deployments being created", limited, false}, // now at the limit
+		{"at the limit", limited, true},
+		{"auth disabled", nil, false},
+		{"no limit", &Tenant{Name: "unlimited"}, false},
+	}
+	for _, tc := range testCases {
+		_, err := rt.reserve(tc.tenant)
+		if tc.wantErr != errors.Is(err, ErrTooManyDeployments) {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+
+	// once a creation finishes, its slot can be used again
+	release()
+	if _, err = rt.reserve(limited); err != nil {
+		t.Errorf("reserve after release returned error: %s", err)
+	}
+}
+
+func TestBuildName(t *testing.T) {
+	rt := newTestRuntime(t)
+	other := "complement-dendrite"
+	bp := &b.Blueprint{Name: "one_to_one_room", Homeservers: []b.Homeserver{{Name: "hs1"}, {Name: "hs2"}}}
+	bpOverride := &b.Blueprint{Name: "one_to_one_room", Homeservers: []b.Homeserver{{Name: "hs1"}, {Name: "hs2", BaseImageURI: &other}}}
+
+	synapse := rt.buildName("complement-synapse", bp)
+	if !strings.HasPrefix(synapse, "one_to_one_room_") {
+		t.Errorf("got build name %s, want the blueprint name as a prefix", synapse)
+	}
+	if got := rt.buildName("complement-synapse", bp); got != synapse {
+		t.Errorf("got build name %s then %s, want the same name each time", synapse, got)
+	}
+	testCases := []struct {
+		name     string
+		imageURI string
+		bp       *b.Blueprint
+	}{
+		{"different base image", "complement-dendrite", bp},
+		{"different homeserver base image", "complement-synapse", bpOverride},
+		{"pre-committed image", "none", bp},
+	}
+	for _, tc := range testCases {
+		if got := rt.buildName(tc.imageURI, tc.bp); got == synapse {
+			t.Errorf("%s: got the same build name %s", tc.name, got)
+		}
+	}
+	if got := rt.buildName("none", bp); got != bp.Name {
+		t.Errorf("got build name %s for a pre-committed image, want the blueprint name", got)
+	}
+	rt.Config.Snapshot = "snapshot.json"
+	if got := rt.buildName("complement-synapse", bp); got != bp.Name {
+		t.Errorf("got build name %s in snapshot mode, want the blueprint name", got)
+	}
+}
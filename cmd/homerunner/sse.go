@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/util"
+)
+
+// sseWriter writes Server-Sent Events, see https://html.spec.whatwg.org/multipage/server-sent-events.html
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("streaming is not supported")
+	}
+	util.SetCORSHeaders(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+	return &sseWriter{
+		w:       w,
+		flusher: flusher,
+	}, nil
+}
+
+// Event writes an event with the JSON encoded data. The ID is optional.
+func (s *sseWriter) Event(event, id string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err = fmt.Fprintf(s.w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// KeepAlive writes a comment, which stops proxies from closing idle connections.
+func (s *sseWriter) KeepAlive() error {
+	if _, err := fmt.Fprint(s.w, ": keep-alive\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// writeJSONResponse writes a JSON response for handlers which cannot use util.MakeJSONAPI because
+// they may stream their response instead.
+func writeJSONResponse(w http.ResponseWriter, res util.JSONResponse) {
+	util.SetCORSHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.Code)
+	_ = json.NewEncoder(w).Encode(res.JSON)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	flagImages     = flag.String("images", "", "Required. Comma separated list of complement-compatible homeserver images to test against each other.")
+	flagPackages   = flag.String("packages", "./tests", "Comma separated list of test packages to run for each pair of images.")
+	flagRun        = flag.String("run", "", "Only run tests matching this regular expression, passed to 'go test -run'. E.g 'TestFederation'")
+	flagTags       = flag.String("tags", "", "Build tags to pass to 'go test -tags'.")
+	flagTimeout    = flag.Duration("timeout", time.Hour, "The timeout for running the test packages for a single pair of images.")
+	flagOutputJSON = flag.String("output-json", "interop.json", "Where to write the JSON report.")
+	flagOutputHTML = flag.String("output-html", "interop.html", "Where to write the HTML report.")
+)
+
+const (
+	ResultPass = "pass"
+	ResultFail = "fail"
+	ResultSkip = "skip"
+)
+
+type Report struct {
+	Images   []string
+	Packages []string
+	Run      string
+	Tags     string
+	Pairs    []PairResult
+}
+
+// PairResult is the outcome of running the test packages with hs1 using HS1Image and hs2 using HS2Image.
+type PairResult struct {
+	HS1Image string
+	HS2Image string
+	Duration time.Duration
+	Passed   int
+	Failed   int
+	Skipped  int
+	// Test name (prefixed with the package) -> pass/fail/skip
+	Tests map[string]string
+	// Set if the tests could not be run, e.g due to a build failure or timeout.
+	Error string
+}
+
+func (p PairResult) FailedTests() (failed []string) {
+	for name, result := range p.Tests {
+		if result == ResultFail {
+			failed = append(failed, name)
+		}
+	}
+	sort.Strings(failed)
+	return
+}
+
+// testEvent is a subset of the JSON emitted by 'go test -json', see 'go doc test2json'
+type testEvent struct {
+	Action  string
+	Package string
+	Test    string
+}
+
+func runPair(hs1Image, hs2Image string, packages []string) PairResult {
+	result := PairResult{
+		HS1Image: hs1Image,
+		HS2Image: hs2Image,
+		Tests:    make(map[string]string),
+	}
+	args := []string{"test", "-json", "-count=1", "-timeout", flagTimeout.String()}
+	if *flagRun != "" {
+		args = append(args, "-run", *flagRun)
+	}
+	if *flagTags != "" {
+		args = append(args, "-tags", *flagTags)
+	}
+	args = append(args, packages...)
+	cmd := exec.Command("go", args...)
+	// hs1 and any other servers use the base image, hs2 uses the second image
+	cmd.Env = append(os.Environ(), "COMPLEMENT_BASE_IMAGE="+hs1Image, "COMPLEMENT_BASE_IMAGE_hs2="+hs2Image)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	startTime := time.Now()
+	if err = cmd.Start(); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if err = parseTestEvents(stdout, &result); err != nil {
+		result.Error = err.Error()
+	}
+	// go test exits non-zero if any test fails, which is reported per-test, so only report the exit
+	// code if no tests ran at all.
+	if err = cmd.Wait(); err != nil && len(result.Tests) == 0 && result.Error == "" {
+		result.Error = fmt.Sprintf("go test failed without running any tests: %s", err)
+	}
+	result.Duration = time.Since(startTime)
+	return result
+}
+
+// parseTestEvents records the result of each test in the 'go test -json' stream. Only leaf tests are
+// counted, as a parent test passes or fails along with its subtests. A parent which fails without a
+// failing subtest, e.g because it failed before running them, is counted as a failure in its own right.
+func parseTestEvents(r io.Reader, result *PairResult) error {
+	results := make(map[string]string) // test name -> pass/fail/skip
+	parents := make(map[string]bool)   // names of tests with subtests
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var ev testEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			// not a test event e.g build output
+			continue
+		}
+		if ev.Test == "" {
+			continue
+		}
+		name := ev.Package + " " + ev.Test
+		switch ev.Action {
+		case "pass":
+			results[name] = ResultPass
+		case "fail":
+			results[name] = ResultFail
+		case "skip":
+			results[name] = ResultSkip
+		default:
+			continue
+		}
+		for i := range ev.Test {
+			if ev.Test[i] == '/' {
+				parents[ev.Package+" "+ev.Test[:i]] = true
+			}
+		}
+	}
+	failedSubtest := make(map[string]bool) // parent name -> true if any of its subtests failed
+	for name, res := range results {
+		if res != ResultFail {
+			continue
+		}
+		// package paths contain slashes too, so only look in the test name
+		for i := strings.Index(name, " "); i < len(name); i++ {
+			if name[i] == '/' {
+				failedSubtest[name[:i]] = true
+			}
+		}
+	}
+	for name, res := range results {
+		if parents[name] && (res != ResultFail || failedSubtest[name]) {
+			continue
+		}
+		result.Tests[name] = res
+		switch res {
+		case ResultPass:
+			result.Passed++
+		case ResultFail:
+			result.Failed++
+		case ResultSkip:
+			result.Skipped++
+		}
+	}
+	return scanner.Err()
+}
+
+var htmlReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"pair": func(r Report, hs1Image, hs2Image string) *PairResult {
+		for i := range r.Pairs {
+			if r.Pairs[i].HS1Image == hs1Image && r.Pairs[i].HS2Image == hs2Image {
+				return &r.Pairs[i]
+			}
+		}
+		return nil
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Complement interop matrix</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #999; padding: 6px; vertical-align: top; }
+td.pass { background: #c8f7c5; }
+td.fail { background: #f7c5c5; }
+td.error { background: #ddd; }
+ul { margin: 4px 0; padding-left: 16px; font-size: 0.8em; }
+</style>
+</head>
+<body>
+<h1>Complement interop matrix</h1>
+<p>Packages: {{range .Packages}}<code>{{.}}</code> {{end}}{{if .Run}}<br>Run: <code>{{.Run}}</code>{{end}}{{if .Tags}}<br>Tags: <code>{{.Tags}}</code>{{end}}</p>
+<table>
+<tr><th>hs1 \ hs2</th>{{range .Images}}<th>{{.}}</th>{{end}}</tr>
+{{$report := .}}{{range $hs1 := .Images}}<tr><th>{{$hs1}}</th>{{range $hs2 := $report.Images}}{{with pair $report $hs1 $hs2}}{{if .Error}}<td class="error">error: {{.Error}}</td>{{else}}<td class="{{if .Failed}}fail{{else}}pass{{end}}">
+{{.Passed}} passed, {{.Failed}} failed, {{.Skipped}} skipped
+{{with .FailedTests}}<ul>{{range .}}<li>{{.}}</li>{{end}}</ul>{{end}}
+</td>{{end}}{{else}}<td></td>{{end}}{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func writeReports(report Report) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(*flagOutputJSON, b, 0644); err != nil {
+		return err
+	}
+	f, err := os.Create(*flagOutputHTML)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return htmlReport.Execute(f, report)
+}
+
+func splitList(s string) (list []string) {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
+
+func main() {
+	flag.Parse()
+	images := splitList(*flagImages)
+	packages := splitList(*flagPackages)
+	if len(images) == 0 || len(packages) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	report := Report{
+		Images:   images,
+		Packages: packages,
+		Run:      *flagRun,
+		Tags:     *flagTags,
+	}
+	failed := false
+	for _, hs1Image := range images {
+		for _, hs2Image := range images {
+			log.Printf("Running hs1=%s hs2=%s", hs1Image, hs2Image)
+			res := runPair(hs1Image, hs2Image, packages)
+			log.Printf("hs1=%s hs2=%s : %d passed, %d failed, %d skipped in %v %s", hs1Image, hs2Image, res.Passed, res.Failed, res.Skipped, res.Duration, res.Error)
+			if res.Failed > 0 || res.Error != "" {
+				failed = true
+			}
+			report.Pairs = append(report.Pairs, res)
+			// write as we go so partial results are available for long runs
+			if err := writeReports(report); err != nil {
+				log.Fatalf("failed to write reports: %s", err)
+			}
+		}
+	}
+	fmt.Printf("Output to %s and %s\n", *flagOutputJSON, *flagOutputHTML)
+	if failed {
+		os.Exit(1)
+	}
+}
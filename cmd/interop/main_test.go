@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseTestEvents(t *testing.T) {
+	// captured from 'go test -json' on a package with subtests, see the Test fields for the structure
+	f, err := os.Open("testdata/go_test.json")
+	if err != nil {
+		t.Fatalf("failed to open fixture: %s", err)
+	}
+	defer f.Close()
+	result := PairResult{Tests: make(map[string]string)}
+	if err = parseTestEvents(f, &result); err != nil {
+		t.Fatalf("parseTestEvents returned error: %s", err)
+	}
+	if result.Passed != 4 || result.Failed != 2 || result.Skipped != 2 {
+		t.Errorf("got %d passed, %d failed, %d skipped, want 4 passed, 2 failed, 2 skipped", result.Passed, result.Failed, result.Skipped)
+	}
+	const pkg = "github.com/matrix-org/complement/tests "
+	want := map[string]string{
+		pkg + "TestPasses":                     ResultPass,
+		pkg + "TestSkipped":                    ResultSkip,
+		pkg + "TestWithSubtests/passes":        ResultPass,
+		pkg + "TestWithSubtests/fails":         ResultFail,
+		pkg + "TestWithSubtests/skipped":       ResultSkip,
+		pkg + "TestWithSubtests/nested/passes": ResultPass,
+		pkg + "TestParentFailsItself/passes":   ResultPass,
+		// fails without a failing subtest, so it is counted itself
+		pkg + "TestParentFailsItself": ResultFail,
+	}
+	for name, res := range want {
+		if result.Tests[name] != res {
+			t.Errorf("%s: got %q want %q", name, result.Tests[name], res)
+		}
+	}
+	for name := range result.Tests {
+		if _, ok := want[name]; !ok {
+			t.Errorf("unexpected test %s: parent tests whose subtests were counted must not be", name)
+		}
+	}
+}
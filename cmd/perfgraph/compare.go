@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// metric is a number extracted from a snapshot which can be compared between runs. Higher is worse.
+type metric struct {
+	Name string
+	Unit string
+	// The value of this metric for the snapshot. prev is the previous snapshot for the same homeserver in the
+	// same run, or nil, for metrics which are cumulative counters.
+	Value func(s, prev *Snapshot) float64
+}
+
+// delta returns a function which returns how much a counter increased during the span.
+func delta(counter func(s *Snapshot) float64) func(s, prev *Snapshot) float64 {
+	return func(s, prev *Snapshot) float64 {
+		if prev == nil {
+			return counter(s)
+		}
+		return counter(s) - counter(prev)
+	}
+}
+
+var metrics = []metric{
+	{"duration", "ms", func(s, _ *Snapshot) float64 { return float64(s.Duration) / float64(time.Millisecond) }},
+	{"cpu", "ms", delta(func(s *Snapshot) float64 { return float64(s.CPUKernel+s.CPUUserland) / float64(time.Millisecond) })},
+	{"memory", "MB", func(s, _ *Snapshot) float64 { return float64(s.MemoryUsage) / 1024 / 1024 }},
+	{"net_tx", "KB", delta(func(s *Snapshot) float64 { return float64(s.TxBytes) / 1024 })},
+	{"net_rx", "KB", delta(func(s *Snapshot) float64 { return float64(s.RxBytes) / 1024 })},
+	{"p50", "ms", func(s, _ *Snapshot) float64 { return float64(s.RequestLatency.P50) / float64(time.Millisecond) }},
+	{"p90", "ms", func(s, _ *Snapshot) float64 { return float64(s.RequestLatency.P90) / float64(time.Millisecond) }},
+	{"p99", "ms", func(s, _ *Snapshot) float64 { return float64(s.RequestLatency.P99) / float64(time.Millisecond) }},
+}
+
+// Comparison is the result of comparing one metric for one span between the baseline and another run.
+type Comparison struct {
+	Run      string
+	Scenario string
+	Span     string
+	HSName   string
+	Metric   string
+	Unit     string
+	Baseline float64
+	Value    float64
+	// The percentage change from the baseline, positive if it got worse. 0 if the baseline is 0, in which
+	// case any increase is a regression if there is a threshold.
+	ChangePercent float64
+	// The percentage increase allowed, or nil if this metric is not checked.
+	Threshold *float64 `json:",omitempty"`
+	Regressed bool
+}
+
+// CompareResults is the machine-readable output of compare mode.
+type CompareResults struct {
+	Baseline    string
+	Comparisons []Comparison
+	// Spans in the baseline which are missing in a run, as "run: scenario/span (hs)". These are regressions
+	// unless missing spans are allowed.
+	Missing   []string
+	Regressed bool
+}
+
+// parseThresholds parses "metric=percent,..." e.g "cpu=10,p99=10"
+func parseThresholds(in string) (map[string]float64, error) {
+	thresholds := make(map[string]float64)
+	if in == "" {
+		return thresholds, nil
+	}
+	for _, kv := range strings.Split(in, ",") {
+		name, val, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("threshold '%s' must be of the form metric=percent", kv)
+		}
+		known := false
+		for _, m := range metrics {
+			known = known || m.Name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown metric '%s' in threshold '%s'", name, kv)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(val, "%"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("threshold '%s' has an invalid percentage: %s", kv, err)
+		}
+		thresholds[name] = percent
+	}
+	return thresholds, nil
+}
+
+type spanKey struct {
+	scenario string
+	span     string
+	hsName   string
+}
+
+// spanValues returns the value of every metric for every span in the run.
+func spanValues(run PerfRun) (keys []spanKey, values map[spanKey]map[string]float64) {
+	values = make(map[spanKey]map[string]float64)
+	prev := make(map[string]*Snapshot) // scenario/hs -> previous snapshot
+	for i := range run.Snapshots {
+		s := &run.Snapshots[i]
+		key := spanKey{s.Scenario, s.Name, s.HSName}
+		vals := make(map[string]float64)
+		for _, m := range metrics {
+			vals[m.Name] = m.Value(s, prev[s.Scenario+"/"+s.HSName])
+		}
+		prev[s.Scenario+"/"+s.HSName] = s
+		if _, exists := values[key]; !exists {
+			keys = append(keys, key)
+		}
+		values[key] = vals
+	}
+	return keys, values
+}
+
+// compareRuns compares every run after the first against the first. If allowMissing is false, a span in the
+// baseline which is missing from a run is a regression, as its metrics cannot be checked.
+func compareRuns(runs []PerfRun, thresholds map[string]float64, allowMissing bool) CompareResults {
+	results := CompareResults{
+		Baseline: runs[0].Name,
+	}
+	baseKeys, baseValues := spanValues(runs[0])
+	for _, run := range runs[1:] {
+		_, values := spanValues(run)
+		for _, key := range baseKeys {
+			vals, ok := values[key]
+			if !ok {
+				results.Missing = append(results.Missing, fmt.Sprintf("%s: %s/%s (%s)", run.Name, key.scenario, key.span, key.hsName))
+				results.Regressed = results.Regressed || !allowMissing
+				continue
+			}
+			for _, m := range metrics {
+				c := Comparison{
+					Run:      run.Name,
+					Scenario: key.scenario,
+					Span:     key.span,
+					HSName:   key.hsName,
+					Metric:   m.Name,
+					Unit:     m.Unit,
+					Baseline: baseValues[key][m.Name],
+					Value:    vals[m.Name],
+				}
+				if c.Baseline != 0 {
+					c.ChangePercent = 100 * (c.Value - c.Baseline) / c.Baseline
+				}
+				if threshold, ok := thresholds[m.Name]; ok {
+					c.Threshold = &threshold
+					c.Regressed = c.ChangePercent > threshold || (c.Baseline == 0 && c.Value > 0)
+				}
+				results.Regressed = results.Regressed || c.Regressed
+				results.Comparisons = append(results.Comparisons, c)
+			}
+		}
+	}
+	return results
+}
+
+// printComparisons prints a table of the comparisons. If all is false, only metrics with thresholds are printed.
+func printComparisons(results CompareResults, all bool) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "RUN\tSPAN\tHS\tMETRIC\tBASELINE\tVALUE\tCHANGE\tTHRESHOLD\tSTATUS\n")
+	comparisons := append([]Comparison{}, results.Comparisons...)
+	sort.SliceStable(comparisons, func(i, j int) bool {
+		// regressions first
+		return comparisons[i].Regressed && !comparisons[j].Regressed
+	})
+	for _, c := range comparisons {
+		if c.Threshold == nil && !all {
+			continue
+		}
+		threshold := "-"
+		status := ""
+		if c.Threshold != nil {
+			threshold = fmt.Sprintf("+%.1f%%", *c.Threshold)
+			status = "ok"
+			if c.Regressed {
+				status = "REGRESSED"
+			}
+		}
+		span := c.Span
+		if c.Scenario != "" {
+			span = c.Scenario + "/" + c.Span
+		}
+		change := fmt.Sprintf("%+.1f%%", c.ChangePercent)
+		if c.Baseline == 0 && c.Value > 0 {
+			change = "new"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.2f%s\t%.2f%s\t%s\t%s\t%s\n",
+			c.Run, span, c.HSName, c.Metric, c.Baseline, c.Unit, c.Value, c.Unit, change, threshold, status)
+	}
+	tw.Flush()
+	for _, missing := range results.Missing {
+		fmt.Printf("missing span %s\n", missing)
+	}
+}
+
+// runCompare compares the runs against the first run, returning the process exit code: 1 if there was a
+// regression, else 0.
+func runCompare(runs []PerfRun, thresholdsFlag, resultsFile string, all, allowMissing bool) int {
+	if len(runs) < 2 {
+		fmt.Println("compare mode needs a baseline and at least one other run")
+		return 2
+	}
+	thresholds, err := parseThresholds(thresholdsFlag)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	results := compareRuns(runs, thresholds, allowMissing)
+	printComparisons(results, all)
+	if resultsFile != "" {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			fmt.Printf("failed to marshal results: %s\n", err)
+			return 2
+		}
+		if err = os.WriteFile(resultsFile, b, 0644); err != nil {
+			fmt.Printf("failed to write results: %s\n", err)
+			return 2
+		}
+	}
+	if results.Regressed {
+		fmt.Printf("Performance regressed compared to baseline '%s'\n", results.Baseline)
+		return 1
+	}
+	fmt.Printf("No regressions compared to baseline '%s'\n", results.Baseline)
+	return 0
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseThresholds(t *testing.T) {
+	testCases := []struct {
+		in      string
+		want    map[string]float64
+		wantErr string
+	}{
+		{in: "", want: map[string]float64{}},
+		{in: "cpu=10", want: map[string]float64{"cpu": 10}},
+		{in: "cpu=10, p99=2.5%", want: map[string]float64{"cpu": 10, "p99": 2.5}},
+		{in: "cpu", wantErr: "must be of the form metric=percent"},
+		{in: "disk=10", wantErr: "unknown metric 'disk'"},
+		{in: "cpu=lots", wantErr: "invalid percentage"},
+	}
+	for _, tc := range testCases {
+		got, err := parseThresholds(tc.in)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%q: got error %v want '%s'", tc.in, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.in, err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%q: got %v want %v", tc.in, got, tc.want)
+			continue
+		}
+		for k, v := range tc.want {
+			if got[k] != v {
+				t.Errorf("%q: got %v want %v", tc.in, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestSpanValues(t *testing.T) {
+	ms := uint64(time.Millisecond)
+	run := PerfRun{Snapshots: []Snapshot{
+		{Scenario: "s", Name: "setup", HSName: "hs1", Duration: 2 * time.Second, CPUUserland: 100 * ms, TxBytes: 1024, MemoryUsage: 1024 * 1024},
+		{Scenario: "s", Name: "setup", HSName: "hs2", CPUUserland: 50 * ms},
+		{Scenario: "s", Name: "sync", HSName: "hs1", CPUUserland: 250 * ms, CPUKernel: 50 * ms, TxBytes: 3072, MemoryUsage: 2 * 1024 * 1024},
+		// a new scenario starts a new deployment, so counters are not deltas from the previous scenario
+		{Scenario: "t", Name: "setup", HSName: "hs1", CPUUserland: 10 * ms},
+	}}
+	keys, values := spanValues(run)
+	wantKeys := []spanKey{{"s", "setup", "hs1"}, {"s", "setup", "hs2"}, {"s", "sync", "hs1"}, {"t", "setup", "hs1"}}
+	if len(keys) != len(wantKeys) {
+		t.Fatalf("got keys %v want %v", keys, wantKeys)
+	}
+	for i := range wantKeys {
+		if keys[i] != wantKeys[i] {
+			t.Errorf("key %d: got %v want %v", i, keys[i], wantKeys[i])
+		}
+	}
+	testCases := []struct {
+		key    spanKey
+		metric string
+		want   float64
+	}{
+		{wantKeys[0], "duration", 2000},
+		{wantKeys[0], "cpu", 100},
+		{wantKeys[0], "net_tx", 1},
+		{wantKeys[0], "memory", 1},
+		{wantKeys[1], "cpu", 50},
+		{wantKeys[2], "cpu", 200},
+		{wantKeys[2], "net_tx", 2},
+		{wantKeys[2], "memory", 2},
+		{wantKeys[3], "cpu", 10},
+	}
+	for _, tc := range testCases {
+		if got := values[tc.key][tc.metric]; got != tc.want {
+			t.Errorf("%v %s: got %v want %v", tc.key, tc.metric, got, tc.want)
+		}
+	}
+}
+
+func TestCompareRuns(t *testing.T) {
+	// each span is on its own homeserver so the counters are not deltas from the previous span
+	snapshot := func(name string, cpuMs, txKB int) Snapshot {
+		return Snapshot{Name: name, HSName: "hs_" + name, CPUUserland: uint64(cpuMs) * uint64(time.Millisecond), TxBytes: int64(txKB) * 1024}
+	}
+	baseline := PerfRun{Name: "base", Snapshots: []Snapshot{snapshot("a", 100, 0), snapshot("b", 200, 10)}}
+	testCases := []struct {
+		name          string
+		snapshots     []Snapshot
+		allowMissing  bool
+		wantRegressed map[string]bool // span/metric -> regressed
+		wantMissing   int
+		// whether the missing spans are a regression
+		wantMissingRegressed bool
+	}{
+		{
+			name:          "within threshold",
+			snapshots:     []Snapshot{snapshot("a", 105, 0), snapshot("b", 220, 10)},
+			wantRegressed: map[string]bool{"a/cpu": false, "b/cpu": false, "a/net_tx": false},
+		},
+		{
+			name:          "over threshold",
+			snapshots:     []Snapshot{snapshot("a", 115, 0), snapshot("b", 210, 10)},
+			wantRegressed: map[string]bool{"a/cpu": true, "b/cpu": false},
+		},
+		{
+			name:          "increase from 0",
+			snapshots:     []Snapshot{snapshot("a", 100, 1), snapshot("b", 200, 11)},
+			wantRegressed: map[string]bool{"a/net_tx": true, "b/net_tx": false},
+		},
+		{
+			name:          "improvements are not regressions",
+			snapshots:     []Snapshot{snapshot("a", 10, 0), snapshot("b", 20, 10)},
+			wantRegressed: map[string]bool{"a/cpu": false, "b/cpu": false},
+		},
+		{
+			name:                 "missing span",
+			snapshots:            []Snapshot{snapshot("a", 100, 0)},
+			wantRegressed:        map[string]bool{"a/cpu": false},
+			wantMissing:          1,
+			wantMissingRegressed: true,
+		},
+		{
+			name:          "allowed missing span",
+			snapshots:     []Snapshot{snapshot("a", 100, 0)},
+			allowMissing:  true,
+			wantRegressed: map[string]bool{"a/cpu": false},
+			wantMissing:   1,
+		},
+	}
+	thresholds := map[string]float64{"cpu": 10, "net_tx": 10}
+	for _, tc := range testCases {
+		results := compareRuns([]PerfRun{baseline, {Name: "candidate", Snapshots: tc.snapshots}}, thresholds, tc.allowMissing)
+		got := make(map[string]Comparison)
+		for _, c := range results.Comparisons {
+			got[c.Span+"/"+c.Metric] = c
+		}
+		anyRegressed := false
+		for key, want := range tc.wantRegressed {
+			c, ok := got[key]
+			if !ok {
+				t.Errorf("%s: no comparison for %s", tc.name, key)
+				continue
+			}
+			if c.Regressed != want {
+				t.Errorf("%s: %s: got regressed %v want %v (%+v)", tc.name, key, c.Regressed, want, c)
+			}
+			anyRegressed = anyRegressed || want
+		}
+		anyRegressed = anyRegressed || tc.wantMissingRegressed
+		if results.Regressed != anyRegressed {
+			t.Errorf("%s: got overall regressed %v want %v", tc.name, results.Regressed, anyRegressed)
+		}
+		if len(results.Missing) != tc.wantMissing {
+			t.Errorf("%s: got missing %v want %d", tc.name, results.Missing, tc.wantMissing)
+		}
+		if c := got["a/memory"]; c.Threshold != nil || c.Regressed {
+			t.Errorf("%s: metrics without a threshold must not be checked: %+v", tc.name, c)
+		}
+	}
+}
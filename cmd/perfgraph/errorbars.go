@@ -0,0 +1,43 @@
+package main
+
+import (
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/font"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// barErrors draws vertical error bars over a bar chart with nominal X values. plotter.YErrorBars can't be used
+// as it has no way to offset the bars within a group.
+type barErrors struct {
+	values []float64
+	errs   []float64
+	offset font.Length
+	style  draw.LineStyle
+	cap    vg.Length
+}
+
+func (e *barErrors) Plot(c draw.Canvas, p *plot.Plot) {
+	trX, trY := p.Transforms(&c)
+	for i, v := range e.values {
+		if e.errs[i] == 0 {
+			continue
+		}
+		x := trX(float64(i)) + e.offset
+		lo, hi := trY(v-e.errs[i]), trY(v+e.errs[i])
+		c.StrokeLine2(e.style, x, lo, x, hi)
+		c.StrokeLine2(e.style, x-e.cap/2, lo, x+e.cap/2, lo)
+		c.StrokeLine2(e.style, x-e.cap/2, hi, x+e.cap/2, hi)
+	}
+}
+
+// DataRange makes sure the top of the error bars is on the graph.
+func (e *barErrors) DataRange() (xmin, xmax, ymin, ymax float64) {
+	xmax = float64(len(e.values) - 1)
+	for i, v := range e.values {
+		if v+e.errs[i] > ymax {
+			ymax = v + e.errs[i]
+		}
+	}
+	return 0, xmax, 0, ymax
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportColumn is a value exported for every span. Values are in base units (seconds, bytes) as is the
+// convention for Prometheus.
+type exportColumn struct {
+	// The CSV column name
+	Name string
+	// The metric family name, and the quantile label if this is a latency percentile
+	Family   string
+	Quantile string
+	Help     string
+	Value    func(s, prev *Snapshot) float64
+}
+
+func latencyColumn(name, quantile string, value func(l EndpointLatency) time.Duration) exportColumn {
+	return exportColumn{
+		Name:     name,
+		Family:   "complement_perf_span_request_latency_seconds",
+		Quantile: quantile,
+		Help:     "Client-observed latency of all requests made during the span.",
+		Value:    func(s, _ *Snapshot) float64 { return value(s.RequestLatency).Seconds() },
+	}
+}
+
+var exportColumns = []exportColumn{
+	{"duration_seconds", "complement_perf_span_duration_seconds", "", "How long the span took.",
+		func(s, _ *Snapshot) float64 { return s.Duration.Seconds() }},
+	{"cpu_seconds", "complement_perf_span_cpu_seconds", "", "User and kernel CPU time used by the homeserver during the span.",
+		delta(func(s *Snapshot) float64 { return time.Duration(s.CPUUserland + s.CPUKernel).Seconds() })},
+	{"memory_bytes", "complement_perf_span_memory_bytes", "", "Memory used by the homeserver at the end of the span.",
+		func(s, _ *Snapshot) float64 { return float64(s.MemoryUsage) }},
+	{"network_transmit_bytes", "complement_perf_span_network_transmit_bytes", "", "Bytes sent by the homeserver during the span.",
+		delta(func(s *Snapshot) float64 { return float64(s.TxBytes) })},
+	{"network_receive_bytes", "complement_perf_span_network_receive_bytes", "", "Bytes received by the homeserver during the span.",
+		delta(func(s *Snapshot) float64 { return float64(s.RxBytes) })},
+	{"requests", "complement_perf_span_requests", "", "The number of requests made to the homeserver during the span.",
+		func(s, _ *Snapshot) float64 { return float64(s.RequestLatency.Count) }},
+	latencyColumn("p50_seconds", "0.5", func(l EndpointLatency) time.Duration { return l.P50 }),
+	latencyColumn("p90_seconds", "0.9", func(l EndpointLatency) time.Duration { return l.P90 }),
+	latencyColumn("p99_seconds", "0.99", func(l EndpointLatency) time.Duration { return l.P99 }),
+	latencyColumn("max_seconds", "1", func(l EndpointLatency) time.Duration { return l.Max }),
+}
+
+// exportRow is the values of every export column for one span of one homeserver.
+type exportRow struct {
+	Run      string
+	Scenario string
+	Span     string
+	HSName   string
+	Values   []float64
+}
+
+func exportRows(runs []PerfRun) []exportRow {
+	var rows []exportRow
+	for _, run := range runs {
+		prev := make(map[string]*Snapshot) // scenario/hs -> previous snapshot
+		for i := range run.Snapshots {
+			s := &run.Snapshots[i]
+			row := exportRow{
+				Run:      run.Name,
+				Scenario: s.Scenario,
+				Span:     s.Name,
+				HSName:   s.HSName,
+			}
+			for _, col := range exportColumns {
+				row.Values = append(row.Values, col.Value(s, prev[s.Scenario+"/"+s.HSName]))
+			}
+			prev[s.Scenario+"/"+s.HSName] = s
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// writeCSV writes a row per span and homeserver.
+func writeCSV(w io.Writer, runs []PerfRun) error {
+	cw := csv.NewWriter(w)
+	header := []string{"run", "scenario", "span", "hs"}
+	for _, col := range exportColumns {
+		header = append(header, col.Name)
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, row := range exportRows(runs) {
+		record := []string{row.Run, row.Scenario, row.Span, row.HSName}
+		for _, v := range row.Values {
+			record = append(record, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeMetrics writes every metric as a gauge labelled with the run, scenario, span and homeserver. If openMetrics
+// is true the OpenMetrics text format is written, else the Prometheus text format, which is what Pushgateway accepts.
+// These only differ in the terminating "# EOF".
+func writeMetrics(w io.Writer, runs []PerfRun, openMetrics bool) error {
+	rows := exportRows(runs)
+	var buf bytes.Buffer
+	seen := make(map[string]bool)
+	for i, col := range exportColumns {
+		if !seen[col.Family] {
+			seen[col.Family] = true
+			fmt.Fprintf(&buf, "# TYPE %s gauge\n# HELP %s %s\n", col.Family, col.Family, col.Help)
+		}
+		for _, row := range rows {
+			labels := fmt.Sprintf(`run="%s",scenario="%s",span="%s",hs="%s"`,
+				escapeLabel(row.Run), escapeLabel(row.Scenario), escapeLabel(row.Span), escapeLabel(row.HSName))
+			if col.Quantile != "" {
+				labels += fmt.Sprintf(`,quantile="%s"`, col.Quantile)
+			}
+			fmt.Fprintf(&buf, "%s{%s} %s\n", col.Family, labels, strconv.FormatFloat(row.Values[i], 'g', -1, 64))
+		}
+	}
+	if openMetrics {
+		buf.WriteString("# EOF\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// pushMetrics replaces the metrics for the job on a Pushgateway-compatible endpoint, e.g http://localhost:9091
+func pushMetrics(gatewayURL, job string, runs []PerfRun) error {
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, runs, false); err != nil {
+		return err
+	}
+	u := strings.TrimSuffix(gatewayURL, "/") + "/metrics/job/" + url.PathEscape(job)
+	req, err := http.NewRequest("PUT", u, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	res, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push metrics to %s: %w", u, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("failed to push metrics to %s: HTTP %d %s", u, res.StatusCode, string(body))
+	}
+	return nil
+}
+
+// runExport writes the runs in the given format to the file, or stdout, and/or pushes them, returning the process
+// exit code.
+func runExport(runs []PerfRun, format, filename, pushURL, pushJob string) int {
+	if format != "" {
+		var out io.Writer = os.Stdout
+		if filename != "" {
+			f, err := os.Create(filename)
+			if err != nil {
+				fmt.Printf("failed to create %s: %s\n", filename, err)
+				return 2
+			}
+			defer f.Close()
+			out = f
+		}
+		var err error
+		switch format {
+		case "csv":
+			err = writeCSV(out, runs)
+		case "openmetrics":
+			err = writeMetrics(out, runs, true)
+		default:
+			err = fmt.Errorf("unknown export format '%s', must be 'openmetrics' or 'csv'", format)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+	if pushURL != "" {
+		if err := pushMetrics(pushURL, pushJob, runs); err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+	return 0
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+var flagUpdate = flag.Bool("update", false, "Update the golden files in testdata")
+
+func exportTestRuns() []PerfRun {
+	return []PerfRun{{
+		Name: `run "1"`,
+		Snapshots: []Snapshot{
+			{
+				Scenario: "sync", Name: "setup", HSName: "hs1",
+				Duration: 1500 * time.Millisecond, CPUUserland: uint64(200 * time.Millisecond), CPUKernel: uint64(50 * time.Millisecond),
+				MemoryUsage: 1048576, TxBytes: 1000, RxBytes: 2000,
+				RequestLatency: EndpointLatency{Count: 4, P50: 10 * time.Millisecond, P90: 20 * time.Millisecond, P99: 30 * time.Millisecond, Max: 40 * time.Millisecond},
+			},
+			{
+				// counters are cumulative, so this span used 250ms of CPU and sent 500 bytes
+				Scenario: "sync", Name: "initial\nsync", HSName: "hs1",
+				Duration: 2 * time.Second, CPUUserland: uint64(400 * time.Millisecond), CPUKernel: uint64(100 * time.Millisecond),
+				MemoryUsage: 2097152, TxBytes: 1500, RxBytes: 2000,
+				RequestLatency: EndpointLatency{Count: 1, P50: 5 * time.Millisecond, P90: 5 * time.Millisecond, P99: 5 * time.Millisecond, Max: 5 * time.Millisecond},
+			},
+		},
+	}}
+}
+
+// checkGolden compares the output against the golden file, or updates it with -update.
+func checkGolden(t *testing.T, filename string, got []byte) {
+	t.Helper()
+	if *flagUpdate {
+		if err := os.WriteFile(filename, got, 0644); err != nil {
+			t.Fatalf("failed to update %s: %s", filename, err)
+		}
+	}
+	want, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", filename, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output does not match %s, run with -update if this is expected. Got:\n%s", filename, string(got))
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeCSV(&buf, exportTestRuns()); err != nil {
+		t.Fatalf("writeCSV returned error: %s", err)
+	}
+	checkGolden(t, "testdata/export.csv", buf.Bytes())
+}
+
+func TestWriteMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, exportTestRuns(), true); err != nil {
+		t.Fatalf("writeMetrics returned error: %s", err)
+	}
+	checkGolden(t, "testdata/export.openmetrics", buf.Bytes())
+
+	var prom bytes.Buffer
+	if err := writeMetrics(&prom, exportTestRuns(), false); err != nil {
+		t.Fatalf("writeMetrics returned error: %s", err)
+	}
+	if !bytes.Equal(append(prom.Bytes(), "# EOF\n"...), buf.Bytes()) {
+		t.Errorf("the Prometheus format must only differ from OpenMetrics by the terminating # EOF")
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	var gotMethod, gotPath, gotContentType string
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotMethod, gotPath, gotContentType = req.Method, req.URL.EscapedPath(), req.Header.Get("Content-Type")
+		gotBody, _ = io.ReadAll(req.Body)
+	}))
+	defer srv.Close()
+	if err := pushMetrics(srv.URL+"/", "perf tests", exportTestRuns()); err != nil {
+		t.Fatalf("pushMetrics returned error: %s", err)
+	}
+	if gotMethod != "PUT" || gotPath != "/metrics/job/perf%20tests" || gotContentType != "text/plain; version=0.0.4" {
+		t.Errorf("got %s %s with Content-Type %s", gotMethod, gotPath, gotContentType)
+	}
+	if bytes.Contains(gotBody, []byte("# EOF")) {
+		t.Errorf("pushed metrics must be in the Prometheus format")
+	}
+}
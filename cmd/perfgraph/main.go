@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"gonum.org/v1/plot"
@@ -14,15 +15,29 @@ import (
 	"gonum.org/v1/plot/vg"
 )
 
+var (
+	flagCompare      = flag.Bool("compare", false, "Compare runs against the first run instead of drawing graphs, exiting with 1 if any regressed.")
+	flagThresholds   = flag.String("thresholds", "cpu=10,p99=10", "In compare mode, the percentage increase in a metric which is a regression, as metric=percent,...\nMetrics: duration, cpu, memory, net_tx, net_rx, p50, p90, p99.")
+	flagResults      = flag.String("results", "", "In compare mode, also write the results as JSON to this file.")
+	flagAll          = flag.Bool("all", false, "In compare mode, print all metrics, not just those with thresholds.")
+	flagAllowMissing = flag.Bool("allow-missing", false, "In compare mode, don't treat spans in the baseline which are missing from a run as a regression.")
+	flagExport       = flag.String("export", "", "Export the runs as 'openmetrics' or 'csv' instead of drawing graphs.")
+	flagExportFile   = flag.String("export-file", "", "The file to export to. Defaults to stdout.")
+	flagPush         = flag.String("push", "", "Push the runs as metrics to this Pushgateway-compatible URL instead of drawing graphs, e.g http://localhost:9091")
+	flagPushJob      = flag.String("push-job", "complement_perftest", "The job name to push metrics under.")
+)
+
 // TODO: remove duplication
 type Output struct {
 	Name      string
 	Snapshots []Snapshot
 	Seed      int64
 	BaseImage string
+	Timelines []Timeline
 }
 
 type Snapshot struct {
+	Scenario    string
 	Name        string
 	Description string
 	HSName      string
@@ -32,10 +47,42 @@ type Snapshot struct {
 	CPUKernel   uint64
 	TxBytes     int64
 	RxBytes     int64
+	// The latency of all requests during the span, then per endpoint.
+	RequestLatency EndpointLatency
+	Latencies      []EndpointLatency
+	// Set if perftest was run with -iterations
+	Stats map[string]Stats
+}
+
+type Stats struct {
+	N      int
+	Mean   float64
+	StdDev float64
+	CI95   float64
+	Min    float64
+	Max    float64
+}
+
+type EndpointLatency struct {
+	Endpoint string
+	Count    int
+	P50      time.Duration
+	P90      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+// Label returns the name to show for this snapshot on graphs.
+func (s Snapshot) Label() string {
+	if s.Scenario == "" {
+		return s.Name
+	}
+	return s.Scenario + "/" + s.Name
 }
 
 type PerfRun struct {
 	Snapshots []Snapshot
+	Timelines []Timeline
 	Name      string
 }
 
@@ -55,22 +102,54 @@ func loadFile(filename string) (*PerfRun, error) {
 	return &PerfRun{
 		Name:      name,
 		Snapshots: s.Snapshots,
+		Timelines: s.Timelines,
 	}, nil
 }
 
+// ci95 returns a function which returns the 95% confidence interval of the named metric, divided by unit.
+func ci95(name string, unit float64) func(s Snapshot) float64 {
+	return func(s Snapshot) float64 {
+		return s.Stats[name].CI95 / unit
+	}
+}
+
 func generateCPUGraph(runs []PerfRun, names []string, filename string) {
+	generateBarGraph(runs, names, filename, "CPU use over time", "Total (user+kernel) CPU Time (ms)", func(s Snapshot) float64 {
+		return float64((float64(s.CPUKernel+s.CPUUserland) / float64(time.Millisecond)))
+	}, ci95("CPU", float64(time.Millisecond)))
+}
+
+func generateMemoryGraph(runs []PerfRun, names []string, filename string) {
+	generateBarGraph(runs, names, filename, "Memory use over time", "Memory (MB)", func(s Snapshot) float64 {
+		return float64((s.MemoryUsage / 1024.0) / 1024.0)
+	}, ci95("MemoryUsage", 1024*1024))
+}
+
+func generateLatencyGraph(runs []PerfRun, names []string, filename, percentile string, value func(l EndpointLatency) time.Duration) {
+	generateBarGraph(runs, names, filename, percentile+" request latency per span", percentile+" latency of all requests (ms)", func(s Snapshot) float64 {
+		return float64(value(s.RequestLatency)) / float64(time.Millisecond)
+	}, ci95(strings.ToUpper(percentile), float64(time.Millisecond)))
+}
+
+// generateBarGraph draws a bar for each snapshot in each run, grouped by snapshot. Error bars of ± errs are drawn
+// for runs which have them.
+func generateBarGraph(runs []PerfRun, names []string, filename, title, yLabel string, value, errs func(s Snapshot) float64) {
 	var groups []plotter.Values
+	var groupErrs [][]float64
 	for _, r := range runs {
 		var g plotter.Values
+		var ge []float64
 		for _, s := range r.Snapshots {
-			g = append(g, float64((float64(s.CPUKernel+s.CPUUserland) / float64(time.Millisecond))))
+			g = append(g, value(s))
+			ge = append(ge, errs(s))
 		}
 		groups = append(groups, g)
+		groupErrs = append(groupErrs, ge)
 	}
 
 	p := plot.New()
-	p.Title.Text = "CPU use over time"
-	p.Y.Label.Text = "Total (user+kernel) CPU Time (ms)"
+	p.Title.Text = title
+	p.Y.Label.Text = yLabel
 
 	w := vg.Points(20)
 	offsets := make([]font.Length, len(groups))
@@ -102,6 +181,13 @@ func generateCPUGraph(runs []PerfRun, names []string, filename string) {
 		bars.Offset = offsets[i]
 		p.Add(bars)
 		p.Legend.Add(runs[i].Name, bars)
+		p.Add(&barErrors{
+			values: groups[i],
+			errs:   groupErrs[i],
+			offset: offsets[i],
+			style:  plotter.DefaultLineStyle,
+			cap:    w / 2,
+		})
 	}
 
 	p.Legend.Top = true
@@ -114,59 +200,19 @@ func generateCPUGraph(runs []PerfRun, names []string, filename string) {
 	}
 }
 
-func generateMemoryGraph(runs []PerfRun, names []string, filename string) {
-	var groups []plotter.Values
+// printLatencies prints the latency of each endpoint for each snapshot which made requests.
+func printLatencies(runs []PerfRun) {
 	for _, r := range runs {
-		var g plotter.Values
+		fmt.Printf("%s\n", r.Name)
 		for _, s := range r.Snapshots {
-			g = append(g, float64((s.MemoryUsage/1024.0)/1024.0))
-		}
-		groups = append(groups, g)
-	}
-
-	p := plot.New()
-	p.Title.Text = "Memory use over time"
-	p.Y.Label.Text = "Memory (MB)"
-
-	w := vg.Points(20)
-	offsets := make([]font.Length, len(groups))
-	switch len(offsets) {
-	case 1:
-		offsets[0] = 0
-	case 2:
-		offsets[0] = -0.5 * w
-		offsets[1] = 0.5 * w
-	case 3:
-		offsets[0] = -w
-		offsets[1] = 0
-		offsets[2] = w
-	case 5:
-		offsets[0] = -2 * w
-		offsets[1] = -w
-		offsets[2] = 0
-		offsets[3] = w
-		offsets[4] = 2 * w
-	}
-
-	for i := range groups {
-		bars, err := plotter.NewBarChart(groups[i], w)
-		if err != nil {
-			panic(err)
+			if s.RequestLatency.Count == 0 {
+				continue
+			}
+			fmt.Printf("  %s (%s)\n", s.Label(), s.HSName)
+			for _, l := range append([]EndpointLatency{s.RequestLatency}, s.Latencies...) {
+				fmt.Printf("    %-70s n=%-6d p50=%-10v p90=%-10v p99=%-10v max=%v\n", l.Endpoint, l.Count, l.P50, l.P90, l.P99, l.Max)
+			}
 		}
-		bars.LineStyle.Width = vg.Length(0)
-		bars.Color = plotutil.Color(i)
-		bars.Offset = offsets[i]
-		p.Add(bars)
-		p.Legend.Add(runs[i].Name, bars)
-	}
-
-	p.Legend.Top = true
-	p.Legend.Left = true
-	p.NominalX(names...)
-	p.Add(plotter.NewGrid())
-
-	if err := p.Save(font.Length(float64(len(runs))*float64(len(names))*3*float64(w)), 3*vg.Inch, filename); err != nil {
-		panic(err)
 	}
 }
 
@@ -184,18 +230,31 @@ func main() {
 		// sanity check that the snapshots are for the same thing
 		if names == nil {
 			for _, s := range pr.Snapshots {
-				names = append(names, s.Name)
+				names = append(names, s.Label())
 			}
 		} else {
 			for i := range pr.Snapshots {
-				if pr.Snapshots[i].Name != names[i] {
-					fmt.Printf("snapshots are for different things, cannot make graph: at pos %v  %v != %v", i, pr.Snapshots[i].Name, names[i])
+				if pr.Snapshots[i].Label() != names[i] {
+					fmt.Printf("snapshots are for different things, cannot make graph: at pos %v  %v != %v", i, pr.Snapshots[i].Label(), names[i])
 				}
 			}
 		}
 		runs[i] = *pr
 	}
+	if *flagCompare {
+		os.Exit(runCompare(runs, *flagThresholds, *flagResults, *flagAll, *flagAllowMissing))
+	}
+	if *flagExport != "" || *flagPush != "" {
+		os.Exit(runExport(runs, *flagExport, *flagExportFile, *flagPush, *flagPushJob))
+	}
 	generateMemoryGraph(runs, names, "memory.svg")
 	generateCPUGraph(runs, names, "cpu.svg")
-	fmt.Println("Output to memory.svg and cpu.svg")
+	generateLatencyGraph(runs, names, "latency_p50.svg", "p50", func(l EndpointLatency) time.Duration { return l.P50 })
+	generateLatencyGraph(runs, names, "latency_p99.svg", "p99", func(l EndpointLatency) time.Duration { return l.P99 })
+	timelineFiles := generateTimelineGraphs(runs)
+	printLatencies(runs)
+	fmt.Println("Output to memory.svg, cpu.svg, latency_p50.svg and latency_p99.svg")
+	if len(timelineFiles) > 0 {
+		fmt.Printf("Timelines output to %s\n", strings.Join(timelineFiles, ", "))
+	}
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+	"time"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/font"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/text"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+type Timeline struct {
+	Scenario  string
+	Iteration int
+	Interval  time.Duration
+	Spans     []SpanMarker
+	Samples   map[string][]TimelineSample
+}
+
+type SpanMarker struct {
+	Name  string
+	Start time.Duration
+	End   time.Duration
+}
+
+type TimelineSample struct {
+	Time        time.Duration
+	MemoryUsage uint64
+	CPUUserland uint64
+	CPUKernel   uint64
+}
+
+// spanMarkers draws a vertical line at the start of each span, labelled with its name.
+type spanMarkers struct {
+	spans []SpanMarker
+}
+
+func (m *spanMarkers) Plot(c draw.Canvas, p *plot.Plot) {
+	trX, _ := p.Transforms(&c)
+	line := draw.LineStyle{
+		Color:  color.Gray{Y: 128},
+		Width:  vg.Points(0.5),
+		Dashes: []vg.Length{vg.Points(2), vg.Points(2)},
+	}
+	label := text.Style{
+		Color:    color.Gray{Y: 64},
+		Font:     font.From(plot.DefaultFont, 7),
+		Rotation: math.Pi / 2,
+		XAlign:   draw.XRight,
+		YAlign:   draw.YTop,
+		Handler:  p.TextHandler,
+	}
+	for _, span := range m.spans {
+		x := trX(span.Start.Seconds())
+		c.StrokeLine2(line, x, c.Min.Y, x, c.Max.Y)
+		c.FillText(label, vg.Point{X: x + vg.Points(1), Y: c.Max.Y}, span.Name)
+	}
+}
+
+// generateTimelineGraphs draws line charts of the memory and CPU use of each homeserver over time, for the
+// first iteration of each scenario in each run. Returns the files written.
+func generateTimelineGraphs(runs []PerfRun) (filenames []string) {
+	for i, r := range runs {
+		for _, tl := range r.Timelines {
+			if tl.Iteration != 0 {
+				continue
+			}
+			prefix := fmt.Sprintf("timeline_%d_%s", i, tl.Scenario)
+			title := fmt.Sprintf("%s: %s", r.Name, tl.Scenario)
+			generateTimelineGraph(tl, prefix+"_memory.svg", title+" memory", "Memory (MB)", func(s, _ TimelineSample) float64 {
+				return float64(s.MemoryUsage) / 1024 / 1024
+			})
+			generateTimelineGraph(tl, prefix+"_cpu.svg", title+" CPU", "CPU (% of one core)", func(s, prev TimelineSample) float64 {
+				elapsed := s.Time - prev.Time
+				if elapsed <= 0 || s.CPUUserland+s.CPUKernel < prev.CPUUserland+prev.CPUKernel {
+					return 0
+				}
+				return 100 * float64(s.CPUUserland+s.CPUKernel-prev.CPUUserland-prev.CPUKernel) / float64(elapsed)
+			})
+			filenames = append(filenames, prefix+"_memory.svg", prefix+"_cpu.svg")
+		}
+	}
+	return filenames
+}
+
+// generateTimelineGraph draws a line for each homeserver in the timeline. value is called with each sample and the
+// one before it, which is the same sample for the first one.
+func generateTimelineGraph(tl Timeline, filename, title, yLabel string, value func(s, prev TimelineSample) float64) {
+	p := plot.New()
+	p.Title.Text = title
+	p.X.Label.Text = "Time (s)"
+	p.Y.Label.Text = yLabel
+	p.Add(plotter.NewGrid())
+	p.Add(&spanMarkers{spans: tl.Spans})
+
+	var hsNames []string
+	for hsName := range tl.Samples {
+		hsNames = append(hsNames, hsName)
+	}
+	sort.Strings(hsNames)
+	for j, hsName := range hsNames {
+		samples := tl.Samples[hsName]
+		pts := make(plotter.XYs, len(samples))
+		for k, s := range samples {
+			prev := s
+			if k > 0 {
+				prev = samples[k-1]
+			}
+			pts[k].X = s.Time.Seconds()
+			pts[k].Y = value(s, prev)
+		}
+		line, err := plotter.NewLine(pts)
+		if err != nil {
+			panic(err)
+		}
+		line.Color = plotutil.Color(j)
+		p.Add(line)
+		p.Legend.Add(hsName, line)
+	}
+	p.Legend.Top = true
+	p.Y.Min = 0
+
+	if err := p.Save(10*vg.Inch, 4*vg.Inch, filename); err != nil {
+		panic(err)
+	}
+}
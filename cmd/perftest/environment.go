@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+// Environment describes what the perf test was run on, so results from different machines are not compared
+// by mistake.
+type Environment struct {
+	// The ID and repo digests of the homeserver image.
+	ImageID       string
+	ImageDigests  []string
+	DockerVersion string
+	// The OS and kernel as reported by Docker, which may be a VM.
+	DockerOS      string
+	KernelVersion string
+	HostCPU       string
+	HostCPUs      int
+	HostMemory    int64
+	HostArch      string
+}
+
+// detectEnvironment returns as much information about the environment as can be found. Errors are ignored
+// as the information is only informative.
+func detectEnvironment(docker *client.Client, image string) Environment {
+	env := Environment{
+		HostCPU:  hostCPUModel(),
+		HostCPUs: runtime.NumCPU(),
+		HostArch: runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	ctx := context.Background()
+	if img, _, err := docker.ImageInspectWithRaw(ctx, image); err == nil {
+		env.ImageID = img.ID
+		env.ImageDigests = img.RepoDigests
+	}
+	if ver, err := docker.ServerVersion(ctx); err == nil {
+		env.DockerVersion = ver.Version
+	}
+	if info, err := docker.Info(ctx); err == nil {
+		env.DockerOS = info.OperatingSystem
+		env.KernelVersion = info.KernelVersion
+		env.HostMemory = info.MemTotal
+		if info.NCPU > 0 {
+			// the CPUs available to containers, which is what matters
+			env.HostCPUs = info.NCPU
+		}
+	}
+	return env
+}
+
+// hostCPUModel returns the CPU model name on Linux, else the architecture.
+func hostCPUModel() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return runtime.GOARCH
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, val, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.TrimSpace(key) == "model name" {
+			return strings.TrimSpace(val)
+		}
+	}
+	return runtime.GOARCH
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// EndpointLatency summarises how long requests to an endpoint took, as observed by the client.
+type EndpointLatency struct {
+	// The method and path template, e.g "PUT /_matrix/client/v3/rooms/{roomId}/send/{eventType}/{txnId}"
+	Endpoint string
+	Count    int
+	P50      time.Duration
+	P90      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+// summariseLatencies returns the percentiles of the durations, which are sorted in place.
+func summariseLatencies(endpoint string, durations []time.Duration) EndpointLatency {
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	el := EndpointLatency{
+		Endpoint: endpoint,
+		Count:    len(durations),
+	}
+	if len(durations) == 0 {
+		return el
+	}
+	// nearest-rank percentiles
+	percentile := func(p float64) time.Duration {
+		rank := int(p*float64(len(durations))+0.999999) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		return durations[rank]
+	}
+	el.P50 = percentile(0.5)
+	el.P90 = percentile(0.9)
+	el.P99 = percentile(0.99)
+	el.Max = durations[len(durations)-1]
+	return el
+}
+
+// LatencyRecorder records the latency of every HTTP request made to homeservers in a deployment, grouped by
+// homeserver and endpoint.
+type LatencyRecorder struct {
+	mu sync.Mutex
+	// host:port -> hs name
+	hosts map[string]string
+	// hs name -> endpoint -> durations
+	samples map[string]map[string][]time.Duration
+}
+
+func NewLatencyRecorder(deployment *docker.Deployment) *LatencyRecorder {
+	lr := &LatencyRecorder{
+		hosts:   make(map[string]string),
+		samples: make(map[string]map[string][]time.Duration),
+	}
+	for hsName, hsInfo := range deployment.HS {
+		u, err := url.Parse(hsInfo.BaseURL)
+		if err != nil {
+			continue
+		}
+		lr.hosts[u.Host] = hsName
+	}
+	return lr
+}
+
+// RoundTripper returns a transport which records the latency of requests then passes them to next.
+func (lr *LatencyRecorder) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	return &latencyRoundTripper{lr, next}
+}
+
+func (lr *LatencyRecorder) record(req *http.Request, duration time.Duration) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	hsName, ok := lr.hosts[req.URL.Host]
+	if !ok {
+		return
+	}
+	endpoints := lr.samples[hsName]
+	if endpoints == nil {
+		endpoints = make(map[string][]time.Duration)
+		lr.samples[hsName] = endpoints
+	}
+	endpoint := req.Method + " " + endpointTemplate(req.URL.EscapedPath())
+	endpoints[endpoint] = append(endpoints[endpoint], duration)
+}
+
+// Take returns a summary of all requests to the homeserver since the last call to Take, followed by a summary
+// for each endpoint sorted by endpoint.
+func (lr *LatencyRecorder) Take(hsName string) (EndpointLatency, []EndpointLatency) {
+	lr.mu.Lock()
+	endpoints := lr.samples[hsName]
+	delete(lr.samples, hsName)
+	lr.mu.Unlock()
+
+	var all []time.Duration
+	perEndpoint := make([]EndpointLatency, 0, len(endpoints))
+	for endpoint, durations := range endpoints {
+		all = append(all, durations...)
+		perEndpoint = append(perEndpoint, summariseLatencies(endpoint, durations))
+	}
+	sort.Slice(perEndpoint, func(i, j int) bool {
+		return perEndpoint[i].Endpoint < perEndpoint[j].Endpoint
+	})
+	return summariseLatencies("all", all), perEndpoint
+}
+
+type latencyRoundTripper struct {
+	lr   *LatencyRecorder
+	next http.RoundTripper
+}
+
+func (t *latencyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	// only time to the response headers, as the body may not be read
+	t.lr.record(req, time.Since(start))
+	return res, err
+}
+
+// endpointPlaceholders are the names of the path segments which follow a fixed segment, e.g /rooms/{roomId}
+var endpointPlaceholders = map[string][]string{
+	"rooms":        {"{roomId}"},
+	"join":         {"{roomIdOrAlias}"},
+	"profile":      {"{userId}"},
+	"user":         {"{userId}"},
+	"send":         {"{eventType}", "{txnId}"},
+	"state":        {"{eventType}", "{stateKey}"},
+	"sendToDevice": {"{eventType}", "{txnId}"},
+	"download":     {"{serverName}", "{mediaId}"},
+	"thumbnail":    {"{serverName}", "{mediaId}"},
+	"account_data": {"{type}"},
+	"tags":         {"{tag}"},
+	"receipt":      {"{receiptType}", "{eventId}"},
+	"event":        {"{eventId}"},
+	"context":      {"{eventId}"},
+	"redact":       {"{eventId}", "{txnId}"},
+	"relations":    {"{eventId}"},
+	"room":         {"{roomAlias}"},
+}
+
+// endpointTemplate replaces the variable parts of a path with placeholders so requests to the same endpoint
+// are grouped together, e.g /_matrix/client/v3/rooms/!foo:hs1/members => /_matrix/client/v3/rooms/{roomId}/members
+func endpointTemplate(path string) string {
+	segments := strings.Split(path, "/")
+	for i := 0; i < len(segments); i++ {
+		if placeholders, ok := endpointPlaceholders[segments[i]]; ok {
+			for j, placeholder := range placeholders {
+				if i+1+j < len(segments) {
+					segments[i+1+j] = placeholder
+				}
+			}
+			i += len(placeholders)
+			continue
+		}
+		// anything else which looks like an ID
+		seg, err := url.PathUnescape(segments[i])
+		if err != nil {
+			seg = segments[i]
+		}
+		if strings.Contains(seg, ":") || (seg != "" && strings.ContainsRune("@!#$", rune(seg[0]))) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
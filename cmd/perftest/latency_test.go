@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSummariseLatencies(t *testing.T) {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	seq := func(n int) (ds []time.Duration) {
+		// in reverse so summariseLatencies has to sort them
+		for i := n; i > 0; i-- {
+			ds = append(ds, ms(i))
+		}
+		return ds
+	}
+	testCases := []struct {
+		name      string
+		durations []time.Duration
+		want      EndpointLatency
+	}{
+		{"no requests", nil, EndpointLatency{Endpoint: "e"}},
+		{"one request", []time.Duration{ms(7)}, EndpointLatency{Endpoint: "e", Count: 1, P50: ms(7), P90: ms(7), P99: ms(7), Max: ms(7)}},
+		{"ten requests", seq(10), EndpointLatency{Endpoint: "e", Count: 10, P50: ms(5), P90: ms(9), P99: ms(10), Max: ms(10)}},
+		{"hundred requests", seq(100), EndpointLatency{Endpoint: "e", Count: 100, P50: ms(50), P90: ms(90), P99: ms(99), Max: ms(100)}},
+	}
+	for _, tc := range testCases {
+		if got := summariseLatencies("e", tc.durations); got != tc.want {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEndpointTemplate(t *testing.T) {
+	testCases := []struct {
+		path string
+		want string
+	}{
+		{"/_matrix/client/v3/sync", "/_matrix/client/v3/sync"},
+		{"/_matrix/client/v3/rooms/!foo:hs1/members", "/_matrix/client/v3/rooms/{roomId}/members"},
+		{"/_matrix/client/v3/rooms/%21foo%3Ahs1/send/m.room.message/txn1", "/_matrix/client/v3/rooms/{roomId}/send/{eventType}/{txnId}"},
+		{"/_matrix/client/v3/rooms/!foo:hs1/state/m.room.name/", "/_matrix/client/v3/rooms/{roomId}/state/{eventType}/{stateKey}"},
+		{"/_matrix/client/v3/user/@alice:hs1/rooms/!foo:hs1/account_data/m.fully_read", "/_matrix/client/v3/user/{userId}/rooms/{roomId}/account_data/{type}"},
+		{"/_matrix/client/v3/join/%23alias%3Ahs1", "/_matrix/client/v3/join/{roomIdOrAlias}"},
+		{"/_matrix/client/v3/directory/room/%23alias%3Ahs1", "/_matrix/client/v3/directory/room/{roomAlias}"},
+		{"/_matrix/media/v3/download/hs1/abcdef", "/_matrix/media/v3/download/{serverName}/{mediaId}"},
+		{"/_matrix/client/v3/presence/@alice:hs1/status", "/_matrix/client/v3/presence/{id}/status"},
+		{"/_matrix/client/v3/rooms", "/_matrix/client/v3/rooms"},
+	}
+	for _, tc := range testCases {
+		if got := endpointTemplate(tc.path); got != tc.want {
+			t.Errorf("%s: got %s want %s", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestLatencyRecorderTake(t *testing.T) {
+	lr := &LatencyRecorder{
+		hosts:   map[string]string{"localhost:1234": "hs1"},
+		samples: make(map[string]map[string][]time.Duration),
+	}
+	record := func(method, url string, d time.Duration) {
+		req, _ := http.NewRequest(method, url, nil)
+		lr.record(req, d)
+	}
+	record("GET", "http://localhost:1234/_matrix/client/v3/sync", 3*time.Millisecond)
+	record("PUT", "http://localhost:1234/_matrix/client/v3/rooms/!a:hs1/send/m.room.message/1", time.Millisecond)
+	record("PUT", "http://localhost:1234/_matrix/client/v3/rooms/!b:hs1/send/m.room.message/2", 2*time.Millisecond)
+	record("GET", "http://localhost:9999/_matrix/client/v3/sync", time.Second) // not a homeserver in the deployment
+
+	all, perEndpoint := lr.Take("hs1")
+	if all.Count != 3 || all.Max != 3*time.Millisecond {
+		t.Errorf("got overall %+v want 3 requests with max 3ms", all)
+	}
+	if len(perEndpoint) != 2 {
+		t.Fatalf("got %d endpoints want 2: %+v", len(perEndpoint), perEndpoint)
+	}
+	if perEndpoint[0].Endpoint != "GET /_matrix/client/v3/sync" || perEndpoint[0].Count != 1 {
+		t.Errorf("got %+v want 1 GET /sync", perEndpoint[0])
+	}
+	if perEndpoint[1].Endpoint != "PUT /_matrix/client/v3/rooms/{roomId}/send/{eventType}/{txnId}" || perEndpoint[1].Count != 2 {
+		t.Errorf("got %+v want 2 sends grouped together", perEndpoint[1])
+	}
+	if all, _ = lr.Take("hs1"); all.Count != 0 {
+		t.Errorf("Take did not reset the samples, got %+v", all)
+	}
+}
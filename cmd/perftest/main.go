@@ -3,8 +3,11 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/docker"
@@ -15,6 +18,15 @@ var (
 	flagSeed   = flag.Int64("seed", 0, "The seed to use for deterministic tests. This allows homeservers to be compared.")
 	flagImage  = flag.String("image", "", "Required. The complement-compatible homserver image to use.")
 	flagOutput = flag.String("output", "output.json", "Where to write the output data")
+
+	flagScenarios      = flag.String("scenarios", "local_mixed", "Comma separated list of scenarios to run, or 'all'. See -list.")
+	flagList           = flag.Bool("list", false, "List the available scenarios and their default sizes, then exit.")
+	flagUsers          = flag.Int("users", 0, "The number of users to create. 0 uses the scenario default.")
+	flagRooms          = flag.Int("rooms", 0, "The number of rooms to create. 0 uses the scenario default.")
+	flagMessages       = flag.Int("messages", 0, "The number of messages to send, see -list for what this means per scenario. 0 uses the scenario default.")
+	flagServers        = flag.Int("servers", 0, "The number of homeservers to deploy, for scenarios using federation. 0 uses the scenario default.")
+	flagSampleInterval = flag.Duration("sample-interval", time.Second, "How often to sample the stats of each homeserver for the timeline. 0 disables sampling.")
+	flagIterations     = flag.Int("iterations", 1, "The number of times to run each scenario on fresh homeservers. If more than 1, each metric is the mean and Stats are recorded.")
 )
 
 type Output struct {
@@ -22,6 +34,21 @@ type Output struct {
 	Snapshots []Snapshot
 	Seed      int64
 	BaseImage string
+	Scenarios []ScenarioInfo
+	// The number of times each scenario was run
+	Iterations  int
+	Environment Environment
+	// The snapshots from each iteration, if there was more than 1.
+	IterationSnapshots [][]Snapshot `json:",omitempty"`
+	// The stats of each homeserver over time, for each scenario and iteration.
+	Timelines []*Timeline `json:",omitempty"`
+}
+
+// ScenarioInfo describes a scenario which was run.
+type ScenarioInfo struct {
+	Name        string
+	Description string
+	Sizes       Sizes
 }
 
 type Config struct {
@@ -29,8 +56,43 @@ type Config struct {
 	Seed      int64
 }
 
+// selectedScenarios returns the scenarios named in -scenarios, in order.
+func selectedScenarios() ([]Scenario, error) {
+	names := strings.Split(*flagScenarios, ",")
+	if *flagScenarios == "all" {
+		names = scenarioNames()
+	}
+	var selected []Scenario
+	for _, name := range names {
+		s, ok := scenarios[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown scenario '%s', valid scenarios are: %s", name, strings.Join(scenarioNames(), ", "))
+		}
+		selected = append(selected, s)
+	}
+	return selected, nil
+}
+
 func main() {
 	flag.Parse()
+	if *flagList {
+		for _, name := range scenarioNames() {
+			s := scenarios[name]
+			fmt.Printf("%s: %s\n    defaults: %+v\n", name, s.Description(), s.DefaultSizes())
+		}
+		return
+	}
+	selected, err := selectedScenarios()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	flagSizes := Sizes{
+		Users:    *flagUsers,
+		Rooms:    *flagRooms,
+		Messages: *flagMessages,
+		Servers:  *flagServers,
+	}
 	cfg := Config{
 		BaseImage: *flagImage,
 		Seed:      *flagSeed,
@@ -49,17 +111,48 @@ func main() {
 		panic(err)
 	}
 
-	// run the test
-	snapshots, err := runTest("my_test", builder, deployer, cfg.Seed)
-	if err != nil {
-		panic(err)
+	iterations := *flagIterations
+	if iterations < 1 {
+		iterations = 1
 	}
-	b, err := json.Marshal(Output{
-		Snapshots: snapshots,
-		Seed:      *flagSeed,
-		BaseImage: *flagImage,
-		Name:      *flagName,
-	})
+	// run the scenarios, each iteration on fresh homeservers
+	iterationSnapshots := make([][]Snapshot, iterations)
+	var infos []ScenarioInfo
+	var timelines []*Timeline
+	for _, s := range selected {
+		sizes := flagSizes.Merge(s.DefaultSizes())
+		for i := 0; i < iterations; i++ {
+			scenarioSnapshots, timeline, err := runScenario(s, sizes, builder, deployer, cfg.Seed, *flagSampleInterval)
+			if err != nil {
+				panic(err)
+			}
+			if timeline != nil {
+				timeline.Iteration = i
+				timelines = append(timelines, timeline)
+			}
+			iterationSnapshots[i] = append(iterationSnapshots[i], scenarioSnapshots...)
+		}
+		infos = append(infos, ScenarioInfo{
+			Name:        s.Name(),
+			Description: s.Description(),
+			Sizes:       sizes,
+		})
+	}
+	output := Output{
+		Snapshots:   iterationSnapshots[0],
+		Seed:        *flagSeed,
+		BaseImage:   *flagImage,
+		Name:        *flagName,
+		Scenarios:   infos,
+		Iterations:  iterations,
+		Environment: detectEnvironment(builder.Docker, cfg.BaseImage),
+		Timelines:   timelines,
+	}
+	if iterations > 1 {
+		output.Snapshots = aggregateSnapshots(iterationSnapshots)
+		output.IterationSnapshots = iterationSnapshots
+	}
+	b, err := json.Marshal(output)
 	if err != nil {
 		panic(err)
 	}
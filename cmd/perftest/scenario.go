@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/instruction"
+)
+
+// Scenario is a workload to benchmark. Each scenario is run against a fresh deployment of clean homeservers.
+type Scenario interface {
+	// Name returns the unique name used to select this scenario with -scenarios.
+	Name() string
+	// Description returns a human readable summary of what this scenario measures.
+	Description() string
+	// DefaultSizes returns the sizes to use when they are not set with flags. Sizes which are not meaningful
+	// for this scenario can be left as 0.
+	DefaultSizes() Sizes
+	// Run the scenario. Spans to measure should be wrapped in ScenarioRun.Span.
+	Run(sr *ScenarioRun) error
+}
+
+// Sizes control how large a scenario is.
+type Sizes struct {
+	Users    int
+	Rooms    int
+	Messages int
+	// The number of homeservers to deploy, named hs1, hs2, ...
+	Servers int
+}
+
+// Merge returns the sizes with any zero values replaced with those in defaults. There is always at least 1 server.
+func (s Sizes) Merge(defaults Sizes) Sizes {
+	if s.Users <= 0 {
+		s.Users = defaults.Users
+	}
+	if s.Rooms <= 0 {
+		s.Rooms = defaults.Rooms
+	}
+	if s.Messages <= 0 {
+		s.Messages = defaults.Messages
+	}
+	if s.Servers <= 0 {
+		s.Servers = defaults.Servers
+	}
+	if s.Servers <= 0 {
+		s.Servers = 1
+	}
+	return s
+}
+
+var scenarios = make(map[string]Scenario)
+
+// registerScenario makes the scenario available to select with -scenarios. Panics if the name is already used.
+func registerScenario(s Scenario) {
+	if _, exists := scenarios[s.Name()]; exists {
+		panic("registerScenario: duplicate scenario " + s.Name())
+	}
+	scenarios[s.Name()] = s
+}
+
+// scenarioNames returns the names of all registered scenarios, sorted.
+func scenarioNames() []string {
+	names := make([]string, 0, len(scenarios))
+	for name := range scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ScenarioRun is the state for a single run of a scenario.
+type ScenarioRun struct {
+	Scenario   Scenario
+	Sizes      Sizes
+	Deployment *docker.Deployment
+	Runner     *instruction.Runner
+	// Seeded with -seed so runs are deterministic.
+	Rand *rand.Rand
+	// For use with CSAPI clients from Client. Failures cause the surrounding Span or Try to return an error.
+	T client.TestLike
+
+	latencies    *LatencyRecorder
+	snapshots    []Snapshot
+	spans        []spanTime
+	absStartTime time.Time
+}
+
+// Span runs fn, then snapshots the stats of all homeservers under the span name.
+func (sr *ScenarioRun) Span(spanName, desc string, fn func() error) error {
+	startTime := time.Now()
+	err := sr.Try(func() {
+		if err := fn(); err != nil {
+			panic(scenarioFailure(err.Error()))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("span %s: %s", spanName, err)
+	}
+	duration := time.Since(startTime)
+	absDuration := time.Since(sr.absStartTime)
+	sr.spans = append(sr.spans, spanTime{spanName, startTime, startTime.Add(duration)})
+	sr.snapshots = append(sr.snapshots, sr.snapshotStats(spanName, desc, absDuration, duration)...)
+	return nil
+}
+
+func (sr *ScenarioRun) snapshotStats(spanName, desc string, absDuration, duration time.Duration) []Snapshot {
+	snapshots := snapshotStats(spanName, desc, sr.Deployment, absDuration, duration)
+	for i := range snapshots {
+		snapshots[i].Scenario = sr.Scenario.Name()
+		snapshots[i].RequestLatency, snapshots[i].Latencies = sr.latencies.Take(snapshots[i].HSName)
+	}
+	return snapshots
+}
+
+// Try calls fn, returning an error if it fails sr.T. Use this when calling CSAPI clients in other goroutines.
+func (sr *ScenarioRun) Try(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			failure, ok := r.(scenarioFailure)
+			if !ok {
+				panic(r)
+			}
+			err = fmt.Errorf("%s", string(failure))
+		}
+	}()
+	fn()
+	return nil
+}
+
+// Client returns a CSAPI client for a user created by the runner, whose requests are measured.
+func (sr *ScenarioRun) Client(hsName, userID string) *client.CSAPI {
+	return &client.CSAPI{
+		UserID:      userID,
+		AccessToken: sr.Runner.AccessTokens(hsName)[userID],
+		DeviceID:    sr.Runner.DeviceIDs(hsName)[userID],
+		BaseURL:     sr.HSURL(hsName),
+		Client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: sr.latencies.RoundTripper(http.DefaultTransport),
+		},
+		SyncUntilTimeout: 30 * time.Second,
+	}
+}
+
+// HSName returns the name of the i'th homeserver, starting from 0.
+func (sr *ScenarioRun) HSName(i int) string {
+	return fmt.Sprintf("hs%d", i+1)
+}
+
+// HSURL returns the client-server API base URL of the homeserver.
+func (sr *ScenarioRun) HSURL(hsName string) string {
+	return sr.Deployment.HS[hsName].BaseURL
+}
+
+// UserHS returns the name of the homeserver which the i'th user is on. Users are spread evenly across servers.
+func (sr *ScenarioRun) UserHS(i int) string {
+	return sr.HSName(i % sr.Sizes.Servers)
+}
+
+// UserID returns the user ID of the i'th user.
+func (sr *ScenarioRun) UserID(i int) string {
+	return fmt.Sprintf("@user-%d:%s", i, sr.UserHS(i))
+}
+
+// CreateUsers registers Sizes.Users users spread across all servers. The function can modify each user before
+// it is created, and may be nil.
+func (sr *ScenarioRun) CreateUsers(modify func(i int, u *b.User)) error {
+	hses := make([]b.Homeserver, sr.Sizes.Servers)
+	for i := range hses {
+		hses[i].Name = sr.HSName(i)
+	}
+	for i := 0; i < sr.Sizes.Users; i++ {
+		u := b.User{
+			Localpart:   fmt.Sprintf("user-%d", i),
+			DisplayName: fmt.Sprintf("User %d", i),
+		}
+		if modify != nil {
+			modify(i, &u)
+		}
+		hs := &hses[i%sr.Sizes.Servers]
+		hs.Users = append(hs.Users, u)
+	}
+	for _, hs := range hses {
+		if err := sr.Runner.Run(hs, sr.HSURL(hs.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanBlueprint returns a blueprint of numServers homeservers without any users or rooms.
+func cleanBlueprint(numServers int) b.Blueprint {
+	if numServers == 1 {
+		return b.BlueprintCleanHS
+	}
+	bp := b.Blueprint{
+		Name: fmt.Sprintf("perf_clean_%dhs", numServers),
+	}
+	for i := 0; i < numServers; i++ {
+		bp.Homeservers = append(bp.Homeservers, b.Homeserver{
+			Name: fmt.Sprintf("hs%d", i+1),
+		})
+	}
+	return bp
+}
+
+// runScenario deploys clean homeservers then runs the scenario on them, returning the snapshots taken. If
+// sampleInterval is non-zero, the homeservers are also sampled at that interval and the timeline is returned.
+func runScenario(s Scenario, sizes Sizes, builder *docker.Builder, deployer *docker.Deployer, seed int64, sampleInterval time.Duration) ([]Snapshot, *Timeline, error) {
+	bp := cleanBlueprint(sizes.Servers)
+	if err := builder.ConstructBlueprintIfNotExist(bp); err != nil {
+		return nil, nil, err
+	}
+	deployment, err := deployer.Deploy(context.Background(), bp.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer deployment.Deployer.Destroy(deployment, false, s.Name(), false)
+
+	var sampler *docker.StatsSampler
+	sampleStart := time.Now()
+	if sampleInterval > 0 {
+		if sampler, err = deployment.StartStatsSampler(sampleInterval); err != nil {
+			return nil, nil, err
+		}
+		defer sampler.Stop()
+	}
+
+	sr := &ScenarioRun{
+		Scenario:   s,
+		Sizes:      sizes,
+		Deployment: deployment,
+		Runner:     instruction.NewRunner(s.Name(), false, true),
+		Rand:       rand.New(rand.NewSource(seed)),
+		T:          scenarioT{},
+		latencies:  NewLatencyRecorder(deployment),
+	}
+	sr.Runner.SetTransport(sr.latencies.RoundTripper(http.DefaultTransport))
+	sr.snapshots = sr.snapshotStats("startup", fmt.Sprintf("%d clean homeserver(s) with no users", sizes.Servers), 0, 0)
+	sr.absStartTime = time.Now()
+	if err := s.Run(sr); err != nil {
+		return nil, nil, fmt.Errorf("scenario %s: %w", s.Name(), err)
+	}
+	if sampler == nil {
+		return sr.snapshots, nil, nil
+	}
+	sampler.Stop()
+	var hsNames []string
+	for hsName := range deployment.HS {
+		hsNames = append(hsNames, hsName)
+	}
+	return sr.snapshots, newTimeline(s.Name(), sampler, hsNames, sampleStart, sampleInterval, sr.spans), nil
+}
+
+// RoomEvents collects events to send into existing rooms, identified by their Ref. Events are grouped by the
+// homeserver of their sender as each homeserver sends its own users' events.
+type RoomEvents struct {
+	sr   *ScenarioRun
+	byHS map[string]map[string]*b.Room // hs name -> ref -> room
+}
+
+// NewRoomEvents returns an empty set of events to send.
+func (sr *ScenarioRun) NewRoomEvents() *RoomEvents {
+	return &RoomEvents{
+		sr:   sr,
+		byHS: make(map[string]map[string]*b.Room),
+	}
+}
+
+// Add an event to send into the room with this Ref. The sender must be a full user ID.
+func (re *RoomEvents) Add(ref string, ev b.Event) {
+	hsName := ev.Sender[strings.Index(ev.Sender, ":")+1:]
+	rooms := re.byHS[hsName]
+	if rooms == nil {
+		rooms = make(map[string]*b.Room)
+		re.byHS[hsName] = rooms
+	}
+	room := rooms[ref]
+	if room == nil {
+		room = &b.Room{Ref: ref}
+		rooms[ref] = room
+	}
+	room.Events = append(room.Events, ev)
+}
+
+// Run sends all the events, one homeserver at a time.
+func (re *RoomEvents) Run() error {
+	for i := 0; i < re.sr.Sizes.Servers; i++ {
+		hsName := re.sr.HSName(i)
+		rooms := re.byHS[hsName]
+		if len(rooms) == 0 {
+			continue
+		}
+		hs := b.Homeserver{Name: hsName}
+		for _, room := range rooms {
+			hs.Rooms = append(hs.Rooms, *room)
+		}
+		if err := re.sr.Runner.Run(hs, re.sr.HSURL(hsName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinEvent returns a join event for the user.
+func joinEvent(userID string) b.Event {
+	return b.Event{
+		Type:     "m.room.member",
+		StateKey: b.Ptr(userID),
+		Sender:   userID,
+		Content: map[string]interface{}{
+			"membership": "join",
+		},
+	}
+}
+
+// messageEvent returns a text message event from the user.
+func messageEvent(userID, body string) b.Event {
+	return b.Event{
+		Type:   "m.room.message",
+		Sender: userID,
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    body,
+		},
+	}
+}
+
+// scenarioFailure is panicked by scenarioT when a CSAPI client fails, and recovered by ScenarioRun.Try.
+type scenarioFailure string
+
+// scenarioT lets scenarios use CSAPI clients, which expect to be run in tests. Any error fails the scenario.
+type scenarioT struct{}
+
+func (scenarioT) Helper() {}
+
+func (scenarioT) Logf(msg string, args ...interface{}) {
+	log.Printf(msg, args...)
+}
+
+func (scenarioT) Skipf(msg string, args ...interface{}) {
+	panic(scenarioFailure("skipped: " + fmt.Sprintf(msg, args...)))
+}
+
+func (scenarioT) Error(args ...interface{}) {
+	panic(scenarioFailure(fmt.Sprint(args...)))
+}
+
+func (scenarioT) Errorf(msg string, args ...interface{}) {
+	panic(scenarioFailure(fmt.Sprintf(msg, args...)))
+}
+
+func (scenarioT) Fatalf(msg string, args ...interface{}) {
+	panic(scenarioFailure(fmt.Sprintf(msg, args...)))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/internal/instruction"
+)
+
+func init() {
+	registerScenario(toDeviceFanOutScenario{})
+}
+
+// The device ID of every user in toDeviceFanOutScenario.
+const perfDeviceID = "PERFDEVICE"
+
+// toDeviceFanOutScenario measures what a client does when sharing a room key with every device in a big
+// encrypted room: query and claim keys for all devices, then send to-device messages to all of them.
+type toDeviceFanOutScenario struct{}
+
+func (toDeviceFanOutScenario) Name() string { return "e2ee_to_device_fan_out" }
+
+func (toDeviceFanOutScenario) Description() string {
+	return "one user queries and claims keys for all other users, sends encrypted to-device messages to all their devices, then they all sync. Messages are the number of /sendToDevice requests."
+}
+
+func (toDeviceFanOutScenario) DefaultSizes() Sizes {
+	return Sizes{Users: 50, Messages: 20, Servers: 1}
+}
+
+func (toDeviceFanOutScenario) Run(sr *ScenarioRun) error {
+	sender := sr.UserID(0)
+	var recipients []string
+	for i := 1; i < sr.Sizes.Users; i++ {
+		recipients = append(recipients, sr.UserID(i))
+	}
+
+	err := sr.Span("create_users", fmt.Sprintf("creates %d users concurrently, each with a device with one-time keys", sr.Sizes.Users), func() error {
+		return sr.CreateUsers(func(i int, u *b.User) {
+			u.DeviceID = b.Ptr(perfDeviceID)
+			u.OneTimeKeys = 5
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	senderOpts := instruction.RunOpts{
+		Concurrency:    instruction.ConcurrencyTypeNone,
+		HSURL:          sr.HSURL(sr.UserHS(0)),
+		StoreNamespace: "_e2ee",
+	}
+	deviceKeys := make(map[string]interface{})
+	oneTimeKeys := make(map[string]interface{})
+	for _, userID := range recipients {
+		deviceKeys[userID] = []string{}
+		oneTimeKeys[userID] = map[string]string{perfDeviceID: "signed_curve25519"}
+	}
+	err = sr.Span("query_keys", fmt.Sprintf("%s queries the device keys of %d users", sender, len(recipients)), func() error {
+		return sr.Runner.RunInstructions(senderOpts, []instruction.Instr{{
+			UserID: sender,
+			Method: "POST",
+			Path:   "/_matrix/client/v3/keys/query",
+			Body:   map[string]interface{}{"device_keys": deviceKeys},
+		}})
+	})
+	if err != nil {
+		return err
+	}
+	err = sr.Span("claim_keys", fmt.Sprintf("%s claims a one-time key for %d devices", sender, len(recipients)), func() error {
+		return sr.Runner.RunInstructions(senderOpts, []instruction.Instr{{
+			UserID: sender,
+			Method: "POST",
+			Path:   "/_matrix/client/v3/keys/claim",
+			Body:   map[string]interface{}{"one_time_keys": oneTimeKeys},
+		}})
+	})
+	if err != nil {
+		return err
+	}
+
+	sends := make([]instruction.Instr, sr.Sizes.Messages)
+	for i := range sends {
+		messages := make(map[string]interface{})
+		for _, userID := range recipients {
+			messages[userID] = map[string]interface{}{
+				perfDeviceID: encryptedToDeviceContent(sr),
+			}
+		}
+		sends[i] = instruction.Instr{
+			UserID: sender,
+			Method: "PUT",
+			Path:   fmt.Sprintf("/_matrix/client/v3/sendToDevice/m.room.encrypted/perf-%d", i),
+			Body:   map[string]interface{}{"messages": messages},
+		}
+	}
+	err = sr.Span("send_to_device", fmt.Sprintf("%s sends %d encrypted to-device messages to %d devices each", sender, len(sends), len(recipients)), func() error {
+		return sr.Runner.RunInstructions(senderOpts, sends)
+	})
+	if err != nil {
+		return err
+	}
+
+	syncs := make(map[string][]instruction.Instr)
+	for i := 1; i < sr.Sizes.Users; i++ {
+		hsName := sr.UserHS(i)
+		syncs[hsName] = append(syncs[hsName], instruction.Instr{
+			UserID:  sr.UserID(i),
+			Method:  "GET",
+			Path:    "/_matrix/client/v3/sync",
+			Queries: map[string]string{"timeout": "0"},
+		})
+	}
+	return sr.Span("sync_to_device", fmt.Sprintf("%d users perform /sync with no since token and timeout=0 to receive their to-device messages", len(recipients)), func() error {
+		return runOnEachHS(sr, instruction.ConcurrencyTypePerUser, "_e2ee", syncs)
+	})
+}
+
+// encryptedToDeviceContent returns content shaped like an Olm-encrypted room key share. The ciphertext is
+// random, as servers cannot decrypt it anyway.
+func encryptedToDeviceContent(sr *ScenarioRun) map[string]interface{} {
+	senderKey := make([]byte, 32)
+	sr.Rand.Read(senderKey)
+	recipientKey := make([]byte, 32)
+	sr.Rand.Read(recipientKey)
+	body := make([]byte, 512)
+	sr.Rand.Read(body)
+	return map[string]interface{}{
+		"algorithm":  "m.olm.v1.curve25519-aes-sha2",
+		"sender_key": base64.RawStdEncoding.EncodeToString(senderKey),
+		"ciphertext": map[string]interface{}{
+			base64.RawStdEncoding.EncodeToString(recipientKey): map[string]interface{}{
+				"type": 0,
+				"body": base64.RawStdEncoding.EncodeToString(body),
+			},
+		},
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+)
+
+func init() {
+	registerScenario(federatedJoinScenario{})
+}
+
+// federatedJoinScenario measures how long it takes for servers which are new to a room to join it, when the
+// room has lots of members and history.
+type federatedJoinScenario struct{}
+
+func (federatedJoinScenario) Name() string { return "federated_join_big_room" }
+
+func (federatedJoinScenario) Description() string {
+	return "a user on each of hs2..hsN joins a room on hs1 with many members and messages, then does an initial sync"
+}
+
+func (federatedJoinScenario) DefaultSizes() Sizes {
+	return Sizes{Users: 200, Messages: 1000, Servers: 2}
+}
+
+func (federatedJoinScenario) Run(sr *ScenarioRun) error {
+	if sr.Sizes.Servers < 2 {
+		return fmt.Errorf("at least 2 servers are required, got %d", sr.Sizes.Servers)
+	}
+	// all members of the room are on hs1 so the joining servers have never seen it before
+	members := make([]string, sr.Sizes.Users)
+	for i := range members {
+		members[i] = fmt.Sprintf("@user-%d:hs1", i)
+	}
+	joiners := make([]string, sr.Sizes.Servers-1)
+	for i := range joiners {
+		joiners[i] = fmt.Sprintf("@joiner:%s", sr.HSName(i+1))
+	}
+
+	err := sr.Span("create_users", fmt.Sprintf("creates %d users on hs1 and 1 user on each other server", len(members)), func() error {
+		users := make([]b.User, len(members))
+		for i := range users {
+			users[i] = b.User{
+				Localpart:   fmt.Sprintf("user-%d", i),
+				DisplayName: fmt.Sprintf("User %d", i),
+			}
+		}
+		if err := sr.Runner.Run(b.Homeserver{Name: "hs1", Users: users}, sr.HSURL("hs1")); err != nil {
+			return err
+		}
+		for i := 1; i < sr.Sizes.Servers; i++ {
+			hsName := sr.HSName(i)
+			err := sr.Runner.Run(b.Homeserver{
+				Name:  hsName,
+				Users: []b.User{{Localpart: "joiner"}},
+			}, sr.HSURL(hsName))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	const ref = "big_room"
+	err = sr.Span("fill_room", fmt.Sprintf("creates a public room on hs1 which %d users join and send %d messages into", len(members), sr.Sizes.Messages), func() error {
+		room := b.Room{
+			Ref:     ref,
+			Creator: members[0],
+			CreateRoom: map[string]interface{}{
+				"preset": "public_chat",
+			},
+		}
+		for _, userID := range members[1:] {
+			room.Events = append(room.Events, joinEvent(userID))
+		}
+		for i := 0; i < sr.Sizes.Messages; i++ {
+			room.Events = append(room.Events, messageEvent(members[sr.Rand.Intn(len(members))], fmt.Sprintf("message %d", i)))
+		}
+		return sr.Runner.Run(b.Homeserver{
+			Name:  "hs1",
+			Rooms: []b.Room{room},
+		}, sr.HSURL("hs1"))
+	})
+	if err != nil {
+		return err
+	}
+
+	err = sr.Span("federated_join", fmt.Sprintf("%d servers join the room over federation concurrently", len(joiners)), func() error {
+		return forEachJoiner(sr, joiners, func(hsName, joiner string) error {
+			return sr.Runner.Run(b.Homeserver{
+				Name: hsName,
+				Rooms: []b.Room{{
+					Ref:    ref,
+					Events: []b.Event{joinEvent(joiner)},
+				}},
+			}, sr.HSURL(hsName))
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return sr.Span("initial_sync_joiners", "each joining user performs /sync with no since token and timeout=0", func() error {
+		return forEachJoiner(sr, joiners, func(hsName, joiner string) error {
+			cli := sr.Client(hsName, joiner)
+			return sr.Try(func() {
+				cli.MustSync(sr.T, client.SyncReq{TimeoutMillis: "0"})
+			})
+		})
+	})
+}
+
+// forEachJoiner calls fn concurrently for each joining user, which are on hs2 onwards.
+func forEachJoiner(sr *ScenarioRun, joiners []string, fn func(hsName, joiner string) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(joiners))
+	for i, joiner := range joiners {
+		wg.Add(1)
+		go func(i int, joiner string) {
+			defer wg.Done()
+			errs[i] = fn(sr.HSName(i+1), joiner)
+		}(i, joiner)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
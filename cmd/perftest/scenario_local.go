@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/internal/instruction"
+)
+
+func init() {
+	registerScenario(localMixedScenario{})
+}
+
+// localMixedScenario simulates a small local-only homeserver with a few large rooms with lots of users and a
+// few small rooms.
+type localMixedScenario struct{}
+
+func (localMixedScenario) Name() string { return "local_mixed" }
+
+func (localMixedScenario) Description() string {
+	return "creates users and rooms, joins rooms according to a normal distribution, sends messages then syncs"
+}
+
+func (localMixedScenario) DefaultSizes() Sizes {
+	return Sizes{Users: 10, Rooms: 50, Messages: 100, Servers: 1}
+}
+
+func (localMixedScenario) Run(sr *ScenarioRun) error {
+	if sr.Sizes.Servers != 1 {
+		return fmt.Errorf("only 1 server is supported, got %d", sr.Sizes.Servers)
+	}
+	numUsers := sr.Sizes.Users
+	runner := sr.Runner
+	rnd := sr.Rand
+	hsURL := sr.HSURL("hs1")
+
+	err := sr.Span("create_users", fmt.Sprintf("creates %d users concurrently", numUsers), func() error {
+		return sr.CreateUsers(nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	var userRoomJoins [][2]string // list of [user_id, roomRef] of joined users who can send messages
+	numRooms := sr.Sizes.Rooms
+	err = sr.Span("create_rooms", fmt.Sprintf("creates %d public rooms with different users", numRooms), func() error {
+		// make M rooms
+		rooms := make([]b.Room, numRooms)
+		for i := 0; i < numRooms; i++ {
+			userID := sr.UserID(int(rnd.Int63() % int64(numUsers)))
+			roomRef := fmt.Sprintf("ref-%d", i)
+			rooms[i] = b.Room{
+				Creator: userID,
+				CreateRoom: map[string]interface{}{
+					"preset": "public_chat",
+				},
+				Ref: roomRef,
+			}
+			userRoomJoins = append(userRoomJoins, [2]string{userID, roomRef})
+		}
+		return runner.Run(b.Homeserver{
+			Name:  "hs1",
+			Rooms: rooms,
+		}, hsURL)
+	})
+	if err != nil {
+		return err
+	}
+
+	// normal distribution around numRooms/2 to join M rooms, P times
+	numJoins := 100
+	stddev := float64(numRooms) / 6.0
+	mean := (float64(numRooms) / 2.0)
+	err = sr.Span("join_rooms", fmt.Sprintf("issues %d /join requests according to a normal distribution (mean=%v,std-dev=%v)", numJoins, mean, stddev), func() error {
+		var hs b.Homeserver
+		roomMap := make(map[string]b.Room)
+		for i := 0; i < numJoins; i++ {
+			// random user
+			userID := sr.UserID(int(rnd.Int63() % int64(numUsers)))
+			// normal distribution so we get some large rooms
+			roomI := int(rnd.NormFloat64()*stddev + mean)
+			ref := fmt.Sprintf("ref-%d", roomI)
+			room := roomMap[ref]
+			room.Ref = ref
+			room.Events = append(room.Events, b.Event{
+				Type:     "m.room.member",
+				StateKey: &userID,
+				Sender:   userID,
+				Content: map[string]interface{}{
+					"membership": "join",
+				},
+			})
+			roomMap[ref] = room
+			userRoomJoins = append(userRoomJoins, [2]string{userID, ref})
+		}
+		for _, room := range roomMap {
+			hs.Rooms = append(hs.Rooms, room)
+		}
+		return runner.Run(hs, hsURL)
+	})
+	if err != nil {
+		return err
+	}
+
+	numEvents := sr.Sizes.Messages
+	err = sr.Span("send_msgs", fmt.Sprintf("sends %d m.room.message text events into random rooms users have joined", numEvents), func() error {
+		var hs b.Homeserver
+		roomMap := make(map[string]b.Room)
+		for i := 0; i < numEvents; i++ {
+			userAndRoom := userRoomJoins[int(rnd.Int63()%int64(len(userRoomJoins)))]
+			userID := userAndRoom[0]
+			ref := userAndRoom[1]
+			room := roomMap[ref]
+			room.Ref = ref
+			room.Events = append(room.Events, b.Event{
+				Sender: userID,
+				Type:   "m.room.message",
+				Content: map[string]interface{}{
+					"body":    fmt.Sprintf("message %d", i),
+					"msgtype": "m.text",
+				},
+			})
+			roomMap[ref] = room
+		}
+		for _, room := range roomMap {
+			hs.Rooms = append(hs.Rooms, room)
+		}
+
+		return runner.Run(hs, hsURL)
+	})
+	if err != nil {
+		return err
+	}
+
+	runOpts := instruction.RunOpts{
+		Concurrency:    instruction.ConcurrencyTypePerUser,
+		HSURL:          hsURL,
+		StoreNamespace: "_syncs",
+	}
+	syncInstructions := make([]instruction.Instr, numUsers)
+	for i := range syncInstructions {
+		userID := sr.UserID(i)
+		syncInstructions[i] = instruction.Instr{
+			UserID:  userID,
+			Method:  "GET",
+			Path:    "/_matrix/client/v3/sync",
+			Queries: map[string]string{"timeout": "0"},
+			Store: map[string]string{
+				userID: ".next_batch",
+			},
+		}
+	}
+	err = sr.Span("initial_syncs", fmt.Sprintf("performs /sync with no since token and timeout=0 for all users"), func() error {
+		return runner.RunInstructions(runOpts, syncInstructions)
+	})
+	if err != nil {
+		return err
+	}
+
+	syncInstructions = make([]instruction.Instr, 0, numUsers)
+	for i := 0; i < numUsers; i++ {
+		userID := sr.UserID(i)
+		syncInstructions = append(syncInstructions, instruction.Instr{
+			UserID: userID,
+			Method: "PUT",
+			Path:   fmt.Sprintf("/_matrix/client/v3/profile/%s/displayname", url.PathEscape(userID)),
+			Body: map[string]interface{}{
+				"displayname": fmt.Sprintf("Updated User %d", i),
+			},
+		})
+	}
+	err = sr.Span("display_name_change", fmt.Sprintf("updates the displayname of all %d users concurrently", numUsers), func() error {
+		return runner.RunInstructions(runOpts, syncInstructions)
+	})
+	if err != nil {
+		return err
+	}
+
+	syncInstructions = make([]instruction.Instr, numUsers)
+	for i := 0; i < numUsers; i++ {
+		userID := sr.UserID(i)
+		syncInstructions[i] = instruction.Instr{
+			UserID:  userID,
+			Method:  "GET",
+			Path:    "/_matrix/client/v3/sync",
+			Queries: map[string]string{"since": runner.GetStoredValue(runOpts, userID)},
+			Store: map[string]string{
+				userID: ".next_batch",
+			},
+		}
+	}
+	err = sr.Span("incremental_sync", fmt.Sprintf("performs an incremental sync on all %d users with the since token from the initial sync", numUsers), func() error {
+		return runner.RunInstructions(runOpts, syncInstructions)
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/complement/internal/instruction"
+)
+
+func init() {
+	registerScenario(mediaBurstScenario{})
+}
+
+// The size of each file uploaded by mediaBurstScenario.
+const mediaUploadSize = 256 * 1024
+
+// mediaBurstScenario measures many users uploading and downloading media at the same time.
+type mediaBurstScenario struct{}
+
+func (mediaBurstScenario) Name() string { return "media_upload_burst" }
+
+func (mediaBurstScenario) Description() string {
+	return fmt.Sprintf("all users upload %d KiB files at the same time, then download them. Messages are the number of files per user.", mediaUploadSize/1024)
+}
+
+func (mediaBurstScenario) DefaultSizes() Sizes {
+	return Sizes{Users: 20, Messages: 10, Servers: 1}
+}
+
+func (mediaBurstScenario) Run(sr *ScenarioRun) error {
+	err := sr.Span("create_users", fmt.Sprintf("creates %d users concurrently", sr.Sizes.Users), func() error {
+		return sr.CreateUsers(nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	// the same random content is uploaded many times, as generating it is not what we are measuring
+	content := make([]byte, mediaUploadSize)
+	sr.Rand.Read(content)
+	uploads := make(map[string][]instruction.Instr) // hs name -> instructions
+	for i := 0; i < sr.Sizes.Users; i++ {
+		hsName := sr.UserHS(i)
+		for j := 0; j < sr.Sizes.Messages; j++ {
+			uploads[hsName] = append(uploads[hsName], instruction.Instr{
+				UserID:      sr.UserID(i),
+				Method:      "POST",
+				Path:        "/_matrix/media/v3/upload",
+				Queries:     map[string]string{"filename": fmt.Sprintf("file-%d.bin", j)},
+				RawBody:     content,
+				ContentType: "application/octet-stream",
+				Store: map[string]string{
+					mediaUploadKey(i, j): ".content_uri",
+				},
+			})
+		}
+	}
+	err = sr.Span("upload_media", fmt.Sprintf("uploads %d files from each user with every upload in flight at once", sr.Sizes.Messages), func() error {
+		return runOnEachHS(sr, instruction.ConcurrencyTypeAll, "_media", uploads)
+	})
+	if err != nil {
+		return err
+	}
+
+	downloads := make(map[string][]instruction.Instr)
+	for i := 0; i < sr.Sizes.Users; i++ {
+		hsName := sr.UserHS(i)
+		for j := 0; j < sr.Sizes.Messages; j++ {
+			mxc := sr.Runner.GetStoredValue(instruction.RunOpts{StoreNamespace: "_media"}, mediaUploadKey(i, j))
+			if !strings.HasPrefix(mxc, "mxc://") {
+				return fmt.Errorf("upload %d for user %d did not return a content URI: '%s'", j, i, mxc)
+			}
+			downloads[hsName] = append(downloads[hsName], instruction.Instr{
+				UserID: sr.UserID(i),
+				Method: "GET",
+				Path:   "/_matrix/media/v3/download/" + strings.TrimPrefix(mxc, "mxc://"),
+			})
+		}
+	}
+	return sr.Span("download_media", "downloads every uploaded file, with each user's downloads in serial", func() error {
+		return runOnEachHS(sr, instruction.ConcurrencyTypePerUser, "_media", downloads)
+	})
+}
+
+func mediaUploadKey(userIndex, fileIndex int) string {
+	return fmt.Sprintf("upload_%d_%d", userIndex, fileIndex)
+}
+
+// runOnEachHS runs the instructions for each homeserver, one homeserver at a time.
+func runOnEachHS(sr *ScenarioRun, concurrency instruction.ConcurrencyType, storeNamespace string, instrs map[string][]instruction.Instr) error {
+	for i := 0; i < sr.Sizes.Servers; i++ {
+		hsName := sr.HSName(i)
+		if len(instrs[hsName]) == 0 {
+			continue
+		}
+		err := sr.Runner.RunInstructions(instruction.RunOpts{
+			Concurrency:    concurrency,
+			HSURL:          sr.HSURL(hsName),
+			StoreNamespace: storeNamespace,
+		}, instrs[hsName])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/internal/instruction"
+)
+
+func init() {
+	registerScenario(largeAccountSyncScenario{})
+}
+
+// largeAccountSyncScenario measures initial syncs for a user who is in lots of busy rooms.
+type largeAccountSyncScenario struct{}
+
+func (largeAccountSyncScenario) Name() string { return "initial_sync_large_account" }
+
+func (largeAccountSyncScenario) Description() string {
+	return "one user in many rooms with lots of members and messages performs initial syncs with and without lazy-loading. Messages are per room."
+}
+
+func (largeAccountSyncScenario) DefaultSizes() Sizes {
+	return Sizes{Users: 20, Rooms: 200, Messages: 50, Servers: 1}
+}
+
+func (largeAccountSyncScenario) Run(sr *ScenarioRun) error {
+	// user-0 is the large account, which is on hs1
+	largeAccount := sr.UserID(0)
+	membersPerRoom := 10
+	if membersPerRoom > sr.Sizes.Users {
+		membersPerRoom = sr.Sizes.Users
+	}
+
+	err := sr.Span("create_users", fmt.Sprintf("creates %d users concurrently", sr.Sizes.Users), func() error {
+		return sr.CreateUsers(nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = sr.Span("create_rooms", fmt.Sprintf("%s creates %d public rooms", largeAccount, sr.Sizes.Rooms), func() error {
+		rooms := make([]b.Room, sr.Sizes.Rooms)
+		for i := range rooms {
+			rooms[i] = b.Room{
+				Ref:     fmt.Sprintf("ref-%d", i),
+				Creator: largeAccount,
+				CreateRoom: map[string]interface{}{
+					"preset": "public_chat",
+				},
+			}
+		}
+		return sr.Runner.Run(b.Homeserver{
+			Name:  "hs1",
+			Rooms: rooms,
+		}, sr.HSURL("hs1"))
+	})
+	if err != nil {
+		return err
+	}
+
+	err = sr.Span("fill_rooms", fmt.Sprintf("joins %d random users to each room then sends %d messages into each room", membersPerRoom-1, sr.Sizes.Messages), func() error {
+		events := sr.NewRoomEvents()
+		for i := 0; i < sr.Sizes.Rooms; i++ {
+			ref := fmt.Sprintf("ref-%d", i)
+			members := []string{largeAccount}
+			for _, userIndex := range sr.Rand.Perm(sr.Sizes.Users - 1)[:membersPerRoom-1] {
+				userID := sr.UserID(userIndex + 1)
+				members = append(members, userID)
+				events.Add(ref, joinEvent(userID))
+			}
+			for j := 0; j < sr.Sizes.Messages; j++ {
+				sender := members[sr.Rand.Intn(len(members))]
+				events.Add(ref, messageEvent(sender, fmt.Sprintf("message %d", j)))
+			}
+		}
+		return events.Run()
+	})
+	if err != nil {
+		return err
+	}
+
+	runOpts := instruction.RunOpts{
+		Concurrency:    instruction.ConcurrencyTypeNone,
+		HSURL:          sr.HSURL("hs1"),
+		StoreNamespace: "_syncs",
+	}
+	err = sr.Span("initial_sync", fmt.Sprintf("%s performs /sync with no since token and timeout=0", largeAccount), func() error {
+		return sr.Runner.RunInstructions(runOpts, []instruction.Instr{{
+			UserID:  largeAccount,
+			Method:  "GET",
+			Path:    "/_matrix/client/v3/sync",
+			Queries: map[string]string{"timeout": "0"},
+		}})
+	})
+	if err != nil {
+		return err
+	}
+
+	return sr.Span("initial_sync_lazy_loading", fmt.Sprintf("%s performs /sync with no since token, timeout=0 and lazy-loaded members", largeAccount), func() error {
+		return sr.Runner.RunInstructions(runOpts, []instruction.Instr{{
+			UserID: largeAccount,
+			Method: "GET",
+			Path:   "/_matrix/client/v3/sync",
+			Queries: map[string]string{
+				"timeout": "0",
+				"filter":  `{"room":{"state":{"lazy_load_members":true}}}`,
+			},
+		}})
+	})
+}
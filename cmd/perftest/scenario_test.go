@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestSizesMerge(t *testing.T) {
+	defaults := Sizes{Users: 10, Rooms: 5, Messages: 100, Servers: 2}
+	testCases := []struct {
+		name     string
+		sizes    Sizes
+		defaults Sizes
+		want     Sizes
+	}{
+		{"all defaults", Sizes{}, defaults, defaults},
+		{"flags override defaults", Sizes{Users: 3, Servers: 4}, defaults, Sizes{Users: 3, Rooms: 5, Messages: 100, Servers: 4}},
+		{"negative sizes use defaults", Sizes{Users: -1, Messages: -5}, defaults, defaults},
+		{"sizes without a default stay 0", Sizes{Rooms: 7}, Sizes{Users: 1}, Sizes{Users: 1, Rooms: 7, Servers: 1}},
+		{"at least 1 server", Sizes{}, Sizes{}, Sizes{Servers: 1}},
+	}
+	for _, tc := range testCases {
+		if got := tc.sizes.Merge(tc.defaults); got != tc.want {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestScenarioNames(t *testing.T) {
+	names := scenarioNames()
+	if len(names) == 0 {
+		t.Fatalf("no scenarios are registered")
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("scenario names are not sorted: %v", names)
+	}
+	for _, name := range names {
+		s := scenarios[name]
+		if s.Name() != name {
+			t.Errorf("scenario %s is registered as %s", s.Name(), name)
+		}
+		if s.Description() == "" {
+			t.Errorf("scenario %s has no description", name)
+		}
+	}
+}
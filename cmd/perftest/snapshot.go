@@ -1,15 +1,14 @@
 package main
 
 import (
-	"context"
-	"encoding/json"
 	"time"
 
-	"github.com/docker/docker/api/types"
 	"github.com/matrix-org/complement/internal/docker"
 )
 
 type Snapshot struct {
+	// The scenario which took this snapshot.
+	Scenario         string
 	Name             string
 	Description      string
 	HSName           string
@@ -22,47 +21,33 @@ type Snapshot struct {
 	BytesRead        uint64
 	TxBytes          int64
 	RxBytes          int64
+	// The latency of all requests made to this homeserver during the span, then per endpoint.
+	RequestLatency EndpointLatency
+	Latencies      []EndpointLatency
+	// If the scenario was run several times, the metrics above are means and these are their statistics, keyed
+	// by the field name, or CPU for CPUUserland+CPUKernel, or P50/P90/P99/Max for RequestLatency.
+	Stats map[string]Stats `json:",omitempty"`
 }
 
 func snapshotStats(spanName, desc string, deployment *docker.Deployment, absDuration, duration time.Duration) (snapshots []Snapshot) {
 	for hsName, hsInfo := range deployment.HS {
-		stats, err := deployment.Deployer.Docker.ContainerStatsOneShot(context.Background(), hsInfo.ContainerID)
+		stats, err := deployment.Deployer.ContainerStats(hsInfo)
 		if err != nil {
 			return nil
 		}
-		var sj types.StatsJSON
-		err = json.NewDecoder(stats.Body).Decode(&sj)
-		stats.Body.Close()
-		if err != nil {
-			return nil
-		}
-
-		var rxBytes, txBytes int64
-		for _, nw := range sj.Networks {
-			rxBytes += int64(nw.RxBytes)
-			txBytes += int64(nw.TxBytes)
-		}
-		var bw, br uint64
-		for _, block := range sj.BlkioStats.IoServiceBytesRecursive {
-			if block.Op == "read" {
-				br = block.Value
-			} else if block.Op == "write" {
-				bw = block.Value
-			}
-		}
 		snapshots = append(snapshots, Snapshot{
 			HSName:           hsName,
 			Name:             spanName,
 			Description:      desc,
 			Duration:         duration,
 			AbsoluteDuration: absDuration,
-			MemoryUsage:      sj.MemoryStats.Usage,
-			CPUUserland:      sj.CPUStats.CPUUsage.UsageInUsermode,
-			CPUKernel:        sj.CPUStats.CPUUsage.UsageInKernelmode,
-			TxBytes:          txBytes,
-			RxBytes:          rxBytes,
-			BytesWritten:     bw,
-			BytesRead:        br,
+			MemoryUsage:      stats.MemoryUsage,
+			CPUUserland:      stats.CPUUserland,
+			CPUKernel:        stats.CPUKernel,
+			TxBytes:          stats.TxBytes,
+			RxBytes:          stats.RxBytes,
+			BytesWritten:     stats.BytesWritten,
+			BytesRead:        stats.BytesRead,
 		})
 	}
 	return
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Stats summarises a metric over several iterations.
+type Stats struct {
+	N      int
+	Mean   float64
+	StdDev float64
+	// The half-width of the 95% confidence interval of the mean, i.e the mean is in Mean ± CI95.
+	CI95 float64
+	Min  float64
+	Max  float64
+}
+
+// tTable95 is the two-tailed 95% critical value of Student's t-distribution, indexed by degrees of freedom - 1.
+var tTable95 = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+func computeStats(xs []float64) Stats {
+	st := Stats{N: len(xs)}
+	if len(xs) == 0 {
+		return st
+	}
+	st.Min, st.Max = xs[0], xs[0]
+	var sum float64
+	for _, x := range xs {
+		sum += x
+		st.Min = math.Min(st.Min, x)
+		st.Max = math.Max(st.Max, x)
+	}
+	st.Mean = sum / float64(len(xs))
+	if len(xs) < 2 {
+		return st
+	}
+	var sumSq float64
+	for _, x := range xs {
+		sumSq += (x - st.Mean) * (x - st.Mean)
+	}
+	// sample standard deviation
+	st.StdDev = math.Sqrt(sumSq / float64(len(xs)-1))
+	t := 1.96
+	if df := len(xs) - 1; df <= len(tTable95) {
+		t = tTable95[df-1]
+	}
+	st.CI95 = t * st.StdDev / math.Sqrt(float64(len(xs)))
+	return st
+}
+
+// snapshotMetrics are the metrics which are aggregated over iterations, keyed by the name used in Snapshot.Stats.
+// Durations are in nanoseconds and sizes in bytes.
+var snapshotMetrics = map[string]struct {
+	get func(s *Snapshot) float64
+	set func(s *Snapshot, mean float64)
+}{
+	"Duration":         {func(s *Snapshot) float64 { return float64(s.Duration) }, func(s *Snapshot, v float64) { s.Duration = time.Duration(v) }},
+	"AbsoluteDuration": {func(s *Snapshot) float64 { return float64(s.AbsoluteDuration) }, func(s *Snapshot, v float64) { s.AbsoluteDuration = time.Duration(v) }},
+	"MemoryUsage":      {func(s *Snapshot) float64 { return float64(s.MemoryUsage) }, func(s *Snapshot, v float64) { s.MemoryUsage = uint64(v) }},
+	"CPUUserland":      {func(s *Snapshot) float64 { return float64(s.CPUUserland) }, func(s *Snapshot, v float64) { s.CPUUserland = uint64(v) }},
+	"CPUKernel":        {func(s *Snapshot) float64 { return float64(s.CPUKernel) }, func(s *Snapshot, v float64) { s.CPUKernel = uint64(v) }},
+	"CPU":              {func(s *Snapshot) float64 { return float64(s.CPUUserland + s.CPUKernel) }, func(s *Snapshot, v float64) {}},
+	"BytesWritten":     {func(s *Snapshot) float64 { return float64(s.BytesWritten) }, func(s *Snapshot, v float64) { s.BytesWritten = uint64(v) }},
+	"BytesRead":        {func(s *Snapshot) float64 { return float64(s.BytesRead) }, func(s *Snapshot, v float64) { s.BytesRead = uint64(v) }},
+	"TxBytes":          {func(s *Snapshot) float64 { return float64(s.TxBytes) }, func(s *Snapshot, v float64) { s.TxBytes = int64(v) }},
+	"RxBytes":          {func(s *Snapshot) float64 { return float64(s.RxBytes) }, func(s *Snapshot, v float64) { s.RxBytes = int64(v) }},
+	"P50":              {func(s *Snapshot) float64 { return float64(s.RequestLatency.P50) }, func(s *Snapshot, v float64) { s.RequestLatency.P50 = time.Duration(v) }},
+	"P90":              {func(s *Snapshot) float64 { return float64(s.RequestLatency.P90) }, func(s *Snapshot, v float64) { s.RequestLatency.P90 = time.Duration(v) }},
+	"P99":              {func(s *Snapshot) float64 { return float64(s.RequestLatency.P99) }, func(s *Snapshot, v float64) { s.RequestLatency.P99 = time.Duration(v) }},
+	"Max":              {func(s *Snapshot) float64 { return float64(s.RequestLatency.Max) }, func(s *Snapshot, v float64) { s.RequestLatency.Max = time.Duration(v) }},
+}
+
+type snapshotKey struct {
+	scenario string
+	name     string
+	hsName   string
+}
+
+// aggregateSnapshots returns a snapshot for each span and homeserver in the iterations, in the order of the first
+// iteration, with each metric set to its mean over all iterations and Stats set. Per-endpoint latencies are
+// taken from the first iteration, as endpoints may differ between iterations.
+func aggregateSnapshots(iterations [][]Snapshot) []Snapshot {
+	if len(iterations) == 0 {
+		return nil
+	}
+	samples := make(map[snapshotKey][]*Snapshot)
+	for _, snapshots := range iterations {
+		for i := range snapshots {
+			s := &snapshots[i]
+			key := snapshotKey{s.Scenario, s.Name, s.HSName}
+			samples[key] = append(samples[key], s)
+		}
+	}
+	aggregated := make([]Snapshot, len(iterations[0]))
+	for i, first := range iterations[0] {
+		agg := first
+		agg.Stats = make(map[string]Stats)
+		ss := samples[snapshotKey{first.Scenario, first.Name, first.HSName}]
+		for name, m := range snapshotMetrics {
+			xs := make([]float64, len(ss))
+			for j, s := range ss {
+				xs[j] = m.get(s)
+			}
+			st := computeStats(xs)
+			agg.Stats[name] = st
+			m.set(&agg, st.Mean)
+		}
+		aggregated[i] = agg
+	}
+	return aggregated
+}
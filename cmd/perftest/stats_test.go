@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestComputeStats(t *testing.T) {
+	alternating := func(n int) (xs []float64) {
+		for i := 0; i < n; i++ {
+			xs = append(xs, float64(2*(i%2)))
+		}
+		return xs
+	}
+	// 15 twos and 16 zeros
+	mean31 := 30.0 / 31
+	stdDev31 := math.Sqrt((15*math.Pow(2-mean31, 2) + 16*math.Pow(mean31, 2)) / 30)
+	testCases := []struct {
+		name string
+		xs   []float64
+		want Stats
+	}{
+		{"no samples", nil, Stats{}},
+		{"one sample has no spread", []float64{4}, Stats{N: 1, Mean: 4, Min: 4, Max: 4}},
+		{"two samples use df=1", []float64{3, 1}, Stats{N: 2, Mean: 2, StdDev: math.Sqrt2, CI95: 12.706, Min: 1, Max: 3}},
+		{
+			"sample standard deviation",
+			[]float64{2, 4, 4, 4, 5, 5, 7, 9},
+			Stats{N: 8, Mean: 5, StdDev: math.Sqrt(32.0 / 7), CI95: 2.365 * math.Sqrt(32.0/7) / math.Sqrt(8), Min: 2, Max: 9},
+		},
+		{
+			"largest tabled df",
+			alternating(31),
+			Stats{N: 31, Mean: mean31, StdDev: stdDev31, CI95: 2.042 * stdDev31 / math.Sqrt(31), Min: 0, Max: 2},
+		},
+		{
+			"normal approximation beyond the table",
+			alternating(32),
+			Stats{N: 32, Mean: 1, StdDev: math.Sqrt(32.0 / 31), CI95: 1.96 * math.Sqrt(32.0/31) / math.Sqrt(32), Min: 0, Max: 2},
+		},
+	}
+
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for _, tc := range testCases {
+		got := computeStats(tc.xs)
+		if got.N != tc.want.N || !near(got.Mean, tc.want.Mean) || !near(got.StdDev, tc.want.StdDev) ||
+			!near(got.CI95, tc.want.CI95) || got.Min != tc.want.Min || got.Max != tc.want.Max {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAggregateSnapshots(t *testing.T) {
+	iteration := func(duration time.Duration, endpoint string) []Snapshot {
+		return []Snapshot{
+			{Scenario: "s", Name: "setup", HSName: "hs1", Duration: duration, Latencies: []EndpointLatency{{Endpoint: endpoint}}},
+			{Scenario: "s", Name: "setup", HSName: "hs2", Duration: 2 * duration},
+		}
+	}
+	got := aggregateSnapshots([][]Snapshot{
+		iteration(time.Second, "GET /first"),
+		iteration(3*time.Second, "GET /second"),
+	})
+	if len(got) != 2 {
+		t.Fatalf("got %d snapshots want 2", len(got))
+	}
+	if got[0].HSName != "hs1" || got[1].HSName != "hs2" {
+		t.Errorf("snapshots are not in the order of the first iteration: %s, %s", got[0].HSName, got[1].HSName)
+	}
+	if got[0].Duration != 2*time.Second || got[1].Duration != 4*time.Second {
+		t.Errorf("got durations %v, %v want the means 2s, 4s", got[0].Duration, got[1].Duration)
+	}
+	if st := got[0].Stats["Duration"]; st.N != 2 || st.Min != float64(time.Second) || st.Max != float64(3*time.Second) {
+		t.Errorf("got Duration stats %+v", st)
+	}
+	if len(got[0].Latencies) != 1 || got[0].Latencies[0].Endpoint != "GET /first" {
+		t.Errorf("per-endpoint latencies were not taken from the first iteration: %+v", got[0].Latencies)
+	}
+	if len(aggregateSnapshots(nil)) != 0 {
+		t.Errorf("aggregating no iterations returned snapshots")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// Timeline is the resource usage of each homeserver sampled at a fixed interval over a whole scenario run, so
+// spikes within a span can be seen. Times are relative to when sampling started, just after deployment.
+type Timeline struct {
+	Scenario  string
+	Iteration int
+	Interval  time.Duration
+	Spans     []SpanMarker
+	// hs name -> samples in time order
+	Samples map[string][]TimelineSample
+}
+
+// SpanMarker is when a span started and ended.
+type SpanMarker struct {
+	Name  string
+	Start time.Duration
+	End   time.Duration
+}
+
+// TimelineSample is a single sample of a homeserver. CPU, IO and network values are cumulative since the
+// container started.
+type TimelineSample struct {
+	Time         time.Duration
+	MemoryUsage  uint64
+	CPUUserland  uint64
+	CPUKernel    uint64
+	BytesRead    uint64
+	BytesWritten uint64
+	RxBytes      int64
+	TxBytes      int64
+}
+
+// spanTime is the wall clock time a span ran for.
+type spanTime struct {
+	name       string
+	start, end time.Time
+}
+
+// newTimeline converts the samples taken by the sampler, which must be stopped, into a timeline.
+func newTimeline(scenario string, sampler *docker.StatsSampler, hsNames []string, start time.Time, interval time.Duration, spans []spanTime) *Timeline {
+	tl := &Timeline{
+		Scenario: scenario,
+		Interval: interval,
+		Samples:  make(map[string][]TimelineSample),
+	}
+	for _, span := range spans {
+		tl.Spans = append(tl.Spans, SpanMarker{
+			Name:  span.name,
+			Start: span.start.Sub(start),
+			End:   span.end.Sub(start),
+		})
+	}
+	sort.Strings(hsNames)
+	for _, hsName := range hsNames {
+		for _, cs := range sampler.Samples(hsName) {
+			tl.Samples[hsName] = append(tl.Samples[hsName], TimelineSample{
+				Time:         cs.Timestamp.Sub(start),
+				MemoryUsage:  cs.MemoryUsage,
+				CPUUserland:  cs.CPUUserland,
+				CPUKernel:    cs.CPUKernel,
+				BytesRead:    cs.BytesRead,
+				BytesWritten: cs.BytesWritten,
+				RxBytes:      cs.RxBytes,
+				TxBytes:      cs.TxBytes,
+			})
+		}
+	}
+	return tl
+}
@@ -1,11 +1,13 @@
 // go run ./sytest_coverage.go
-// Add -v to see verbose output.
+// Add -v to see verbose output, -format json|markdown for machine-readable output and -diff old.json to compare.
 
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"go/ast"
 	"go/parser"
 	"go/token"
 	"io/ioutil"
@@ -26,27 +28,38 @@ var (
 
 var debug bool
 var verbose bool
+var format string
+var diffFile string
 
 func init() {
-	debugFlag := flag.Bool("d", false, "debug mode")
-	verboseFlag := flag.Bool("v", false, "verbose mode")
-
-	flag.Parse()
-
-	debug = *debugFlag
-	verbose = *verboseFlag
+	flag.BoolVar(&debug, "d", false, "debug mode")
+	flag.BoolVar(&verbose, "v", false, "verbose mode")
+	flag.StringVar(&format, "format", "text", "output format: text, json or markdown")
+	flag.StringVar(&diffFile, "diff", "", "a previous -format json report to show changes since")
 }
 
 // Maps test names to filenames then looks for:
-//   sytest: $test_name
+//
+//	sytest: $test_name
+//
 // in all files in ./tests - if there's a match it marks that test as converted.
 func main() {
+	flag.Parse()
+	filenameToTestName, testNameToFilename, allTestNames := getList()
 
-	filenameToTestName, testNameToFilename := getList()
-
-	total := len(testNameToFilename)
+	var previous *Report
+	if diffFile != "" {
+		b, err := ioutil.ReadFile(diffFile)
+		if err != nil {
+			panic(err)
+		}
+		if err = json.Unmarshal(b, &previous); err != nil {
+			panic(fmt.Sprintf("failed to parse %s as a JSON report: %s", diffFile, err))
+		}
+	}
 
-	convertedTests := make(map[string]bool)
+	convertedTests := make(map[string][]string) // test name -> locations
+	var unknownMarkers []Marker
 
 	// Walk all files defined under ./tests
 	// we already panic inside Walk, so we can ignore the error
@@ -61,51 +74,97 @@ func main() {
 			panic(err)
 		}
 		for _, cmt := range astFile.Comments {
-			comment := strings.TrimSpace(cmt.Text())
-			lines := strings.Split(comment, "\n")
-			for _, line := range lines {
-				_, ok := testNameToFilename[line]
-				if !ok {
-					if debug && strings.Contains(line, "sytest:") {
-						fmt.Printf("Found unrecognised sytest marker in %s: %v\n", path, line)
+			for _, c := range cmt.List {
+				for i, line := range commentLines(c) {
+					lineNum := fset.Position(c.Slash).Line + i
+					_, ok := testNameToFilename[line]
+					if !ok {
+						if !strings.HasPrefix(line, "sytest:") || allTestNames[line] {
+							continue
+						}
+						if debug {
+							fmt.Fprintf(os.Stderr, "Found unrecognised sytest marker in %s: %v\n", path, line)
+						}
+						unknownMarkers = append(unknownMarkers, Marker{
+							Name: strings.TrimSpace(strings.TrimPrefix(line, "sytest:")),
+							File: path,
+							Line: lineNum,
+						})
+						continue
 					}
-					continue
+					convertedTests[line] = append(convertedTests[line], fmt.Sprintf("%s:%d", path, lineNum))
 				}
-				convertedTests[line] = true
 			}
 		}
 		return nil
 	})
 
-	numComplementTests := len(convertedTests)
-	for _, fname := range sorted(filenameToTestName) {
-		testNames := filenameToTestName[fname]
-		convertedTestsInFile := 0
-		// try to find the filename
-		for i := range testNames {
-			// see if this test was converted
-			if convertedTests[testNames[i]] {
-				convertedTestsInFile++
-				testNames[i] = "✓ " + strings.TrimPrefix(testNames[i], "sytest: ")
-			} else {
-				testNames[i] = "× " + strings.TrimPrefix(testNames[i], "sytest: ")
-			}
-		}
-		fmt.Printf("%s %d/%d tests\n", fname, convertedTestsInFile, len(testNames))
-		if !verbose || convertedTestsInFile == 0 {
-			continue
+	report := newReport(filenameToTestName, testNameToFilename, convertedTests, unknownMarkers)
+	if previous != nil {
+		report.Diff = diffReports(previous, report)
+	}
+
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			panic(err)
 		}
-		for _, tn := range testNames {
-			fmt.Printf("    %s\n", tn)
+		fmt.Println(string(b))
+	case "markdown":
+		fmt.Print(report.Markdown(verbose))
+	case "text":
+		printText(report)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format '%s', must be text, json or markdown\n", format)
+		os.Exit(2)
+	}
+}
+
+func printText(report *Report) {
+	for _, area := range report.Areas {
+		for _, file := range area.Files {
+			fmt.Printf("%s %d/%d tests\n", file.Name, file.Converted, file.Total)
+			if !verbose || file.Converted == 0 {
+				continue
+			}
+			for _, t := range file.Tests {
+				if t.Converted {
+					fmt.Printf("    ✓ %s\n", t.Name)
+				} else {
+					fmt.Printf("    × %s\n", t.Name)
+				}
+			}
+			fmt.Println()
 		}
-		fmt.Println()
 	}
-	fmt.Printf("\nTOTAL: %d/%d tests converted\n", numComplementTests, total)
+	fmt.Printf("\nTOTAL: %d/%d tests converted\n", report.Converted, report.Total)
+	for _, m := range report.UnknownMarkers {
+		fmt.Printf("Unknown sytest marker at %s:%d: %s\n", m.File, m.Line, m.Name)
+	}
+	if report.Diff != nil {
+		fmt.Print(report.Diff.String())
+	}
+}
+
+// commentLines returns the trimmed lines of the comment, without comment markers.
+func commentLines(c *ast.Comment) []string {
+	text := c.Text
+	if strings.HasPrefix(text, "//") {
+		text = text[2:]
+	} else {
+		text = strings.TrimSuffix(strings.TrimPrefix(text, "/*"), "*/")
+	}
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return lines
 }
 
 // filenameToTestName and testNameToFilename
-// will filter ignored tests
-func getList() (map[string][]string, map[string]string) {
+// will filter ignored tests. allTestNames includes ignored tests.
+func getList() (map[string][]string, map[string]string, map[string]bool) {
 	var ignoredTests = make(map[string]bool)
 	var ignoredPaths []string
 	ignoredBody, err := ioutil.ReadFile("./sytest.ignored.list")
@@ -135,12 +194,14 @@ func getList() (map[string][]string, map[string]string) {
 	testLines := strings.Split(string(body), "\n")
 	filenameToTestName := make(map[string][]string)
 	testNameToFilename := make(map[string]string)
+	allTestNames := make(map[string]bool)
 lines:
 	for _, line := range testLines {
 		name, filename := extract(line)
 		if name == "" || filename == "" {
 			continue
 		}
+		allTestNames["sytest: "+strings.TrimSpace(name)] = true
 		if _, ok := ignoredTests[name]; ok {
 			continue
 		}
@@ -154,7 +215,7 @@ lines:
 		testNameToFilename[name] = strings.TrimSpace(filename)
 	}
 
-	return filenameToTestName, testNameToFilename
+	return filenameToTestName, testNameToFilename, allTestNames
 }
 
 func sorted(in map[string][]string) []string {
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Report is the coverage of sytest by Complement, grouped by area (the top level directory in sytest's ./tests, or
+// the file if it is not in a directory) then by file.
+type Report struct {
+	// The number of unique test names converted and in sytest, which is less than the sum of the areas as some
+	// test names appear in several files.
+	Converted      int
+	Total          int
+	Percent        float64
+	Areas          []AreaReport
+	UnknownMarkers []Marker `json:",omitempty"`
+	// Set if a previous report was given with -diff
+	Diff *Diff `json:",omitempty"`
+}
+
+type AreaReport struct {
+	Name      string
+	Converted int
+	Total     int
+	Percent   float64
+	Files     []FileReport
+}
+
+type FileReport struct {
+	Name      string
+	Converted int
+	Total     int
+	Percent   float64
+	Tests     []TestReport
+}
+
+type TestReport struct {
+	Name      string
+	Converted bool
+	// Where the sytest markers for this test are, as path:line
+	Locations []string `json:",omitempty"`
+}
+
+// Marker is a sytest marker which does not match any test in sytest.list.
+type Marker struct {
+	Name string
+	File string
+	Line int
+}
+
+// Diff is what changed since a previous report.
+type Diff struct {
+	PreviousConverted int
+	PreviousTotal     int
+	Converted         int
+	Total             int
+	// "file: test name" for tests converted since the previous report
+	NewlyConverted []string
+	// "file: test name" for tests which were converted in the previous report, but no longer are
+	Lost  []string
+	Areas []AreaDiff
+}
+
+// AreaDiff is how the coverage of an area changed. Only areas which changed are included.
+type AreaDiff struct {
+	Name              string
+	PreviousConverted int
+	Converted         int
+	PreviousTotal     int
+	Total             int
+}
+
+func percent(converted, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(converted) / float64(total)
+}
+
+// areaName returns the area of a sytest file, e.g "31sync/16room-summary" is in "31sync".
+func areaName(filename string) string {
+	area, _, _ := strings.Cut(filename, "/")
+	return area
+}
+
+func newReport(filenameToTestName map[string][]string, testNameToFilename map[string]string, convertedTests map[string][]string, unknownMarkers []Marker) *Report {
+	report := &Report{
+		Converted:      len(convertedTests),
+		Total:          len(testNameToFilename),
+		UnknownMarkers: unknownMarkers,
+	}
+	areas := make(map[string]*AreaReport)
+	var areaNames []string
+	for _, fname := range sorted(filenameToTestName) {
+		file := FileReport{
+			Name: fname,
+		}
+		for _, testName := range filenameToTestName[fname] {
+			locations := convertedTests[testName]
+			t := TestReport{
+				Name:      strings.TrimPrefix(testName, "sytest: "),
+				Converted: len(locations) > 0,
+				Locations: locations,
+			}
+			if t.Converted {
+				file.Converted++
+			}
+			file.Tests = append(file.Tests, t)
+		}
+		file.Total = len(file.Tests)
+		file.Percent = percent(file.Converted, file.Total)
+
+		name := areaName(fname)
+		area, ok := areas[name]
+		if !ok {
+			area = &AreaReport{Name: name}
+			areas[name] = area
+			areaNames = append(areaNames, name)
+		}
+		area.Files = append(area.Files, file)
+		area.Converted += file.Converted
+		area.Total += file.Total
+	}
+	for _, name := range areaNames {
+		area := areas[name]
+		area.Percent = percent(area.Converted, area.Total)
+		report.Areas = append(report.Areas, *area)
+	}
+	report.Percent = percent(report.Converted, report.Total)
+	sort.Slice(report.UnknownMarkers, func(i, j int) bool {
+		a, b := report.UnknownMarkers[i], report.UnknownMarkers[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	return report
+}
+
+// convertedSet returns "file: test name" for every converted test.
+func (r *Report) convertedSet() map[string]bool {
+	set := make(map[string]bool)
+	for _, area := range r.Areas {
+		for _, file := range area.Files {
+			for _, t := range file.Tests {
+				if t.Converted {
+					set[file.Name+": "+t.Name] = true
+				}
+			}
+		}
+	}
+	return set
+}
+
+func diffReports(previous, current *Report) *Diff {
+	diff := &Diff{
+		PreviousConverted: previous.Converted,
+		PreviousTotal:     previous.Total,
+		Converted:         current.Converted,
+		Total:             current.Total,
+	}
+	before := previous.convertedSet()
+	after := current.convertedSet()
+	for t := range after {
+		if !before[t] {
+			diff.NewlyConverted = append(diff.NewlyConverted, t)
+		}
+	}
+	for t := range before {
+		if !after[t] {
+			diff.Lost = append(diff.Lost, t)
+		}
+	}
+	sort.Strings(diff.NewlyConverted)
+	sort.Strings(diff.Lost)
+
+	prevAreas := make(map[string]AreaReport)
+	for _, area := range previous.Areas {
+		prevAreas[area.Name] = area
+	}
+	seen := make(map[string]bool)
+	addArea := func(name string, prev, cur AreaReport) {
+		seen[name] = true
+		if prev.Converted == cur.Converted && prev.Total == cur.Total {
+			return
+		}
+		diff.Areas = append(diff.Areas, AreaDiff{
+			Name:              name,
+			PreviousConverted: prev.Converted,
+			Converted:         cur.Converted,
+			PreviousTotal:     prev.Total,
+			Total:             cur.Total,
+		})
+	}
+	for _, area := range current.Areas {
+		addArea(area.Name, prevAreas[area.Name], area)
+	}
+	for _, area := range previous.Areas {
+		if !seen[area.Name] {
+			addArea(area.Name, area, AreaReport{})
+		}
+	}
+	sort.Slice(diff.Areas, func(i, j int) bool {
+		return diff.Areas[i].Name < diff.Areas[j].Name
+	})
+	return diff
+}
+
+// String returns the diff as text.
+func (d *Diff) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\nSINCE PREVIOUS REPORT: %d/%d -> %d/%d tests converted\n", d.PreviousConverted, d.PreviousTotal, d.Converted, d.Total)
+	for _, a := range d.Areas {
+		fmt.Fprintf(&sb, "  %s %d/%d -> %d/%d\n", a.Name, a.PreviousConverted, a.PreviousTotal, a.Converted, a.Total)
+	}
+	for _, t := range d.NewlyConverted {
+		fmt.Fprintf(&sb, "  + %s\n", t)
+	}
+	for _, t := range d.Lost {
+		fmt.Fprintf(&sb, "  - %s\n", t)
+	}
+	return sb.String()
+}
+
+// Markdown returns the report as Markdown. If verbose, every test in each area is listed.
+func (r *Report) Markdown(verbose bool) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Sytest coverage\n\n**%d/%d** tests converted (%.1f%%)\n\n", r.Converted, r.Total, r.Percent)
+	sb.WriteString("| Area | Converted | Total | % |\n|---|---:|---:|---:|\n")
+	for _, area := range r.Areas {
+		fmt.Fprintf(&sb, "| %s | %d | %d | %.1f%% |\n", area.Name, area.Converted, area.Total, area.Percent)
+	}
+	if d := r.Diff; d != nil {
+		fmt.Fprintf(&sb, "\n## Changes since previous report\n\n%d/%d → %d/%d tests converted\n\n", d.PreviousConverted, d.PreviousTotal, d.Converted, d.Total)
+		if len(d.Areas) > 0 {
+			sb.WriteString("| Area | Before | After |\n|---|---:|---:|\n")
+			for _, a := range d.Areas {
+				fmt.Fprintf(&sb, "| %s | %d/%d | %d/%d |\n", a.Name, a.PreviousConverted, a.PreviousTotal, a.Converted, a.Total)
+			}
+			sb.WriteString("\n")
+		}
+		writeList(&sb, "Newly converted", d.NewlyConverted)
+		writeList(&sb, "No longer converted", d.Lost)
+	}
+	if len(r.UnknownMarkers) > 0 {
+		sb.WriteString("\n## Unknown sytest markers\n\nThese markers do not match any test in `sytest.list`:\n\n")
+		for _, m := range r.UnknownMarkers {
+			fmt.Fprintf(&sb, "- `%s:%d`: %s\n", m.File, m.Line, markdownEscape(m.Name))
+		}
+	}
+	if !verbose {
+		return sb.String()
+	}
+	sb.WriteString("\n## Tests\n")
+	for _, area := range r.Areas {
+		fmt.Fprintf(&sb, "\n### %s (%d/%d)\n", area.Name, area.Converted, area.Total)
+		for _, file := range area.Files {
+			fmt.Fprintf(&sb, "\n#### %s (%d/%d)\n\n", file.Name, file.Converted, file.Total)
+			for _, t := range file.Tests {
+				check := " "
+				if t.Converted {
+					check = "x"
+				}
+				fmt.Fprintf(&sb, "- [%s] %s\n", check, markdownEscape(t.Name))
+			}
+		}
+	}
+	return sb.String()
+}
+
+func writeList(sb *strings.Builder, title string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Fprintf(sb, "### %s (%d)\n\n", title, len(items))
+	for _, item := range items {
+		fmt.Fprintf(sb, "- %s\n", markdownEscape(item))
+	}
+	sb.WriteString("\n")
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "<", `\<`, "|", `\|`)
+
+func markdownEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
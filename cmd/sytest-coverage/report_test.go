@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testReport builds a report from sytest files of the form "file: test,test" where converted tests are prefixed with +
+func testReport(files ...string) *Report {
+	filenameToTestName := make(map[string][]string)
+	testNameToFilename := make(map[string]string)
+	convertedTests := make(map[string][]string)
+	for _, f := range files {
+		fname, tests, _ := strings.Cut(f, ": ")
+		for _, name := range strings.Split(tests, ",") {
+			converted := strings.HasPrefix(name, "+")
+			name = "sytest: " + strings.TrimPrefix(name, "+")
+			filenameToTestName[fname] = append(filenameToTestName[fname], name)
+			testNameToFilename[name] = fname
+			if converted {
+				convertedTests[name] = []string{"tests/" + fname + "_test.go:1"}
+			}
+		}
+	}
+	return newReport(filenameToTestName, testNameToFilename, convertedTests, []Marker{
+		{Name: "sytest: b", File: "z_test.go", Line: 1},
+		{Name: "sytest: a", File: "a_test.go", Line: 9},
+		{Name: "sytest: c", File: "a_test.go", Line: 2},
+	})
+}
+
+func TestNewReport(t *testing.T) {
+	r := testReport("31sync/01filter: +A,B", "31sync/02sync: +C,+D", "10apidoc/01register: E", "90jira: F")
+	if r.Converted != 3 || r.Total != 6 || r.Percent != 50 {
+		t.Errorf("got %d/%d (%v%%) want 3/6 (50%%)", r.Converted, r.Total, r.Percent)
+	}
+	testCases := []struct {
+		area      string
+		files     string
+		converted int
+		total     int
+		percent   float64
+	}{
+		{"10apidoc", "10apidoc/01register", 0, 1, 0},
+		{"31sync", "31sync/01filter,31sync/02sync", 3, 4, 75},
+		{"90jira", "90jira", 0, 1, 0},
+	}
+	if len(r.Areas) != len(testCases) {
+		t.Fatalf("got %d areas want %d: %+v", len(r.Areas), len(testCases), r.Areas)
+	}
+	for i, tc := range testCases {
+		area := r.Areas[i]
+		var files []string
+		for _, f := range area.Files {
+			files = append(files, f.Name)
+		}
+		if area.Name != tc.area || strings.Join(files, ",") != tc.files || area.Converted != tc.converted ||
+			area.Total != tc.total || area.Percent != tc.percent {
+			t.Errorf("area %d: got %s with files %v %d/%d (%v%%), want %s with files %s %d/%d (%v%%)",
+				i, area.Name, files, area.Converted, area.Total, area.Percent, tc.area, tc.files, tc.converted, tc.total, tc.percent)
+		}
+	}
+	filter := r.Areas[1].Files[0]
+	if filter.Tests[0].Name != "A" || !filter.Tests[0].Converted || filter.Tests[0].Locations[0] != "tests/31sync/01filter_test.go:1" {
+		t.Errorf("got test %+v, want A converted without the sytest prefix", filter.Tests[0])
+	}
+	if filter.Tests[1].Converted || len(filter.Tests[1].Locations) != 0 {
+		t.Errorf("got test %+v, want B not converted", filter.Tests[1])
+	}
+	var markers []string
+	for _, m := range r.UnknownMarkers {
+		markers = append(markers, m.File+":"+m.Name)
+	}
+	if got := strings.Join(markers, ","); got != "a_test.go:sytest: c,a_test.go:sytest: a,z_test.go:sytest: b" {
+		t.Errorf("unknown markers are not sorted by file then line: %s", got)
+	}
+}
+
+func TestDiffReports(t *testing.T) {
+	previous := testReport("31sync/01filter: +A,B", "31sync/02sync: +C", "40presence: +P", "50old: +O")
+	current := testReport("31sync/01filter: +A,+B", "31sync/02sync: C", "40presence: +P", "60new: N")
+	diff := diffReports(previous, current)
+	if diff.PreviousConverted != 4 || diff.PreviousTotal != 5 || diff.Converted != 3 || diff.Total != 5 {
+		t.Errorf("got %d/%d -> %d/%d want 4/5 -> 3/5", diff.PreviousConverted, diff.PreviousTotal, diff.Converted, diff.Total)
+	}
+	if got := strings.Join(diff.NewlyConverted, ","); got != "31sync/01filter: B" {
+		t.Errorf("got newly converted %s", got)
+	}
+	if got := strings.Join(diff.Lost, ","); got != "31sync/02sync: C,50old: O" {
+		t.Errorf("got lost %s", got)
+	}
+	want := []AreaDiff{
+		{Name: "50old", PreviousConverted: 1, PreviousTotal: 1},
+		{Name: "60new", Total: 1},
+	}
+	// 31sync is unchanged overall, as one test was converted and another lost, and 40presence did not change
+	if len(diff.Areas) != len(want) {
+		t.Fatalf("got areas %+v want %+v", diff.Areas, want)
+	}
+	for i := range want {
+		if diff.Areas[i] != want[i] {
+			t.Errorf("area %d: got %+v want %+v", i, diff.Areas[i], want[i])
+		}
+	}
+	if s := diff.String(); !strings.Contains(s, "4/5 -> 3/5") || !strings.Contains(s, "+ 31sync/01filter: B") || !strings.Contains(s, "- 50old: O") {
+		t.Errorf("unexpected diff text:\n%s", s)
+	}
+}
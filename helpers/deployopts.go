@@ -0,0 +1,25 @@
+package helpers
+
+// DeployOpts configures a deployment made via complement.DeployWithOptions.
+type DeployOpts struct {
+	NumServers int // the number of servers to deploy, named hs1, hs2, ... hsN
+	// Per-server options, keyed on the server name e.g "hs1". Servers without options use the defaults.
+	// Deployments with per-server options are always dedicated.
+	Servers map[string]HomeserverOpts
+	// If true, the deployment will never be a dirty deployment, even if COMPLEMENT_ENABLE_DIRTY_RUNS is
+	// set. Use this for tests which would pollute other tests, or be polluted by them.
+	Dedicated bool
+}
+
+type HomeserverOpts struct {
+	BaseImageURI string            // default '' (COMPLEMENT_BASE_IMAGE or COMPLEMENT_BASE_IMAGE_*)
+	Env          map[string]string // default nil (only environment variables from COMPLEMENT_SHARE_ENV_PREFIX)
+	Files        map[string][]byte // default nil; container path to file contents, copied before the server starts
+	HostMounts   []HostMount       // default nil (only mounts from COMPLEMENT_HOST_MOUNTS)
+}
+
+type HostMount struct {
+	HostPath      string
+	ContainerPath string
+	ReadOnly      bool
+}
@@ -14,6 +14,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/docker/go-units"
 )
 
 type HostMount struct {
@@ -116,6 +118,20 @@ type Complement struct {
 	// called exactly once at the end of the test suite, and is called with the TestName of "COMPLEMENT_ENABLE_DIRTY_RUNS"
 	// and TestFailed=false.
 	PostTestScript string
+
+	// Name: COMPLEMENT_CONTAINER_CPU_CORES
+	// Default: 0
+	// Description: The number of CPU cores each homeserver container may use, e.g `0.5` or `2`. If 0, the
+	// container may use all CPUs on the host. Useful for reproducing behaviour seen in low-resource
+	// environments such as CI runners.
+	ContainerCPUCores float64
+
+	// Name: COMPLEMENT_CONTAINER_MEMORY
+	// Default: 0
+	// Description: The maximum amount of memory each homeserver container may use, e.g `512m` or `2g`.
+	// If 0, the container has no memory limit. Containers which exceed this limit are killed by Docker,
+	// which will cause the test to fail.
+	ContainerMemoryBytes int64
 }
 
 var hsRegex = regexp.MustCompile(`COMPLEMENT_BASE_IMAGE_(.+)=(.+)$`)
@@ -146,6 +162,18 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 			panic("COMPLEMENT_HOST_MOUNTS parse error: " + err.Error())
 		}
 	}
+	if cpuCores := os.Getenv("COMPLEMENT_CONTAINER_CPU_CORES"); cpuCores != "" {
+		cfg.ContainerCPUCores, err = strconv.ParseFloat(cpuCores, 64)
+		if err != nil {
+			panic("COMPLEMENT_CONTAINER_CPU_CORES parse error: " + err.Error())
+		}
+	}
+	if memory := os.Getenv("COMPLEMENT_CONTAINER_MEMORY"); memory != "" {
+		cfg.ContainerMemoryBytes, err = units.RAMInBytes(memory)
+		if err != nil {
+			panic("COMPLEMENT_CONTAINER_MEMORY parse error: " + err.Error())
+		}
+	}
 	if cfg.BaseImageURI == "" {
 		panic("COMPLEMENT_BASE_IMAGE must be set")
 	}
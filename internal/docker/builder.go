@@ -15,6 +15,7 @@ package docker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -27,6 +28,7 @@ import (
 	"github.com/docker/go-connections/nat"
 
 	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/internal/config"
 	"github.com/matrix-org/complement/internal/instruction"
 )
@@ -40,6 +42,9 @@ var (
 
 const complementLabel = "complement_context"
 
+// baseImageLabel is the label on blueprint images which records the base image they were built from.
+const baseImageLabel = "complement_base_image"
+
 type Builder struct {
 	Config *config.Complement
 	Docker *client.Client
@@ -246,19 +251,17 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 	}
 
 	runner := instruction.NewRunner(bprint.Name, d.Config.BestEffort, d.Config.DebugLoggingEnabled)
+	// if homeservers depend on each other, they must all be running before any instructions are run
+	scheduled := b.HasDependencies(bprint)
 	results := make([]result, len(bprint.Homeservers))
 	for i, hs := range bprint.Homeservers {
-		res := d.constructHomeserver(bprint.Name, runner, hs, networkName)
+		res := d.constructHomeserver(bprint.Name, runner, hs, networkName, !scheduled)
 		if res.err != nil {
 			errs = append(errs, res.err)
-			if res.containerID != "" {
-				// something went wrong, but we have a container which may have interesting logs
-				printLogs(d.Docker, res.containerID, res.contextStr)
-			}
-			if delErr := d.Docker.ContainerRemove(context.Background(), res.containerID, types.ContainerRemoveOptions{
-				Force: true,
-			}); delErr != nil {
-				d.log("%s: failed to remove container which failed to deploy: %s", res.contextStr, delErr)
+			d.removeFailedContainer(res)
+			// the homeservers which were already set up won't be committed, so remove them too
+			for _, started := range results[:i] {
+				d.removeContainer(started)
 			}
 			// there is little point continuing to set up the remaining homeservers at this point
 			return
@@ -286,6 +289,28 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 		results[i] = res
 	}
 
+	if scheduled {
+		hsURLs := make([]string, len(results))
+		for i, res := range results {
+			hsURLs[i] = res.baseURL
+		}
+		if err := runner.RunScheduled(bprint.Homeservers, hsURLs); err != nil {
+			d.log("%s : failed to run instructions: %s\n", bprint.Name, err)
+			errs = append(errs, err)
+			// the error says which homeserver failed if it was a request, else we don't know so print
+			// all their logs. None of them will be committed, so remove them all.
+			var instrErr *instruction.InstructionError
+			for _, res := range results {
+				if !errors.As(err, &instrErr) || instrErr.Homeserver == res.homeserver.Name {
+					d.removeFailedContainer(res)
+				} else {
+					d.removeContainer(res)
+				}
+			}
+			return
+		}
+	}
+
 	// commit containers
 	for _, res := range results {
 		if res.err != nil {
@@ -294,6 +319,7 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 		// collect and store access tokens as labels 'access_token_$userid: $token'
 		labels := make(map[string]string)
 		accessTokens := runner.AccessTokens(res.homeserver.Name)
+		deviceTokens := runner.DeviceAccessTokens(res.homeserver.Name)
 		if len(bprint.KeepAccessTokensForUsers) > 0 {
 			// only keep access tokens for specified users
 			for _, userID := range bprint.KeepAccessTokensForUsers {
@@ -301,12 +327,20 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 				if ok {
 					labels["access_token_"+userID] = tok
 				}
+				for deviceID, tok := range deviceTokens[userID] {
+					labels[deviceTokenLabel(userID, deviceID)] = tok
+				}
 			}
 		} else {
 			// keep all tokens
 			for k, v := range accessTokens {
 				labels["access_token_"+k] = v
 			}
+			for userID, tokens := range deviceTokens {
+				for deviceID, tok := range tokens {
+					labels[deviceTokenLabel(userID, deviceID)] = tok
+				}
+			}
 		}
 
 		deviceIDs := runner.DeviceIDs(res.homeserver.Name)
@@ -319,6 +353,8 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 		for k, v := range asLabels {
 			labels[k] = v
 		}
+		// record the base image, so users of the image can check where it came from
+		labels[baseImageLabel] = d.baseImageURI(res.homeserver)
 
 		// Stop the container before we commit it.
 		// This gives it chance to shut down gracefully.
@@ -362,8 +398,26 @@ func toChanges(labels map[string]string) []string {
 	return changes
 }
 
-// construct this homeserver and execute its instructions, keeping the container alive.
-func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.Runner, hs b.Homeserver, networkName string) result {
+// removeFailedContainer prints the logs of a homeserver which failed to be constructed then removes its container.
+func (d *Builder) removeFailedContainer(res result) {
+	if res.containerID != "" {
+		// something went wrong, but we have a container which may have interesting logs
+		printLogs(d.Docker, res.containerID, res.contextStr)
+	}
+	d.removeContainer(res)
+}
+
+// removeContainer removes a container which will not be committed.
+func (d *Builder) removeContainer(res result) {
+	if delErr := d.Docker.ContainerRemove(context.Background(), res.containerID, types.ContainerRemoveOptions{
+		Force: true,
+	}); delErr != nil {
+		d.log("%s: failed to remove container: %s", res.contextStr, delErr)
+	}
+}
+
+// construct this homeserver and execute its instructions if runInstructions is true, keeping the container alive.
+func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.Runner, hs b.Homeserver, networkName string, runInstructions bool) result {
 	contextStr := fmt.Sprintf("%s.%s.%s", d.Config.PackageNamespace, blueprintName, hs.Name)
 	d.log("%s : constructing homeserver...\n", contextStr)
 	dep, err := d.deployBaseImage(blueprintName, hs, contextStr, networkName)
@@ -381,39 +435,62 @@ func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.
 		}
 	}
 	d.log("%s : deployed base image to %s (%s)\n", contextStr, dep.BaseURL, dep.ContainerID)
-	err = runner.Run(hs, dep.BaseURL)
-	if err != nil {
-		d.log("%s : failed to run instructions: %s\n", contextStr, err)
+	if runInstructions {
+		err = runner.Run(hs, dep.BaseURL)
+		if err != nil {
+			d.log("%s : failed to run instructions: %s\n", contextStr, err)
+		}
 	}
 	return result{
 		err:         err,
 		containerID: dep.ContainerID,
 		contextStr:  contextStr,
 		homeserver:  hs,
+		baseURL:     dep.BaseURL,
 	}
 }
 
 // deployBaseImage runs the base image and returns the baseURL, containerID or an error.
 func (d *Builder) deployBaseImage(blueprintName string, hs b.Homeserver, contextStr, networkName string) (*HomeserverDeployment, error) {
 	asIDToRegistrationMap := asIDToRegistrationFromLabels(labelsForApplicationServices(hs))
-	var baseImageURI string
-	if hs.BaseImageURI == nil {
-		baseImageURI = d.Config.BaseImageURI
-		// Use HS specific base image if defined
-		if uri, ok := d.Config.BaseImageURIs[hs.Name]; ok {
-			baseImageURI = uri
-		}
-	} else {
-		baseImageURI = *hs.BaseImageURI
-	}
-
 	return deployImage(
-		d.Docker, baseImageURI, fmt.Sprintf("complement_%s", contextStr),
+		d.Docker, d.baseImageURI(hs), fmt.Sprintf("complement_%s", contextStr),
 		d.Config.PackageNamespace, blueprintName, hs.Name, asIDToRegistrationMap, contextStr,
-		networkName, d.Config,
+		networkName, d.Config, helpers.HomeserverOpts{},
 	)
 }
 
+// baseImageURI returns the base image which this homeserver is built from.
+func (d *Builder) baseImageURI(hs b.Homeserver) string {
+	if hs.BaseImageURI != nil {
+		return *hs.BaseImageURI
+	}
+	// Use HS specific base image if defined
+	if uri, ok := d.Config.BaseImageURIs[hs.Name]; ok {
+		return uri
+	}
+	return d.Config.BaseImageURI
+}
+
+// BaseImages returns the base images which the images of this blueprint were built from, one per image.
+// Images which were built before base images were recorded have an empty base image.
+func (d *Builder) BaseImages(blueprintName string) ([]string, error) {
+	images, err := d.Docker.ImageList(context.Background(), types.ImageListOptions{
+		Filters: label(
+			"complement_pkg="+d.Config.PackageNamespace,
+			"complement_blueprint="+blueprintName,
+		),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("BaseImages: failed to ImageList: %w", err)
+	}
+	baseImages := make([]string, 0, len(images))
+	for _, img := range images {
+		baseImages = append(baseImages, img.Labels[baseImageLabel])
+	}
+	return baseImages, nil
+}
+
 // Multilines label using Dockerfile syntax is unsupported, let's inline \n instead
 func generateASRegistrationYaml(as b.ApplicationService) string {
 	return fmt.Sprintf("id: %s\\n", as.ID) +
@@ -518,4 +595,5 @@ type result struct {
 	containerID string
 	contextStr  string
 	homeserver  b.Homeserver
+	baseURL     string
 }
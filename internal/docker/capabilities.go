@@ -0,0 +1,128 @@
+package docker
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/tidwall/gjson"
+
+	complementRuntime "github.com/matrix-org/complement/runtime"
+)
+
+// CapabilitiesPath is the path to an optional JSON array of capability names in a homeserver image,
+// which will be advertised in addition to any capabilities detected by probing the homeserver.
+const CapabilitiesPath = "/complement/capabilities.json"
+
+// probeCapabilities returns the capabilities advertised by the homeserver, see runtime.SkipUnless.
+func probeCapabilities(docker *client.Client, hsDep *HomeserverDeployment) ([]string, error) {
+	caps, err := capabilitiesFromFile(docker, hsDep.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := getJSON(hsDep.BaseURL+"/_matrix/client/versions", "")
+	if err != nil {
+		return nil, err
+	}
+	versions.Get("versions").ForEach(func(_, v gjson.Result) bool {
+		caps = append(caps, complementRuntime.SpecVersion(v.Str))
+		return true
+	})
+	versions.Get("unstable_features").ForEach(func(k, v gjson.Result) bool {
+		if v.Bool() {
+			caps = append(caps, complementRuntime.UnstableFeature(k.Str))
+		}
+		return true
+	})
+
+	// /capabilities needs an access token, so we can only probe it if there are existing users. Otherwise
+	// the capabilities and room versions it lists are unknown, rather than unsupported.
+	unknown := append(append([]string{}, caps...),
+		complementRuntime.Unknown(complementRuntime.CapabilityPrefixCapability),
+		complementRuntime.Unknown(complementRuntime.CapabilityPrefixRoomVersion),
+	)
+	var accessToken string
+	hsDep.accessTokensMutex.RLock()
+	for _, token := range hsDep.AccessTokens {
+		accessToken = token
+		break
+	}
+	hsDep.accessTokensMutex.RUnlock()
+	if accessToken == "" {
+		return unknown, nil
+	}
+	capabilities, err := getJSON(hsDep.BaseURL+"/_matrix/client/v3/capabilities", accessToken)
+	if err != nil {
+		log.Printf("WARNING: %s: failed to probe /capabilities, runtime.SkipUnless will run tests which need them: %s", hsDep.BaseURL, err)
+		return unknown, nil
+	}
+	capabilities.Get("capabilities").ForEach(func(k, v gjson.Result) bool {
+		if v.Get("enabled").Bool() {
+			caps = append(caps, complementRuntime.Capability(k.Str))
+		}
+		return true
+	})
+	capabilities.Get(`capabilities.m\.room_versions.available`).ForEach(func(k, _ gjson.Result) bool {
+		caps = append(caps, complementRuntime.RoomVersion(k.Str))
+		return true
+	})
+	return caps, nil
+}
+
+// probeClient is used to probe capabilities, so a homeserver which accepts connections but never responds
+// cannot block the deployment forever.
+var probeClient = &http.Client{Timeout: 10 * time.Second}
+
+func getJSON(url, accessToken string) (*gjson.Result, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	res, err := probeClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s => error: %s", url, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("GET %s => HTTP %s", url, res.Status)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s => failed to read body: %s", url, err)
+	}
+	result := gjson.ParseBytes(body)
+	return &result, nil
+}
+
+// capabilitiesFromFile reads CapabilitiesPath from the container, returning no capabilities if it does
+// not exist.
+func capabilitiesFromFile(docker *client.Client, containerID string) ([]string, error) {
+	reader, _, err := docker.CopyFromContainer(context.Background(), containerID, CapabilitiesPath)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to copy %s from container: %s", CapabilitiesPath, err)
+	}
+	defer reader.Close()
+	// the file is returned as a tarball containing the single file
+	tr := tar.NewReader(reader)
+	if _, err = tr.Next(); err != nil {
+		return nil, fmt.Errorf("failed to read %s from container: %s", CapabilitiesPath, err)
+	}
+	var caps []string
+	if err = json.NewDecoder(tr).Decode(&caps); err != nil {
+		return nil, fmt.Errorf("%s is not a JSON array of strings: %s", CapabilitiesPath, err)
+	}
+	return caps, nil
+}
@@ -19,18 +19,21 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 	complementRuntime "github.com/matrix-org/complement/runtime"
 
@@ -39,6 +42,7 @@ import (
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 
+	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/internal/config"
 )
 
@@ -52,8 +56,12 @@ type Deployer struct {
 	DeployNamespace string
 	Docker          *client.Client
 	Counter         int
-	debugLogging    bool
-	config          *config.Complement
+	// If true, each deployment gets its own network rather than sharing one with all deployments of
+	// the same blueprint, and the network is removed when the deployment is destroyed. This allows the
+	// same blueprint to be deployed concurrently, as otherwise homeserver names would clash in DNS.
+	IsolateNetwork bool
+	debugLogging   bool
+	config         *config.Complement
 }
 
 func NewDeployer(deployNamespace string, cfg *config.Complement) (*Deployer, error) {
@@ -93,7 +101,7 @@ func (d *Deployer) CreateDirtyServer(hsName string) (*HomeserverDeployment, erro
 	hsDeployment, err := deployImage(
 		d.Docker, baseImageURI, fmt.Sprintf("complement_%s_dirty_%s", d.config.PackageNamespace, hsName),
 		d.config.PackageNamespace, "", hsName, nil, "dirty",
-		networkName, d.config,
+		networkName, d.config, helpers.HomeserverOpts{},
 	)
 	if err != nil {
 		if hsDeployment != nil && hsDeployment.ContainerID != "" {
@@ -125,6 +133,12 @@ func (d *Deployer) CreateDirtyDeployment() (*Deployment, error) {
 }
 
 func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deployment, error) {
+	return d.DeployWithServerOptions(ctx, blueprintName, nil)
+}
+
+// DeployWithServerOptions deploys the given blueprint, applying the options for each named homeserver
+// in `hsOpts` when creating its container. Homeservers without options use the defaults.
+func (d *Deployer) DeployWithServerOptions(ctx context.Context, blueprintName string, hsOpts map[string]helpers.HomeserverOpts) (*Deployment, error) {
 	dep := &Deployment{
 		Deployer:      d,
 		BlueprintName: blueprintName,
@@ -143,7 +157,11 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 	if len(images) == 0 {
 		return nil, fmt.Errorf("Deploy: No images have been built for blueprint %s", blueprintName)
 	}
-	networkName, err := createNetworkIfNotExists(d.Docker, d.config.PackageNamespace, blueprintName)
+	networkBlueprintName := blueprintName
+	if d.IsolateNetwork {
+		networkBlueprintName = blueprintName + "_" + d.DeployNamespace
+	}
+	networkName, err := createNetworkIfNotExists(d.Docker, d.config.PackageNamespace, networkBlueprintName)
 	if err != nil {
 		return nil, fmt.Errorf("Deploy: %w", err)
 	}
@@ -166,6 +184,7 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 		deployment, err := deployImage(
 			d.Docker, img.ID, fmt.Sprintf("complement_%s_%s_%s_%d", d.config.PackageNamespace, d.DeployNamespace, contextStr, counter),
 			d.config.PackageNamespace, blueprintName, hsName, asIDToRegistrationMap, contextStr, networkName, d.config,
+			hsOpts[hsName],
 		)
 		if err != nil {
 			if deployment != nil && deployment.ContainerID != "" {
@@ -177,6 +196,10 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 		mu.Lock()
 		d.log("%s -> %s (%s)\n", contextStr, deployment.BaseURL, deployment.ContainerID)
 		dep.HS[hsName] = deployment
+		// snapshots remember how many users were registered so new users don't clash with existing ones
+		if counter, err := strconv.ParseInt(img.Labels["complement_localpart_counter"], 10, 64); err == nil && counter > dep.localpartCounter.Load() {
+			dep.localpartCounter.Store(counter)
+		}
 		mu.Unlock()
 		return nil
 	}
@@ -202,6 +225,25 @@ func (d *Deployer) PrintLogs(dep *Deployment) {
 	}
 }
 
+// FollowLogs streams the logs of a homeserver container to stdout and stderr until the container is
+// removed or the context is cancelled. Each line is prefixed with its RFC3339Nano timestamp. If `since`
+// is not empty, only logs from this timestamp onwards are streamed.
+func (d *Deployer) FollowLogs(ctx context.Context, hsDep *HomeserverDeployment, since string, stdout, stderr io.Writer) error {
+	reader, err := d.Docker.ContainerLogs(ctx, hsDep.ContainerID, types.ContainerLogsOptions{
+		ShowStderr: true,
+		ShowStdout: true,
+		Follow:     true,
+		Timestamps: true,
+		Since:      since,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to follow logs for container %s: %w", hsDep.ContainerID, err)
+	}
+	defer reader.Close()
+	_, err = stdcopy.StdCopy(stdout, stderr, reader)
+	return err
+}
+
 // Destroy a deployment. This will kill all running containers.
 func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool, testName string, failed bool) {
 	for _, hsDep := range dep.HS {
@@ -239,6 +281,15 @@ func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool, testName strin
 			log.Printf("Destroy: Failed to remove container %s : %s\n", hsDep.ContainerID, err)
 		}
 	}
+	if d.IsolateNetwork {
+		for _, hsDep := range dep.HS {
+			err := d.Docker.NetworkRemove(context.Background(), hsDep.Network)
+			if err != nil {
+				log.Printf("Destroy: Failed to remove network %s : %s\n", hsDep.Network, err)
+			}
+			break // all homeservers are on the same network
+		}
+	}
 }
 
 func (d *Deployer) executePostScript(hsDep *HomeserverDeployment, testName string, failed bool) ([]byte, error) {
@@ -291,6 +342,78 @@ func (d *Deployer) Restart(hsDep *HomeserverDeployment) error {
 	return nil
 }
 
+// Snapshot the current state of every homeserver in a deployment as images for the blueprint `name`,
+// which can then be deployed via Deploy(ctx, name). Containers are stopped gracefully before being
+// committed, then started again so the deployment remains usable. Access tokens and device IDs for
+// all known users are stored as labels so they are available to deployments of the snapshot.
+func (d *Deployer) Snapshot(dep *Deployment, name string) error {
+	ctx := context.Background()
+	images, err := d.Docker.ImageList(ctx, types.ImageListOptions{
+		Filters: label(
+			"complement_pkg="+d.config.PackageNamespace,
+			"complement_blueprint="+name,
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("Snapshot: failed to ImageList: %w", err)
+	}
+	if len(images) > 0 {
+		return fmt.Errorf("Snapshot: images already exist for blueprint %s", name)
+	}
+	for hsName, hsDep := range dep.HS {
+		contextStr := fmt.Sprintf("%s.%s.%s", d.config.PackageNamespace, name, hsName)
+		info, err := d.Docker.ContainerInspect(ctx, hsDep.ContainerID)
+		if err != nil {
+			return fmt.Errorf("Snapshot: failed to inspect container %s: %w", hsDep.ContainerID, err)
+		}
+		labels := map[string]string{
+			complementLabel:                contextStr,
+			"complement_blueprint":         name,
+			"complement_hs_name":           hsName,
+			"complement_localpart_counter": strconv.FormatInt(dep.localpartCounter.Load(), 10),
+			// the snapshot is built from the same base image as the blueprint image it was deployed from
+			baseImageLabel: info.Config.Labels[baseImageLabel],
+		}
+		hsDep.accessTokensMutex.RLock()
+		for userID, token := range hsDep.AccessTokens {
+			labels["access_token_"+userID] = token
+		}
+		for userID, deviceID := range hsDep.DeviceIDs {
+			labels["device_id"+userID] = deviceID
+		}
+		for userID, tokens := range hsDep.DeviceAccessTokens {
+			for deviceID, token := range tokens {
+				labels[deviceTokenLabel(userID, deviceID)] = token
+			}
+		}
+		hsDep.accessTokensMutex.RUnlock()
+
+		// Stop the container before we commit it, for the same reasons as when constructing blueprints.
+		d.log("%s: Stopping container: %s", contextStr, hsDep.ContainerID)
+		tenSeconds := 10
+		err = d.Docker.ContainerStop(ctx, hsDep.ContainerID, container.StopOptions{
+			Timeout: &tenSeconds,
+		})
+		if err != nil {
+			return fmt.Errorf("Snapshot: failed to stop container %s: %w", hsDep.ContainerID, err)
+		}
+		commit, err := d.Docker.ContainerCommit(ctx, hsDep.ContainerID, types.ContainerCommitOptions{
+			Author:    "Complement",
+			Pause:     true,
+			Reference: "localhost/complement:" + contextStr,
+			Changes:   toChanges(labels),
+		})
+		if err != nil {
+			return fmt.Errorf("Snapshot: %s : failed to ContainerCommit: %w", contextStr, err)
+		}
+		d.log("%s: Created docker image %s\n", contextStr, strings.Replace(commit.ID, "sha256:", "", 1))
+		if err = d.StartServer(hsDep); err != nil {
+			return fmt.Errorf("Snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
 func (d *Deployer) StartServer(hsDep *HomeserverDeployment) error {
 	ctx := context.Background()
 	err := d.Docker.ContainerStart(ctx, hsDep.ContainerID, types.ContainerStartOptions{})
@@ -318,6 +441,7 @@ func (d *Deployer) StartServer(hsDep *HomeserverDeployment) error {
 func deployImage(
 	docker *client.Client, imageID string, containerName, pkgNamespace, blueprintName, hsName string,
 	asIDToRegistrationMap map[string]string, contextStr, networkName string, cfg *config.Complement,
+	hsOpts helpers.HomeserverOpts,
 ) (*HomeserverDeployment, error) {
 	ctx := context.Background()
 	var extraHosts []string
@@ -340,6 +464,14 @@ func deployImage(
 			Type:     mount.TypeBind,
 		})
 	}
+	for _, m := range hsOpts.HostMounts {
+		mounts = append(mounts, mount.Mount{
+			Source:   m.HostPath,
+			Target:   m.ContainerPath,
+			ReadOnly: m.ReadOnly,
+			Type:     mount.TypeBind,
+		})
+	}
 	if len(mounts) > 0 {
 		log.Printf("Using host mounts: %+v", mounts)
 	}
@@ -355,6 +487,15 @@ func deployImage(
 		}
 		log.Printf("Sharing %v host environment variables with container", env)
 	}
+	// sort so the container config is deterministic
+	envKeys := make([]string, 0, len(hsOpts.Env))
+	for k := range hsOpts.Env {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+	for _, k := range envKeys {
+		env = append(env, k+"="+hsOpts.Env[k])
+	}
 
 	body, err := docker.ContainerCreate(ctx, &container.Config{
 		Image: imageID,
@@ -383,6 +524,10 @@ func deployImage(
 		},
 		ExtraHosts: extraHosts,
 		Mounts:     mounts,
+		Resources: container.Resources{
+			NanoCPUs: int64(cfg.ContainerCPUCores * 1e9),
+			Memory:   cfg.ContainerMemoryBytes,
+		},
 	}, &network.NetworkingConfig{
 		EndpointsConfig: map[string]*network.EndpointSettings{
 			networkName: {
@@ -413,6 +558,14 @@ func deployImage(
 		}
 	}
 
+	// Create any extra files
+	for path, data := range hsOpts.Files {
+		err = copyToContainer(docker, containerID, path, data)
+		if err != nil {
+			return stubDeployment, err
+		}
+	}
+
 	// Copy CA certificate and key
 	certBytes, err := cfg.CACertificateBytes()
 	if err != nil {
@@ -461,6 +614,7 @@ func deployImage(
 		AccessTokens:        tokensFromLabels(inspect.Config.Labels),
 		ApplicationServices: asIDToRegistrationFromLabels(inspect.Config.Labels),
 		DeviceIDs:           deviceIDsFromLabels(inspect.Config.Labels),
+		DeviceAccessTokens:  deviceTokensFromLabels(inspect.Config.Labels),
 		Network:             networkName,
 	}
 
@@ -473,6 +627,14 @@ func deployImage(
 			log.Printf("%s: Server is responding after %d iterations", contextStr, iterCount)
 		}
 	}
+	caps, err := probeCapabilities(docker, d)
+	if err != nil {
+		log.Printf("WARNING: %s: failed to probe capabilities, runtime.SkipUnless will run all tests: %s", contextStr, err)
+	} else {
+		// nil means the capabilities are unknown, which is not the case if the HS advertises nothing
+		d.Capabilities = append([]string{}, caps...)
+		sort.Strings(d.Capabilities)
+	}
 	return d, nil
 }
 
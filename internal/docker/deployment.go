@@ -27,6 +27,9 @@ type Deployment struct {
 	HS               map[string]*HomeserverDeployment
 	Config           *config.Complement
 	localpartCounter atomic.Int64
+	// Any stats samplers started via SampleStats, which are stopped when the deployment is destroyed.
+	statsSamplers   []*StatsSampler
+	statsSamplersMu sync.Mutex
 }
 
 // HomeserverDeployment represents a running homeserver in a container.
@@ -37,7 +40,9 @@ type HomeserverDeployment struct {
 	AccessTokens        map[string]string // e.g { "@alice:hs1": "myAcc3ssT0ken" }
 	accessTokensMutex   sync.RWMutex
 	ApplicationServices map[string]string // e.g { "my-as-id": "id: xxx\nas_token: xxx ..."} }
-	DeviceIDs           map[string]string // e.g { "@alice:hs1": "myDeviceID" }
+	DeviceIDs           map[string]string // e.g { "@alice:hs1": "myDeviceID" }, protected by accessTokensMutex
+	// The access tokens for additional devices created by the blueprint, e.g { "@alice:hs1": { "PHONE": "myAcc3ssT0ken" } }
+	DeviceAccessTokens map[string]map[string]string
 
 	// track all clients so if Restart() is called we can repoint to the new high-numbered port
 	CSAPIClients      []*client.CSAPI
@@ -45,6 +50,9 @@ type HomeserverDeployment struct {
 	// The docker network this HS is connected to.
 	// Useful if you want to connect other containers to the same network.
 	Network string
+	// The capabilities advertised by this HS when it was deployed, see runtime.SkipUnless. Nil if they
+	// could not be detected.
+	Capabilities []string
 }
 
 // Updates the client and federation base URLs of the homeserver deployment.
@@ -71,6 +79,7 @@ func (d *Deployment) DestroyAtCleanup() {
 // will print container logs before killing the container.
 func (d *Deployment) Destroy(t *testing.T) {
 	t.Helper()
+	d.stopStatsSamplers()
 	if d.Dirty {
 		if t.Failed() {
 			d.Deployer.PrintLogs(d)
@@ -80,6 +89,54 @@ func (d *Deployment) Destroy(t *testing.T) {
 	d.Deployer.Destroy(d, d.Deployer.config.AlwaysPrintServerLogs || t.Failed(), t.Name(), t.Failed())
 }
 
+// SampleStats starts sampling the resource usage of every homeserver in this deployment at the
+// given interval. Sampling stops when the deployment is destroyed or the test finishes, at which
+// point a summary is logged to the test output. Fails the test if the interval is not positive.
+func (d *Deployment) SampleStats(t *testing.T, interval time.Duration) Sampler {
+	t.Helper()
+	sampler, err := d.StartStatsSampler(interval)
+	if err != nil {
+		t.Fatalf("Deployment.SampleStats: %s", err)
+	}
+	t.Cleanup(func() {
+		sampler.Stop()
+		t.Logf("Deployment.SampleStats:\n%s", sampler)
+	})
+	return sampler
+}
+
+// StartStatsSampler is like SampleStats but for use outside of tests, e.g by perftest. The sampler runs until
+// Stop is called or the deployment is destroyed via Destroy. Returns an error if the interval is not positive.
+func (d *Deployment) StartStatsSampler(interval time.Duration) (*StatsSampler, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("stats sampling interval must be positive, got %v", interval)
+	}
+	sampler := newStatsSampler(d.Deployer, d.HS, interval)
+	d.statsSamplersMu.Lock()
+	d.statsSamplers = append(d.statsSamplers, sampler)
+	d.statsSamplersMu.Unlock()
+	return sampler, nil
+}
+
+func (d *Deployment) stopStatsSamplers() {
+	d.statsSamplersMu.Lock()
+	defer d.statsSamplersMu.Unlock()
+	for _, sampler := range d.statsSamplers {
+		sampler.Stop()
+	}
+	d.statsSamplers = nil
+}
+
+// Capabilities returns the capabilities advertised by each homeserver in this deployment when it was
+// deployed, keyed by HS name. Capabilities are nil for homeservers where they could not be detected.
+func (d *Deployment) Capabilities() map[string][]string {
+	caps := make(map[string][]string, len(d.HS))
+	for hsName, hsDep := range d.HS {
+		caps[hsName] = hsDep.Capabilities
+	}
+	return caps
+}
+
 func (d *Deployment) GetConfig() *config.Complement {
 	return d.Config
 }
@@ -120,9 +177,10 @@ func (d *Deployment) Register(t *testing.T, hsName string, opts helpers.Registra
 		userID, accessToken, deviceID = client.RegisterUser(t, localpart, password)
 	}
 
-	// remember the token so subsequent calls to deployment.Client return the user
+	// remember the token and device so subsequent calls to deployment.ExistingUser return the user
 	dep.accessTokensMutex.Lock()
 	dep.AccessTokens[userID] = accessToken
+	dep.DeviceIDs[userID] = deviceID
 	dep.accessTokensMutex.Unlock()
 
 	client.UserID = userID
@@ -204,12 +262,12 @@ func (d *Deployment) AppServiceUser(t *testing.T, hsName, appServiceUserID strin
 	}
 	dep.accessTokensMutex.RLock()
 	token := dep.AccessTokens[appServiceUserID]
+	deviceID := dep.DeviceIDs[appServiceUserID]
 	dep.accessTokensMutex.RUnlock()
 	if token == "" && appServiceUserID != "" {
 		t.Fatalf("Deployment.Client - HS name '%s' - user ID '%s' not found", hsName, appServiceUserID)
 		return nil
 	}
-	deviceID := dep.DeviceIDs[appServiceUserID]
 	if deviceID == "" && appServiceUserID != "" {
 		t.Logf("WARNING: Deployment.Client - HS name '%s' - user ID '%s' - deviceID not found", hsName, appServiceUserID)
 	}
@@ -230,6 +288,49 @@ func (d *Deployment) AppServiceUser(t *testing.T, hsName, appServiceUserID strin
 	return client
 }
 
+// ExistingUser returns a client for a user who was registered before this deployment was created,
+// using the access token captured in the blueprint or snapshot.
+func (d *Deployment) ExistingUser(t *testing.T, hsName, userID string) *client.CSAPI {
+	t.Helper()
+	dep, ok := d.HS[hsName]
+	if !ok {
+		t.Fatalf("Deployment.ExistingUser - HS name '%s' not found", hsName)
+		return nil
+	}
+	dep.accessTokensMutex.RLock()
+	token := dep.AccessTokens[userID]
+	deviceID := dep.DeviceIDs[userID]
+	dep.accessTokensMutex.RUnlock()
+	if token == "" {
+		t.Fatalf("Deployment.ExistingUser - HS name '%s' - user ID '%s' not found", hsName, userID)
+		return nil
+	}
+	client := &client.CSAPI{
+		UserID:           userID,
+		AccessToken:      token,
+		DeviceID:         deviceID,
+		BaseURL:          dep.BaseURL,
+		Client:           client.NewLoggedClient(t, hsName, nil),
+		SyncUntilTimeout: 5 * time.Second,
+		Debug:            d.Deployer.debugLogging,
+	}
+	// Appending a slice is not thread-safe. Protect the write with a mutex.
+	dep.CSAPIClientsMutex.Lock()
+	dep.CSAPIClients = append(dep.CSAPIClients, client)
+	dep.CSAPIClientsMutex.Unlock()
+	return client
+}
+
+// Snapshot the current state of this deployment so it can be deployed by other tests via
+// DeploySnapshot. Servers are stopped and restarted, so base URLs may change.
+func (d *Deployment) Snapshot(t *testing.T, name string) {
+	t.Helper()
+	t.Logf("Snapshot %s", name)
+	if err := d.Deployer.Snapshot(d, name); err != nil {
+		t.Fatalf("Deployment.Snapshot: %s", err)
+	}
+}
+
 // Restart a deployment.
 func (d *Deployment) Restart(t *testing.T) error {
 	t.Helper()
@@ -61,3 +61,33 @@ func deviceIDsFromLabels(labels map[string]string) map[string]string {
 	}
 	return userIDToToken
 }
+
+// deviceTokenLabel returns the label for the access token of an additional device of a user, which is
+// 'device_access_token_$user_id/$device_id' as user IDs cannot contain a '/' after the ':'.
+func deviceTokenLabel(userID, deviceID string) string {
+	return "device_access_token_" + userID + "/" + deviceID
+}
+
+func deviceTokensFromLabels(labels map[string]string) map[string]map[string]string {
+	userIDToDeviceTokens := make(map[string]map[string]string)
+	for k, v := range labels {
+		if !strings.HasPrefix(k, "device_access_token_") {
+			continue
+		}
+		userAndDevice := strings.TrimPrefix(k, "device_access_token_")
+		colon := strings.Index(userAndDevice, ":")
+		if colon < 0 {
+			continue
+		}
+		slash := strings.Index(userAndDevice[colon:], "/")
+		if slash < 0 {
+			continue
+		}
+		userID, deviceID := userAndDevice[:colon+slash], userAndDevice[colon+slash+1:]
+		if userIDToDeviceTokens[userID] == nil {
+			userIDToDeviceTokens[userID] = make(map[string]string)
+		}
+		userIDToDeviceTokens[userID][deviceID] = v
+	}
+	return userIDToDeviceTokens
+}
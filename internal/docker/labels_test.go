@@ -0,0 +1,32 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeviceTokensFromLabels(t *testing.T) {
+	labels := map[string]string{
+		deviceTokenLabel("@alice:hs1", "PHONE"):        "alice_phone",
+		deviceTokenLabel("@alice:hs1", "LAPTOP"):       "alice_laptop",
+		deviceTokenLabel("@bob_smith:hs1", "MY_PHONE"): "bob_phone",
+		deviceTokenLabel("@bob_smith:hs1", "a/b:c"):    "bob_odd_device",
+		"access_token_@alice:hs1":                      "alice_token",
+		"device_id@alice:hs1":                          "ALICE",
+		"device_access_token_alice":                    "no user ID",
+		"device_access_token_@alice:hs1":               "no device ID",
+	}
+	want := map[string]map[string]string{
+		"@alice:hs1": {
+			"PHONE":  "alice_phone",
+			"LAPTOP": "alice_laptop",
+		},
+		"@bob_smith:hs1": {
+			"MY_PHONE": "bob_phone",
+			"a/b:c":    "bob_odd_device",
+		},
+	}
+	if got := deviceTokensFromLabels(labels); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
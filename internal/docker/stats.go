@@ -0,0 +1,223 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-units"
+)
+
+// ContainerStats is a point-in-time sample of the resource usage of a homeserver container.
+// CPU, IO and network values are cumulative since the container started.
+type ContainerStats struct {
+	Timestamp    time.Time // by the docker daemon's clock, except for samples taken by a StatsSampler
+	MemoryUsage  uint64    // bytes
+	CPUUserland  uint64    // nanoseconds
+	CPUKernel    uint64    // nanoseconds
+	BytesRead    uint64
+	BytesWritten uint64
+	RxBytes      int64
+	TxBytes      int64
+}
+
+// ContainerStats returns the current resource usage of the given homeserver container.
+func (d *Deployer) ContainerStats(hsDep *HomeserverDeployment) (*ContainerStats, error) {
+	return containerStats(d.Docker, hsDep.ContainerID)
+}
+
+func containerStats(docker *client.Client, containerID string) (*ContainerStats, error) {
+	stats, err := docker.ContainerStatsOneShot(context.Background(), containerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats for container %s: %w", containerID, err)
+	}
+	defer stats.Body.Close()
+	var sj types.StatsJSON
+	if err = json.NewDecoder(stats.Body).Decode(&sj); err != nil {
+		return nil, fmt.Errorf("failed to decode stats for container %s: %w", containerID, err)
+	}
+
+	cs := &ContainerStats{
+		Timestamp:   sj.Read,
+		MemoryUsage: sj.MemoryStats.Usage,
+		CPUUserland: sj.CPUStats.CPUUsage.UsageInUsermode,
+		CPUKernel:   sj.CPUStats.CPUUsage.UsageInKernelmode,
+	}
+	if cs.Timestamp.IsZero() {
+		cs.Timestamp = time.Now()
+	}
+	for _, nw := range sj.Networks {
+		cs.RxBytes += int64(nw.RxBytes)
+		cs.TxBytes += int64(nw.TxBytes)
+	}
+	for _, block := range sj.BlkioStats.IoServiceBytesRecursive {
+		if block.Op == "read" {
+			cs.BytesRead = block.Value
+		} else if block.Op == "write" {
+			cs.BytesWritten = block.Value
+		}
+	}
+	return cs, nil
+}
+
+// StatsSummary summarises the samples taken for a single homeserver by a StatsSampler.
+type StatsSummary struct {
+	HSName       string
+	NumSamples   int
+	Duration     time.Duration
+	PeakMemory   uint64
+	MeanMemory   uint64
+	CPUUserland  time.Duration // CPU time used between the first and last sample
+	CPUKernel    time.Duration
+	BytesRead    uint64 // bytes read between the first and last sample
+	BytesWritten uint64
+	RxBytes      int64
+	TxBytes      int64
+}
+
+func (s StatsSummary) String() string {
+	return fmt.Sprintf(
+		"%s: %d samples over %v: memory peak=%s mean=%s, cpu user=%v kernel=%v, io read=%s write=%s, network rx=%s tx=%s",
+		s.HSName, s.NumSamples, s.Duration.Round(time.Millisecond),
+		units.BytesSize(float64(s.PeakMemory)), units.BytesSize(float64(s.MeanMemory)),
+		s.CPUUserland.Round(time.Millisecond), s.CPUKernel.Round(time.Millisecond),
+		units.BytesSize(float64(s.BytesRead)), units.BytesSize(float64(s.BytesWritten)),
+		units.BytesSize(float64(s.RxBytes)), units.BytesSize(float64(s.TxBytes)),
+	)
+}
+
+// Sampler is the part of StatsSampler which tests use, exposed as complement.StatsSampler so tests do not
+// depend on this package.
+type Sampler interface {
+	// Stop sampling. Safe to call multiple times.
+	Stop()
+	// Summary returns a summary of the samples taken so far for each homeserver, sorted by HS name.
+	Summary() []StatsSummary
+	// String returns a human readable summary, one line per homeserver.
+	String() string
+}
+
+// StatsSampler periodically samples the resource usage of every homeserver in a deployment
+// until it is stopped.
+type StatsSampler struct {
+	deployer *Deployer
+	mu       sync.Mutex
+	samples  map[string][]ContainerStats // HS name -> samples in time order
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newStatsSampler(deployer *Deployer, hs map[string]*HomeserverDeployment, interval time.Duration) *StatsSampler {
+	s := &StatsSampler{
+		deployer: deployer,
+		samples:  make(map[string][]ContainerStats),
+		stopCh:   make(chan struct{}),
+	}
+	for hsName, hsDep := range hs {
+		s.wg.Add(1)
+		go s.sample(hsName, hsDep, interval)
+	}
+	return s
+}
+
+func (s *StatsSampler) sample(hsName string, hsDep *HomeserverDeployment, interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// Errors are expected if the server is stopped or paused by the test, so skip these samples.
+		if cs, err := s.deployer.ContainerStats(hsDep); err == nil {
+			// Use the local clock rather than the daemon's, which may be skewed, so samples line up
+			// with times measured by the test.
+			cs.Timestamp = time.Now()
+			s.mu.Lock()
+			s.samples[hsName] = append(s.samples[hsName], *cs)
+			s.mu.Unlock()
+		}
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop sampling. Blocks until all in-flight samples have been recorded. Safe to call multiple times.
+func (s *StatsSampler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+	s.wg.Wait()
+}
+
+// Samples returns a copy of the samples taken so far for the given homeserver, in time order.
+func (s *StatsSampler) Samples(hsName string) []ContainerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ContainerStats(nil), s.samples[hsName]...)
+}
+
+// Summary returns a summary of the samples taken so far for each homeserver, sorted by HS name.
+func (s *StatsSampler) Summary() []StatsSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var summaries []StatsSummary
+	for hsName, samples := range s.samples {
+		if len(samples) == 0 {
+			continue
+		}
+		summary := StatsSummary{
+			HSName:     hsName,
+			NumSamples: len(samples),
+			Duration:   samples[len(samples)-1].Timestamp.Sub(samples[0].Timestamp),
+		}
+		var totalMemory uint64
+		for i, sample := range samples {
+			totalMemory += sample.MemoryUsage
+			if sample.MemoryUsage > summary.PeakMemory {
+				summary.PeakMemory = sample.MemoryUsage
+			}
+			if i == 0 {
+				continue
+			}
+			prev := samples[i-1]
+			summary.CPUUserland += time.Duration(counterDelta(prev.CPUUserland, sample.CPUUserland))
+			summary.CPUKernel += time.Duration(counterDelta(prev.CPUKernel, sample.CPUKernel))
+			summary.BytesRead += counterDelta(prev.BytesRead, sample.BytesRead)
+			summary.BytesWritten += counterDelta(prev.BytesWritten, sample.BytesWritten)
+			summary.RxBytes += int64(counterDelta(uint64(prev.RxBytes), uint64(sample.RxBytes)))
+			summary.TxBytes += int64(counterDelta(uint64(prev.TxBytes), uint64(sample.TxBytes)))
+		}
+		summary.MeanMemory = totalMemory / uint64(len(samples))
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].HSName < summaries[j].HSName
+	})
+	return summaries
+}
+
+// String returns a human readable summary of the samples taken so far, one line per homeserver.
+func (s *StatsSampler) String() string {
+	var lines []string
+	for _, summary := range s.Summary() {
+		lines = append(lines, summary.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// counterDelta returns the increase in a cumulative counter between two samples. Counters reset
+// when a container is restarted, in which case the entire current value is the increase.
+func counterDelta(prev, cur uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
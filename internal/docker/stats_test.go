@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterDelta(t *testing.T) {
+	testCases := []struct {
+		name string
+		prev uint64
+		cur  uint64
+		want uint64
+	}{
+		{"unchanged", 10, 10, 0},
+		{"increased", 10, 25, 15},
+		{"from zero", 0, 7, 7},
+		{"reset by a restart", 100, 30, 30},
+		{"reset to zero", 100, 0, 0},
+	}
+	for _, tc := range testCases {
+		if got := counterDelta(tc.prev, tc.cur); got != tc.want {
+			t.Errorf("%s: got %d want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestStatsSamplerSummary(t *testing.T) {
+	start := time.Unix(1000, 0)
+	s := &StatsSampler{
+		samples: map[string][]ContainerStats{
+			"hs2": {
+				{Timestamp: start, MemoryUsage: 100, CPUUserland: 1000, CPUKernel: 10, BytesRead: 5, BytesWritten: 1, RxBytes: 50, TxBytes: 60},
+				{Timestamp: start.Add(time.Second), MemoryUsage: 300, CPUUserland: 3000, CPUKernel: 30, BytesRead: 15, BytesWritten: 2, RxBytes: 150, TxBytes: 80},
+				// the container was restarted, so cumulative counters start again
+				{Timestamp: start.Add(2 * time.Second), MemoryUsage: 200, CPUUserland: 500, CPUKernel: 5, BytesRead: 4, BytesWritten: 1, RxBytes: 10, TxBytes: 20},
+			},
+			"hs1": {
+				{Timestamp: start, MemoryUsage: 42},
+			},
+			"hs3": {}, // every sample failed
+		},
+	}
+	got := s.Summary()
+	want := []StatsSummary{
+		{HSName: "hs1", NumSamples: 1, PeakMemory: 42, MeanMemory: 42},
+		{
+			HSName:       "hs2",
+			NumSamples:   3,
+			Duration:     2 * time.Second,
+			PeakMemory:   300,
+			MeanMemory:   200,
+			CPUUserland:  2000 + 500,
+			CPUKernel:    20 + 5,
+			BytesRead:    10 + 4,
+			BytesWritten: 1 + 1,
+			RxBytes:      100 + 10,
+			TxBytes:      20 + 20,
+		},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d summaries want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("summary %d: got %+v want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package instruction
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// InstructionError is returned when an instruction fails, with enough context to work out which part
+// of the blueprint caused it.
+type InstructionError struct {
+	// The name the runner was created with, which is the blueprint name when building blueprints.
+	Blueprint string
+	// The name of the homeserver the instruction was sent to when building blueprints, or its URL for
+	// instructions run via RunInstructions.
+	Homeserver string
+	// The index of the failing instruction in its instruction set.
+	Index int
+	// The request which failed. Access tokens are removed from the URL.
+	Method      string
+	URL         string
+	RequestBody interface{}
+	// The HTTP status code and body of the response, if there was one.
+	StatusCode   int
+	ResponseBody string
+	// The number of times the request was sent, including retries.
+	Attempts int
+	// The underlying error, if the request could not be performed or its response could not be read.
+	Err error
+}
+
+func (e *InstructionError) Error() string {
+	msg := fmt.Sprintf("%s.%s : instruction %d %s %s", e.Blueprint, e.Homeserver, e.Index, e.Method, e.URL)
+	if e.Attempts > 1 {
+		msg += fmt.Sprintf(" (after %d attempts)", e.Attempts)
+	}
+	if e.Err != nil {
+		msg += fmt.Sprintf(" failed: %s", e.Err)
+	} else {
+		msg += fmt.Sprintf(" returned HTTP %d : %s", e.StatusCode, e.ResponseBody)
+	}
+	if e.RequestBody != nil {
+		msg += fmt.Sprintf(" -- request body: %+v", e.RequestBody)
+	}
+	return msg
+}
+
+func (e *InstructionError) Unwrap() error {
+	return e.Err
+}
+
+// redactURL removes the access token from the URL so it is not included in logs.
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	if q.Has("access_token") {
+		q.Set("access_token", "redacted")
+	}
+	redacted := *u
+	redacted.RawQuery = q.Encode()
+	return redacted.String()
+}
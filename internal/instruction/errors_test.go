@@ -0,0 +1,42 @@
+package instruction
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRedactURL(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   "http://localhost:8008/_matrix/client/v3/sync",
+			want: "http://localhost:8008/_matrix/client/v3/sync",
+		},
+		{
+			in:   "http://localhost:8008/_matrix/client/v3/sync?access_token=secret",
+			want: "http://localhost:8008/_matrix/client/v3/sync?access_token=redacted",
+		},
+		{
+			in:   "http://localhost:8008/_matrix/client/v3/sync?since=s1&access_token=secret&timeout=0",
+			want: "http://localhost:8008/_matrix/client/v3/sync?access_token=redacted&since=s1&timeout=0",
+		},
+		{
+			in:   "http://localhost:8008/_matrix/client/v3/rooms/%21abc%3Ahs1/send/m.room.message/1?access_token=",
+			want: "http://localhost:8008/_matrix/client/v3/rooms/%21abc%3Ahs1/send/m.room.message/1?access_token=redacted",
+		},
+	}
+	for _, tc := range testCases {
+		u, err := url.Parse(tc.in)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", tc.in, err)
+		}
+		if got := redactURL(u); got != tc.want {
+			t.Errorf("redactURL(%s): got %s want %s", tc.in, got, tc.want)
+		}
+		if u.Query().Get("access_token") == "redacted" {
+			t.Errorf("redactURL(%s) modified the original URL", tc.in)
+		}
+	}
+}
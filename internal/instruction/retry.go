@@ -0,0 +1,79 @@
+package instruction
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// RetryPolicy controls how the runner retries requests which failed for transient reasons: being rate
+// limited (HTTP 429), or the homeserver being temporarily unavailable (HTTP 503). Requests which may have
+// reached the homeserver (HTTP 502, 504) are only retried if they are idempotent, as POST instructions
+// are not. Other failures are never retried.
+type RetryPolicy struct {
+	// The maximum number of times to send a request, including the first attempt. 1 disables retries.
+	MaxAttempts int
+	// How long to wait before the first retry, doubling for each subsequent retry. Rate limited requests
+	// wait for `retry_after_ms` or Retry-After instead, if the homeserver provides it.
+	InitialBackoff time.Duration
+	// The maximum time to wait between attempts, unless the homeserver says how long to wait.
+	MaxBackoff time.Duration
+	// The maximum time to wait when the homeserver says how long to wait. 0 means no limit.
+	MaxRetryAfter time.Duration
+}
+
+// DefaultRetryPolicy is used by runners unless SetRetryPolicy is called.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    8,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+	MaxRetryAfter:  2 * time.Minute,
+}
+
+// backoff returns how long to wait before sending the request again, or false if it should not be retried.
+// `attempt` is the number of times the request has been sent so far.
+func (p RetryPolicy) backoff(attempt int, method string, res *http.Response, body []byte) (time.Duration, bool) {
+	if attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	wait := p.InitialBackoff << (attempt - 1)
+	switch res.StatusCode {
+	case http.StatusTooManyRequests:
+		retryAfter := time.Duration(-1)
+		if retryAfterMs := gjson.GetBytes(body, "retry_after_ms"); retryAfterMs.Exists() {
+			retryAfter = time.Duration(retryAfterMs.Int()) * time.Millisecond
+		} else if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(secs) * time.Second
+		}
+		if retryAfter >= 0 {
+			if p.MaxRetryAfter > 0 && retryAfter > p.MaxRetryAfter {
+				retryAfter = p.MaxRetryAfter
+			}
+			return retryAfter, true
+		}
+	case http.StatusServiceUnavailable:
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		// the homeserver may have processed the request even though the proxy in front of it failed
+		if !isIdempotent(method) {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	if wait > p.MaxBackoff || wait < 0 {
+		wait = p.MaxBackoff
+	}
+	return wait, true
+}
+
+// isIdempotent returns true if sending a request with this method more than once has the same effect as
+// sending it once. PUTs in the client-server API include a transaction ID so can be safely retried.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
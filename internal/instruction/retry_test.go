@@ -0,0 +1,74 @@
+package instruction
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		MaxRetryAfter:  time.Minute,
+	}
+	testCases := []struct {
+		name      string
+		attempt   int
+		method    string
+		status    int
+		header    http.Header
+		body      string
+		wantWait  time.Duration
+		wantRetry bool
+	}{
+		{name: "success", attempt: 1, method: "POST", status: 200},
+		{name: "client error", attempt: 1, method: "PUT", status: 400},
+		{name: "server error", attempt: 1, method: "PUT", status: 500},
+		{name: "unavailable", attempt: 1, method: "POST", status: 503, wantWait: 100 * time.Millisecond, wantRetry: true},
+		{name: "backoff doubles", attempt: 3, method: "POST", status: 503, wantWait: 400 * time.Millisecond, wantRetry: true},
+		{name: "too many attempts", attempt: 4, method: "POST", status: 503},
+		{name: "bad gateway PUT", attempt: 1, method: "PUT", status: 502, wantWait: 100 * time.Millisecond, wantRetry: true},
+		{name: "gateway timeout GET", attempt: 2, method: "GET", status: 504, wantWait: 200 * time.Millisecond, wantRetry: true},
+		{name: "bad gateway POST", attempt: 1, method: "POST", status: 502},
+		{name: "gateway timeout POST", attempt: 1, method: "POST", status: 504},
+		{name: "rate limited without hint", attempt: 1, method: "POST", status: 429, wantWait: 100 * time.Millisecond, wantRetry: true},
+		{
+			name: "retry_after_ms", attempt: 1, method: "POST", status: 429,
+			body:     `{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":2500}`,
+			wantWait: 2500 * time.Millisecond, wantRetry: true,
+		},
+		{
+			name: "retry_after_ms is not limited by MaxBackoff", attempt: 1, method: "POST", status: 429,
+			body:     `{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":30000}`,
+			wantWait: 30 * time.Second, wantRetry: true,
+		},
+		{
+			name: "retry_after_ms is limited by MaxRetryAfter", attempt: 1, method: "POST", status: 429,
+			body:     `{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":600000}`,
+			wantWait: time.Minute, wantRetry: true,
+		},
+		{
+			name: "Retry-After header", attempt: 1, method: "POST", status: 429,
+			header:   http.Header{"Retry-After": []string{"3"}},
+			wantWait: 3 * time.Second, wantRetry: true,
+		},
+		{
+			name: "retry_after_ms takes precedence over Retry-After", attempt: 1, method: "POST", status: 429,
+			header:   http.Header{"Retry-After": []string{"3"}},
+			body:     `{"retry_after_ms":10}`,
+			wantWait: 10 * time.Millisecond, wantRetry: true,
+		},
+	}
+	for _, tc := range testCases {
+		res := &http.Response{StatusCode: tc.status, Header: tc.header}
+		if res.Header == nil {
+			res.Header = http.Header{}
+		}
+		gotWait, gotRetry := policy.backoff(tc.attempt, tc.method, res, []byte(tc.body))
+		if gotRetry != tc.wantRetry || gotWait != tc.wantWait {
+			t.Errorf("%s: got (%v, %v) want (%v, %v)", tc.name, gotWait, gotRetry, tc.wantWait, tc.wantRetry)
+		}
+	}
+}
@@ -2,11 +2,13 @@ package instruction
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -15,6 +17,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/tidwall/gjson"
 	"maunium.net/go/mautrix/crypto/olm"
 
@@ -29,6 +32,11 @@ type Instr struct {
 	Queries map[string]string
 	Body    interface{}
 	Store   map[string]string
+	// Optional: complete User-Interactive Auth with a password if the endpoint requires it.
+	UIA *UIAPassword
+	// Optional: a non-JSON body to send instead of Body, e.g for media uploads.
+	RawBody     []byte
+	ContentType string
 }
 
 type ConcurrencyType int
@@ -60,6 +68,10 @@ type Runner struct {
 	roomConcurrency int
 	// if true, does not treat non 2xx as fatal
 	bestEffort bool
+	// how to retry requests which fail for transient reasons
+	retryPolicy RetryPolicy
+	// the transport to make requests with, or nil for the default
+	transport http.RoundTripper
 	// set to true if the runner should stop
 	terminate atomic.Value
 }
@@ -75,9 +87,20 @@ func NewRunner(blueprintName string, bestEffort, debugLogging bool) *Runner {
 		roomConcurrency: 40,
 		terminate:       v,
 		bestEffort:      bestEffort,
+		retryPolicy:     DefaultRetryPolicy,
 	}
 }
 
+// SetRetryPolicy changes how requests which fail for transient reasons are retried.
+func (r *Runner) SetRetryPolicy(policy RetryPolicy) {
+	r.retryPolicy = policy
+}
+
+// SetTransport changes how HTTP requests are made, e.g to measure them. The default transport is used if nil.
+func (r *Runner) SetTransport(transport http.RoundTripper) {
+	r.transport = transport
+}
+
 func (r *Runner) log(str string, args ...interface{}) {
 	if !r.debugLogging {
 		return
@@ -115,6 +138,28 @@ func (r *Runner) DeviceIDs(hsDomain string) map[string]string {
 	return res
 }
 
+// DeviceAccessTokens returns the access tokens for the additional devices of users who were created on the
+// given HS domain. Returns a map of user_id => device_id => access_token
+func (r *Runner) DeviceAccessTokens(hsDomain string) map[string]map[string]string {
+	res := make(map[string]map[string]string)
+	r.lookup.Range(func(k, v interface{}) bool {
+		userID, deviceID, ok := parseDeviceTokenKey(k.(string))
+		if !ok || !strings.HasSuffix(userID, ":"+hsDomain) {
+			return true
+		}
+		token := v.(string)
+		if token == "" {
+			return true // the device was deleted
+		}
+		if res[userID] == nil {
+			res[userID] = make(map[string]string)
+		}
+		res[userID][deviceID] = token
+		return true
+	})
+	return res
+}
+
 // Load a previously stored value from RunInstructions
 func (r *Runner) GetStoredValue(opts RunOpts, key string) string {
 	fullKey := opts.StoreNamespace + key
@@ -133,7 +178,7 @@ func (r *Runner) RunInstructions(opts RunOpts, instrs []Instr) (resErr error) {
 	for _, set := range sets {
 		go func(s []instruction) {
 			defer wg.Done()
-			err := r.runInstructionSet("RunInstructions", opts.HSURL, s)
+			err := r.runInstructionSet(opts.HSURL, opts.HSURL, s)
 			if err != nil {
 				r.log("RunInstructions set failed: %s", err)
 				resErr = err
@@ -157,7 +202,7 @@ func (r *Runner) Run(hs b.Homeserver, hsURL string) (resErr error) {
 	for _, set := range userInstrSets {
 		go func(s []instruction) {
 			defer wg.Done()
-			err := r.runInstructionSet(fmt.Sprintf("%s.%s", r.blueprintName, hs.Name), hsURL, s)
+			err := r.runInstructionSet(hs.Name, hsURL, s)
 			if err != nil {
 				r.log("Instruction set failed: %s", err)
 				resErr = err
@@ -171,12 +216,12 @@ func (r *Runner) Run(hs b.Homeserver, hsURL string) (resErr error) {
 		r.log("Terminating: user creation failed: %s", resErr)
 		return resErr
 	}
-	roomInstrSets := calculateRoomInstructionSets(r, hs)
+	roomInstrSets := calculateRoomInstructionSets(r, hs, false)
 	wg.Add(len(roomInstrSets))
 	for _, set := range roomInstrSets {
 		go func(s []instruction) {
 			defer wg.Done()
-			err := r.runInstructionSet(fmt.Sprintf("%s.%s", r.blueprintName, hs.Name), hsURL, s)
+			err := r.runInstructionSet(hs.Name, hsURL, s)
 			if err != nil {
 				r.log("Instruction set failed: %s", err)
 				resErr = err
@@ -189,10 +234,94 @@ func (r *Runner) Run(hs b.Homeserver, hsURL string) (resErr error) {
 	return resErr
 }
 
-func (r *Runner) runInstructionSet(contextStr string, hsURL string, instrs []instruction) error {
+// RunScheduled runs all instructions for all homeservers in the blueprint, which must already be running,
+// with URLs in the same order as the homeservers. Unlike Run, rooms on different homeservers are set up at
+// the same time, with events waiting for the events they depend on. See b.HasDependencies.
+func (r *Runner) RunScheduled(homeservers []b.Homeserver, hsURLs []string) error {
+	var userSets, roomSets []hsInstructionSet
+	for i, hs := range homeservers {
+		for _, set := range calculateUserInstructionSets(r, hs) {
+			userSets = append(userSets, hsInstructionSet{hs.Name, hsURLs[i], set})
+		}
+		for _, set := range calculateRoomInstructionSets(r, hs, true) {
+			roomSets = append(roomSets, hsInstructionSet{hs.Name, hsURLs[i], set})
+		}
+	}
+	// all users must exist before any rooms are made, as they may be invited by other homeservers
+	if err := r.runConcurrently(userSets); err != nil {
+		r.log("Terminating: user creation failed: %s", err)
+		return err
+	}
+	return r.runConcurrently(roomSets)
+}
+
+// hsInstructionSet is a set of instructions to run in order against a homeserver.
+type hsInstructionSet struct {
+	hsName string
+	hsURL  string
+	instrs []instruction
+}
+
+// runConcurrently runs all the sets at the same time, returning an error if any set failed.
+func (r *Runner) runConcurrently(sets []hsInstructionSet) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var resErr error
+	wg.Add(len(sets))
+	for _, set := range sets {
+		go func(s hsInstructionSet) {
+			defer wg.Done()
+			err := r.runInstructionSet(s.hsName, s.hsURL, s.instrs)
+			if err != nil {
+				r.log("Instruction set failed: %s", err)
+				mu.Lock()
+				if resErr == nil {
+					resErr = err
+				}
+				mu.Unlock()
+				r.terminate.Store(true)
+			}
+		}(set)
+	}
+	wg.Wait()
+	return resErr
+}
+
+// waitFor blocks until all of the keys are in the lookup table, returning an error if the runner is terminated
+// or the keys do not appear within stepTimeout.
+func (r *Runner) waitFor(keys []string) error {
+	deadline := time.Now().Add(stepTimeout)
+	for _, key := range keys {
+		for {
+			if _, ok := r.lookup.Load(key); ok {
+				break
+			}
+			if r.terminate.Load().(bool) {
+				return fmt.Errorf("terminated")
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out after %v waiting for %s", stepTimeout, key)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// stepTimeout is how long an instruction waits for the instructions it depends on before giving up.
+const stepTimeout = 5 * time.Minute
+
+// stepKey returns the lookup key which is stored when the event with this ID has been sent.
+func stepKey(eventID string) string {
+	return "step_" + eventID
+}
+
+func (r *Runner) runInstructionSet(hsName string, hsURL string, instrs []instruction) error {
+	contextStr := fmt.Sprintf("%s.%s", r.blueprintName, hsName)
 	i := 0
 	cli := http.Client{
-		Timeout: 30 * time.Second,
+		Timeout:   30 * time.Second,
+		Transport: r.transport,
 	}
 	isFatalErr := func(err error) error {
 		if r.bestEffort {
@@ -201,34 +330,59 @@ func (r *Runner) runInstructionSet(contextStr string, hsURL string, instrs []ins
 		}
 		return err
 	}
-	req, instr, i := r.next(instrs, hsURL, i)
+	// wait for the dependencies of the next instruction before making its request, as the request may
+	// refer to things which do not exist until its dependencies have completed
+	var req *http.Request
+	var instr *instruction
+	next := func() error {
+		if i < len(instrs) && len(instrs[i].after) > 0 {
+			if err := r.waitFor(instrs[i].after); err != nil {
+				return fmt.Errorf("%s : instruction %d : %w", contextStr, i, err)
+			}
+		}
+		req, instr, i = r.next(instrs, hsURL, i)
+		return nil
+	}
+	if err := next(); err != nil {
+		return err
+	}
 	for req != nil {
 		if r.terminate.Load().(bool) {
 			return fmt.Errorf("terminated")
 		}
-		res, err := cli.Do(req)
+		instrErr := &InstructionError{
+			Blueprint:   r.blueprintName,
+			Homeserver:  hsName,
+			Index:       i - 1,
+			Method:      req.Method,
+			URL:         redactURL(req.URL),
+			RequestBody: instr.body,
+		}
+		res, body, err := r.doWithRetries(&cli, req, instrErr)
+		if err == nil {
+			// resend the request with auth if the server wants UIA
+			var authReq *http.Request
+			authReq, err = uiaRequest(req, instr.body, instr.uia, res, body)
+			if err == nil && authReq != nil {
+				res, body, err = r.doWithRetries(&cli, authReq, instrErr)
+			}
+		}
 		if err != nil {
-			err = isFatalErr(fmt.Errorf("%s : failed to perform HTTP request to %s with body %+v: %w", contextStr, req.URL.String(), instr.body, err))
-			if err != nil {
+			instrErr.Err = err
+			if err = isFatalErr(instrErr); err != nil {
 				return err
 			}
 		}
 		// parse the response if we have one (if bestEffort=true then we don't return an error above)
-		if res != nil && res.Body != nil {
+		if res != nil {
 			if i < 100 || i%200 == 0 {
-				r.log("%s [%d/%d] %s => HTTP %s\n", contextStr, i, len(instrs), req.URL.String(), res.Status)
-			}
-			body, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				err = isFatalErr(fmt.Errorf("%s : failed to read response body: %w", contextStr, err))
-				if err != nil {
-					return err
-				}
+				r.log("%s [%d/%d] %s => HTTP %s\n", contextStr, i, len(instrs), instrErr.URL, res.Status)
 			}
 			if res.StatusCode < 200 || res.StatusCode >= 300 {
 				r.log("INSTRUCTION: %+v\n", instr)
-				err = isFatalErr(fmt.Errorf("%s : request %s returned HTTP %s : %s", contextStr, req.URL.String(), res.Status, string(body)))
-				if err != nil {
+				instrErr.StatusCode = res.StatusCode
+				instrErr.ResponseBody = string(body)
+				if err = isFatalErr(instrErr); err != nil {
 					return err
 				}
 			}
@@ -245,11 +399,49 @@ func (r *Runner) runInstructionSet(contextStr string, hsURL string, instrs []ins
 				}
 			}
 		}
-		req, instr, i = r.next(instrs, hsURL, i)
+		if instr.completes != "" {
+			r.lookup.Store(instr.completes, "")
+		}
+		if err := next(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// doWithRetries performs the request, retrying according to the runner's retry policy. Returns the final
+// response and its body, or an error if the request could not be performed or the body could not be read.
+// The number of attempts is recorded in instrErr.
+func (r *Runner) doWithRetries(cli *http.Client, req *http.Request, instrErr *InstructionError) (*http.Response, []byte, error) {
+	for {
+		instrErr.Attempts++
+		res, err := cli.Do(req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to perform HTTP request: %w", err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+		wait, retry := r.retryPolicy.backoff(instrErr.Attempts, req.Method, res, body)
+		if !retry {
+			return res, body, nil
+		}
+		r.log("%s.%s : %s %s => HTTP %s, retrying in %v\n", instrErr.Blueprint, instrErr.Homeserver, req.Method, instrErr.URL, res.Status, wait)
+		time.Sleep(wait)
+		// the body has been consumed so make a new request
+		if req.GetBody != nil {
+			newBody, err := req.GetBody()
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to recreate request body for retry: %w", err)
+			}
+			req = req.Clone(req.Context())
+			req.Body = newBody
+		}
+	}
+}
+
 // next returns the next request to make, along with its instruction. Return nil if there are no more instructions.
 func (r *Runner) next(instrs []instruction, hsURL string, i int) (*http.Request, *instruction, int) {
 	if i >= len(instrs) {
@@ -262,7 +454,9 @@ func (r *Runner) next(instrs []instruction, hsURL string, i int) (*http.Request,
 	if instr.body == nil && instr.bodyFn != nil {
 		instr.body = instr.bodyFn(r.lookup)
 	}
-	if instr.body != nil {
+	if instr.rawBody != nil {
+		body = bytes.NewReader(instr.rawBody)
+	} else if instr.body != nil {
 		b, err := json.Marshal(instr.body)
 		if err != nil {
 			r.log("Stopping. Failed to marshal JSON request for instruction: %s -- %+v", err, instr)
@@ -276,8 +470,10 @@ func (r *Runner) next(instrs []instruction, hsURL string, i int) (*http.Request,
 		return nil, nil, 0
 	}
 
-	if body != nil {
-		// all bodies, if set, are JSON encoded
+	if instr.rawBody != nil {
+		req.Header["Content-Type"] = []string{instr.contentType}
+	} else if body != nil {
+		// all other bodies, if set, are JSON encoded
 		req.Header["Content-Type"] = []string{"application/json"}
 	}
 
@@ -340,6 +536,10 @@ func (r *Runner) toInstruction(opts RunOpts, i Instr) instruction {
 	for k, v := range i.Store {
 		sr[opts.StoreNamespace+k] = v
 	}
+	contentType := i.ContentType
+	if i.RawBody != nil && contentType == "" {
+		contentType = "application/octet-stream"
+	}
 	return instruction{
 		method:        i.Method,
 		path:          i.Path,
@@ -347,6 +547,9 @@ func (r *Runner) toInstruction(opts RunOpts, i Instr) instruction {
 		accessToken:   "user_" + i.UserID,
 		body:          i.Body,
 		storeResponse: sr,
+		uia:           i.UIA,
+		rawBody:       i.RawBody,
+		contentType:   contentType,
 	}
 }
 
@@ -373,6 +576,15 @@ type instruction struct {
 	storeResponse map[string]string
 	// Optional: A function to create the request body from the lookup map provided. Only used if `body` is <nil>.
 	bodyFn func(lk *sync.Map) interface{}
+	// Optional: the credentials to use if the server responds with a User-Interactive Auth challenge.
+	uia *UIAPassword
+	// Optional: a non-JSON body to send instead of `body`, with its content type.
+	rawBody     []byte
+	contentType string
+	// Optional: lookup table keys which must exist before this instruction is run.
+	after []string
+	// Optional: a lookup table key to store once this instruction has been run, for other instructions to wait for.
+	completes string
 }
 
 // url returns the complete path resolved url for this instruction. Query parameters must be
@@ -418,8 +630,48 @@ func calculateUserInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 		}
 		createdUsers[user.Localpart] = true
 
+		userID := fmt.Sprintf("@%s:%s", user.Localpart, hs.Name)
 		if user.OneTimeKeys > 0 {
-			instrs = append(instrs, instructionOneTimeKeyUpload(hs, user))
+			instrs = append(instrs, instructionOneTimeKeyUpload(userID, *user.DeviceID, "user_"+userID, user.OneTimeKeys))
+		}
+		// upload media first so the avatar URL can refer to it
+		for _, media := range user.Media {
+			instrs = append(instrs, instructionMediaUpload(hs.Name, userID, media))
+		}
+		if user.AvatarURL != "" {
+			instrs = append(instrs, instructionAvatarURL(hs.Name, userID, user.AvatarURL))
+		}
+		for _, ad := range user.AccountData {
+			instrs = append(instrs, instruction{
+				method:      "PUT",
+				path:        "/_matrix/client/v3/user/$userId/account_data/$type",
+				accessToken: "user_" + userID,
+				substitutions: map[string]string{
+					"$userId": userID,
+					"$type":   ad.Type,
+				},
+				body: ad.Value,
+			})
+		}
+		for _, pusher := range user.Pushers {
+			instrs = append(instrs, instruction{
+				method:      "POST",
+				path:        "/_matrix/client/v3/pushers/set",
+				accessToken: "user_" + userID,
+				body:        pusher,
+			})
+		}
+		for _, device := range user.Devices {
+			instrs = append(instrs, instructionLoginDevice(userID, user.Localpart, device))
+			if device.OneTimeKeys > 0 {
+				instrs = append(instrs, instructionOneTimeKeyUpload(userID, device.ID, deviceTokenKey(userID, device.ID), device.OneTimeKeys))
+			}
+			if device.Delete {
+				instrs = append(instrs, instructionDeleteDevice(userID, device.ID))
+			}
+		}
+		if user.CrossSigning {
+			instrs = append(instrs, instructionCrossSigningUpload(userID))
 		}
 		sets[i] = instrs
 	}
@@ -429,13 +681,43 @@ func calculateUserInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 // calculateRoomInstructionSets returns sets of HTTP requests to be executed in order. Sets can be executed in any order. Various substitutions
 // and placeholders are returned in these instructions as it's impossible to know at this time what room IDs etc
 // will be allocated, so use an instruction loader to load the right requests.
-func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
+//
+// If scheduled is true, instructions wait for the events they depend on, which may be sent by other homeservers
+// at the same time. Rooms which wait are given their own set, so they cannot hold up rooms which don't.
+func calculateRoomInstructionSets(r *Runner, hs b.Homeserver, scheduled bool) [][]instruction {
 	sets := make([][]instruction, r.roomConcurrency)
 
 	// add instructions to create rooms and send events
 	for roomIndex, room := range hs.Rooms {
+		// the events which receipts are sent for, so we need to remember their event IDs
+		receiptEvents := make(map[int]bool)
+		for _, receipt := range room.Receipts {
+			receiptEvents[receipt.EventIndex] = true
+		}
 		setIndex := indexFor(fmt.Sprintf("%d", roomIndex), r.roomConcurrency)
+		// the lookup keys which the next instruction must wait for
+		var waitFor []string
+		if scheduled && room.Creator == "" {
+			// wait for the room to be created by another homeserver
+			waitFor = append(waitFor, fmt.Sprintf("room_ref_%s", room.Ref))
+		}
+		if scheduled && (room.Creator == "" || roomWaits(room)) {
+			setIndex = len(sets)
+			sets = append(sets, nil)
+		}
 		instrs := sets[setIndex]
+		// add appends instructions to this room's set, making the first wait for anything pending in waitFor
+		add := func(in ...instruction) {
+			if len(in) > 0 && len(waitFor) > 0 {
+				in[0].after = append(in[0].after, waitFor...)
+				waitFor = nil
+			}
+			instrs = append(instrs, in...)
+		}
+		roomIDKey := roomKey(hs.Name, roomIndex)
+		if room.Ref != "" {
+			roomIDKey = fmt.Sprintf("room_ref_%s", room.Ref)
+		}
 		var queryParams = make(map[string]string)
 
 		// If we're joining the room, we record a sender so that we can ensure
@@ -444,7 +726,7 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 
 		if room.Creator != "" {
 			storeRes := map[string]string{
-				fmt.Sprintf("room_%d", roomIndex): ".room_id",
+				roomKey(hs.Name, roomIndex): ".room_id",
 			}
 			if room.Ref != "" {
 				storeRes[fmt.Sprintf("room_ref_%s", room.Ref)] = ".room_id"
@@ -453,7 +735,7 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 				// to join this room know which server to contact
 				r.lookup.Store(fmt.Sprintf("room_ref_%s_server_name", room.Ref), hs.Name)
 			}
-			instrs = append(instrs, instruction{
+			add(instruction{
 				method:        "POST",
 				path:          "/_matrix/client/v3/createRoom",
 				accessToken:   "user_" + room.Creator,
@@ -467,15 +749,17 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 			return nil
 		}
 		for eventIndex, event := range room.Events {
+			if scheduled {
+				for _, id := range event.After {
+					waitFor = append(waitFor, stepKey(id))
+				}
+			}
 			method := "PUT"
 			var path string
 			subs := map[string]string{
-				"$roomId":    fmt.Sprintf(".room_%d", roomIndex),
+				"$roomId":    "." + roomIDKey,
 				"$eventType": event.Type,
 			}
-			if room.Ref != "" {
-				subs["$roomId"] = fmt.Sprintf(".room_ref_%s", room.Ref)
-			}
 			if event.StateKey != nil {
 				path = "/_matrix/client/v3/rooms/$roomId/state/$eventType/$stateKey"
 				subs["$stateKey"] = *event.StateKey
@@ -520,18 +804,18 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 			} else if event.Type == "m.room.canonical_alias" && event.StateKey != nil &&
 				*event.StateKey == "" {
 				// create the alias first then send the canonical alias
-				// keep a ref to the current room index so it's correct when bodyFn is called
+				// keep a ref to the current room ID key so it's correct when bodyFn is called
 				alias, ok := event.Content["alias"].(string)
 				if ok {
-					ri := roomIndex
-					instrs = append(instrs, instruction{
+					rk := roomIDKey
+					add(instruction{
 						method:        "PUT",
 						path:          "/_matrix/client/v3/directory/room/" + url.PathEscape(alias),
 						accessToken:   fmt.Sprintf("user_%s", event.Sender),
 						substitutions: subs,
 						queryParams:   queryParams,
 						bodyFn: func(lk *sync.Map) interface{} {
-							val, _ := lk.Load(fmt.Sprintf("room_%d", ri))
+							val, _ := lk.Load(rk)
 							return map[string]interface{}{
 								"room_id": val,
 							}
@@ -539,26 +823,43 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 					})
 				}
 			}
-			instrs = append(instrs, instruction{
+			instr := instruction{
 				method:        method,
 				path:          path,
 				body:          event.Content,
 				accessToken:   fmt.Sprintf("user_%s", event.Sender),
 				substitutions: subs,
 				queryParams:   queryParams,
-			})
+			}
+			if event.ID != "" {
+				instr.completes = stepKey(event.ID)
+			}
+			if receiptEvents[eventIndex] {
+				instr.storeResponse = map[string]string{
+					eventIDKey(hs.Name, roomIndex, eventIndex): ".event_id",
+				}
+			}
+			if refersToMedia(event.Content) {
+				content := event.Content
+				instr.body = nil
+				instr.bodyFn = func(lk *sync.Map) interface{} {
+					return substituteMedia(hs.Name, content, lk)
+				}
+			}
+			add(instr)
 		}
+		add(roomExtrasInstructions(hs.Name, room, roomIndex)...)
 
 		if joiningSender != "" {
 			// We specifically call the /members API to ensure that we have fully
 			// joined the room before continuing. Otherwise we'll stop and save the
 			// HS half way through the join
-			instrs = append(instrs, instruction{
+			add(instruction{
 				method:      "GET",
 				path:        "/_matrix/client/v3/rooms/$roomId/members",
 				accessToken: "user_" + joiningSender,
 				substitutions: map[string]string{
-					"$roomId": fmt.Sprintf(".room_%d", roomIndex),
+					"$roomId": "." + roomIDKey,
 				},
 				body: map[string]interface{}{},
 			})
@@ -570,10 +871,25 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 	return sets
 }
 
+// roomWaits returns true if any event in the room waits for other events.
+func roomWaits(room b.Room) bool {
+	for _, event := range room.Events {
+		if len(event.After) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// roomKey returns the lookup key for the room ID of a room created on a homeserver.
+func roomKey(hsName string, roomIndex int) string {
+	return fmt.Sprintf("room_%s_%d", hsName, roomIndex)
+}
+
 func instructionRegister(hs b.Homeserver, user b.User) instruction {
 	body := map[string]interface{}{
 		"username": user.Localpart,
-		"password": "complement_meets_min_pasword_req_" + user.Localpart,
+		"password": blueprintPassword(user.Localpart),
 		"auth": map[string]string{
 			"type": "m.login.dummy",
 		},
@@ -614,7 +930,7 @@ func instructionLogin(hs b.Homeserver, user b.User) instruction {
 	body := map[string]interface{}{
 		"type":     "m.login.password",
 		"user":     user.Localpart,
-		"password": "complement_meets_min_pasword_req_" + user.Localpart,
+		"password": blueprintPassword(user.Localpart),
 		"auth": map[string]string{
 			"type": "m.login.dummy",
 		},
@@ -636,13 +952,12 @@ func instructionLogin(hs b.Homeserver, user b.User) instruction {
 	}
 }
 
-func instructionOneTimeKeyUpload(hs b.Homeserver, user b.User) instruction {
+// instructionOneTimeKeyUpload uploads device keys and the given amount of one-time keys for the device,
+// using the access token stored under accessTokenKey.
+func instructionOneTimeKeyUpload(userID, deviceID, accessTokenKey string, numOneTimeKeys uint) instruction {
 	account := olm.NewAccount()
 	ed25519Key, curveKey := account.IdentityKeys()
 
-	userID := fmt.Sprintf("@%s:%s", user.Localpart, hs.Name)
-	deviceID := *user.DeviceID
-
 	ed25519KeyID := fmt.Sprintf("ed25519:%s", deviceID)
 	curveKeyID := fmt.Sprintf("curve25519:%s", deviceID)
 
@@ -664,7 +979,7 @@ func instructionOneTimeKeyUpload(hs b.Homeserver, user b.User) instruction {
 		},
 	}
 
-	account.GenOneTimeKeys(user.OneTimeKeys)
+	account.GenOneTimeKeys(numOneTimeKeys)
 
 	oneTimeKeys := map[string]interface{}{}
 
@@ -687,7 +1002,7 @@ func instructionOneTimeKeyUpload(hs b.Homeserver, user b.User) instruction {
 	return instruction{
 		method:      "POST",
 		path:        "/_matrix/client/v3/keys/upload",
-		accessToken: fmt.Sprintf("user_@%s:%s", user.Localpart, hs.Name),
+		accessToken: accessTokenKey,
 		body: map[string]interface{}{
 			"device_keys":   deviceKeys,
 			"one_time_keys": oneTimeKeys,
@@ -695,6 +1010,306 @@ func instructionOneTimeKeyUpload(hs b.Homeserver, user b.User) instruction {
 	}
 }
 
+// deviceTokenKey returns the lookup key for the access token of an additional device. These are returned by
+// DeviceAccessTokens, as AccessTokens only returns the token of the device the user registered with.
+func deviceTokenKey(userID, deviceID string) string {
+	return fmt.Sprintf("device_token_%s/%s", userID, deviceID)
+}
+
+// parseDeviceTokenKey is the inverse of deviceTokenKey. User IDs cannot contain a '/' after the ':', so the
+// first '/' after it separates the user ID from the device ID.
+func parseDeviceTokenKey(key string) (userID, deviceID string, ok bool) {
+	if !strings.HasPrefix(key, "device_token_") {
+		return "", "", false
+	}
+	key = strings.TrimPrefix(key, "device_token_")
+	colon := strings.Index(key, ":")
+	if colon < 0 {
+		return "", "", false
+	}
+	slash := strings.Index(key[colon:], "/")
+	if slash < 0 {
+		return "", "", false
+	}
+	return key[:colon+slash], key[colon+slash+1:], true
+}
+
+func instructionLoginDevice(userID, localpart string, device b.Device) instruction {
+	return instruction{
+		method: "POST",
+		path:   "/_matrix/client/v3/login",
+		body: map[string]interface{}{
+			"type": "m.login.password",
+			"identifier": map[string]interface{}{
+				"type": "m.id.user",
+				"user": localpart,
+			},
+			"password":  blueprintPassword(localpart),
+			"device_id": device.ID,
+		},
+		storeResponse: map[string]string{
+			deviceTokenKey(userID, device.ID): ".access_token",
+		},
+	}
+}
+
+// instructionDeleteDevice deletes an additional device of the user, which requires User-Interactive Auth.
+func instructionDeleteDevice(userID, deviceID string) instruction {
+	return instruction{
+		method:      "DELETE",
+		path:        "/_matrix/client/v3/devices/$deviceId",
+		accessToken: "user_" + userID,
+		substitutions: map[string]string{
+			"$deviceId": deviceID,
+		},
+		uia: &UIAPassword{UserID: userID},
+		// the access token of the deleted device is no longer valid, so blank it out
+		completes: deviceTokenKey(userID, deviceID),
+	}
+}
+
+// instructionCrossSigningUpload uploads new master, self-signing and user-signing keys for the user, which
+// requires User-Interactive Auth. The private keys are discarded, so nothing can be signed with them later.
+func instructionCrossSigningUpload(userID string) instruction {
+	masterKey, masterKeyID, masterPriv := crossSigningKey(userID, "master")
+	body := map[string]interface{}{
+		"master_key": masterKey,
+	}
+	for _, usage := range []string{"self_signing", "user_signing"} {
+		key, _, _ := crossSigningKey(userID, usage)
+		// the self-signing and user-signing keys must be signed by the master key
+		unsigned, _ := json.Marshal(key)
+		signed, err := gomatrixserverlib.SignJSON(userID, masterKeyID, masterPriv, unsigned)
+		if err != nil {
+			panic("failed to sign cross-signing key: " + err.Error())
+		}
+		body[usage+"_key"] = json.RawMessage(signed)
+	}
+	return instruction{
+		method:      "POST",
+		path:        "/_matrix/client/v3/keys/device_signing/upload",
+		accessToken: "user_" + userID,
+		body:        body,
+		uia:         &UIAPassword{UserID: userID},
+	}
+}
+
+// crossSigningKey returns a new cross-signing key for the user with the given usage, as it would be uploaded,
+// along with its key ID and private key.
+func crossSigningKey(userID, usage string) (map[string]interface{}, gomatrixserverlib.KeyID, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic("failed to generate cross-signing key: " + err.Error())
+	}
+	public := base64.RawStdEncoding.EncodeToString(pub)
+	keyID := gomatrixserverlib.KeyID("ed25519:" + public)
+	return map[string]interface{}{
+		"user_id": userID,
+		"usage":   []string{usage},
+		"keys": map[string]string{
+			string(keyID): public,
+		},
+	}, keyID, priv
+}
+
+// mediaKey returns the lookup key for the mxc URI of media uploaded to a homeserver.
+func mediaKey(hsName, ref string) string {
+	return fmt.Sprintf("media_%s_%s", hsName, ref)
+}
+
+func instructionMediaUpload(hsName, userID string, media b.Media) instruction {
+	contentType := media.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	queryParams := make(map[string]string)
+	if media.Filename != "" {
+		queryParams["filename"] = media.Filename
+	}
+	return instruction{
+		method:      "POST",
+		path:        "/_matrix/media/v3/upload",
+		accessToken: "user_" + userID,
+		queryParams: queryParams,
+		rawBody:     media.Content,
+		contentType: contentType,
+		storeResponse: map[string]string{
+			mediaKey(hsName, media.Ref): ".content_uri",
+		},
+	}
+}
+
+func instructionAvatarURL(hsName, userID, avatarURL string) instruction {
+	return instruction{
+		method:      "PUT",
+		path:        "/_matrix/client/v3/profile/$userId/avatar_url",
+		accessToken: "user_" + userID,
+		substitutions: map[string]string{
+			"$userId": userID,
+		},
+		bodyFn: func(lk *sync.Map) interface{} {
+			return map[string]interface{}{
+				"avatar_url": substituteMedia(hsName, avatarURL, lk),
+			}
+		},
+	}
+}
+
+// refersToMedia returns true if any string in the value starts with b.MediaRefPrefix.
+func refersToMedia(v interface{}) bool {
+	switch val := v.(type) {
+	case string:
+		return strings.HasPrefix(val, b.MediaRefPrefix)
+	case map[string]interface{}:
+		for _, child := range val {
+			if refersToMedia(child) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, child := range val {
+			if refersToMedia(child) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// substituteMedia returns a copy of the value with references to media uploaded to the homeserver replaced with
+// their mxc URIs.
+func substituteMedia(hsName string, v interface{}, lk *sync.Map) interface{} {
+	switch val := v.(type) {
+	case string:
+		if !strings.HasPrefix(val, b.MediaRefPrefix) {
+			return val
+		}
+		mxc, ok := lk.Load(mediaKey(hsName, strings.TrimPrefix(val, b.MediaRefPrefix)))
+		if !ok {
+			return val
+		}
+		return mxc
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, child := range val {
+			out[k] = substituteMedia(hsName, child, lk)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, child := range val {
+			out[i] = substituteMedia(hsName, child, lk)
+		}
+		return out
+	}
+	return v
+}
+
+// eventIDKey returns the lookup key for the event ID of an event in a room, which is only stored if needed.
+func eventIDKey(hsName string, roomIndex, eventIndex int) string {
+	return fmt.Sprintf("%s_event_%d", roomKey(hsName, roomIndex), eventIndex)
+}
+
+// roomExtrasInstructions returns the instructions to set up room account data, tags, receipts, aliases and
+// directory visibility, which must be run after the room's events have been sent.
+func roomExtrasInstructions(hsName string, room b.Room, roomIndex int) (instrs []instruction) {
+	roomIDKey := "." + roomKey(hsName, roomIndex)
+	if room.Ref != "" {
+		roomIDKey = fmt.Sprintf(".room_ref_%s", room.Ref)
+	}
+	for _, ad := range room.AccountData {
+		instrs = append(instrs, instruction{
+			method:      "PUT",
+			path:        "/_matrix/client/v3/user/$userId/rooms/$roomId/account_data/$type",
+			accessToken: "user_" + ad.User,
+			substitutions: map[string]string{
+				"$userId": ad.User,
+				"$roomId": roomIDKey,
+				"$type":   ad.Type,
+			},
+			body: ad.Value,
+		})
+	}
+	for _, tag := range room.Tags {
+		body := map[string]interface{}{}
+		if tag.Order != nil {
+			body["order"] = *tag.Order
+		}
+		instrs = append(instrs, instruction{
+			method:      "PUT",
+			path:        "/_matrix/client/v3/user/$userId/rooms/$roomId/tags/$tag",
+			accessToken: "user_" + tag.User,
+			substitutions: map[string]string{
+				"$userId": tag.User,
+				"$roomId": roomIDKey,
+				"$tag":    tag.Tag,
+			},
+			body: body,
+		})
+	}
+	for _, receipt := range room.Receipts {
+		eventIDLookup := "." + eventIDKey(hsName, roomIndex, receipt.EventIndex)
+		if receipt.Type == b.ReceiptTypeFullyRead {
+			instrs = append(instrs, instruction{
+				method:      "POST",
+				path:        "/_matrix/client/v3/rooms/$roomId/read_markers",
+				accessToken: "user_" + receipt.User,
+				substitutions: map[string]string{
+					"$roomId": roomIDKey,
+				},
+				bodyFn: func(lk *sync.Map) interface{} {
+					eventID, _ := lk.Load(strings.TrimPrefix(eventIDLookup, "."))
+					return map[string]interface{}{
+						b.ReceiptTypeFullyRead: eventID,
+					}
+				},
+			})
+			continue
+		}
+		instrs = append(instrs, instruction{
+			method:      "POST",
+			path:        "/_matrix/client/v3/rooms/$roomId/receipt/$receiptType/$eventId",
+			accessToken: "user_" + receipt.User,
+			substitutions: map[string]string{
+				"$roomId":      roomIDKey,
+				"$receiptType": receipt.Type,
+				"$eventId":     eventIDLookup,
+			},
+			body: map[string]interface{}{},
+		})
+	}
+	for _, alias := range room.Aliases {
+		instrs = append(instrs, instruction{
+			method:      "PUT",
+			path:        "/_matrix/client/v3/directory/room/$alias",
+			accessToken: "user_" + room.Creator,
+			substitutions: map[string]string{
+				"$alias": alias,
+			},
+			bodyFn: func(lk *sync.Map) interface{} {
+				roomID, _ := lk.Load(strings.TrimPrefix(roomIDKey, "."))
+				return map[string]interface{}{
+					"room_id": roomID,
+				}
+			},
+		})
+	}
+	if room.Publish {
+		instrs = append(instrs, instruction{
+			method:      "PUT",
+			path:        "/_matrix/client/v3/directory/list/room/$roomId",
+			accessToken: "user_" + room.Creator,
+			substitutions: map[string]string{
+				"$roomId": roomIDKey,
+			},
+			body: map[string]interface{}{
+				"visibility": "public",
+			},
+		})
+	}
+	return instrs
+}
+
 // indexFor hashes the input and returns a number % numEntries
 func indexFor(input string, numEntries int) int {
 	hh := fnv.New32a()
@@ -0,0 +1,212 @@
+package instruction
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/b"
+)
+
+func TestRefersToMedia(t *testing.T) {
+	testCases := []struct {
+		name string
+		v    interface{}
+		want bool
+	}{
+		{"media ref", "$media:cat", true},
+		{"plain string", "cat", false},
+		{"prefix not at the start", "see $media:cat", false},
+		{"nested in a map", map[string]interface{}{"info": map[string]interface{}{"thumbnail_url": "$media:thumb"}}, true},
+		{"nested in a list", map[string]interface{}{"urls": []interface{}{"a", "$media:cat"}}, true},
+		{"map without refs", map[string]interface{}{"body": "hello", "size": 3.0}, false},
+		{"other types", 42.0, false},
+	}
+	for _, tc := range testCases {
+		if got := refersToMedia(tc.v); got != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSubstituteMedia(t *testing.T) {
+	lk := &sync.Map{}
+	lk.Store(mediaKey("hs1", "cat"), "mxc://hs1/cat")
+	lk.Store(mediaKey("hs2", "dog"), "mxc://hs2/dog")
+	content := map[string]interface{}{
+		"msgtype": "m.image",
+		"url":     "$media:cat",
+		"info": map[string]interface{}{
+			"thumbnail_url": "$media:cat",
+			"size":          3.0,
+		},
+		"list":    []interface{}{"$media:cat", "plain"},
+		"other":   "$media:dog", // uploaded to another homeserver
+		"unknown": "$media:mouse",
+	}
+	want := map[string]interface{}{
+		"msgtype": "m.image",
+		"url":     "mxc://hs1/cat",
+		"info": map[string]interface{}{
+			"thumbnail_url": "mxc://hs1/cat",
+			"size":          3.0,
+		},
+		"list":    []interface{}{"mxc://hs1/cat", "plain"},
+		"other":   "$media:dog",
+		"unknown": "$media:mouse",
+	}
+	got := substituteMedia("hs1", content, lk)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if content["url"] != "$media:cat" {
+		t.Errorf("substituteMedia modified its input: %v", content)
+	}
+}
+
+func TestRoomExtrasInstructions(t *testing.T) {
+	zero := 0.0
+	room := b.Room{
+		Creator: "@alice:hs1",
+		Events: []b.Event{
+			{Type: "m.room.message", Sender: "@alice:hs1"},
+			{Type: "m.room.message", Sender: "@bob:hs1"},
+		},
+		AccountData: []b.RoomAccountData{{User: "@bob:hs1", Type: "org.example.data", Value: map[string]interface{}{"a": "b"}}},
+		Tags: []b.Tag{
+			{User: "@bob:hs1", Tag: "m.favourite", Order: &zero},
+			{User: "@bob:hs1", Tag: "u.work"},
+		},
+		Receipts: []b.Receipt{
+			{User: "@bob:hs1", Type: b.ReceiptTypeRead, EventIndex: 1},
+			{User: "@bob:hs1", Type: b.ReceiptTypeFullyRead, EventIndex: 0},
+		},
+		Aliases: []string{"#room:hs1"},
+		Publish: true,
+	}
+	lk := &sync.Map{}
+	lk.Store(roomKey("hs1", 2), "!room:hs1")
+	lk.Store(eventIDKey("hs1", 2, 0), "$event0")
+	lk.Store(eventIDKey("hs1", 2, 1), "$event1")
+
+	want := []struct {
+		method      string
+		url         string
+		accessToken string
+		body        string
+	}{
+		{"PUT", "/_matrix/client/v3/user/@bob:hs1/rooms/%21room:hs1/account_data/org.example.data", "user_@bob:hs1", `{"a":"b"}`},
+		{"PUT", "/_matrix/client/v3/user/@bob:hs1/rooms/%21room:hs1/tags/m.favourite", "user_@bob:hs1", `{"order":0}`},
+		{"PUT", "/_matrix/client/v3/user/@bob:hs1/rooms/%21room:hs1/tags/u.work", "user_@bob:hs1", `{}`},
+		{"POST", "/_matrix/client/v3/rooms/%21room:hs1/receipt/m.read/$event1", "user_@bob:hs1", `{}`},
+		{"POST", "/_matrix/client/v3/rooms/%21room:hs1/read_markers", "user_@bob:hs1", `{"m.fully_read":"$event0"}`},
+		{"PUT", "/_matrix/client/v3/directory/room/%23room:hs1", "user_@alice:hs1", `{"room_id":"!room:hs1"}`},
+		{"PUT", "/_matrix/client/v3/directory/list/room/%21room:hs1", "user_@alice:hs1", `{"visibility":"public"}`},
+	}
+	instrs := roomExtrasInstructions("hs1", room, 2)
+	if len(instrs) != len(want) {
+		t.Fatalf("got %d instructions want %d", len(instrs), len(want))
+	}
+	for i, w := range want {
+		instr := instrs[i]
+		body := instr.body
+		if body == nil {
+			body = instr.bodyFn(lk)
+		}
+		gotBody, _ := json.Marshal(body)
+		if instr.method != w.method || instr.url("", lk) != w.url || instr.accessToken != w.accessToken || string(gotBody) != w.body {
+			t.Errorf("instruction %d: got %s %s as %s with %s, want %s %s as %s with %s", i,
+				instr.method, instr.url("", lk), instr.accessToken, gotBody, w.method, w.url, w.accessToken, w.body)
+		}
+	}
+
+	// rooms with a Ref are looked up by their Ref, as they may be created on another homeserver
+	room = b.Room{Ref: "shared", Publish: true, Creator: "@alice:hs1"}
+	lk.Store("room_ref_shared", "!shared:hs2")
+	instrs = roomExtrasInstructions("hs1", room, 0)
+	if len(instrs) != 1 || instrs[0].url("", lk) != "/_matrix/client/v3/directory/list/room/%21shared:hs2" {
+		t.Errorf("got instructions %+v, want to publish the referenced room", instrs)
+	}
+}
+
+// TestMediaAndDeviceTokens is a regression test for media with the same Ref on different homeservers, which
+// clobbered each other, and access tokens for additional devices, which were not kept.
+func TestMediaAndDeviceTokens(t *testing.T) {
+	runner := NewRunner("test", false, false)
+	avatars := make(map[string]string) // hs name -> avatar URL
+	var mu sync.Mutex
+	for _, hsName := range []string{"hs1", "hs2"} {
+		hsName := hsName
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.Method + " " + req.URL.Path {
+			case "POST /_matrix/client/v3/register":
+				w.Write([]byte(`{"user_id":"@alice:` + hsName + `","access_token":"alice_token","device_id":"ALICE"}`))
+			case "POST /_matrix/client/v3/login":
+				w.Write([]byte(`{"user_id":"@alice:` + hsName + `","access_token":"phone_token_` + hsName + `","device_id":"MY_PHONE"}`))
+			case "POST /_matrix/media/v3/upload":
+				w.Write([]byte(`{"content_uri":"mxc://` + hsName + `/avatar"}`))
+			case "PUT /_matrix/client/v3/profile/@alice:" + hsName + "/avatar_url":
+				body, _ := io.ReadAll(req.Body)
+				mu.Lock()
+				avatars[hsName] = gjson.GetBytes(body, "avatar_url").Str
+				mu.Unlock()
+				w.Write([]byte(`{}`))
+			default:
+				t.Errorf("%s: unexpected request %s %s", hsName, req.Method, req.URL.Path)
+				w.WriteHeader(404)
+			}
+		}))
+		defer srv.Close()
+		err := runner.Run(b.Homeserver{
+			Name: hsName,
+			Users: []b.User{{
+				Localpart: "alice",
+				Media:     []b.Media{{Ref: "avatar", ContentType: "image/png", Content: []byte("png")}},
+				AvatarURL: "$media:avatar",
+				Devices:   []b.Device{{ID: "MY_PHONE"}},
+			}},
+		}, srv.URL)
+		if err != nil {
+			t.Fatalf("%s: Run returned error: %s", hsName, err)
+		}
+	}
+	for _, hsName := range []string{"hs1", "hs2"} {
+		if want := "mxc://" + hsName + "/avatar"; avatars[hsName] != want {
+			t.Errorf("%s: got avatar URL %s want %s", hsName, avatars[hsName], want)
+		}
+		want := map[string]map[string]string{
+			"@alice:" + hsName: {"MY_PHONE": "phone_token_" + hsName},
+		}
+		if got := runner.DeviceAccessTokens(hsName); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got device access tokens %v want %v", hsName, got, want)
+		}
+	}
+}
+
+func TestParseDeviceTokenKey(t *testing.T) {
+	testCases := []struct {
+		userID   string
+		deviceID string
+	}{
+		{"@alice:hs1", "PHONE"},
+		{"@alice_smith:hs1", "MY_PHONE"},
+		{"@alice:hs1", "a/b:c"},
+	}
+	for _, tc := range testCases {
+		userID, deviceID, ok := parseDeviceTokenKey(deviceTokenKey(tc.userID, tc.deviceID))
+		if !ok || userID != tc.userID || deviceID != tc.deviceID {
+			t.Errorf("got %s,%s,%v want %s,%s", userID, deviceID, ok, tc.userID, tc.deviceID)
+		}
+	}
+	for _, key := range []string{"user_@alice:hs1", "device_token_alice", "device_token_@alice:hs1"} {
+		if _, _, ok := parseDeviceTokenKey(key); ok {
+			t.Errorf("%s: parsed a key which is not a device token key", key)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package instruction
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// UIAPassword makes the runner complete User-Interactive Authentication with a password, for endpoints
+// like deleting devices, uploading cross-signing keys and deactivating accounts. The request is sent as
+// normal, then resent with password auth if the homeserver responds with a UIA challenge.
+type UIAPassword struct {
+	// The user to authenticate as e.g "@alice:hs1"
+	UserID string
+	// The user's password. If empty, the password of users created by blueprints is used.
+	Password string
+}
+
+func (u *UIAPassword) password() string {
+	if u.Password != "" {
+		return u.Password
+	}
+	localpart := strings.TrimPrefix(strings.Split(u.UserID, ":")[0], "@")
+	return blueprintPassword(localpart)
+}
+
+// blueprintPassword returns the password of users created by blueprints.
+func blueprintPassword(localpart string) string {
+	return "complement_meets_min_pasword_req_" + localpart
+}
+
+// uiaRequest returns the request to send in response to a UIA challenge, or nil if the response is not
+// a UIA challenge which can be completed with a password.
+func uiaRequest(req *http.Request, reqBody interface{}, uia *UIAPassword, res *http.Response, resBody []byte) (*http.Request, error) {
+	if uia == nil || res.StatusCode != http.StatusUnauthorized {
+		return nil, nil
+	}
+	challenge := gjson.ParseBytes(resBody)
+	session := challenge.Get("session").Str
+	if session == "" || !challenge.Get("flows").Exists() {
+		return nil, nil // not a UIA challenge e.g unknown token
+	}
+	hasPasswordFlow := false
+	challenge.Get("flows.#.stages").ForEach(func(_, stages gjson.Result) bool {
+		if len(stages.Array()) == 1 && stages.Array()[0].Str == "m.login.password" {
+			hasPasswordFlow = true
+		}
+		return !hasPasswordFlow
+	})
+	if !hasPasswordFlow {
+		return nil, fmt.Errorf("UIA challenge has no m.login.password flow: %s", string(resBody))
+	}
+
+	// add the auth dict to the original body
+	body := make(map[string]interface{})
+	if reqBody != nil {
+		b, err := json.Marshal(reqBody)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(b, &body); err != nil {
+			return nil, fmt.Errorf("cannot add UIA auth to a request body which is not a JSON object: %s", err)
+		}
+	}
+	body["auth"] = map[string]interface{}{
+		"type": "m.login.password",
+		"identifier": map[string]interface{}{
+			"type": "m.id.user",
+			"user": uia.UserID,
+		},
+		"password": uia.password(),
+		"session":  session,
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	authReq, err := http.NewRequest(req.Method, req.URL.String(), bytes.NewBuffer(b))
+	if err != nil {
+		return nil, err
+	}
+	authReq.Header = req.Header.Clone()
+	authReq.Header.Set("Content-Type", "application/json")
+	return authReq, nil
+}
@@ -0,0 +1,146 @@
+package instruction
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/b"
+)
+
+func TestUIA(t *testing.T) {
+	var mu sync.Mutex
+	authed := make(map[string]int)     // method + path -> number of requests with valid auth
+	challenged := make(map[string]int) // method + path -> number of requests which were challenged
+	var crossSigningBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(req.Body)
+		endpoint := req.Method + " " + req.URL.Path
+		switch endpoint {
+		case "POST /_matrix/client/v3/register":
+			w.Write([]byte(`{"user_id":"@alice:hs1","access_token":"alice_token","device_id":"ALICE"}`))
+			return
+		case "POST /_matrix/client/v3/login":
+			w.Write([]byte(`{"user_id":"@alice:hs1","access_token":"phone_token","device_id":"PHONE"}`))
+			return
+		case "DELETE /_matrix/client/v3/devices/PHONE", "POST /_matrix/client/v3/keys/device_signing/upload":
+		default:
+			t.Errorf("unexpected request %s", endpoint)
+			w.WriteHeader(404)
+			return
+		}
+		if req.URL.Query().Get("access_token") != "alice_token" {
+			t.Errorf("%s: got access token %s want alice_token", endpoint, req.URL.Query().Get("access_token"))
+		}
+		auth := gjson.GetBytes(body, "auth")
+		if !auth.Exists() {
+			challenged[endpoint]++
+			w.WriteHeader(401)
+			w.Write([]byte(`{"flows":[{"stages":["m.login.sso"]},{"stages":["m.login.password"]}],"params":{},"session":"sess"}`))
+			return
+		}
+		if auth.Get("type").Str != "m.login.password" || auth.Get("session").Str != "sess" ||
+			auth.Get("identifier.user").Str != "@alice:hs1" || auth.Get("password").Str != blueprintPassword("alice") {
+			t.Errorf("%s: bad auth dict %s", endpoint, auth.Raw)
+		}
+		authed[endpoint]++
+		if req.URL.Path == "/_matrix/client/v3/keys/device_signing/upload" {
+			crossSigningBody = body
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	runner := NewRunner("test", false, false)
+	err := runner.Run(b.Homeserver{
+		Name: "hs1",
+		Users: []b.User{{
+			Localpart:    "alice",
+			Devices:      []b.Device{{ID: "PHONE", Delete: true}},
+			CrossSigning: true,
+		}},
+	}, srv.URL)
+	if err != nil {
+		t.Fatalf("Run returned error: %s", err)
+	}
+	for _, endpoint := range []string{"DELETE /_matrix/client/v3/devices/PHONE", "POST /_matrix/client/v3/keys/device_signing/upload"} {
+		if challenged[endpoint] != 1 || authed[endpoint] != 1 {
+			t.Errorf("%s: got %d challenges and %d authed requests, want 1 of each", endpoint, challenged[endpoint], authed[endpoint])
+		}
+	}
+	if tokens := runner.DeviceAccessTokens("hs1"); len(tokens) != 0 {
+		t.Errorf("got device access tokens %v for a deleted device, want none", tokens)
+	}
+
+	// the self-signing and user-signing keys must be signed by the master key
+	var masterKeyID gomatrixserverlib.KeyID
+	var masterKey []byte
+	gjson.GetBytes(crossSigningBody, "master_key.keys").ForEach(func(k, v gjson.Result) bool {
+		masterKeyID = gomatrixserverlib.KeyID(k.Str)
+		masterKey, err = base64.RawStdEncoding.DecodeString(v.Str)
+		if err != nil {
+			t.Fatalf("master key is not unpadded base64: %s", err)
+		}
+		return false
+	})
+	if masterKeyID == "" {
+		t.Fatalf("no master key in %s", string(crossSigningBody))
+	}
+	for _, usage := range []string{"self_signing", "user_signing"} {
+		key := gjson.GetBytes(crossSigningBody, usage+"_key")
+		if got := key.Get("usage.0").Str; got != usage {
+			t.Errorf("%s key has usage %s", usage, got)
+		}
+		if err := gomatrixserverlib.VerifyJSON("@alice:hs1", masterKeyID, masterKey, []byte(key.Raw)); err != nil {
+			t.Errorf("%s key is not signed by the master key: %s", usage, err)
+		}
+	}
+}
+
+func TestUIARequest(t *testing.T) {
+	uia := &UIAPassword{UserID: "@alice:hs1", Password: "secret"}
+	testCases := []struct {
+		name     string
+		uia      *UIAPassword
+		status   int
+		resBody  string
+		wantAuth bool
+		wantErr  bool
+	}{
+		{name: "no UIA", uia: nil, status: 401, resBody: `{"flows":[{"stages":["m.login.password"]}],"session":"s"}`},
+		{name: "success", uia: uia, status: 200, resBody: `{}`},
+		{name: "unknown token", uia: uia, status: 401, resBody: `{"errcode":"M_UNKNOWN_TOKEN"}`},
+		{name: "password flow", uia: uia, status: 401, resBody: `{"flows":[{"stages":["m.login.password"]}],"session":"s"}`, wantAuth: true},
+		{name: "multi-stage flow only", uia: uia, status: 401, resBody: `{"flows":[{"stages":["m.login.password","m.login.email.identity"]}],"session":"s"}`, wantErr: true},
+	}
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("DELETE", "http://localhost/_matrix/client/v3/devices/D", nil)
+		authReq, err := uiaRequest(req, map[string]interface{}{"keep": "me"}, tc.uia, &http.Response{StatusCode: tc.status}, []byte(tc.resBody))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if (authReq != nil) != tc.wantAuth {
+			t.Errorf("%s: got auth request %v, want one: %v", tc.name, authReq, tc.wantAuth)
+			continue
+		}
+		if authReq == nil {
+			continue
+		}
+		body, _ := io.ReadAll(authReq.Body)
+		if gjson.GetBytes(body, "keep").Str != "me" || gjson.GetBytes(body, "auth.password").Str != "secret" || gjson.GetBytes(body, "auth.session").Str != "s" {
+			t.Errorf("%s: bad auth request body %s", tc.name, string(body))
+		}
+		if authReq.Method != "DELETE" {
+			t.Errorf("%s: got method %s want DELETE", tc.name, authReq.Method)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package runtime
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Prefixes for capabilities which are detected by probing the homeserver. Capabilities listed in a
+// capabilities file shipped with the image are used verbatim, and do not need a prefix.
+const (
+	// Spec versions listed in `versions` on /_matrix/client/versions
+	CapabilityPrefixSpecVersion = "version:"
+	// Unstable features enabled in `unstable_features` on /_matrix/client/versions
+	CapabilityPrefixUnstableFeature = "unstable_feature:"
+	// Capabilities enabled on /_matrix/client/v3/capabilities
+	CapabilityPrefixCapability = "capability:"
+	// Room versions listed in `m.room_versions` on /_matrix/client/v3/capabilities
+	CapabilityPrefixRoomVersion = "room_version:"
+	// Marks a prefix whose capabilities could not be probed, e.g "unknown:room_version:". See Unknown.
+	CapabilityPrefixUnknown = "unknown:"
+)
+
+// Unknown returns the capability which marks that capabilities with the given prefix could not be probed,
+// so the homeserver may support them without advertising them.
+func Unknown(prefix string) string {
+	return CapabilityPrefixUnknown + prefix
+}
+
+// probedPrefixes are the prefixes which can be marked as Unknown.
+var probedPrefixes = []string{
+	CapabilityPrefixSpecVersion, CapabilityPrefixUnstableFeature, CapabilityPrefixCapability, CapabilityPrefixRoomVersion,
+}
+
+// isUnknown returns true if the capability is not advertised because its prefix could not be probed.
+func isUnknown(advertised map[string]bool, c string) bool {
+	for _, prefix := range probedPrefixes {
+		if strings.HasPrefix(c, prefix) && advertised[Unknown(prefix)] {
+			return true
+		}
+	}
+	return false
+}
+
+// SpecVersion returns the capability for the given spec version e.g "v1.4"
+func SpecVersion(version string) string {
+	return CapabilityPrefixSpecVersion + version
+}
+
+// UnstableFeature returns the capability for the given unstable feature e.g "org.matrix.msc3440"
+func UnstableFeature(feature string) string {
+	return CapabilityPrefixUnstableFeature + feature
+}
+
+// Capability returns the capability for the given /capabilities entry e.g "m.change_password"
+func Capability(name string) string {
+	return CapabilityPrefixCapability + name
+}
+
+// RoomVersion returns the capability for the given room version e.g "10"
+func RoomVersion(version string) string {
+	return CapabilityPrefixRoomVersion + version
+}
+
+// CapabilityDeployment is a deployment of homeservers which advertise capabilities, such as
+// complement.Deployment.
+type CapabilityDeployment interface {
+	// Capabilities returns the capabilities advertised by each homeserver, keyed by HS name. Capabilities
+	// are nil for homeservers where they could not be detected.
+	Capabilities() map[string][]string
+}
+
+// Skip the test (via t.Skipf) unless every homeserver in the deployment advertises all of the given
+// capabilities, else return.
+//
+// Capabilities are detected when homeservers are deployed by probing the homeserver's /versions and
+// /capabilities endpoints (see the CapabilityPrefix constants), along with an optional JSON array of
+// capability names in the image at `/complement/capabilities.json`. The /capabilities endpoint requires
+// authentication, so it is only probed if the deployment already has a user e.g from a blueprint. Images
+// can list their room versions and capabilities in the capabilities file to make them available to all tests.
+//
+// If the capabilities of a homeserver, or the family of a capability e.g room versions, could not be
+// detected, a warning is logged and the test will be run.
+func SkipUnless(t *testing.T, deployment CapabilityDeployment, caps ...string) {
+	t.Helper()
+	hsCaps := deployment.Capabilities()
+	hsNames := make([]string, 0, len(hsCaps))
+	for hsName := range hsCaps {
+		hsNames = append(hsNames, hsName)
+	}
+	sort.Strings(hsNames)
+	for _, hsName := range hsNames {
+		advertised := hsCaps[hsName]
+		if advertised == nil {
+			t.Logf(
+				"WARNING: %s called runtime.SkipUnless(%v) but the capabilities of %s are unknown: executing test.",
+				t.Name(), caps, hsName,
+			)
+			continue
+		}
+		set := make(map[string]bool, len(advertised))
+		for _, c := range advertised {
+			set[c] = true
+		}
+		for _, c := range caps {
+			if set[c] {
+				continue
+			}
+			if isUnknown(set, c) {
+				t.Logf(
+					"WARNING: %s called runtime.SkipUnless(%v) but %s could not be probed for %s: executing test.",
+					t.Name(), caps, hsName, c,
+				)
+				continue
+			}
+			t.Skipf("skipped as %s does not advertise %s", hsName, c)
+			return
+		}
+	}
+}
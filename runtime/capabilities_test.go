@@ -0,0 +1,76 @@
+package runtime
+
+import (
+	"testing"
+)
+
+type testDeployment map[string][]string
+
+func (d testDeployment) Capabilities() map[string][]string {
+	return d
+}
+
+func TestSkipUnless(t *testing.T) {
+	unknownRoomVersions := Unknown(CapabilityPrefixRoomVersion)
+	testCases := []struct {
+		name     string
+		dep      testDeployment
+		caps     []string
+		wantSkip bool
+	}{
+		{
+			name: "all advertised",
+			dep:  testDeployment{"hs1": {SpecVersion("v1.4"), RoomVersion("10")}},
+			caps: []string{SpecVersion("v1.4"), RoomVersion("10")},
+		},
+		{
+			name:     "not advertised",
+			dep:      testDeployment{"hs1": {SpecVersion("v1.4")}},
+			caps:     []string{SpecVersion("v1.5")},
+			wantSkip: true,
+		},
+		{
+			name:     "one server does not advertise",
+			dep:      testDeployment{"hs1": {RoomVersion("10")}, "hs2": {RoomVersion("9")}},
+			caps:     []string{RoomVersion("10")},
+			wantSkip: true,
+		},
+		{
+			name: "unknown server runs",
+			dep:  testDeployment{"hs1": nil},
+			caps: []string{RoomVersion("10")},
+		},
+		{
+			name: "unknown family runs",
+			dep:  testDeployment{"hs1": {SpecVersion("v1.4"), unknownRoomVersions}},
+			caps: []string{RoomVersion("10")},
+		},
+		{
+			name:     "unknown family does not cover other families",
+			dep:      testDeployment{"hs1": {SpecVersion("v1.4"), unknownRoomVersions}},
+			caps:     []string{UnstableFeature("org.matrix.msc3030")},
+			wantSkip: true,
+		},
+		{
+			name:     "capabilities from the image file are used verbatim",
+			dep:      testDeployment{"hs1": {"msc2836", unknownRoomVersions}},
+			caps:     []string{"msc2836", "msc9999"},
+			wantSkip: true,
+		},
+		{
+			name: "no capabilities needed",
+			dep:  testDeployment{"hs1": {}},
+		},
+	}
+	for _, tc := range testCases {
+		var skipped bool
+		t.Run(tc.name, func(t *testing.T) {
+			// SkipUnless stops this goroutine when it skips, so record whether it returned
+			defer func() { skipped = t.Skipped() }()
+			SkipUnless(t, tc.dep, tc.caps...)
+		})
+		if skipped != tc.wantSkip {
+			t.Errorf("%s: got skipped %v want %v", tc.name, skipped, tc.wantSkip)
+		}
+	}
+}
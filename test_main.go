@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/helpers"
 )
 
 var testPackage *TestPackage
@@ -62,3 +63,24 @@ func Deploy(t *testing.T, numServers int) Deployment {
 	}
 	return testPackage.Deploy(t, numServers)
 }
+
+// DeployWithOptions will deploy the given number of servers with per-server configuration, or terminate
+// the test. This can be used to enable a feature flag on one server only via environment variables or
+// config files, or to run a different homeserver implementation for one server.
+func DeployWithOptions(t *testing.T, opts helpers.DeployOpts) Deployment {
+	t.Helper()
+	if testPackage == nil {
+		t.Fatalf("DeployWithOptions: testPackage not set, did you forget to call complement.TestMain?")
+	}
+	return testPackage.DeployWithOptions(t, opts)
+}
+
+// DeploySnapshot will deploy a snapshot previously made in this package via Deployment.Snapshot, or
+// terminate the test. Each call returns a fresh set of containers, so tests cannot affect each other.
+func DeploySnapshot(t *testing.T, name string) Deployment {
+	t.Helper()
+	if testPackage == nil {
+		t.Fatalf("DeploySnapshot: testPackage not set, did you forget to call complement.TestMain?")
+	}
+	return testPackage.DeploySnapshot(t, name)
+}
@@ -2,9 +2,11 @@ package complement
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -27,9 +29,19 @@ type Deployment interface {
 	// Login to an existing user account on the given server. In order to make tests not hardcode full user IDs,
 	// an existing logged in client must be supplied.
 	Login(t *testing.T, hsName string, existing *client.CSAPI, opts helpers.LoginOpts) *client.CSAPI
+	// ExistingUser returns a client for a user who already exists on the given server, such as a user
+	// registered before a deployment was snapshotted via Snapshot. Fails the test if the user is not known.
+	ExistingUser(t *testing.T, hsName, userID string) *client.CSAPI
 	// AppServiceUser returns a client for the given app service user ID. The HS in question must have an appservice
 	// hooked up to it already. TODO: REMOVE
 	AppServiceUser(t *testing.T, hsName, appServiceUserID string) *client.CSAPI
+	// Snapshot the current state of all homeservers in this deployment under the given name. Other tests
+	// in the same package can then get a fresh copy of this state via DeploySnapshot, including users
+	// registered on this deployment, which are accessible via ExistingUser. Snapshot names must be unique
+	// per package. All servers are gracefully stopped and restarted, so ports may change.
+	// This function is designed to perform expensive setup like creating large federated rooms once
+	// per package.
+	Snapshot(t *testing.T, name string)
 	// Restart a deployment. Restarts all homeservers in this deployment.
 	// This function is designed to be used to make assertions that servers are persisting information to disk.
 	Restart(t *testing.T) error
@@ -62,8 +74,22 @@ type Deployment interface {
 	RoundTripper() http.RoundTripper
 	// Return the network name if you want to attach additional containers to this network
 	Network() string
+	// Capabilities returns the capabilities advertised by each homeserver in this deployment, keyed by
+	// HS name. Prefer runtime.SkipUnless to checking these directly.
+	Capabilities() map[string][]string
+	// SampleStats starts sampling the memory, CPU, IO and network usage of every homeserver in this
+	// deployment at the given interval. Sampling stops when the deployment is destroyed, and a summary
+	// is logged when the test finishes. This can be used to catch excessive resource usage, e.g by
+	// asserting on the peak memory in StatsSampler.Summary(). Fails the test if the interval is not positive.
+	SampleStats(t *testing.T, interval time.Duration) StatsSampler
 }
 
+// StatsSampler samples the resource usage of every homeserver in a deployment, see Deployment.SampleStats.
+type StatsSampler = docker.Sampler
+
+// StatsSummary summarises the resource usage of a single homeserver between the first and last sample.
+type StatsSummary = docker.StatsSummary
+
 // TestPackage represents the configuration for a package of tests. A package of tests
 // are all tests in the same Go package (directory).
 type TestPackage struct {
@@ -141,11 +167,31 @@ func (tp *TestPackage) OldDeploy(t *testing.T, blueprint b.Blueprint) Deployment
 
 func (tp *TestPackage) Deploy(t *testing.T, numServers int) Deployment {
 	t.Helper()
-	if tp.Config.EnableDirtyRuns {
-		return tp.dirtyDeploy(t, numServers)
+	return tp.DeployWithOptions(t, helpers.DeployOpts{
+		NumServers: numServers,
+	})
+}
+
+func (tp *TestPackage) DeployWithOptions(t *testing.T, opts helpers.DeployOpts) Deployment {
+	t.Helper()
+	if opts.NumServers < 1 {
+		t.Fatalf("DeployWithOptions: NumServers must be at least 1, got %d", opts.NumServers)
+	}
+	if tp.Config.EnableDirtyRuns && !opts.Dedicated && len(opts.Servers) == 0 {
+		return tp.dirtyDeploy(t, opts.NumServers)
 	}
 	// non-dirty deployments below
-	blueprint := mapServersToBlueprint(numServers)
+	blueprint := mapServersToBlueprint(opts.NumServers)
+	for hsName, hsOpts := range opts.Servers {
+		i := serverIndex(hsName)
+		if i < 0 || i >= opts.NumServers {
+			t.Fatalf("DeployWithOptions: options given for '%s' but only deploying hs1-hs%d", hsName, opts.NumServers)
+		}
+		if hsOpts.BaseImageURI != "" {
+			blueprint.Homeservers[i].BaseImageURI = b.Ptr(hsOpts.BaseImageURI)
+		}
+	}
+	blueprint.Name = blueprintNameWithImages(blueprint)
 	timeStartBlueprint := time.Now()
 	if err := tp.complementBuilder.ConstructBlueprintIfNotExist(blueprint); err != nil {
 		t.Fatalf("Deploy: Failed to construct blueprint: %s", err)
@@ -156,7 +202,7 @@ func (tp *TestPackage) Deploy(t *testing.T, numServers int) Deployment {
 		t.Fatalf("Deploy: NewDeployer returned error %s", err)
 	}
 	timeStartDeploy := time.Now()
-	dep, err := d.Deploy(context.Background(), blueprint.Name)
+	dep, err := d.DeployWithServerOptions(context.Background(), blueprint.Name, opts.Servers)
 	if err != nil {
 		t.Fatalf("Deploy: Deploy returned error %s", err)
 	}
@@ -164,6 +210,23 @@ func (tp *TestPackage) Deploy(t *testing.T, numServers int) Deployment {
 	return dep
 }
 
+// DeploySnapshot deploys a snapshot previously made via Deployment.Snapshot, or terminates the test.
+func (tp *TestPackage) DeploySnapshot(t *testing.T, name string) Deployment {
+	t.Helper()
+	namespace := fmt.Sprintf("%d", atomic.AddUint64(&tp.namespaceCounter, 1))
+	d, err := docker.NewDeployer(namespace, tp.complementBuilder.Config)
+	if err != nil {
+		t.Fatalf("DeploySnapshot: NewDeployer returned error %s", err)
+	}
+	timeStartDeploy := time.Now()
+	dep, err := d.Deploy(context.Background(), name)
+	if err != nil {
+		t.Fatalf("DeploySnapshot: Deploy returned error %s", err)
+	}
+	t.Logf("DeploySnapshot times: %v containers", time.Since(timeStartDeploy))
+	return dep
+}
+
 func (tp *TestPackage) dirtyDeploy(t *testing.T, numServers int) Deployment {
 	tp.existingDeploymentMu.Lock()
 	defer tp.existingDeploymentMu.Unlock()
@@ -220,3 +283,28 @@ func mapServersToBlueprint(numServers int) b.Blueprint {
 		Homeservers: servers,
 	})
 }
+
+// serverIndex returns the index of the server in a blueprint made via mapServersToBlueprint, or -1.
+func serverIndex(hsName string) int {
+	var i int
+	if _, err := fmt.Sscanf(hsName, "hs%d", &i); err != nil || fmt.Sprintf("hs%d", i) != hsName {
+		return -1
+	}
+	return i - 1
+}
+
+// blueprintNameWithImages suffixes the blueprint name with a hash of any overridden base images, so
+// blueprints built from different images don't clash.
+func blueprintNameWithImages(bp b.Blueprint) string {
+	var images []string
+	for _, hs := range bp.Homeservers {
+		if hs.BaseImageURI != nil {
+			images = append(images, hs.Name+"="+*hs.BaseImageURI)
+		}
+	}
+	if len(images) == 0 {
+		return bp.Name
+	}
+	hash := sha256.Sum256([]byte(strings.Join(images, ",")))
+	return fmt.Sprintf("%s_%x", bp.Name, hash[:4])
+}
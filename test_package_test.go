@@ -0,0 +1,64 @@
+package complement
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/b"
+)
+
+func TestServerIndex(t *testing.T) {
+	testCases := []struct {
+		hsName string
+		want   int
+	}{
+		{"hs1", 0},
+		{"hs2", 1},
+		{"hs10", 9},
+		{"hs01", -1},
+		{"hs1x", -1},
+		{"hs", -1},
+		{"server1", -1},
+		{"", -1},
+	}
+	for _, tc := range testCases {
+		if got := serverIndex(tc.hsName); got != tc.want {
+			t.Errorf("%s: got %d want %d", tc.hsName, got, tc.want)
+		}
+	}
+}
+
+func TestBlueprintNameWithImages(t *testing.T) {
+	withImages := func(images ...string) b.Blueprint {
+		bp := mapServersToBlueprint(len(images))
+		for i, image := range images {
+			if image != "" {
+				bp.Homeservers[i].BaseImageURI = b.Ptr(image)
+			}
+		}
+		return bp
+	}
+	if got := blueprintNameWithImages(withImages("", "")); got != "2_servers" {
+		t.Errorf("got %s without overridden images, want the blueprint name", got)
+	}
+	name := blueprintNameWithImages(withImages("", "complement-dendrite"))
+	if !strings.HasPrefix(name, "2_servers_") {
+		t.Errorf("got %s, want the blueprint name as a prefix", name)
+	}
+	if got := blueprintNameWithImages(withImages("", "complement-dendrite")); got != name {
+		t.Errorf("got %s then %s for the same images", name, got)
+	}
+	testCases := []struct {
+		name string
+		bp   b.Blueprint
+	}{
+		{"different image", withImages("", "complement-conduit")},
+		{"same image on a different server", withImages("complement-dendrite", "")},
+		{"additional image", withImages("complement-dendrite", "complement-dendrite")},
+	}
+	for _, tc := range testCases {
+		if got := blueprintNameWithImages(tc.bp); got == name {
+			t.Errorf("%s: got the same name %s", tc.name, got)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	dockerClient "github.com/docker/docker/client"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// Test that per-server options are applied to only the server they are given for, and that servers with
+// an overridden base image can federate with the others.
+func TestDeployWithOptions(t *testing.T) {
+	// the same image, but overridden explicitly so the blueprint is built with the override
+	baseImageURI := os.Getenv("COMPLEMENT_BASE_IMAGE")
+	deployment := complement.DeployWithOptions(t, helpers.DeployOpts{
+		NumServers: 2,
+		Servers: map[string]helpers.HomeserverOpts{
+			"hs2": {
+				BaseImageURI: baseImageURI,
+				Env:          map[string]string{"COMPLEMENT_TEST_OPTION": "hs2"},
+				Files:        map[string][]byte{"/complement_test_option.txt": []byte("hs2 file")},
+			},
+		},
+	})
+	defer deployment.Destroy(t)
+
+	cli, err := dockerClient.NewClientWithOpts(dockerClient.FromEnv, dockerClient.WithAPIVersionNegotiation())
+	if err != nil {
+		t.Fatalf("failed to make docker client: %s", err)
+	}
+	hs := deployment.(*docker.Deployment).HS
+	for _, hsName := range []string{"hs1", "hs2"} {
+		containerID := hs[hsName].ContainerID
+		info, err := cli.ContainerInspect(context.Background(), containerID)
+		if err != nil {
+			t.Fatalf("%s: failed to inspect container: %s", hsName, err)
+		}
+		hasEnv := false
+		for _, env := range info.Config.Env {
+			if env == "COMPLEMENT_TEST_OPTION=hs2" {
+				hasEnv = true
+			}
+		}
+		file := readContainerFile(t, cli, containerID, "/complement_test_option.txt")
+		if hsName == "hs1" {
+			if hasEnv || file != "" {
+				t.Errorf("hs1: got options meant for hs2: env %v file '%s'", hasEnv, file)
+			}
+			continue
+		}
+		if !hasEnv {
+			t.Errorf("hs2: missing env var, got %v", info.Config.Env)
+		}
+		if file != "hs2 file" {
+			t.Errorf("hs2: got file '%s' want 'hs2 file'", file)
+		}
+		if got := info.Config.Labels["complement_base_image"]; got != baseImageURI {
+			t.Errorf("hs2: built from base image '%s' want '%s'", got, baseImageURI)
+		}
+	}
+
+	// the servers work and can federate with each other
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs2", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	bob.MustJoinRoom(t, roomID, []string{"hs1"})
+}
+
+// readContainerFile returns the contents of the file in the container, or an empty string if it does not exist.
+func readContainerFile(t *testing.T, cli *dockerClient.Client, containerID, path string) string {
+	t.Helper()
+	reader, _, err := cli.CopyFromContainer(context.Background(), containerID, path)
+	if dockerClient.IsErrNotFound(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatalf("failed to copy %s from container: %s", path, err)
+	}
+	defer reader.Close()
+	// the file is returned as a tarball containing the single file
+	tr := tar.NewReader(reader)
+	if _, err = tr.Next(); err != nil {
+		t.Fatalf("failed to read %s from container: %s", path, err)
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatalf("failed to read %s from container: %s", path, err)
+	}
+	return string(data)
+}
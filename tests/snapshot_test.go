@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Test that a deployment can be snapshotted and deployed again by later tests, with access to the users
+// registered before the snapshot, and that each deployment of the snapshot is independent.
+func TestSnapshot(t *testing.T) {
+	deployment := complement.DeployWithOptions(t, helpers.DeployOpts{NumServers: 1, Dedicated: true})
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+	})
+	beforeEventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "before snapshot",
+		},
+	})
+	deployment.Snapshot(t, "snapshot_test")
+
+	// the deployment can still be used after being snapshotted, but the server was restarted so the
+	// client needs the new base URL
+	alice = deployment.ExistingUser(t, "hs1", alice.UserID)
+	afterEventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "after snapshot",
+		},
+	})
+	deployment.Destroy(t)
+
+	for _, name := range []string{"first deployment", "second deployment"} {
+		t.Run(name, func(t *testing.T) {
+			snapshot := complement.DeploySnapshot(t, "snapshot_test")
+			defer snapshot.Destroy(t)
+			alice := snapshot.ExistingUser(t, "hs1", alice.UserID)
+			alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, beforeEventID))
+			// events sent after the snapshot, including by the other deployment of it, are not included
+			res := alice.Do(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "event", afterEventID})
+			if res.StatusCode != 404 {
+				t.Errorf("got status %d for an event sent after the snapshot, want 404", res.StatusCode)
+			}
+			afterEventID = alice.SendEventSynced(t, roomID, b.Event{
+				Type: "m.room.message",
+				Content: map[string]interface{}{
+					"msgtype": "m.text",
+					"body":    name,
+				},
+			})
+			// new users must not clash with users registered before the snapshot
+			bob := snapshot.Register(t, "hs1", helpers.RegistrationOpts{})
+			if bob.UserID == alice.UserID {
+				t.Fatalf("registered %s again", bob.UserID)
+			}
+			bob.MustJoinRoom(t, roomID, nil)
+		})
+	}
+}